@@ -405,7 +405,7 @@ func (s *Server) initMesh(args *PilotArgs) error {
 				s.mesh = meshConfig
 				if s.EnvoyXdsServer != nil {
 					s.EnvoyXdsServer.Env.Mesh = meshConfig
-					s.EnvoyXdsServer.ConfigUpdate(&model.PushRequest{Full: true})
+					s.EnvoyXdsServer.ConfigUpdate(&model.PushRequest{Full: true, Reason: []model.TriggerReason{model.GlobalUpdate}})
 				}
 			}
 		})
@@ -476,7 +476,7 @@ func (s *Server) initMeshNetworks(args *PilotArgs) error { //nolint: unparam
 			}
 			if s.EnvoyXdsServer != nil {
 				s.EnvoyXdsServer.Env.MeshNetworks = meshNetworks
-				s.EnvoyXdsServer.ConfigUpdate(&model.PushRequest{Full: true})
+				s.EnvoyXdsServer.ConfigUpdate(&model.PushRequest{Full: true, Reason: []model.TriggerReason{model.GlobalUpdate}})
 			}
 		}
 	})
@@ -524,7 +524,7 @@ func (s *Server) initMCPConfigController(args *PilotArgs) error {
 	options := coredatamodel.Options{
 		DomainSuffix: args.Config.ControllerOptions.DomainSuffix,
 		ClearDiscoveryServerCache: func() {
-			s.EnvoyXdsServer.ConfigUpdate(&model.PushRequest{Full: true})
+			s.EnvoyXdsServer.ConfigUpdate(&model.PushRequest{Full: true, Reason: []model.TriggerReason{model.ConfigUpdate}})
 		},
 	}
 
@@ -971,6 +971,12 @@ func (s *Server) initDiscoveryService(args *PilotArgs) error {
 
 				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 				defer cancel()
+				if !args.ForceStop {
+					// Drain pending pushes and ask proxies to reconnect before the gRPC server stops.
+					if err := s.EnvoyXdsServer.Shutdown(ctx); err != nil {
+						log.Warnf("XDS server shutdown did not complete: %v", err)
+					}
+				}
 				err := s.httpServer.Shutdown(ctx)
 				if err != nil {
 					log.Warna(err)
@@ -41,12 +41,55 @@ var (
 			"Default is 100, not recommended for production use.",
 	).Get()
 
+	// UpdateServiceShardsConcurrency is the number of workers rebuilding the endpoint shards of services
+	// from the service registries on a full push.
+	UpdateServiceShardsConcurrency = env.RegisterIntVar(
+		"PILOT_UPDATE_SERVICE_SHARDS_CONCURRENCY",
+		8,
+		"Number of services whose endpoint shards are rebuilt concurrently on a full push.",
+	)
+
+	// MaxOutboundListeners is a soft cap on the number of outbound listeners generated for a sidecar.
+	MaxOutboundListeners = env.RegisterIntVar(
+		"PILOT_MAX_OUTBOUND_LISTENERS",
+		10000,
+		"Limits the number of outbound listeners generated for a single sidecar. Once reached, no new outbound "+
+			"listeners are added and a push status warning is recorded. Define a Sidecar egress scope to reduce "+
+			"the number of listeners instead of raising this limit. Set to 0 to disable the limit.",
+	)
+
 	PushThrottle = env.RegisterIntVar(
 		"PILOT_PUSH_THROTTLE",
 		100,
 		"Limits the number of concurrent pushes allowed. On larger machines this can be increased for faster pushes",
 	).Get()
 
+	// PushChannelSize is the buffer size of the channel queueing push requests for debouncing.
+	PushChannelSize = env.RegisterIntVar(
+		"PILOT_PUSH_CHANNEL_SIZE",
+		10,
+		"The number of push requests that can be queued for debouncing before config updates block. "+
+			"Blocked updates are reported by the pilot_push_channel_blocked metric.",
+	).Get()
+
+	// MaxRequestHeadersKb is the default maximum size, in KiB, of the request headers accepted by the HTTP
+	// listeners. Zero keeps the Envoy default.
+	MaxRequestHeadersKb = env.RegisterIntVar(
+		"PILOT_MAX_REQUEST_HEADERS_KB",
+		0,
+		"The maximum size in KiB of the request headers accepted by the HTTP listeners, between 1 and 96. "+
+			"Zero keeps the Envoy default. Can be overridden per proxy with the MAX_REQUEST_HEADERS_KB metadata.",
+	).Get()
+
+	// HTTP2MaxConcurrentStreams is the default maximum number of concurrent streams of the HTTP/2
+	// connections accepted by the HTTP listeners. Zero keeps the Envoy default.
+	HTTP2MaxConcurrentStreams = env.RegisterIntVar(
+		"PILOT_HTTP2_MAX_CONCURRENT_STREAMS",
+		0,
+		"The maximum number of concurrent streams of the HTTP/2 connections accepted by the HTTP listeners. "+
+			"Zero keeps the Envoy default. Can be overridden per proxy with the HTTP2_MAX_CONCURRENT_STREAMS metadata.",
+	).Get()
+
 	// DebugConfigs controls saving snapshots of configs for /debug/adsz.
 	// Defaults to false, can be enabled with PILOT_DEBUG_ADSZ_CONFIG=1
 	// For larger clusters it can increase memory use and GC - useful for small tests.
@@ -57,6 +100,15 @@ var (
 	// Default is 0 (disabled).
 	RefreshDuration = env.RegisterDurationVar("V2_REFRESH", 0, "").Get()
 
+	// RefreshJitter is the fraction of RefreshDuration by which each periodic refresh is randomly
+	// advanced or delayed, so that the refreshes of Pilot replicas started together don't align.
+	RefreshJitter = env.RegisterFloatVar(
+		"PILOT_REFRESH_JITTER",
+		0.1,
+		"The fraction of V2_REFRESH by which each periodic refresh is randomly advanced or delayed. "+
+			"Set to 0 to disable the jitter.",
+	).Get()
+
 	DebounceAfter = env.RegisterDurationVar(
 		"PILOT_DEBOUNCE_AFTER",
 		100*time.Millisecond,
@@ -72,6 +124,20 @@ var (
 			"for this time, we'll trigger a push.",
 	).Get()
 
+	// EndpointShardStaleness is the time after which the endpoints of a registry shard that were not
+	// updated are evicted, as a failsafe for registry watches that stopped without an error.
+	// Only the registries other than Kubernetes are affected: their endpoints are re-read on every
+	// full push and periodic refresh, so it requires RefreshDuration (V2_REFRESH) and should be set
+	// well above it.
+	// Kubernetes registries only send the Endpoints that changed, so their shards are never evicted.
+	// Default is 0 (disabled).
+	EndpointShardStaleness = env.RegisterDurationVar(
+		"PILOT_ENDPOINT_SHARD_STALENESS",
+		0,
+		"If set, the endpoints of a non Kubernetes registry shard that were not updated for this duration are "+
+			"evicted and an EDS push is triggered. Requires V2_REFRESH. Disabled by default.",
+	).Get()
+
 	EnableEDSDebounce = env.RegisterBoolVar(
 		"PILOT_ENABLE_EDS_DEBOUNCE",
 		true,
@@ -94,6 +160,14 @@ var (
 		"Enables the use of HTTP 1.0 in the outbound HTTP listeners, to support legacy applications.",
 	).Get()
 
+	// InboundGRPCHTTP2Codec sets the HTTP/2 codec, rather than protocol detection, on the inbound gRPC listeners.
+	InboundGRPCHTTP2Codec = env.RegisterBoolVar(
+		"PILOT_INBOUND_GRPC_HTTP2_CODEC",
+		false,
+		"Use the HTTP/2 codec on the inbound gRPC listeners instead of detecting the protocol. "+
+			"HTTP/1 requests, such as h2c upgrades and health checks, are then rejected on these ports.",
+	).Get()
+
 	initialFetchTimeoutVar = env.RegisterDurationVar(
 		"PILOT_INITIAL_FETCH_TIMEOUT",
 		0,
@@ -103,6 +177,15 @@ var (
 	)
 	InitialFetchTimeout = types.DurationProto(initialFetchTimeoutVar.Get())
 
+	// SdsRequestTimeout is the timeout of the SDS gRPC requests of the workload proxies, zero to
+	// use the Envoy default of no timeout. It is independent from InitialFetchTimeout.
+	SdsRequestTimeout = env.RegisterDurationVar(
+		"PILOT_SDS_REQUEST_TIMEOUT",
+		0,
+		"Specifies the timeout of the SDS gRPC requests of the proxies. Zero disables the timeout. "+
+			"Can be overridden per proxy with the SDS_REQUEST_TIMEOUT metadata.",
+	).Get()
+
 	terminationDrainDurationVar = env.RegisterIntVar(
 		"TERMINATION_DRAIN_DURATION_SECONDS",
 		5,
@@ -131,7 +214,8 @@ var (
 	).Get()
 
 	// EnableMysqlFilter enables injection of `envoy.filters.network.mysql_proxy` in the filter chain.
-	// Pilot injects this outbound filter if the service port name is `mysql`.
+	// Pilot injects this filter ahead of the TCP proxy on the outbound, inbound and management port
+	// listeners of ports whose protocol is MySQL (port name `mysql`).
 	EnableMysqlFilter = env.RegisterBoolVar(
 		"PILOT_ENABLE_MYSQL_FILTER",
 		false,
@@ -170,6 +254,31 @@ var (
 			"and will be removed in the near future.",
 	)
 
+	EnableBlackholeAccessLog = env.RegisterBoolVar(
+		"PILOT_ENABLE_BLACKHOLE_ACCESS_LOG",
+		false,
+		"If enabled, connections dropped by the blackhole filter chains (pod IP traffic loops and "+
+			"REGISTRY_ONLY outbound traffic) are written to the mesh access log. These entries carry "+
+			"BlackHoleCluster as the upstream cluster and the UH response flag, which distinguishes them "+
+			"from PassthroughCluster traffic.",
+	)
+
+	EnableAccessLogAttemptDetails = env.RegisterBoolVar(
+		"PILOT_ENABLE_ACCESS_LOG_ATTEMPT_DETAILS",
+		false,
+		"If enabled, the default JSON access log format also logs the upstream request attempt count and the "+
+			"connection termination details. These fields require a proxy that supports the "+
+			"%UPSTREAM_REQUEST_ATTEMPT_COUNT% and %CONNECTION_TERMINATION_DETAILS% operators, older proxies "+
+			"reject the listeners that use them.",
+	)
+
+	EnableAccessLogGRPCStatus = env.RegisterBoolVar(
+		"PILOT_ENABLE_ACCESS_LOG_GRPC_STATUS",
+		true,
+		"If enabled, the default access log formats log the gRPC status of the responses. Disable it for "+
+			"proxies that do not support the %GRPC_STATUS% operator, as they reject the listeners that use it.",
+	)
+
 	ScopePushes = env.RegisterBoolVar(
 		"PILOT_SCOPE_PUSHES",
 		true,
@@ -184,6 +293,88 @@ var (
 			"Gateways with same selectors in different namespaces will not be applicable.",
 	)
 
+	// PreferredIPFamily is the mesh wide default for the IP family preferred by proxies, which
+	// can be overridden per proxy with the PREFERRED_IP_FAMILY node metadata.
+	PreferredIPFamily = env.RegisterStringVar(
+		"PILOT_PREFERRED_IP_FAMILY",
+		"IPV4",
+		"The IP family preferred when choosing listener bind addresses and resolving DNS services. "+
+			"One of IPV4, IPV6 or DUAL. IPV4 prefers IPv4 binds whenever the proxy has an IPv4 address.",
+	)
+
+	// EnablePushContextPrewarm precomputes state shared by the connected proxies on a new push context
+	// before it replaces the current one.
+	EnablePushContextPrewarm = env.RegisterBoolVar(
+		"PILOT_ENABLE_PUSH_CONTEXT_PREWARM",
+		false,
+		"If enabled, the default sidecar scopes used by the connected proxies are computed when a new "+
+			"push context is created instead of on the first push of each proxy, which reduces the latency "+
+			"of the pushes following a config change.",
+	)
+
+	// OutboundListenerConflictPolicy decides which service gets an outbound listener when services
+	// conflict on the same bind and port.
+	OutboundListenerConflictPolicy = env.RegisterStringVar(
+		"PILOT_OUTBOUND_LISTENER_CONFLICT_POLICY",
+		"FIRST_WINS",
+		"How conflicts between services on the same outbound listener are resolved. FIRST_WINS keeps the listener "+
+			"of the service processed first. NAMESPACE_PRIORITY lets a service replace the conflicting listener if its "+
+			"namespace comes earlier in PILOT_OUTBOUND_LISTENER_PRIORITY_NAMESPACES, falling back to FIRST_WINS.",
+	)
+
+	OutboundListenerPriorityNamespaces = env.RegisterStringVar(
+		"PILOT_OUTBOUND_LISTENER_PRIORITY_NAMESPACES",
+		"",
+		"Comma separated list of namespaces, highest priority first, used by the NAMESPACE_PRIORITY outbound "+
+			"listener conflict policy. Namespaces not listed have the lowest priority.",
+	)
+
+	// InboundListenerConflictPolicy decides which service gets an inbound listener when services
+	// select the same port of the workload.
+	InboundListenerConflictPolicy = env.RegisterStringVar(
+		"PILOT_INBOUND_LISTENER_CONFLICT_POLICY",
+		"FIRST_WINS",
+		"How conflicts between services selecting the same inbound port are resolved. FIRST_WINS keeps the listener "+
+			"of the service processed first. NEWEST_WINS replaces it with the listener of the most recently created "+
+			"service, so that a stale service does not hold the port during deployments. Envoy drains the connections "+
+			"of the replaced listener.",
+	)
+
+	EnableListenerVersionMetadata = env.RegisterBoolVar(
+		"PILOT_ENABLE_LISTENER_VERSION_METADATA",
+		true,
+		"If enabled, the version of Pilot that generated a listener is added to the listener metadata, "+
+			"which helps to identify proxies holding config from an older Pilot after an upgrade.",
+	)
+
+	// AccessLogServiceAddress is the address of a remote Envoy access log service. When set, proxies
+	// connect to it directly instead of through the envoy_accesslog_service bootstrap cluster.
+	AccessLogServiceAddress = env.RegisterStringVar(
+		"PILOT_ACCESS_LOG_SERVICE_ADDRESS",
+		"",
+		"The host:port of a remote Envoy access log service. If unset, access logs are sent to the "+
+			"envoy_accesslog_service cluster defined in the proxy bootstrap.",
+	)
+
+	AccessLogServiceRootCert = env.RegisterStringVar(
+		"PILOT_ACCESS_LOG_SERVICE_ROOT_CERT",
+		"",
+		"Path, on the proxy, of the root certificate used to verify the remote access log service. "+
+			"Setting it enables TLS for PILOT_ACCESS_LOG_SERVICE_ADDRESS.",
+	)
+
+	AccessLogServiceCertChain = env.RegisterStringVar(
+		"PILOT_ACCESS_LOG_SERVICE_CERT_CHAIN",
+		"",
+		"Path, on the proxy, of the client certificate chain presented to the remote access log service for mTLS.",
+	)
+
+	AccessLogServicePrivateKey = env.RegisterStringVar(
+		"PILOT_ACCESS_LOG_SERVICE_PRIVATE_KEY",
+		"",
+		"Path, on the proxy, of the client private key used for mTLS with the remote access log service.",
+	)
+
 	RespectDNSTTL = env.RegisterBoolVar(
 		"PILOT_RESPECT_DNS_TTL",
 		true,
@@ -26,6 +26,7 @@ import (
 
 	meshconfig "istio.io/api/mesh/v1alpha1"
 
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pkg/config/labels"
 )
 
@@ -124,6 +125,9 @@ type Proxy struct {
 
 	// Istio version associated with the Proxy
 	IstioVersion *IstioVersion
+
+	// listenerMetadata is the typed form of the listener related Metadata, see SetListenerMetadata.
+	listenerMetadata *ListenerMetadata
 }
 
 var (
@@ -195,6 +199,20 @@ func IsApplicationNodeType(nType NodeType) bool {
 	}
 }
 
+// ValidateIPAddresses checks that every IP address of the proxy is well formed. Sidecars must
+// have at least one address, since listeners are bound and workloads are matched based on it.
+func (node *Proxy) ValidateIPAddresses() error {
+	if len(node.IPAddresses) == 0 && node.Type == SidecarProxy {
+		return fmt.Errorf("no IP addresses for sidecar proxy %s", node.ID)
+	}
+	for _, ip := range node.IPAddresses {
+		if !isValidIPAddress(ip) {
+			return fmt.Errorf("invalid IP address %q for proxy %s", ip, node.ID)
+		}
+	}
+	return nil
+}
+
 // ServiceNode encodes the proxy node attributes into a URI-acceptable string
 func (node *Proxy) ServiceNode() string {
 	ip := ""
@@ -508,6 +526,15 @@ const (
 	// If not set, Pilot uses the default SDS token path.
 	NodeMetadataSdsTokenPath = "SDS_TOKEN_PATH"
 
+	// NodeMetadataSdsRequestTimeout is the timeout of the SDS gRPC requests of the proxy, for example
+	// "5s", overriding PILOT_SDS_REQUEST_TIMEOUT. "0s" disables the timeout.
+	NodeMetadataSdsRequestTimeout = "SDS_REQUEST_TIMEOUT"
+
+	// NodeMetadataSdsEnvoyGrpcCluster is the name of a statically defined cluster of the proxy serving
+	// SDS. When set, the proxy fetches its secrets with the Envoy gRPC client from that cluster instead
+	// of the Google gRPC client, for Envoy builds without Google gRPC.
+	NodeMetadataSdsEnvoyGrpcCluster = "SDS_ENVOY_GRPC_CLUSTER"
+
 	// NodeMetadataTLSServerCertChain is the absolute path to server cert-chain file
 	NodeMetadataTLSServerCertChain = "TLS_SERVER_CERT_CHAIN"
 
@@ -529,6 +556,141 @@ const (
 	// NodeMetadataIdleTimeout specifies the idle timeout for the proxy, in duration format (10s).
 	// If not set, no timeout is set.
 	NodeMetadataIdleTimeout = "IDLE_TIMEOUT"
+
+	// NodeMetadataStreamIdleTimeout specifies the stream idle timeout of the HTTP connection managers
+	// of the proxy, in duration format (5m). If not set, stream idle timeouts are disabled.
+	NodeMetadataStreamIdleTimeout = "STREAM_IDLE_TIMEOUT"
+
+	// NodeMetadataDisableWebsocketUpgrade disables websocket upgrades on the HTTP listeners of the
+	// proxy, so Upgrade requests are rejected. Set to "1" to enable.
+	NodeMetadataDisableWebsocketUpgrade = "DISABLE_WEBSOCKET_UPGRADE"
+
+	// NodeMetadataInboundSocketOptions is a comma separated list of TCP socket options enabled on
+	// the inbound listeners of the proxy, among TCP_NODELAY and TCP_QUICKACK. If not set, the
+	// kernel and Envoy defaults apply.
+	NodeMetadataInboundSocketOptions = "INBOUND_SOCKET_OPTIONS"
+
+	// NodeMetadataInboundHTTP2MaxConcurrentStreams is the maximum number of concurrent streams per
+	// connection of the inbound HTTP/2 and gRPC filter chains of the proxy, which the virtual
+	// inbound listener serves. If not set, the Envoy default applies.
+	NodeMetadataInboundHTTP2MaxConcurrentStreams = "INBOUND_HTTP2_MAX_CONCURRENT_STREAMS"
+
+	// NodeMetadataDisableManagementListeners disables the generation of inbound listeners for the
+	// management ports of the workload, regardless of the sidecar scope. Useful when health checks
+	// are handled outside of the proxy. Set to "1" to enable.
+	NodeMetadataDisableManagementListeners = "DISABLE_MANAGEMENT_LISTENERS"
+
+	// NodeMetadataPreferredIPFamily is the IP family preferred by the proxy, one of IPV4, IPV6
+	// or DUAL, see IPFamily. If not set, the mesh wide default is used.
+	NodeMetadataPreferredIPFamily = "PREFERRED_IP_FAMILY"
+
+	// NodeMetadataFastPush makes pushes triggered by updates of the proxy workload, a new workload
+	// or a label change, skip the debounce, so the proxy is updated right away. A label change still
+	// triggers the debounced full push of all the proxies. Intended for canary testing of push
+	// latency sensitive changes. Set to "1" to enable.
+	NodeMetadataFastPush = "FAST_PUSH"
+
+	// NodeMetadataWarmupPush makes Pilot answer the first CDS and LDS requests of a new sidecar with
+	// its essential config, and then push the full config right away. The essential config has the
+	// inbound and virtual listeners, with the inbound, passthrough and blackhole clusters: the sidecar
+	// gets ready and serves the traffic to its workload before applying the full config, and its
+	// outbound traffic goes through the passthrough or blackhole cluster until then. Ignored for
+	// gateways, which have no smaller config serving their traffic, and for reconnecting proxies.
+	// Set to "1" to enable.
+	NodeMetadataWarmupPush = "WARMUP_PUSH"
+
+	// NodeMetadataLoopbackBindAddress is the loopback address that egress listeners bound to
+	// a port (capture mode NONE) listen on when no bind address is given in the Sidecar,
+	// for example 127.0.0.2. Defaults to 127.0.0.1, or ::1 for IPv6 proxies.
+	NodeMetadataLoopbackBindAddress = "LOOPBACK_BIND_ADDRESS"
+
+	// NodeMetadataInboundBindLoopback makes the Sidecar ingress listeners bound to a port (capture
+	// mode NONE) listen on the loopback address instead of the instance IP when no bind address is
+	// given in the Sidecar: 127.0.0.1, or ::1 for IPv6 proxies, the address the inbound clusters
+	// forward to. Intended for proxies deployed without traffic capture. Set to "1" to enable.
+	NodeMetadataInboundBindLoopback = "INBOUND_BIND_LOOPBACK"
+
+	// NodeMetadataAccessLogJSONIncludeFields is a comma separated list of the fields of the default
+	// JSON access log format to keep, for example "start_time,response_code". Other fields are dropped.
+	NodeMetadataAccessLogJSONIncludeFields = "ACCESS_LOG_JSON_INCLUDE_FIELDS"
+
+	// NodeMetadataAccessLogJSONExcludeFields is a comma separated list of the fields of the default
+	// JSON access log format to drop, for example "user_agent,x_forwarded_for".
+	NodeMetadataAccessLogJSONExcludeFields = "ACCESS_LOG_JSON_EXCLUDE_FIELDS"
+
+	// NodeMetadataHTTPAccessLogEncoding overrides the mesh access log encoding (TEXT or JSON)
+	// for the HTTP listeners of the proxy.
+	NodeMetadataHTTPAccessLogEncoding = "HTTP_ACCESS_LOG_ENCODING"
+
+	// NodeMetadataTCPAccessLogEncoding overrides the mesh access log encoding (TEXT or JSON)
+	// for the TCP listeners of the proxy.
+	NodeMetadataTCPAccessLogEncoding = "TCP_ACCESS_LOG_ENCODING"
+
+	// NodeMetadataInboundForwardClientCert sets how the inbound HTTP listeners of the proxy handle the
+	// x-forwarded-client-cert header: SANITIZE, FORWARD_ONLY, APPEND_FORWARD, SANITIZE_SET or
+	// ALWAYS_FORWARD_ONLY. Defaults to APPEND_FORWARD.
+	NodeMetadataInboundForwardClientCert = "INBOUND_FORWARD_CLIENT_CERT"
+
+	// NodeMetadataInboundClientCertDetails is a comma separated list of the client certificate details
+	// the inbound HTTP listeners of the proxy add to the x-forwarded-client-cert header with
+	// APPEND_FORWARD or SANITIZE_SET: Subject, Cert, Chain, DNS and URI. Defaults to "Subject,URI,DNS".
+	NodeMetadataInboundClientCertDetails = "INBOUND_CLIENT_CERT_DETAILS"
+
+	// NodeMetadataNormalizePath sets the path normalization of the HTTP listeners of the proxy: "on"
+	// normalizes the request paths per RFC 3986, "merge-slashes" also merges adjacent slashes, and
+	// "off" forwards the paths as received, for backends that rely on non normalized paths.
+	// Defaults to "on".
+	NodeMetadataNormalizePath = "NORMALIZE_PATH"
+
+	// NodeMetadataAccessLogMinResponseCode is the minimum response code of the requests logged in
+	// the file access log of the HTTP listeners of the proxy, for example "400" to only log errors.
+	// All requests are logged if not set.
+	NodeMetadataAccessLogMinResponseCode = "ACCESS_LOG_MIN_RESPONSE_CODE"
+
+	// NodeMetadataTraceClientSampling, NodeMetadataTraceRandomSampling and NodeMetadataTraceOverallSampling
+	// override the client, random and overall tracing sampling percentages of the HTTP listeners of the
+	// proxy, for example "100" to trace all requests of a debug deployment. Values must be between 0
+	// and 100. The mesh defaults apply if not set.
+	NodeMetadataTraceClientSampling  = "TRACE_CLIENT_SAMPLING"
+	NodeMetadataTraceRandomSampling  = "TRACE_RANDOM_SAMPLING"
+	NodeMetadataTraceOverallSampling = "TRACE_OVERALL_SAMPLING"
+
+	// NodeMetadataMaxRequestHeadersKb is the maximum size in KiB of the request headers accepted by the
+	// HTTP listeners of the proxy, between 1 and 96, overriding PILOT_MAX_REQUEST_HEADERS_KB.
+	NodeMetadataMaxRequestHeadersKb = "MAX_REQUEST_HEADERS_KB"
+
+	// NodeMetadataHTTP2MaxConcurrentStreams is the maximum number of concurrent streams of the HTTP/2
+	// connections accepted by the HTTP listeners of the proxy, overriding PILOT_HTTP2_MAX_CONCURRENT_STREAMS.
+	// NodeMetadataInboundHTTP2MaxConcurrentStreams takes precedence for the inbound listeners.
+	NodeMetadataHTTP2MaxConcurrentStreams = "HTTP2_MAX_CONCURRENT_STREAMS"
+
+	// NodeMetadataGatewaySNIFallthrough adds a filter chain to the TLS listeners of the gateway handling the
+	// connections whose SNI matches no server, which are reset by default. With "reset", listeners
+	// terminating HTTPS respond with 404 and other listeners reset the connections. There is no passthrough
+	// mode: gateways do not redirect traffic, so the original destination of a connection is the gateway
+	// itself. Listeners with a server matching all SNIs are unchanged.
+	NodeMetadataGatewaySNIFallthrough = "GATEWAY_SNI_FALLTHROUGH"
+
+	// NodeMetadataDisableTLSInspector, if "1", omits the TLS inspector from all the listeners of the proxy,
+	// saving its per connection latency. Filter chains matching on SNI or ALPN then never match, so it is
+	// only meant for proxies whose listeners do not rely on them, such as TCP passthrough gateways.
+	NodeMetadataDisableTLSInspector = "DISABLE_TLS_INSPECTOR"
+
+	// NodeMetadataTransparentProxy, if "1", indicates that the traffic of a sidecar in NONE interception mode
+	// is transparently redirected to its listeners by another proxy, which adds the original destination
+	// listener filter to them.
+	NodeMetadataTransparentProxy = "TRANSPARENT_PROXY"
+
+	// NodeMetadataProxyProtocol, if "1", adds the PROXY protocol (v1 and v2) listener filter to the gateway
+	// listeners and the sidecar inbound listeners, so that the client addresses of the connections forwarded
+	// by an L4 load balancer prepending the PROXY protocol header are recovered. Connections without the
+	// header are then rejected.
+	NodeMetadataProxyProtocol = "PROXY_PROTOCOL"
+
+	// NodeMetadataInboundTCPIdleTimeout specifies the idle timeout of the TCP proxies of the sidecar inbound
+	// listeners, in duration format (1h). Idle connections are closed and reestablished by the clients against
+	// the current configuration. If not set, no timeout is set.
+	NodeMetadataInboundTCPIdleTimeout = "INBOUND_TCP_IDLE_TIMEOUT"
 )
 
 // TrafficInterceptionMode indicates how traffic to/from the workload is captured and
@@ -549,6 +711,40 @@ const (
 	InterceptionRedirect TrafficInterceptionMode = "REDIRECT"
 )
 
+// IPFamily indicates the IP family preferred by the proxy when choosing the addresses
+// its listeners bind to and when resolving DNS based services.
+type IPFamily string
+
+const (
+	// IPFamilyIPv4 prefers IPv4 whenever the proxy has an IPv4 address. This is the default.
+	IPFamilyIPv4 IPFamily = "IPV4"
+
+	// IPFamilyIPv6 prefers IPv6 whenever the proxy has an IPv6 address.
+	IPFamilyIPv6 IPFamily = "IPV6"
+
+	// IPFamilyDual binds like IPFamilyIPv4: the listeners use the IPv4 wildcard and localhost
+	// addresses, and the inbound listeners the first IPv4 address of the proxy, whenever it has one.
+	// DNS services are resolved to both families.
+	IPFamilyDual IPFamily = "DUAL"
+)
+
+// GetPreferredIPFamily returns the preferred IP family of the proxy, from the proxy metadata,
+// falling back to the mesh wide default, and to IPv4 if that is not a valid family either.
+func (node *Proxy) GetPreferredIPFamily() IPFamily {
+	if node != nil {
+		if family := node.GetListenerMetadata().PreferredIPFamily; family != "" {
+			return family
+		}
+	}
+
+	switch family := IPFamily(features.PreferredIPFamily.Get()); family {
+	case IPFamilyIPv6, IPFamilyDual:
+		return family
+	}
+
+	return IPFamilyIPv4
+}
+
 // GetInterceptionMode extracts the interception mode associated with the proxy
 // from the proxy metadata
 func (node *Proxy) GetInterceptionMode() TrafficInterceptionMode {
@@ -15,11 +15,13 @@
 package model_test
 
 import (
+	"os"
 	"reflect"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/serviceregistry/memory"
 )
@@ -186,3 +188,54 @@ func Test_parseIstioVersion(t *testing.T) {
 		})
 	}
 }
+
+func TestGetPreferredIPFamily(t *testing.T) {
+	cases := []struct {
+		name     string
+		meta     string
+		env      string
+		expected model.IPFamily
+	}{
+		{"default", "", "", model.IPFamilyIPv4},
+		{"metadata ipv6", "IPV6", "", model.IPFamilyIPv6},
+		{"metadata dual", "DUAL", "", model.IPFamilyDual},
+		{"mesh default ipv6", "", "IPV6", model.IPFamilyIPv6},
+		{"metadata overrides mesh default", "IPV4", "IPV6", model.IPFamilyIPv4},
+		{"invalid", "IPV5", "", model.IPFamilyIPv4},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				_ = os.Setenv(features.PreferredIPFamily.Name, tt.env)
+				defer func() { _ = os.Unsetenv(features.PreferredIPFamily.Name) }()
+			}
+			proxy := &model.Proxy{Metadata: map[string]string{model.NodeMetadataPreferredIPFamily: tt.meta}}
+			if got := proxy.GetPreferredIPFamily(); got != tt.expected {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestValidateIPAddresses(t *testing.T) {
+	cases := []struct {
+		name    string
+		typ     model.NodeType
+		ips     []string
+		wantErr bool
+	}{
+		{"valid", model.SidecarProxy, []string{"10.0.0.1", "fd00::1"}, false},
+		{"sidecar without ips", model.SidecarProxy, nil, true},
+		{"router without ips", model.Router, nil, false},
+		{"malformed", model.SidecarProxy, []string{"10.0.0.1", "not-an-ip"}, true},
+		{"empty", model.Router, []string{""}, true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := &model.Proxy{Type: tt.typ, ID: "test", IPAddresses: tt.ips}
+			if err := proxy.ValidateIPAddresses(); (err != nil) != tt.wantErr {
+				t.Fatalf("expected error: %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
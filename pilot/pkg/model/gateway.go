@@ -46,8 +46,45 @@ type MergedGateway struct {
 	// Inverse of ServersByRouteName. Returning this as part of merge result allows to keep route name generation logic
 	// encapsulated within the model and, as a side effect, to avoid generating route names twice.
 	RouteNamesByServer map[*networking.Server]string
+
+	// maps from server to the access log format set by the annotations of the owning gateway.
+	// Servers without an access log annotation use the mesh access log format.
+	AccessLogFormatForServer map[*networking.Server]string
+
+	// maps from server to the SDS source of its root CA set by the annotations of the owning gateway.
+	// Servers without SDS CA annotations use the defaults.
+	SdsCaForServer map[*networking.Server]GatewaySdsCa
+}
+
+// GatewaySdsCa is the SDS source of the root CA used to validate the client certificates of a gateway
+// server, set by the gateway annotations. Empty fields keep the defaults: the credential name
+// suffixed by "-cacert", fetched from the SDS server of the certificate.
+type GatewaySdsCa struct {
+	// Name is the SDS resource name of the root CA, see GatewaySdsCaNameAnnotation.
+	Name string
+	// UdsPath is the path of the SDS server of the root CA, see GatewaySdsCaUdsPathAnnotation.
+	UdsPath string
 }
 
+const (
+	// GatewayAccessLogFormatAnnotation is the annotation on gateways that sets the access log format
+	// of their HTTP servers, overriding the mesh access log format. The format must match the mesh
+	// access log encoding. The format of a single server can be set with the annotation suffixed by
+	// "." and the server port name, e.g. "networking.istio.io/accessLogFormat.https-public".
+	GatewayAccessLogFormatAnnotation = "networking.istio.io/accessLogFormat"
+
+	// GatewaySdsCaNameAnnotation is the annotation on gateways that sets the SDS resource name of the
+	// root CA of their MUTUAL TLS servers with a credentialName, for gateways fetching the CAs from
+	// different SDS backends. As for GatewayAccessLogFormatAnnotation, it can be suffixed by "." and
+	// the server port name to set the CA of a single server.
+	GatewaySdsCaNameAnnotation = "networking.istio.io/sdsCaName"
+
+	// GatewaySdsCaUdsPathAnnotation is the annotation on gateways that sets the path of the SDS server
+	// of the root CA of their MUTUAL TLS servers with a credentialName, e.g. "unix:/var/run/ca/sds".
+	// It can be suffixed by "." and the server port name to set the path for a single server.
+	GatewaySdsCaUdsPathAnnotation = "networking.istio.io/sdsCaUdsPath"
+)
+
 var (
 	typeTag = monitoring.MustCreateTag("type")
 	nameTag = monitoring.MustCreateTag("name")
@@ -79,6 +116,8 @@ func MergeGateways(gateways ...Config) *MergedGateway {
 	serversByRouteName := make(map[string][]*networking.Server)
 	routeNamesByServer := make(map[*networking.Server]string)
 	gatewayNameForServer := make(map[*networking.Server]string)
+	accessLogFormatForServer := make(map[*networking.Server]string)
+	sdsCaForServer := make(map[*networking.Server]GatewaySdsCa)
 	tlsHostsByPort := map[uint32]map[string]struct{}{} // port -> host -> exists
 
 	log.Debugf("MergeGateways: merging %d gateways", len(gateways))
@@ -91,6 +130,16 @@ func MergeGateways(gateways ...Config) *MergedGateway {
 		for _, s := range gatewayCfg.Servers {
 			sanitizeServerHostNamespace(s, gatewayConfig.Namespace)
 			gatewayNameForServer[s] = gatewayName
+			if format := gatewayServerAnnotation(gatewayConfig, s, GatewayAccessLogFormatAnnotation); format != "" {
+				accessLogFormatForServer[s] = format
+			}
+			sdsCa := GatewaySdsCa{
+				Name:    gatewayServerAnnotation(gatewayConfig, s, GatewaySdsCaNameAnnotation),
+				UdsPath: gatewayServerAnnotation(gatewayConfig, s, GatewaySdsCaUdsPathAnnotation),
+			}
+			if sdsCa != (GatewaySdsCa{}) {
+				sdsCaForServer[s] = sdsCa
+			}
 			log.Debugf("MergeGateways: gateway %q processing server %v", gatewayName, s.Hosts)
 			p := protocol.Parse(s.Port.Protocol)
 
@@ -195,11 +244,24 @@ func MergeGateways(gateways ...Config) *MergedGateway {
 	}
 
 	return &MergedGateway{
-		Servers:              servers,
-		GatewayNameForServer: gatewayNameForServer,
-		ServersByRouteName:   serversByRouteName,
-		RouteNamesByServer:   routeNamesByServer,
+		Servers:                  servers,
+		GatewayNameForServer:     gatewayNameForServer,
+		ServersByRouteName:       serversByRouteName,
+		RouteNamesByServer:       routeNamesByServer,
+		AccessLogFormatForServer: accessLogFormatForServer,
+		SdsCaForServer:           sdsCaForServer,
+	}
+}
+
+// gatewayServerAnnotation returns the value the gateway annotations set for the server, preferring
+// the server specific annotation, suffixed by the server port name, over the gateway wide one.
+func gatewayServerAnnotation(gatewayConfig Config, s *networking.Server, annotation string) string {
+	if s.Port != nil && s.Port.Name != "" {
+		if v := gatewayConfig.Annotations[annotation+"."+s.Port.Name]; v != "" {
+			return v
+		}
 	}
+	return gatewayConfig.Annotations[annotation]
 }
 
 // checkDuplicates returns all of the hosts provided that are already known
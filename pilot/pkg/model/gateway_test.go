@@ -94,6 +94,57 @@ func TestMergeGateways(t *testing.T) {
 	}
 }
 
+func TestMergeGatewaysAccessLogFormat(t *testing.T) {
+	public := makeConfig("public", "default", "foo.bar.com", "http-public", "http", 80, "ingressgateway")
+	public.Annotations = map[string]string{
+		GatewayAccessLogFormatAnnotation:                  "gateway format",
+		GatewayAccessLogFormatAnnotation + ".http-public": "server format",
+	}
+	internal := makeConfig("internal", "default", "internal.bar.com", "http-internal", "http", 8080, "ingressgateway")
+	internal.Annotations = map[string]string{GatewayAccessLogFormatAnnotation: "gateway format"}
+	plain := makeConfig("plain", "default", "plain.bar.com", "http-plain", "http", 9080, "ingressgateway")
+
+	mgw := MergeGateways(public, internal, plain)
+	expected := map[string]string{
+		"http-public":   "server format",
+		"http-internal": "gateway format",
+		"http-plain":    "",
+	}
+	for _, servers := range mgw.Servers {
+		for _, s := range servers {
+			if got := mgw.AccessLogFormatForServer[s]; got != expected[s.Port.Name] {
+				t.Errorf("expected access log format %q for server %s, got %q", expected[s.Port.Name], s.Port.Name, got)
+			}
+		}
+	}
+}
+
+func TestMergeGatewaysSdsCa(t *testing.T) {
+	public := makeConfig("public", "default", "foo.bar.com", "https-public", "https", 443, "ingressgateway")
+	public.Annotations = map[string]string{
+		GatewaySdsCaNameAnnotation:                   "gateway-ca",
+		GatewaySdsCaNameAnnotation + ".https-public": "public-ca",
+		GatewaySdsCaUdsPathAnnotation:                "unix:/var/run/ca/sds",
+	}
+	internal := makeConfig("internal", "default", "internal.bar.com", "https-internal", "https", 8443, "ingressgateway")
+	internal.Annotations = map[string]string{GatewaySdsCaUdsPathAnnotation: "unix:/var/run/internal/sds"}
+	plain := makeConfig("plain", "default", "plain.bar.com", "https-plain", "https", 9443, "ingressgateway")
+
+	mgw := MergeGateways(public, internal, plain)
+	expected := map[string]GatewaySdsCa{
+		"https-public":   {Name: "public-ca", UdsPath: "unix:/var/run/ca/sds"},
+		"https-internal": {UdsPath: "unix:/var/run/internal/sds"},
+		"https-plain":    {},
+	}
+	for _, servers := range mgw.Servers {
+		for _, s := range servers {
+			if got := mgw.SdsCaForServer[s]; got != expected[s.Port.Name] {
+				t.Errorf("expected SDS CA %+v for server %s, got %+v", expected[s.Port.Name], s.Port.Name, got)
+			}
+		}
+	}
+}
+
 func makeConfig(name, namespace, host, portName, portProtocol string, portNumber uint32, gw string) Config {
 	c := Config{
 		ConfigMeta: ConfigMeta{
@@ -0,0 +1,403 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	http_conn "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	"github.com/gogo/protobuf/types"
+	"github.com/hashicorp/go-multierror"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+)
+
+// ListenerMetadata is the typed form of the proxy metadata that influences listener generation.
+// Values that fail validation are left at their zero value.
+type ListenerMetadata struct {
+	// HTTP10 enables HTTP/1.0 on the HTTP listeners. See NodeMetadataHTTP10.
+	HTTP10 bool
+
+	// IdleTimeout is the idle timeout of the proxy connections, zero if unset or set to 0, which keeps
+	// the Envoy default. See NodeMetadataIdleTimeout.
+	IdleTimeout time.Duration
+
+	// StreamIdleTimeout is the stream idle timeout of the HTTP connection managers, zero if unset.
+	// See NodeMetadataStreamIdleTimeout.
+	StreamIdleTimeout time.Duration
+
+	// InboundTCPIdleTimeout is the idle timeout of the TCP proxies of the inbound listeners, zero if unset.
+	// See NodeMetadataInboundTCPIdleTimeout.
+	InboundTCPIdleTimeout time.Duration
+
+	// DisableWebsocketUpgrade disables websocket upgrades on the HTTP listeners.
+	// See NodeMetadataDisableWebsocketUpgrade.
+	DisableWebsocketUpgrade bool
+
+	// DisablePathNormalization disables the path normalization of the HTTP listeners, and MergeSlashes
+	// merges the adjacent slashes of the normalized paths. See NodeMetadataNormalizePath.
+	DisablePathNormalization bool
+	MergeSlashes             bool
+
+	// InboundForwardClientCert is how the inbound HTTP listeners handle the x-forwarded-client-cert
+	// header, nil if unset. See NodeMetadataInboundForwardClientCert.
+	InboundForwardClientCert *http_conn.HttpConnectionManager_ForwardClientCertDetails
+
+	// InboundClientCertDetails are the client certificate details added to the x-forwarded-client-cert
+	// header by the inbound HTTP listeners, nil if unset. See NodeMetadataInboundClientCertDetails.
+	InboundClientCertDetails *http_conn.HttpConnectionManager_SetCurrentClientCertDetails
+
+	// PreferredIPFamily is the IP family preferred by the proxy, empty if unset.
+	// See NodeMetadataPreferredIPFamily.
+	PreferredIPFamily IPFamily
+
+	// InboundSocketOptions are the names of the TCP socket options enabled on the inbound listeners,
+	// keys of TCPSocketOptions. See NodeMetadataInboundSocketOptions.
+	InboundSocketOptions []string
+
+	// InboundHTTP2MaxConcurrentStreams is the maximum number of concurrent streams of the inbound
+	// HTTP/2 connections, zero if unset. See NodeMetadataInboundHTTP2MaxConcurrentStreams.
+	InboundHTTP2MaxConcurrentStreams uint32
+
+	// HTTP2MaxConcurrentStreams is the maximum number of concurrent streams of the HTTP/2 connections,
+	// zero if unset. See NodeMetadataHTTP2MaxConcurrentStreams.
+	HTTP2MaxConcurrentStreams uint32
+
+	// MaxRequestHeadersKb is the maximum size in KiB of the request headers, zero if unset.
+	// See NodeMetadataMaxRequestHeadersKb.
+	MaxRequestHeadersKb uint32
+
+	// SidecarUID is the user ID running envoy, empty if unset. See NodeMetadataSidecarUID.
+	SidecarUID string
+
+	// DisableManagementListeners disables the management port listeners.
+	// See NodeMetadataDisableManagementListeners.
+	DisableManagementListeners bool
+
+	// LoopbackBindAddress is the loopback address egress listeners bound to a port listen on, empty
+	// if unset. See NodeMetadataLoopbackBindAddress.
+	LoopbackBindAddress string
+
+	// InboundBindLoopback makes the Sidecar ingress listeners bound to a port listen on the loopback
+	// address. See NodeMetadataInboundBindLoopback.
+	InboundBindLoopback bool
+
+	// AccessLogJSONIncludeFields and AccessLogJSONExcludeFields select the fields of the default
+	// JSON access log format. See NodeMetadataAccessLogJSONIncludeFields.
+	AccessLogJSONIncludeFields []string
+	AccessLogJSONExcludeFields []string
+
+	// HTTPAccessLogEncoding and TCPAccessLogEncoding override the mesh access log encoding, nil if
+	// unset. See NodeMetadataHTTPAccessLogEncoding.
+	HTTPAccessLogEncoding *meshconfig.MeshConfig_AccessLogEncoding
+	TCPAccessLogEncoding  *meshconfig.MeshConfig_AccessLogEncoding
+
+	// AccessLogMinResponseCode is the minimum response code of the requests logged in the HTTP file
+	// access log, zero if unset. See NodeMetadataAccessLogMinResponseCode.
+	AccessLogMinResponseCode uint32
+
+	// TraceClientSampling, TraceRandomSampling and TraceOverallSampling override the tracing sampling
+	// percentages of the HTTP listeners, nil if unset. See NodeMetadataTraceClientSampling.
+	TraceClientSampling  *float64
+	TraceRandomSampling  *float64
+	TraceOverallSampling *float64
+
+	// GatewaySNIFallthrough is the handling of the connections whose SNI matches no server of the gateway
+	// TLS listeners, GatewaySNIFallthroughReset or empty if unset.
+	// See NodeMetadataGatewaySNIFallthrough.
+	GatewaySNIFallthrough string
+
+	// DisableTLSInspector omits the TLS inspector from the listeners. See NodeMetadataDisableTLSInspector.
+	DisableTLSInspector bool
+
+	// TransparentProxy adds the original destination listener filter to the listeners of sidecars in NONE
+	// interception mode. See NodeMetadataTransparentProxy.
+	TransparentProxy bool
+
+	// ProxyProtocol adds the PROXY protocol listener filter to the gateway and sidecar inbound listeners.
+	// See NodeMetadataProxyProtocol.
+	ProxyProtocol bool
+}
+
+// GatewaySNIFallthroughReset resets the connections whose SNI matches no gateway server.
+const GatewaySNIFallthroughReset = "reset"
+
+// MaxRequestHeadersKbLimit is the largest request headers size, in KiB, accepted by Envoy.
+const MaxRequestHeadersKbLimit = 96
+
+// IsValidMaxRequestHeadersKb returns whether kb is a request headers size accepted by Envoy.
+func IsValidMaxRequestHeadersKb(kb int) bool {
+	return kb > 0 && kb <= MaxRequestHeadersKbLimit
+}
+
+// TCPSocketOptions maps the TCP socket options that can be set through the proxy metadata to their
+// Linux option names, at the SOL_TCP level.
+var TCPSocketOptions = map[string]int64{
+	"TCP_NODELAY":  1,
+	"TCP_QUICKACK": 12,
+}
+
+// ParseListenerMetadata parses the listener metadata out of the proxy metadata. Invalid values
+// are reported in the returned error and ignored, so the returned metadata is always usable.
+func ParseListenerMetadata(metadata map[string]string) (*ListenerMetadata, error) {
+	var errs error
+	out := &ListenerMetadata{
+		HTTP10:                     metadata[NodeMetadataHTTP10] == "1",
+		DisableWebsocketUpgrade:    metadata[NodeMetadataDisableWebsocketUpgrade] == "1",
+		SidecarUID:                 metadata[NodeMetadataSidecarUID],
+		DisableManagementListeners: metadata[NodeMetadataDisableManagementListeners] == "1",
+		InboundBindLoopback:        metadata[NodeMetadataInboundBindLoopback] == "1",
+		DisableTLSInspector:        metadata[NodeMetadataDisableTLSInspector] == "1",
+		TransparentProxy:           metadata[NodeMetadataTransparentProxy] == "1",
+		ProxyProtocol:              metadata[NodeMetadataProxyProtocol] == "1",
+		AccessLogJSONIncludeFields: splitMetadataList(metadata[NodeMetadataAccessLogJSONIncludeFields]),
+		AccessLogJSONExcludeFields: splitMetadataList(metadata[NodeMetadataAccessLogJSONExcludeFields]),
+	}
+
+	if v, f := metadata[NodeMetadataIdleTimeout]; f {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout < 0 {
+			errs = multierror.Append(errs, fmt.Errorf("invalid %s %q: must be a duration", NodeMetadataIdleTimeout, v))
+		} else {
+			out.IdleTimeout = timeout
+		}
+	}
+
+	if v, f := metadata[NodeMetadataStreamIdleTimeout]; f {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout < 0 {
+			errs = multierror.Append(errs, fmt.Errorf("invalid %s %q: must be a duration", NodeMetadataStreamIdleTimeout, v))
+		} else {
+			out.StreamIdleTimeout = timeout
+		}
+	}
+
+	if v, f := metadata[NodeMetadataInboundTCPIdleTimeout]; f {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			errs = multierror.Append(errs, fmt.Errorf("invalid %s %q: must be a positive duration", NodeMetadataInboundTCPIdleTimeout, v))
+		} else {
+			out.InboundTCPIdleTimeout = timeout
+		}
+	}
+
+	if v := metadata[NodeMetadataLoopbackBindAddress]; v != "" {
+		if ip := net.ParseIP(v); ip == nil || !ip.IsLoopback() {
+			errs = multierror.Append(errs, fmt.Errorf("invalid %s %q: not a loopback address", NodeMetadataLoopbackBindAddress, v))
+		} else {
+			out.LoopbackBindAddress = v
+		}
+	}
+
+	if v, f := metadata[NodeMetadataInboundHTTP2MaxConcurrentStreams]; f {
+		// Envoy accepts values in [1, 2^31 - 1].
+		streams, err := strconv.ParseUint(v, 10, 31)
+		if err != nil || streams == 0 {
+			errs = multierror.Append(errs, fmt.Errorf("invalid %s %q: must be a positive integer below 2^31",
+				NodeMetadataInboundHTTP2MaxConcurrentStreams, v))
+		} else {
+			out.InboundHTTP2MaxConcurrentStreams = uint32(streams)
+		}
+	}
+
+	if v, f := metadata[NodeMetadataHTTP2MaxConcurrentStreams]; f {
+		streams, err := strconv.ParseUint(v, 10, 31)
+		if err != nil || streams == 0 {
+			errs = multierror.Append(errs, fmt.Errorf("invalid %s %q: must be a positive integer below 2^31",
+				NodeMetadataHTTP2MaxConcurrentStreams, v))
+		} else {
+			out.HTTP2MaxConcurrentStreams = uint32(streams)
+		}
+	}
+
+	if v, f := metadata[NodeMetadataMaxRequestHeadersKb]; f {
+		kb, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || !IsValidMaxRequestHeadersKb(int(kb)) {
+			errs = multierror.Append(errs, fmt.Errorf("invalid %s %q: must be between 1 and %d",
+				NodeMetadataMaxRequestHeadersKb, v, MaxRequestHeadersKbLimit))
+		} else {
+			out.MaxRequestHeadersKb = uint32(kb)
+		}
+	}
+
+	if v, f := metadata[NodeMetadataInboundForwardClientCert]; f {
+		if mode, f := http_conn.HttpConnectionManager_ForwardClientCertDetails_value[v]; f {
+			m := http_conn.HttpConnectionManager_ForwardClientCertDetails(mode)
+			out.InboundForwardClientCert = &m
+		} else {
+			errs = multierror.Append(errs, fmt.Errorf("invalid %s %q: must be SANITIZE, FORWARD_ONLY, APPEND_FORWARD, "+
+				"SANITIZE_SET or ALWAYS_FORWARD_ONLY", NodeMetadataInboundForwardClientCert, v))
+		}
+	}
+
+	if v, f := metadata[NodeMetadataInboundClientCertDetails]; f {
+		details, err := parseClientCertDetails(v)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		} else {
+			out.InboundClientCertDetails = details
+		}
+	}
+
+	switch v := IPFamily(metadata[NodeMetadataPreferredIPFamily]); v {
+	case "":
+	case IPFamilyIPv4, IPFamilyIPv6, IPFamilyDual:
+		out.PreferredIPFamily = v
+	default:
+		errs = multierror.Append(errs, fmt.Errorf("invalid %s %q: must be %s, %s or %s",
+			NodeMetadataPreferredIPFamily, v, IPFamilyIPv4, IPFamilyIPv6, IPFamilyDual))
+	}
+
+	switch v := metadata[NodeMetadataGatewaySNIFallthrough]; v {
+	case "":
+	case GatewaySNIFallthroughReset:
+		out.GatewaySNIFallthrough = v
+	default:
+		errs = multierror.Append(errs, fmt.Errorf("invalid %s %q: must be %s",
+			NodeMetadataGatewaySNIFallthrough, v, GatewaySNIFallthroughReset))
+	}
+
+	switch v := metadata[NodeMetadataNormalizePath]; v {
+	case "", "on":
+	case "off":
+		out.DisablePathNormalization = true
+	case "merge-slashes":
+		out.MergeSlashes = true
+	default:
+		errs = multierror.Append(errs, fmt.Errorf("invalid %s %q: must be on, off or merge-slashes",
+			NodeMetadataNormalizePath, v))
+	}
+
+	if v, f := metadata[NodeMetadataAccessLogMinResponseCode]; f {
+		code, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || code < 100 || code > 599 {
+			errs = multierror.Append(errs, fmt.Errorf("invalid %s %q: must be a response code between 100 and 599",
+				NodeMetadataAccessLogMinResponseCode, v))
+		} else {
+			out.AccessLogMinResponseCode = uint32(code)
+		}
+	}
+
+	for _, name := range splitMetadataList(metadata[NodeMetadataInboundSocketOptions]) {
+		if _, f := TCPSocketOptions[name]; !f {
+			errs = multierror.Append(errs, fmt.Errorf("invalid %s %q: must be TCP_NODELAY or TCP_QUICKACK",
+				NodeMetadataInboundSocketOptions, name))
+			continue
+		}
+		out.InboundSocketOptions = append(out.InboundSocketOptions, name)
+	}
+
+	var err error
+	if out.HTTPAccessLogEncoding, err = parseAccessLogEncoding(metadata, NodeMetadataHTTPAccessLogEncoding); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if out.TCPAccessLogEncoding, err = parseAccessLogEncoding(metadata, NodeMetadataTCPAccessLogEncoding); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if out.TraceClientSampling, err = parseSamplingPercentage(metadata, NodeMetadataTraceClientSampling); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if out.TraceRandomSampling, err = parseSamplingPercentage(metadata, NodeMetadataTraceRandomSampling); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if out.TraceOverallSampling, err = parseSamplingPercentage(metadata, NodeMetadataTraceOverallSampling); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	return out, errs
+}
+
+func parseAccessLogEncoding(metadata map[string]string, key string) (*meshconfig.MeshConfig_AccessLogEncoding, error) {
+	v, f := metadata[key]
+	if !f {
+		return nil, nil
+	}
+	encoding, f := meshconfig.MeshConfig_AccessLogEncoding_value[v]
+	if !f {
+		return nil, fmt.Errorf("invalid %s %q: must be TEXT or JSON", key, v)
+	}
+	e := meshconfig.MeshConfig_AccessLogEncoding(encoding)
+	return &e, nil
+}
+
+func parseSamplingPercentage(metadata map[string]string, key string) (*float64, error) {
+	v, f := metadata[key]
+	if !f {
+		return nil, nil
+	}
+	percentage, err := strconv.ParseFloat(v, 64)
+	if err != nil || percentage < 0 || percentage > 100 {
+		return nil, fmt.Errorf("invalid %s %q: must be a percentage between 0 and 100", key, v)
+	}
+	return &percentage, nil
+}
+
+// parseClientCertDetails parses the client certificate details of NodeMetadataInboundClientCertDetails.
+// An empty list is valid and adds no details.
+func parseClientCertDetails(v string) (*http_conn.HttpConnectionManager_SetCurrentClientCertDetails, error) {
+	details := &http_conn.HttpConnectionManager_SetCurrentClientCertDetails{}
+	for _, name := range splitMetadataList(v) {
+		switch name {
+		case "Subject":
+			details.Subject = &types.BoolValue{Value: true}
+		case "Cert":
+			details.Cert = true
+		case "Chain":
+			details.Chain = true
+		case "DNS":
+			details.Dns = true
+		case "URI":
+			details.Uri = true
+		default:
+			return nil, fmt.Errorf("invalid %s %q: must be Subject, Cert, Chain, DNS or URI",
+				NodeMetadataInboundClientCertDetails, name)
+		}
+	}
+	return details, nil
+}
+
+// splitMetadataList splits a comma separated metadata value, dropping empty entries.
+func splitMetadataList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// SetListenerMetadata parses the listener metadata of the proxy once, logging invalid values.
+func (node *Proxy) SetListenerMetadata() {
+	lm, err := ParseListenerMetadata(node.Metadata)
+	if err != nil {
+		log.Warnf("ignoring invalid metadata of proxy %s: %v", node.ID, err)
+	}
+	node.listenerMetadata = lm
+}
+
+// GetListenerMetadata returns the listener metadata of the proxy, as set by SetListenerMetadata.
+// If it was not set, the metadata is parsed on every call.
+func (node *Proxy) GetListenerMetadata() *ListenerMetadata {
+	if node.listenerMetadata != nil {
+		return node.listenerMetadata
+	}
+	lm, _ := ParseListenerMetadata(node.Metadata)
+	return lm
+}
@@ -0,0 +1,183 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	http_conn "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestParseListenerMetadata(t *testing.T) {
+	json := meshconfig.MeshConfig_JSON
+	sanitize := http_conn.SANITIZE
+	randomSampling, overallSampling := 12.5, 0.0
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		want     *model.ListenerMetadata
+		wantErr  bool
+	}{
+		{
+			name:     "empty",
+			metadata: nil,
+			want:     &model.ListenerMetadata{},
+		},
+		{
+			name: "valid",
+			metadata: map[string]string{
+				model.NodeMetadataHTTP10:                           "1",
+				model.NodeMetadataIdleTimeout:                      "10s",
+				model.NodeMetadataStreamIdleTimeout:                "0s",
+				model.NodeMetadataInboundTCPIdleTimeout:            "1h",
+				model.NodeMetadataDisableWebsocketUpgrade:          "1",
+				model.NodeMetadataInboundSocketOptions:             "TCP_NODELAY,TCP_QUICKACK",
+				model.NodeMetadataInboundHTTP2MaxConcurrentStreams: "100",
+				model.NodeMetadataSidecarUID:                       "0",
+				model.NodeMetadataDisableManagementListeners:       "1",
+				model.NodeMetadataLoopbackBindAddress:              "127.0.0.2",
+				model.NodeMetadataInboundBindLoopback:              "1",
+				model.NodeMetadataAccessLogJSONIncludeFields:       "start_time, response_code,",
+				model.NodeMetadataHTTPAccessLogEncoding:            "JSON",
+				model.NodeMetadataAccessLogMinResponseCode:         "400",
+				model.NodeMetadataNormalizePath:                    "merge-slashes",
+				model.NodeMetadataInboundForwardClientCert:         "SANITIZE",
+				model.NodeMetadataInboundClientCertDetails:         "URI, DNS",
+				model.NodeMetadataTraceRandomSampling:              "12.5",
+				model.NodeMetadataMaxRequestHeadersKb:              "96",
+				model.NodeMetadataHTTP2MaxConcurrentStreams:        "1000",
+				model.NodeMetadataGatewaySNIFallthrough:            "reset",
+				model.NodeMetadataPreferredIPFamily:                "DUAL",
+				model.NodeMetadataDisableTLSInspector:              "1",
+				model.NodeMetadataTransparentProxy:                 "1",
+				model.NodeMetadataProxyProtocol:                    "1",
+				model.NodeMetadataTraceOverallSampling:             "0",
+			},
+			want: &model.ListenerMetadata{
+				HTTP10:                           true,
+				IdleTimeout:                      10 * time.Second,
+				InboundTCPIdleTimeout:            time.Hour,
+				DisableWebsocketUpgrade:          true,
+				InboundSocketOptions:             []string{"TCP_NODELAY", "TCP_QUICKACK"},
+				InboundHTTP2MaxConcurrentStreams: 100,
+				SidecarUID:                       "0",
+				DisableManagementListeners:       true,
+				LoopbackBindAddress:              "127.0.0.2",
+				InboundBindLoopback:              true,
+				AccessLogJSONIncludeFields:       []string{"start_time", "response_code"},
+				HTTPAccessLogEncoding:            &json,
+				AccessLogMinResponseCode:         400,
+				MergeSlashes:                     true,
+				InboundForwardClientCert:         &sanitize,
+				InboundClientCertDetails:         &http_conn.HttpConnectionManager_SetCurrentClientCertDetails{Uri: true, Dns: true},
+				TraceRandomSampling:              &randomSampling,
+				MaxRequestHeadersKb:              96,
+				HTTP2MaxConcurrentStreams:        1000,
+				GatewaySNIFallthrough:            model.GatewaySNIFallthroughReset,
+				PreferredIPFamily:                model.IPFamilyDual,
+				DisableTLSInspector:              true,
+				TransparentProxy:                 true,
+				ProxyProtocol:                    true,
+				TraceOverallSampling:             &overallSampling,
+			},
+		},
+		{
+			name: "invalid values are dropped",
+			metadata: map[string]string{
+				model.NodeMetadataHTTP10:                           "true",
+				model.NodeMetadataIdleTimeout:                      "-1s",
+				model.NodeMetadataStreamIdleTimeout:                "5 minutes",
+				model.NodeMetadataInboundTCPIdleTimeout:            "0s",
+				model.NodeMetadataLoopbackBindAddress:              "10.0.0.1",
+				model.NodeMetadataTCPAccessLogEncoding:             "XML",
+				model.NodeMetadataHTTPAccessLogEncoding:            "JSON",
+				model.NodeMetadataInboundSocketOptions:             "TCP_NODELAY,SO_KEEPALIVE",
+				model.NodeMetadataInboundHTTP2MaxConcurrentStreams: "2147483648",
+				model.NodeMetadataAccessLogMinResponseCode:         "99",
+				model.NodeMetadataNormalizePath:                    "raw",
+				model.NodeMetadataInboundForwardClientCert:         "DROP",
+				model.NodeMetadataInboundClientCertDetails:         "URI,Issuer",
+				model.NodeMetadataTraceClientSampling:              "100.1",
+				model.NodeMetadataMaxRequestHeadersKb:              "97",
+				model.NodeMetadataHTTP2MaxConcurrentStreams:        "0",
+				model.NodeMetadataGatewaySNIFallthrough:            "passthrough",
+				model.NodeMetadataPreferredIPFamily:                "ipv6",
+				model.NodeMetadataTraceRandomSampling:              "-1",
+				model.NodeMetadataTraceOverallSampling:             "all",
+			},
+			want:    &model.ListenerMetadata{HTTPAccessLogEncoding: &json, InboundSocketOptions: []string{"TCP_NODELAY"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := model.ParseListenerMetadata(tt.metadata)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error: %v, got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseListenerMetadataIdleTimeout(t *testing.T) {
+	cases := []struct {
+		timeout  string
+		expected time.Duration
+		wantErr  bool
+	}{
+		{"10s", 10 * time.Second, false},
+		{"0s", 0, false},
+		{"-1s", 0, true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.timeout, func(t *testing.T) {
+			got, err := model.ParseListenerMetadata(map[string]string{model.NodeMetadataIdleTimeout: tt.timeout})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got.IdleTimeout != tt.expected {
+				t.Fatalf("expected idle timeout %v, got %v", tt.expected, got.IdleTimeout)
+			}
+		})
+	}
+}
+
+func TestGetListenerMetadata(t *testing.T) {
+	metadata := map[string]string{model.NodeMetadataIdleTimeout: "5s"}
+	proxy, err := model.ParseServiceNodeWithMetadata("sidecar~10.0.0.1~test.default~default.svc.cluster.local", metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.SetListenerMetadata()
+	metadata[model.NodeMetadataIdleTimeout] = "1s"
+	if got := proxy.GetListenerMetadata().IdleTimeout; got != 5*time.Second {
+		t.Fatalf("expected idle timeout 5s, got %v", got)
+	}
+
+	// Proxies without parsed listener metadata are parsed on demand.
+	proxy = &model.Proxy{Metadata: metadata}
+	if got := proxy.GetListenerMetadata().IdleTimeout; got != time.Second {
+		t.Fatalf("expected idle timeout 1s, got %v", got)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"sort"
 	"sync"
 
+	authn "istio.io/api/authentication/v1alpha1"
 	networking "istio.io/api/networking/v1alpha3"
 
 	"istio.io/istio/pilot/pkg/features"
@@ -93,9 +94,33 @@ type PushContext struct {
 	// ServiceAccounts contains a map of hostname and port to service accounts.
 	ServiceAccounts map[host.Name]map[int][]string `json:"-"`
 
+	// authnPolicies memoizes the authentication policies of the workloads for the duration of the push,
+	// and authnPolicyCalls tracks the resolutions in progress. See AuthenticationPolicyForWorkload.
+	authnPoliciesMutex sync.Mutex
+	authnPolicies      map[authnPolicyKey]*authn.Policy
+	authnPolicyCalls   map[authnPolicyKey]*authnPolicyCall
+
 	initDone bool
 }
 
+// authnPolicyKey identifies the workloads sharing the same authentication policy. The policies are
+// selected in the namespace of the service, and services of different namespaces may share a hostname.
+type authnPolicyKey struct {
+	hostname  host.Name
+	namespace string
+	port      int
+	portName  string
+	labels    string
+}
+
+// authnPolicyCall is an authentication policy resolution in progress, shared by the concurrent
+// requests for the same workloads. done is closed once policy and err are set.
+type authnPolicyCall struct {
+	done   chan struct{}
+	policy *authn.Policy
+	err    error
+}
+
 type processedDestRules struct {
 	// List of dest rule hosts. We match with the most specific host first
 	hosts []host.Name
@@ -160,8 +185,36 @@ type PushRequest struct {
 	// Key is the hostname (serviceName).
 	// This is used by incremental eds.
 	EdsUpdates map[string]struct{}
+
+	// Reason records what triggered the push, for observability. Merged requests keep each
+	// reason once.
+	Reason []TriggerReason
+
+	// TargetProxies contains the IDs of the proxies the push is meant for. It is used for changes
+	// that only affect specific proxies, such as their metadata: the current push context is reused
+	// and only the connections of these proxies are pushed.
+	// If this is empty, the push applies to all connected proxies.
+	TargetProxies map[string]struct{}
 }
 
+// TriggerReason describes what triggered a push.
+type TriggerReason string
+
+const (
+	// EndpointUpdate is used when the endpoints of a service changed.
+	EndpointUpdate TriggerReason = "endpoint"
+	// ConfigUpdate is used when an Istio config changed.
+	ConfigUpdate TriggerReason = "config"
+	// ServiceUpdate is used when a service changed.
+	ServiceUpdate TriggerReason = "service"
+	// ProxyUpdate is used when the workload of a proxy changed, such as its labels.
+	ProxyUpdate TriggerReason = "proxy"
+	// GlobalUpdate is used when a change affects all proxies, such as the mesh config or a new registry.
+	GlobalUpdate TriggerReason = "global"
+	// UnknownTrigger is used when the cause of the push is not known.
+	UnknownTrigger TriggerReason = "unknown"
+)
+
 // Merge two update requests together
 func (first *PushRequest) Merge(other *PushRequest) *PushRequest {
 	if first == nil {
@@ -172,8 +225,23 @@ func (first *PushRequest) Merge(other *PushRequest) *PushRequest {
 	}
 
 	first.Full = first.Full || other.Full
-	// Only merge EdsUpdates when incremental eds push needed.
+	for _, reason := range other.Reason {
+		first.addReason(reason)
+	}
+	// If either does not target specific proxies, the merged request applies to all proxies.
+	if len(first.TargetProxies) == 0 || len(other.TargetProxies) == 0 {
+		first.TargetProxies = nil
+	} else {
+		for proxy := range other.TargetProxies {
+			first.TargetProxies[proxy] = struct{}{}
+		}
+	}
+	// Only merge EdsUpdates when incremental eds push needed. A batch stays incremental as long
+	// as all merged requests are, in which case the push context is not recomputed on push.
 	if !first.Full {
+		if first.EdsUpdates == nil && len(other.EdsUpdates) > 0 {
+			first.EdsUpdates = make(map[string]struct{}, len(other.EdsUpdates))
+		}
 		// Merge the updates
 		for update := range other.EdsUpdates {
 			first.EdsUpdates[update] = struct{}{}
@@ -200,6 +268,16 @@ func (first *PushRequest) Merge(other *PushRequest) *PushRequest {
 	return first
 }
 
+// addReason adds the reason to the request, unless it is already present.
+func (first *PushRequest) addReason(reason TriggerReason) {
+	for _, r := range first.Reason {
+		if r == reason {
+			return
+		}
+	}
+	first.Reason = append(first.Reason, reason)
+}
+
 // ProxyPushStatus represents an event captured during config push to proxies.
 // It may contain additional message and the affected proxy.
 type ProxyPushStatus struct {
@@ -290,6 +368,55 @@ var (
 		"Number of conflicting inbound listeners.",
 	)
 
+	// ProxyStatusConflictInboundListeners tracks the conflicting inbound listeners of each proxy. Unlike
+	// ProxyStatusConflictInboundListener, which counts proxies, it counts every conflicting listener.
+	ProxyStatusConflictInboundListeners = monitoring.NewGauge(
+		"pilot_conflict_inbound_listeners",
+		"Number of conflicting inbound listeners, across all proxies.",
+	)
+
+	// ProxyStatusSNIOverlap tracks listeners whose filter chains have overlapping server names, so that
+	// connections for some names are only routed to one of the chains.
+	ProxyStatusSNIOverlap = monitoring.NewGauge(
+		"pilot_sni_overlap_listeners",
+		"Number of listeners with overlapping server names between their filter chains.",
+	)
+
+	// ProxyStatusSidecarIngressNoInstance tracks Sidecar ingress listeners that were skipped
+	// because the proxy has no service instance with a matching port.
+	ProxyStatusSidecarIngressNoInstance = monitoring.NewGauge(
+		"pilot_sidecar_ingress_listener_no_instance",
+		"Number of Sidecar ingress listeners skipped for lack of a matching service instance.",
+	)
+
+	// ProxyStatusOutboundListenerLimit tracks sidecars whose outbound listeners were capped
+	// at PILOT_MAX_OUTBOUND_LISTENERS.
+	ProxyStatusOutboundListenerLimit = monitoring.NewGauge(
+		"pilot_outbound_listener_limit",
+		"Number of sidecars whose outbound listeners were capped at the configured maximum.",
+	)
+
+	// ProxyStatusUnknownListenerProtocol tracks service and Sidecar listener ports that were
+	// skipped because their protocol does not parse to a known protocol, typically a typo.
+	ProxyStatusUnknownListenerProtocol = monitoring.NewGauge(
+		"pilot_unknown_listener_protocol",
+		"Number of listener ports skipped because of an unknown protocol.",
+	)
+
+	// ProxyStatusInvalidIPAddresses tracks proxies whose listeners were not built because
+	// their IP addresses are missing or malformed.
+	ProxyStatusInvalidIPAddresses = monitoring.NewGauge(
+		"pilot_proxy_invalid_ip_addresses",
+		"Number of proxies without listeners because of missing or malformed IP addresses.",
+	)
+
+	// ProxyStatusAuthnPolicyJwksFailure tracks authentication policies that were not applied
+	// because their JWKS URIs could not be resolved.
+	ProxyStatusAuthnPolicyJwksFailure = monitoring.NewGauge(
+		"pilot_authn_policy_jwks_failures",
+		"Number of authentication policies ignored because their JWKS URIs could not be resolved.",
+	)
+
 	// DuplicatedClusters tracks duplicate clusters seen while computing CDS
 	DuplicatedClusters = monitoring.NewGauge(
 		"pilot_duplicate_envoy_clusters",
@@ -336,6 +463,13 @@ var (
 		ProxyStatusConflictOutboundListenerTCPOverTCP,
 		ProxyStatusConflictOutboundListenerHTTPOverTCP,
 		ProxyStatusConflictInboundListener,
+		ProxyStatusConflictInboundListeners,
+		ProxyStatusSNIOverlap,
+		ProxyStatusSidecarIngressNoInstance,
+		ProxyStatusOutboundListenerLimit,
+		ProxyStatusUnknownListenerProtocol,
+		ProxyStatusInvalidIPAddresses,
+		ProxyStatusAuthnPolicyJwksFailure,
 		DuplicatedClusters,
 		ProxyStatusClusterNoInstances,
 		DuplicatedDomains,
@@ -371,7 +505,59 @@ func NewPushContext() *PushContext {
 		ServiceByHostnameAndNamespace: map[host.Name]map[string]*Service{},
 		ProxyStatus:                   map[string]map[string]ProxyPushStatus{},
 		ServiceAccounts:               map[host.Name]map[int][]string{},
+		authnPolicies:                 map[authnPolicyKey]*authn.Policy{},
+	}
+}
+
+// AuthenticationPolicyForWorkload returns the authentication policy of the workloads of service with
+// the given labels and port, computing it with resolve the first time it is requested during this push.
+// Errors returned by resolve are not memoized, so that a transient JWKS resolution failure is retried
+// rather than leaving the workloads without authentication for the rest of the push. The push context
+// is rebuilt for each full push, which invalidates the memoized policies.
+// resolve may fetch the JWKS of the policy issuers, so it runs without holding the lock: the concurrent
+// requests for the same workloads wait for its result, the others are not blocked.
+func (ps *PushContext) AuthenticationPolicyForWorkload(service *Service, l labels.Instance, port *Port,
+	resolve func() (*authn.Policy, error)) (*authn.Policy, error) {
+	key := authnPolicyKey{
+		hostname:  service.Hostname,
+		namespace: service.Attributes.Namespace,
+		labels:    l.String(),
+	}
+	if port != nil {
+		key.port = port.Port
+		key.portName = port.Name
+	}
+
+	ps.authnPoliciesMutex.Lock()
+	if policy, f := ps.authnPolicies[key]; f {
+		ps.authnPoliciesMutex.Unlock()
+		return policy, nil
+	}
+	if call, f := ps.authnPolicyCalls[key]; f {
+		ps.authnPoliciesMutex.Unlock()
+		<-call.done
+		return call.policy, call.err
+	}
+	call := &authnPolicyCall{done: make(chan struct{})}
+	if ps.authnPolicyCalls == nil {
+		ps.authnPolicyCalls = map[authnPolicyKey]*authnPolicyCall{}
+	}
+	ps.authnPolicyCalls[key] = call
+	ps.authnPoliciesMutex.Unlock()
+
+	call.policy, call.err = resolve()
+
+	ps.authnPoliciesMutex.Lock()
+	if call.err == nil {
+		if ps.authnPolicies == nil {
+			ps.authnPolicies = map[authnPolicyKey]*authn.Policy{}
+		}
+		ps.authnPolicies[key] = call.policy
 	}
+	delete(ps.authnPolicyCalls, key)
+	ps.authnPoliciesMutex.Unlock()
+	close(call.done)
+	return call.policy, call.err
 }
 
 // JSON implements json.Marshaller, with a lock.
@@ -523,6 +709,17 @@ func (ps *PushContext) getSidecarScope(proxy *Proxy, workloadLabels labels.Colle
 	return DefaultSidecarScopeForNamespace(ps, proxy.ConfigNamespace)
 }
 
+// PrewarmSidecarScopes computes the default sidecar scope for the given config namespaces that
+// have no scope yet, so they are shared by all proxies instead of being computed per proxy.
+// It must be called before the push context is used for pushes.
+func (ps *PushContext) PrewarmSidecarScopes(namespaces []string) {
+	for _, ns := range namespaces {
+		if len(ps.sidecarsByNamespace[ns]) == 0 {
+			ps.sidecarsByNamespace[ns] = []*SidecarScope{DefaultSidecarScopeForNamespace(ps, ns)}
+		}
+	}
+}
+
 // GetAllSidecarScopes returns a map of namespace and the set of SidecarScope
 // object associated with the namespace. This will be used by the CDS code to
 // precompute CDS output for each sidecar scope. Since we have a default sidecarscope
@@ -16,7 +16,13 @@ package model
 
 import (
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	authn "istio.io/api/authentication/v1alpha1"
+
+	"istio.io/istio/pkg/config/mesh"
 )
 
 func TestMergeUpdateRequest(t *testing.T) {
@@ -74,6 +80,42 @@ func TestMergeUpdateRequest(t *testing.T) {
 			&PushRequest{Full: false, TargetNamespaces: map[string]struct{}{"ns2": {}}, EdsUpdates: map[string]struct{}{"svc-2": {}}},
 			PushRequest{Full: false, TargetNamespaces: map[string]struct{}{"ns1": {}, "ns2": {}}, EdsUpdates: map[string]struct{}{"svc-1": {}, "svc-2": {}}},
 		},
+		{
+			"reason merge",
+			&PushRequest{Full: true, Reason: []TriggerReason{ConfigUpdate, EndpointUpdate}},
+			&PushRequest{Full: true, Reason: []TriggerReason{EndpointUpdate, ServiceUpdate}},
+			PushRequest{Full: true, Reason: []TriggerReason{ConfigUpdate, EndpointUpdate, ServiceUpdate}},
+		},
+		{
+			"reason merge: left without reason",
+			&PushRequest{Full: false, EdsUpdates: map[string]struct{}{"svc-1": {}}},
+			&PushRequest{Full: false, EdsUpdates: map[string]struct{}{"svc-2": {}}, Reason: []TriggerReason{EndpointUpdate}},
+			PushRequest{Full: false, EdsUpdates: map[string]struct{}{"svc-1": {}, "svc-2": {}}, Reason: []TriggerReason{EndpointUpdate}},
+		},
+		{
+			"incremental merge: left without eds updates",
+			&PushRequest{Full: false},
+			&PushRequest{Full: false, EdsUpdates: map[string]struct{}{"svc-1": {}}},
+			PushRequest{Full: false, EdsUpdates: map[string]struct{}{"svc-1": {}}},
+		},
+		{
+			"target proxies merge",
+			&PushRequest{Full: true, TargetProxies: map[string]struct{}{"proxy-1": {}}},
+			&PushRequest{Full: false, TargetProxies: map[string]struct{}{"proxy-2": {}}},
+			PushRequest{Full: true, TargetProxies: map[string]struct{}{"proxy-1": {}, "proxy-2": {}}},
+		},
+		{
+			"target proxies merge: right for all proxies",
+			&PushRequest{Full: true, TargetProxies: map[string]struct{}{"proxy-1": {}}},
+			&PushRequest{Full: true},
+			PushRequest{Full: true},
+		},
+		{
+			"target proxies merge: left for all proxies",
+			&PushRequest{Full: false, EdsUpdates: map[string]struct{}{"svc-1": {}}},
+			&PushRequest{Full: true, TargetProxies: map[string]struct{}{"proxy-1": {}}},
+			PushRequest{Full: true},
+		},
 	}
 
 	for _, tt := range cases {
@@ -85,3 +127,69 @@ func TestMergeUpdateRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestPrewarmSidecarScopes(t *testing.T) {
+	ps := NewPushContext()
+	meshConfig := mesh.DefaultMeshConfig()
+	ps.Env = &Environment{Mesh: &meshConfig}
+	existing := &SidecarScope{}
+	ps.sidecarsByNamespace["with-sidecar"] = []*SidecarScope{existing}
+
+	ps.PrewarmSidecarScopes([]string{"with-sidecar", "default"})
+
+	if got := ps.getSidecarScope(&Proxy{ConfigNamespace: "with-sidecar"}, nil); got != existing {
+		t.Fatalf("expected existing sidecar scope to be kept, got %v", got)
+	}
+	prewarmed := ps.sidecarsByNamespace["default"]
+	if len(prewarmed) != 1 {
+		t.Fatalf("expected a prewarmed sidecar scope for namespace default, got %v", prewarmed)
+	}
+	if got := ps.getSidecarScope(&Proxy{ConfigNamespace: "default"}, nil); got != prewarmed[0] {
+		t.Fatalf("expected the prewarmed sidecar scope to be used, got %v", got)
+	}
+}
+
+func TestAuthenticationPolicyForWorkloadResolvesOutsideLock(t *testing.T) {
+	ps := NewPushContext()
+	port := &Port{Name: "http", Port: 80}
+	slow := &Service{Hostname: "slow.default.svc.cluster.local", Attributes: ServiceAttributes{Namespace: "default"}}
+	fast := &Service{Hostname: "fast.default.svc.cluster.local", Attributes: ServiceAttributes{Namespace: "default"}}
+	policy := &authn.Policy{}
+
+	release := make(chan struct{})
+	var slowResolutions int32
+	resolveSlow := func() (*authn.Policy, error) {
+		atomic.AddInt32(&slowResolutions, 1)
+		<-release
+		return policy, nil
+	}
+	results := make(chan *authn.Policy, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			got, _ := ps.AuthenticationPolicyForWorkload(slow, nil, port, resolveSlow)
+			results <- got
+		}()
+	}
+
+	// A slow resolution, for example of the JWKS of an issuer, does not block other workloads.
+	done := make(chan struct{})
+	go func() {
+		_, _ = ps.AuthenticationPolicyForWorkload(fast, nil, port, func() (*authn.Policy, error) { return nil, nil })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected other workloads not to wait for a pending resolution")
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if got := <-results; got != policy {
+			t.Fatalf("expected %v, got %v", policy, got)
+		}
+	}
+	if n := atomic.LoadInt32(&slowResolutions); n != 1 {
+		t.Fatalf("expected concurrent requests to share the resolution, got %d resolutions", n)
+	}
+}
@@ -361,6 +361,14 @@ type ServiceAttributes struct {
 	// Used by the aggregator to aggregate the Attributes.ClusterExternalAddresses
 	// for clusters where the service resides
 	ClusterExternalAddresses map[string][]string
+
+	// HTTPSRedirectPorts is the set of service ports on which plain HTTP requests are answered
+	// with a redirect to HTTPS, instead of being routed to the workload.
+	HTTPSRedirectPorts map[int]bool
+
+	// DisableAccessLog suppresses access logs on the inbound listeners of the service,
+	// even when access logging is enabled mesh wide.
+	DisableAccessLog bool
 }
 
 // ServiceDiscovery enumerates Istio service instances.
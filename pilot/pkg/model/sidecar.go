@@ -15,7 +15,9 @@
 package model
 
 import (
+	"strconv"
 	"strings"
+	"time"
 
 	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 
@@ -31,6 +33,22 @@ const (
 	wildcardService   = host.Name("*")
 )
 
+const (
+	// SidecarIdleTimeoutAnnotation is the annotation on Sidecar resources that sets the idle timeout of
+	// the HTTP connection managers of the workloads, in duration format (10s). It takes precedence
+	// over the IDLE_TIMEOUT proxy metadata.
+	SidecarIdleTimeoutAnnotation = "networking.istio.io/idleTimeout"
+
+	// SidecarAccessLogFormatAnnotation is the annotation on Sidecar resources that sets the access log
+	// format of the workloads, overriding the mesh access log format. The format must match the
+	// access log encoding. On a Sidecar without workload selector, it applies to the whole namespace.
+	SidecarAccessLogFormatAnnotation = "networking.istio.io/accessLogFormat"
+
+	// SidecarAccessLogDisabledAnnotation is the annotation on Sidecar resources that disables the
+	// access logs configured in mesh config for the workloads. Set to "true" to disable.
+	SidecarAccessLogDisabledAnnotation = "networking.istio.io/accessLogDisabled"
+)
+
 // SidecarScope is a wrapper over the Sidecar resource with some
 // preprocessed data to determine the list of services, virtualServices,
 // and destinationRules that are accessible to a given
@@ -96,6 +114,15 @@ type SidecarScope struct {
 
 	// Set of all namespaces this sidecar depends on. This is determined from the egress config
 	namespaceDependencies map[string]struct{}
+
+	// IdleTimeout is the idle timeout of the HTTP connection managers set by the Sidecar
+	// resource, see SidecarIdleTimeoutAnnotation. Zero if unset.
+	IdleTimeout time.Duration
+
+	// AccessLogFormat and AccessLogDisabled are the access log settings of the Sidecar resource,
+	// see SidecarAccessLogFormatAnnotation. The mesh config applies if unset.
+	AccessLogFormat   string
+	AccessLogDisabled bool
 }
 
 // IstioEgressListenerWrapper is a wrapper for
@@ -252,6 +279,25 @@ func ConvertToSidecarScope(ps *PushContext, sidecarConfig *Config, configNamespa
 		out.HasCustomIngressListeners = true
 	}
 
+	if v, f := sidecarConfig.Annotations[SidecarIdleTimeoutAnnotation]; f {
+		if timeout, err := time.ParseDuration(v); err == nil && timeout > 0 {
+			out.IdleTimeout = timeout
+		} else {
+			log.Warnf("ignoring invalid %s %q on sidecar %s/%s", SidecarIdleTimeoutAnnotation, v,
+				sidecarConfig.Namespace, sidecarConfig.Name)
+		}
+	}
+
+	out.AccessLogFormat = sidecarConfig.Annotations[SidecarAccessLogFormatAnnotation]
+	if v, f := sidecarConfig.Annotations[SidecarAccessLogDisabledAnnotation]; f {
+		if disabled, err := strconv.ParseBool(v); err == nil {
+			out.AccessLogDisabled = disabled
+		} else {
+			log.Warnf("ignoring invalid %s %q on sidecar %s/%s", SidecarAccessLogDisabledAnnotation, v,
+				sidecarConfig.Namespace, sidecarConfig.Name)
+		}
+	}
+
 	return out
 }
 
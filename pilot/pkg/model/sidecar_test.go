@@ -20,6 +20,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"istio.io/api/mesh/v1alpha1"
 	networking "istio.io/api/networking/v1alpha3"
@@ -433,6 +434,76 @@ func TestContainsEgressNamespace(t *testing.T) {
 	}
 }
 
+func TestSidecarIdleTimeoutAnnotation(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		expected    time.Duration
+	}{
+		{"unset", nil, 0},
+		{"valid", map[string]string{SidecarIdleTimeoutAnnotation: "30s"}, 30 * time.Second},
+		{"invalid", map[string]string{SidecarIdleTimeoutAnnotation: "thirty seconds"}, 0},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				ConfigMeta: ConfigMeta{
+					Name:        "foo",
+					Namespace:   "default",
+					Annotations: tt.annotations,
+				},
+				Spec: &networking.Sidecar{},
+			}
+			ps := NewPushContext()
+			meshConfig := mesh.DefaultMeshConfig()
+			ps.Env = &Environment{
+				Mesh: &meshConfig,
+			}
+
+			if got := ConvertToSidecarScope(ps, cfg, "default").IdleTimeout; got != tt.expected {
+				t.Fatalf("expected idle timeout %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestSidecarAccessLogAnnotations(t *testing.T) {
+	cases := []struct {
+		name             string
+		annotations      map[string]string
+		expectedFormat   string
+		expectedDisabled bool
+	}{
+		{"unset", nil, "", false},
+		{"format", map[string]string{SidecarAccessLogFormatAnnotation: "[%START_TIME%]\n"}, "[%START_TIME%]\n", false},
+		{"disabled", map[string]string{SidecarAccessLogDisabledAnnotation: "true"}, "", true},
+		{"invalid disabled", map[string]string{SidecarAccessLogDisabledAnnotation: "yes please"}, "", false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				ConfigMeta: ConfigMeta{
+					Name:        "foo",
+					Namespace:   "default",
+					Annotations: tt.annotations,
+				},
+				Spec: &networking.Sidecar{},
+			}
+			ps := NewPushContext()
+			meshConfig := mesh.DefaultMeshConfig()
+			ps.Env = &Environment{
+				Mesh: &meshConfig,
+			}
+
+			scope := ConvertToSidecarScope(ps, cfg, "default")
+			if scope.AccessLogFormat != tt.expectedFormat || scope.AccessLogDisabled != tt.expectedDisabled {
+				t.Fatalf("expected access log format %q disabled %v, got %q %v", tt.expectedFormat, tt.expectedDisabled,
+					scope.AccessLogFormat, scope.AccessLogDisabled)
+			}
+		})
+	}
+}
+
 func TestSidecarOutboundTrafficPolicy(t *testing.T) {
 
 	configWithoutOutboundTrafficPolicy := &Config{
@@ -15,7 +15,6 @@
 package model
 
 import (
-	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -25,12 +24,80 @@ import (
 
 	"istio.io/istio/pkg/config"
 	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/config/protocol"
 )
 
 // UnixAddressPrefix is the prefix used to indicate an address is for a Unix Domain socket. It is used in
 // ServiceEntry.Endpoint.Address message.
 const UnixAddressPrefix = "unix://"
 
+// maxHostnameLength is the maximum length of a service hostname (RFC 1035). It also bounds the
+// number of labels of the hostname, to 127.
+const maxHostnameLength = 253
+
+// ValidationErrorCode is a machine readable code describing why a field failed validation.
+type ValidationErrorCode string
+
+const (
+	// ValidationErrorInvalid indicates the value of the field is malformed or out of range.
+	ValidationErrorInvalid ValidationErrorCode = "Invalid"
+
+	// ValidationErrorRequired indicates a required field is missing or empty.
+	ValidationErrorRequired ValidationErrorCode = "Required"
+
+	// ValidationErrorDuplicate indicates the value of the field is already used elsewhere.
+	ValidationErrorDuplicate ValidationErrorCode = "Duplicate"
+
+	// ValidationErrorNotFound indicates the field references something that does not exist.
+	ValidationErrorNotFound ValidationErrorCode = "NotFound"
+
+	// ValidationErrorMismatch indicates the value of the field does not match the value it refers to.
+	ValidationErrorMismatch ValidationErrorCode = "Mismatch"
+)
+
+// ValidationError is a validation failure of a single field. It carries the path of the field
+// (e.g. "ports[2].name") and a code, so that consumers such as admission webhooks can report
+// precise feedback. Its Error message is the human readable description of the failure.
+type ValidationError struct {
+	Field   string
+	Code    ValidationErrorCode
+	Message string
+}
+
+// Error implements the error interface.
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func newValidationError(field string, code ValidationErrorCode, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// prefixValidationErrors prefixes the field path of the validation errors in err with the given
+// parent path. Other errors are wrapped into a validation error for the parent path.
+func prefixValidationErrors(parent string, err error) error {
+	var errs []error
+	if merr, ok := err.(*multierror.Error); ok {
+		errs = merr.Errors
+	} else {
+		errs = []error{err}
+	}
+
+	var out error
+	for _, e := range errs {
+		if verr, ok := e.(*ValidationError); ok {
+			field := parent
+			if verr.Field != "" {
+				field = parent + "." + verr.Field
+			}
+			out = multierror.Append(out, &ValidationError{Field: field, Code: verr.Code, Message: verr.Message})
+		} else {
+			out = multierror.Append(out, newValidationError(parent, ValidationErrorInvalid, "%v", e))
+		}
+	}
+	return out
+}
+
 // Validate checks that each name conforms to the spec and has a ProtoMessage
 func (descriptor ConfigDescriptor) Validate() error {
 	var errs error
@@ -38,28 +105,34 @@ func (descriptor ConfigDescriptor) Validate() error {
 	messages := make(map[string]bool)
 	clusterMessages := make(map[string]bool)
 
-	for _, v := range descriptor {
+	for i, v := range descriptor {
 		if !labels.IsDNS1123Label(v.Type) {
-			errs = multierror.Append(errs, fmt.Errorf("invalid type: %q", v.Type))
+			errs = multierror.Append(errs, newValidationError(fmt.Sprintf("[%d].type", i), ValidationErrorInvalid,
+				"invalid type: %q", v.Type))
 		}
 		if !labels.IsDNS1123Label(v.Plural) {
-			errs = multierror.Append(errs, fmt.Errorf("invalid plural: %q", v.Type))
+			errs = multierror.Append(errs, newValidationError(fmt.Sprintf("[%d].plural", i), ValidationErrorInvalid,
+				"invalid plural: %q", v.Type))
 		}
 		if proto.MessageType(v.MessageName) == nil {
-			errs = multierror.Append(errs, fmt.Errorf("cannot discover proto message type: %q", v.MessageName))
+			errs = multierror.Append(errs, newValidationError(fmt.Sprintf("[%d].messageName", i), ValidationErrorNotFound,
+				"cannot discover proto message type: %q", v.MessageName))
 		}
 		if _, exists := descriptorTypes[v.Type]; exists {
-			errs = multierror.Append(errs, fmt.Errorf("duplicate type: %q", v.Type))
+			errs = multierror.Append(errs, newValidationError(fmt.Sprintf("[%d].type", i), ValidationErrorDuplicate,
+				"duplicate type: %q", v.Type))
 		}
 		descriptorTypes[v.Type] = true
 		if v.ClusterScoped {
 			if _, exists := clusterMessages[v.MessageName]; exists {
-				errs = multierror.Append(errs, fmt.Errorf("duplicate message type: %q", v.MessageName))
+				errs = multierror.Append(errs, newValidationError(fmt.Sprintf("[%d].messageName", i), ValidationErrorDuplicate,
+					"duplicate message type: %q", v.MessageName))
 			}
 			clusterMessages[v.MessageName] = true
 		} else {
 			if _, exists := messages[v.MessageName]; exists {
-				errs = multierror.Append(errs, fmt.Errorf("duplicate message type: %q", v.MessageName))
+				errs = multierror.Append(errs, newValidationError(fmt.Sprintf("[%d].messageName", i), ValidationErrorDuplicate,
+					"duplicate message type: %q", v.MessageName))
 			}
 			messages[v.MessageName] = true
 		}
@@ -67,37 +140,76 @@ func (descriptor ConfigDescriptor) Validate() error {
 	return errs
 }
 
+// sameProtocol returns whether the protocols are the same, ignoring case. Unknown protocols
+// only match if they are equal.
+func sameProtocol(a, b protocol.Instance) bool {
+	if a == b {
+		return true
+	}
+	parsed := protocol.Parse(string(a))
+	return parsed != protocol.Unsupported && parsed == protocol.Parse(string(b))
+}
+
 // Validate ensures that the service object is well-defined
 func (s *Service) Validate() error {
 	var errs error
 	if len(s.Hostname) == 0 {
-		errs = multierror.Append(errs, fmt.Errorf("invalid empty hostname"))
+		errs = multierror.Append(errs, newValidationError("hostname", ValidationErrorRequired, "invalid empty hostname"))
+	}
+	if len(s.Hostname) > maxHostnameLength {
+		errs = multierror.Append(errs, newValidationError("hostname", ValidationErrorInvalid,
+			"hostname is %d characters long, more than the maximum of %d", len(s.Hostname), maxHostnameLength))
 	}
 	parts := strings.Split(string(s.Hostname), ".")
-	for _, part := range parts {
+	for i, part := range parts {
+		// Only the first part may be a wildcard, as in *.foo.com
+		if i == 0 && labels.IsWildcardDNS1123Label(part) {
+			continue
+		}
 		if !labels.IsDNS1123Label(part) {
-			errs = multierror.Append(errs, fmt.Errorf("invalid hostname part: %q", part))
+			errs = multierror.Append(errs, newValidationError("hostname", ValidationErrorInvalid,
+				"invalid hostname part: %q", part))
 		}
 	}
 
 	// Require at least one port
 	if len(s.Ports) == 0 {
-		errs = multierror.Append(errs, fmt.Errorf("service must have at least one declared port"))
+		errs = multierror.Append(errs, newValidationError("ports", ValidationErrorRequired,
+			"service must have at least one declared port"))
 	}
 
+	// Ports must be unique by name, and by number unless they use different transports,
+	// such as TCP and UDP for DNS.
+	portNames := make(map[string]*Port, len(s.Ports))
+	portNumbers := make(map[int]*Port, len(s.Ports))
 	// Port names can be empty if there exists only one port
-	for _, port := range s.Ports {
+	for i, port := range s.Ports {
+		if port.Name != "" {
+			if other, f := portNames[port.Name]; f {
+				errs = multierror.Append(errs, newValidationError(fmt.Sprintf("ports[%d].name", i), ValidationErrorDuplicate,
+					"duplicate port name %q, used by ports %d and %d", port.Name, other.Port, port.Port))
+			} else {
+				portNames[port.Name] = port
+			}
+		}
+		if other, f := portNumbers[port.Port]; f && (other.Protocol == protocol.UDP) == (port.Protocol == protocol.UDP) {
+			errs = multierror.Append(errs, newValidationError(fmt.Sprintf("ports[%d].port", i), ValidationErrorDuplicate,
+				"duplicate port number %d, used by ports %q and %q", port.Port, other.Name, port.Name))
+		} else if !f {
+			portNumbers[port.Port] = port
+		}
 		if port.Name == "" {
 			if len(s.Ports) > 1 {
-				errs = multierror.Append(errs,
-					fmt.Errorf("empty port names are not allowed for services with multiple ports"))
+				errs = multierror.Append(errs, newValidationError(fmt.Sprintf("ports[%d].name", i), ValidationErrorRequired,
+					"empty port names are not allowed for services with multiple ports"))
 			}
 		} else if !labels.IsDNS1123Label(port.Name) {
-			errs = multierror.Append(errs, fmt.Errorf("invalid name: %q", port.Name))
+			errs = multierror.Append(errs, newValidationError(fmt.Sprintf("ports[%d].name", i), ValidationErrorInvalid,
+				"invalid name: %q", port.Name))
 		}
 		if err := config.ValidatePort(port.Port); err != nil {
-			errs = multierror.Append(errs,
-				fmt.Errorf("invalid service port value %d for %q: %v", port.Port, port.Name, err))
+			errs = multierror.Append(errs, newValidationError(fmt.Sprintf("ports[%d].port", i), ValidationErrorInvalid,
+				"invalid service port value %d for %q: %v", port.Port, port.Name, err))
 		}
 	}
 	return errs
@@ -107,34 +219,35 @@ func (s *Service) Validate() error {
 func (instance *ServiceInstance) Validate() error {
 	var errs error
 	if instance.Service == nil {
-		errs = multierror.Append(errs, fmt.Errorf("missing service in the instance"))
+		errs = multierror.Append(errs, newValidationError("service", ValidationErrorRequired, "missing service in the instance"))
 	} else if err := instance.Service.Validate(); err != nil {
-		errs = multierror.Append(errs, err)
+		errs = multierror.Append(errs, prefixValidationErrors("service", err))
 	}
 
 	if err := instance.Labels.Validate(); err != nil {
-		errs = multierror.Append(errs, err)
+		errs = multierror.Append(errs, prefixValidationErrors("labels", err))
 	}
 
 	if err := config.ValidatePort(instance.Endpoint.Port); err != nil {
-		errs = multierror.Append(errs, err)
+		errs = multierror.Append(errs, newValidationError("endpoint.port", ValidationErrorInvalid, "%v", err))
 	}
 
 	port := instance.Endpoint.ServicePort
 	if port == nil {
-		errs = multierror.Append(errs, fmt.Errorf("missing service port"))
+		errs = multierror.Append(errs, newValidationError("endpoint.servicePort", ValidationErrorRequired, "missing service port"))
 	} else if instance.Service != nil {
 		expected, ok := instance.Service.Ports.Get(port.Name)
 		if !ok {
-			errs = multierror.Append(errs, fmt.Errorf("missing service port %q", port.Name))
+			errs = multierror.Append(errs, newValidationError("endpoint.servicePort.name", ValidationErrorNotFound,
+				"missing service port %q", port.Name))
 		} else {
 			if expected.Port != port.Port {
-				errs = multierror.Append(errs,
-					fmt.Errorf("unexpected service port value %d, expected %d", port.Port, expected.Port))
+				errs = multierror.Append(errs, newValidationError("endpoint.servicePort.port", ValidationErrorMismatch,
+					"unexpected service port value %d, expected %d", port.Port, expected.Port))
 			}
-			if expected.Protocol != port.Protocol {
-				errs = multierror.Append(errs,
-					fmt.Errorf("unexpected service protocol %s, expected %s", port.Protocol, expected.Protocol))
+			if !sameProtocol(expected.Protocol, port.Protocol) {
+				errs = multierror.Append(errs, newValidationError("endpoint.servicePort.protocol", ValidationErrorMismatch,
+					"unexpected service protocol %s, expected %s", port.Protocol, expected.Protocol))
 			}
 		}
 	}
@@ -143,20 +256,50 @@ func (instance *ServiceInstance) Validate() error {
 }
 
 // ValidateNetworkEndpointAddress checks the Address field of a NetworkEndpoint. If the family is TCP, it checks the
-// address is a valid IP address. If the family is Unix, it checks the address is a valid socket file path.
+// address is a valid IP address, possibly an IPv6 address with a zone (fe80::1%eth0), or FQDN. If the family is Unix,
+// it checks the address is a valid socket file path.
 func ValidateNetworkEndpointAddress(n *NetworkEndpoint) error {
 	switch n.Family {
 	case AddressFamilyTCP:
+		if strings.HasPrefix(n.Address, UnixAddressPrefix) {
+			return newValidationError("family", ValidationErrorMismatch,
+				"address %s is a Unix domain socket address, but the endpoint family is TCP", n.Address)
+		}
+		if i := strings.LastIndex(n.Address, "%"); i >= 0 {
+			// Only IPv6 addresses have zones
+			if ipAddr := net.ParseIP(n.Address[:i]); ipAddr == nil || ipAddr.To4() != nil {
+				return newValidationError("address", ValidationErrorInvalid, "invalid address %s", n.Address)
+			}
+			if !isValidIPv6Zone(n.Address[i+1:]) {
+				return newValidationError("address", ValidationErrorInvalid, "invalid zone %q in address %s", n.Address[i+1:], n.Address)
+			}
+			return nil
+		}
 		ipAddr := net.ParseIP(n.Address) // Typically it is an IP address
 		if ipAddr == nil {
 			if err := config.ValidateFQDN(n.Address); err != nil { // Otherwise could be an FQDN
-				return errors.New("invalid address " + n.Address)
+				return newValidationError("address", ValidationErrorInvalid, "invalid address %s", n.Address)
 			}
 		}
 	case AddressFamilyUnix:
-		return config.ValidateUnixAddress(n.Address)
+		if err := config.ValidateUnixAddress(n.Address); err != nil {
+			return newValidationError("address", ValidationErrorInvalid, "%v", err)
+		}
 	default:
 		panic(fmt.Sprintf("unhandled Family %v", n.Family))
 	}
 	return nil
 }
+
+// isValidIPv6Zone checks the zone of an IPv6 address, which is an interface name or index.
+func isValidIPv6Zone(zone string) bool {
+	if zone == "" {
+		return false
+	}
+	for _, c := range zone {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
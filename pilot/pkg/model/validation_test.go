@@ -20,7 +20,9 @@ import (
 	"testing"
 
 	"github.com/gogo/protobuf/proto"
+	"github.com/hashicorp/go-multierror"
 
+	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/protocol"
 	testConfig "istio.io/istio/pkg/test/config"
@@ -241,6 +243,37 @@ func TestServiceInstanceValidate(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "endpoint protocol differs in case",
+			instance: &ServiceInstance{
+				Service: service1,
+				Endpoint: NetworkEndpoint{
+					Address: "192.168.1.2",
+					Port:    service1.Ports[1].Port,
+					ServicePort: &Port{
+						Name:     service1.Ports[1].Name,
+						Port:     service1.Ports[1].Port,
+						Protocol: "http",
+					},
+				},
+			},
+			valid: true,
+		},
+		{
+			name: "endpoint protocol mismatch",
+			instance: &ServiceInstance{
+				Service: service1,
+				Endpoint: NetworkEndpoint{
+					Address: "192.168.1.2",
+					Port:    service1.Ports[1].Port,
+					ServicePort: &Port{
+						Name:     service1.Ports[1].Name,
+						Port:     service1.Ports[1].Port,
+						Protocol: protocol.TCP,
+					},
+				},
+			},
+		},
 	}
 	for _, c := range cases {
 		t.Log("running case " + c.name)
@@ -276,6 +309,29 @@ func TestServiceValidate(t *testing.T) {
 			name:    "invalid hostname",
 			service: &Service{Hostname: "hostname.^.com", Address: address, Ports: ports},
 		},
+		{
+			name:    "valid",
+			service: &Service{Hostname: "hostname.default.svc.cluster.local", Address: address, Ports: ports},
+			valid:   true,
+		},
+		{
+			name:    "wildcard hostname",
+			service: &Service{Hostname: "*.foo.com", Address: address, Ports: ports},
+			valid:   true,
+		},
+		{
+			name:    "wildcard in a later part",
+			service: &Service{Hostname: "foo.*.com", Address: address, Ports: ports},
+		},
+		{
+			name:    "hostname too long",
+			service: &Service{Hostname: host.Name(strings.Repeat("a.", 126) + "com"), Address: address, Ports: ports},
+		},
+		{
+			name:    "hostname at the maximum length",
+			service: &Service{Hostname: host.Name(strings.Repeat("a.", 125) + "com"), Address: address, Ports: ports},
+			valid:   true,
+		},
 		{
 			name:    "empty ports",
 			service: &Service{Hostname: "hostname", Address: address},
@@ -284,6 +340,28 @@ func TestServiceValidate(t *testing.T) {
 			name:    "bad ports",
 			service: &Service{Hostname: "hostname", Address: address, Ports: badPorts},
 		},
+		{
+			name: "duplicate port numbers",
+			service: &Service{Hostname: "hostname", Address: address, Ports: PortList{
+				{Name: "http", Port: 80, Protocol: protocol.HTTP},
+				{Name: "http-alt", Port: 80, Protocol: protocol.HTTP},
+			}},
+		},
+		{
+			name: "duplicate port names",
+			service: &Service{Hostname: "hostname", Address: address, Ports: PortList{
+				{Name: "http", Port: 80, Protocol: protocol.HTTP},
+				{Name: "http", Port: 8080, Protocol: protocol.HTTP},
+			}},
+		},
+		{
+			name: "same port number for TCP and UDP",
+			service: &Service{Hostname: "hostname", Address: address, Ports: PortList{
+				{Name: "dns-tcp", Port: 53, Protocol: protocol.TCP},
+				{Name: "dns-udp", Port: 53, Protocol: protocol.UDP},
+			}},
+			valid: true,
+		},
 	}
 	for _, c := range cases {
 		if got := c.service.Validate(); (got == nil) != c.valid {
@@ -292,6 +370,110 @@ func TestServiceValidate(t *testing.T) {
 	}
 }
 
+func TestValidationErrorFields(t *testing.T) {
+	service := &Service{
+		Hostname: "hostname",
+		Ports: PortList{
+			{Name: "http", Port: 80, Protocol: protocol.HTTP},
+			{Name: "http-alt^", Port: 8080, Protocol: protocol.HTTP},
+		},
+	}
+	instance := &ServiceInstance{
+		Service: service,
+		Endpoint: NetworkEndpoint{
+			Port:        80,
+			ServicePort: &Port{Name: "http", Port: 81, Protocol: protocol.HTTP},
+		},
+	}
+
+	err := instance.Validate()
+	merr, ok := err.(*multierror.Error)
+	if !ok {
+		t.Fatalf("expected a multierror, got %v", err)
+	}
+	expected := []ValidationError{
+		{Field: "service.ports[1].name", Code: ValidationErrorInvalid, Message: `invalid name: "http-alt^"`},
+		{Field: "endpoint.servicePort.port", Code: ValidationErrorMismatch, Message: "unexpected service port value 81, expected 80"},
+	}
+	if len(merr.Errors) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(merr.Errors), err)
+	}
+	for i, e := range merr.Errors {
+		verr, ok := e.(*ValidationError)
+		if !ok {
+			t.Fatalf("expected a ValidationError, got %T: %v", e, e)
+		}
+		if *verr != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], *verr)
+		}
+	}
+}
+
+func TestServiceValidateDuplicatePortNumber(t *testing.T) {
+	service := &Service{
+		Hostname: "hostname",
+		Ports: PortList{
+			{Name: "http", Port: 80, Protocol: protocol.HTTP},
+			{Name: "http-alt", Port: 80, Protocol: protocol.HTTP},
+		},
+	}
+	err := service.Validate()
+	merr, ok := err.(*multierror.Error)
+	if !ok || len(merr.Errors) != 1 {
+		t.Fatalf("expected a single error, got %v", err)
+	}
+	expected := ValidationError{Field: "ports[1].port", Code: ValidationErrorDuplicate,
+		Message: `duplicate port number 80, used by ports "http" and "http-alt"`}
+	if verr, ok := merr.Errors[0].(*ValidationError); !ok || *verr != expected {
+		t.Fatalf("expected %+v, got %#v", expected, merr.Errors[0])
+	}
+}
+
+func TestConfigDescriptorValidationErrorFields(t *testing.T) {
+	descriptor := ConfigDescriptor{
+		{Type: "gateway", Plural: "gateways", MessageName: "istio.networking.v1alpha3.Gateway"},
+		{Type: "gateway", Plural: "gateways", MessageName: "istio.networking.v1alpha3.VirtualService"},
+	}
+	err := descriptor.Validate()
+	merr, ok := err.(*multierror.Error)
+	if !ok || len(merr.Errors) != 1 {
+		t.Fatalf("expected a single error, got %v", err)
+	}
+	expected := ValidationError{Field: "[1].type", Code: ValidationErrorDuplicate, Message: `duplicate type: "gateway"`}
+	if verr, ok := merr.Errors[0].(*ValidationError); !ok || *verr != expected {
+		t.Fatalf("expected %+v, got %#v", expected, merr.Errors[0])
+	}
+}
+
+func TestValidateNetworkEndpointAddressError(t *testing.T) {
+	cases := []struct {
+		name     string
+		ne       *NetworkEndpoint
+		expected ValidationError
+	}{
+		{
+			name: "invalid zone",
+			ne:   &NetworkEndpoint{Address: "fe80::1%eth 0"},
+			expected: ValidationError{Field: "address", Code: ValidationErrorInvalid,
+				Message: `invalid zone "eth 0" in address fe80::1%eth 0`},
+		},
+		{
+			name: "unix address with TCP family",
+			ne:   &NetworkEndpoint{Family: AddressFamilyTCP, Address: UnixAddressPrefix + "/var/run/app.sock"},
+			expected: ValidationError{Field: "family", Code: ValidationErrorMismatch,
+				Message: "address unix:///var/run/app.sock is a Unix domain socket address, but the endpoint family is TCP"},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateNetworkEndpointAddress(tt.ne)
+			if verr, ok := err.(*ValidationError); !ok || *verr != tt.expected {
+				t.Fatalf("expected %+v, got %#v", tt.expected, err)
+			}
+		})
+	}
+}
+
 func TestValidateNetworkEndpointAddress(t *testing.T) {
 	testCases := []struct {
 		name  string
@@ -318,6 +500,41 @@ func TestValidateNetworkEndpointAddress(t *testing.T) {
 			&NetworkEndpoint{Address: "260.3.4.5", Port: 76},
 			false,
 		},
+		{
+			"IPv6 OK",
+			&NetworkEndpoint{Address: "fe80::1", Port: 76},
+			true,
+		},
+		{
+			"IPv6 with zone OK",
+			&NetworkEndpoint{Address: "fe80::1%eth0", Port: 76},
+			true,
+		},
+		{
+			"IPv6 with numeric zone OK",
+			&NetworkEndpoint{Address: "fe80::1%2", Port: 76},
+			true,
+		},
+		{
+			"IPv6 with empty zone",
+			&NetworkEndpoint{Address: "fe80::1%", Port: 76},
+			false,
+		},
+		{
+			"IPv6 with invalid zone",
+			&NetworkEndpoint{Address: "fe80::1%eth0/24", Port: 76},
+			false,
+		},
+		{
+			"IPv4 with zone",
+			&NetworkEndpoint{Address: "12.3.4.5%eth0", Port: 76},
+			false,
+		},
+		{
+			"FQDN OK",
+			&NetworkEndpoint{Address: "foo.example.com", Port: 76},
+			true,
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -507,7 +507,7 @@ func (configgen *ConfigGeneratorImpl) buildInboundClusters(env *model.Environmen
 			// as inbound|portNumber|portName|Hostname
 			listenPort := &model.Port{
 				Port:     int(ingressListener.Port.Number),
-				Protocol: protocol.Parse(ingressListener.Port.Protocol),
+				Protocol: sidecarIngressProtocol(ingressListener.Port),
 				Name:     ingressListener.Port.Name,
 			}
 
@@ -1125,7 +1125,14 @@ func buildDefaultCluster(env *model.Environment, name string, discoveryType apiv
 	}
 
 	if discoveryType == apiv2.Cluster_STRICT_DNS {
-		cluster.DnsLookupFamily = apiv2.Cluster_V4_ONLY
+		switch proxy.GetPreferredIPFamily() {
+		case model.IPFamilyIPv6:
+			cluster.DnsLookupFamily = apiv2.Cluster_V6_ONLY
+		case model.IPFamilyDual:
+			cluster.DnsLookupFamily = apiv2.Cluster_AUTO
+		default:
+			cluster.DnsLookupFamily = apiv2.Cluster_V4_ONLY
+		}
 		dnsRate := util.GogoDurationToDuration(env.Mesh.DnsRefreshRate)
 		cluster.DnsRefreshRate = dnsRate
 		if util.IsIstioVersionGE13(proxy) && features.RespectDNSTTL.Get() {
@@ -1021,3 +1021,27 @@ func TestRedisProtocolCluster(t *testing.T) {
 		}
 	}
 }
+
+func TestDNSClusterLookupFamily(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cases := []struct {
+		name     string
+		family   string
+		expected apiv2.Cluster_DnsLookupFamily
+	}{
+		{"default", "", apiv2.Cluster_V4_ONLY},
+		{"ipv4", "IPV4", apiv2.Cluster_V4_ONLY},
+		{"ipv6", "IPV6", apiv2.Cluster_V6_ONLY},
+		{"dual", "DUAL", apiv2.Cluster_AUTO},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := &model.Proxy{Metadata: map[string]string{model.NodeMetadataPreferredIPFamily: tt.family}}
+			env := newTestEnvironment(&fakes.ServiceDiscovery{}, testMesh, &fakes.IstioConfigStore{})
+			cluster := buildDefaultCluster(env, "dns-cluster", apiv2.Cluster_STRICT_DNS, nil,
+				model.TrafficDirectionOutbound, proxy, nil)
+			g.Expect(cluster.DnsLookupFamily).To(Equal(tt.expected))
+		})
+	}
+}
@@ -76,10 +76,13 @@ func (configgen *ConfigGeneratorImpl) buildGatewayListeners(
 		// HTTPS/TLS servers with SNI. We cannot have a mix of http and https server on same port.
 		opts := buildListenerOpts{
 			env:        env,
+			push:       push,
 			proxy:      node,
 			bind:       actualWildcard,
 			port:       int(portNumber),
 			bindToPort: true,
+			// Gateways are typically exposed through an external load balancer.
+			proxyProtocol: node.GetListenerMetadata().ProxyProtocol,
 		}
 
 		p := protocol.Parse(servers[0].Port.Protocol)
@@ -88,8 +91,12 @@ func (configgen *ConfigGeneratorImpl) buildGatewayListeners(
 			// We have a list of HTTP servers on this port. Build a single listener for the server port.
 			// We only need to look at the first server in the list as the merge logic
 			// ensures that all servers are of same type.
+			// The servers share a single HTTP connection manager, which uses the access log format of the first server.
 			routeName := mergedGateway.RouteNamesByServer[servers[0]]
-			opts.filterChainOpts = []*filterChainOpts{configgen.createGatewayHTTPFilterChainOpts(node, servers[0], routeName)}
+			fco := configgen.createGatewayHTTPFilterChainOpts(node, servers[0], routeName,
+				mergedGateway.SdsCaForServer[servers[0]])
+			fco.httpOpts.accessLogFormat = mergedGateway.AccessLogFormatForServer[servers[0]]
+			opts.filterChainOpts = []*filterChainOpts{fco}
 		} else {
 			// build http connection manager with TLS context, for HTTPS servers using simple/mutual TLS
 			// build listener with tcp proxy, with or without TLS context, for TCP servers
@@ -102,13 +109,20 @@ func (configgen *ConfigGeneratorImpl) buildGatewayListeners(
 				if gateway.IsTLSServer(server) && gateway.IsHTTPServer(server) {
 					// This is a HTTPS server, where we are doing TLS termination. Build a http connection manager with TLS context
 					routeName := mergedGateway.RouteNamesByServer[server]
-					filterChainOpts = append(filterChainOpts, configgen.createGatewayHTTPFilterChainOpts(node, server, routeName))
+					fco := configgen.createGatewayHTTPFilterChainOpts(node, server, routeName,
+						mergedGateway.SdsCaForServer[server])
+					fco.httpOpts.accessLogFormat = mergedGateway.AccessLogFormatForServer[server]
+					filterChainOpts = append(filterChainOpts, fco)
 				} else {
 					// passthrough or tcp, yields multiple filter chains
 					filterChainOpts = append(filterChainOpts, configgen.createGatewayTCPFilterChainOpts(node, env, push,
-						server, map[string]bool{mergedGateway.GatewayNameForServer[server]: true})...)
+						server, map[string]bool{mergedGateway.GatewayNameForServer[server]: true},
+						mergedGateway.SdsCaForServer[server])...)
 				}
 			}
+			if fallthroughOpts := buildGatewayFallthroughFilterChainOpts(node, filterChainOpts); fallthroughOpts != nil {
+				filterChainOpts = append(filterChainOpts, fallthroughOpts)
+			}
 			opts.filterChainOpts = filterChainOpts
 		}
 
@@ -206,6 +220,69 @@ func (configgen *ConfigGeneratorImpl) buildGatewayListeners(
 	return builder
 }
 
+// gatewayFallthroughRouteName is the name of the route configuration of the gateway filter chains
+// responding 404 to the HTTPS connections whose SNI matches no server.
+const gatewayFallthroughRouteName = "gateway_sni_fallthrough"
+
+// buildGatewayFallthroughFilterChainOpts builds the filter chain handling the connections whose SNI matches
+// none of the chains of a gateway TLS listener, as set by the GatewaySNIFallthrough proxy metadata. If all
+// the chains terminate HTTPS, it responds 404 using the TLS context of the first chain. Otherwise it
+// resets the connections. It never forwards them to their original destination: without a redirect,
+// that is the listener itself, and the connections would loop. Returns nil if disabled or if a chain
+// already matches all connections, since a listener can have a single catch all chain.
+func buildGatewayFallthroughFilterChainOpts(node *model.Proxy, chains []*filterChainOpts) *filterChainOpts {
+	mode := node.GetListenerMetadata().GatewaySNIFallthrough
+	if mode == "" || len(chains) == 0 {
+		return nil
+	}
+
+	https := true
+	for _, chain := range chains {
+		if isCatchAllFilterChain(chain) {
+			return nil
+		}
+		if chain.httpOpts == nil || chain.tlsContext == nil {
+			https = false
+		}
+	}
+
+	if https {
+		httpOpts := *chains[0].httpOpts
+		// Without virtual hosts, all the requests get a 404.
+		httpOpts.routeConfig = &xdsapi.RouteConfiguration{Name: gatewayFallthroughRouteName}
+		httpOpts.rds = ""
+		// The connection manager is filled in when building the filter chain, it cannot be shared.
+		if cm := chains[0].httpOpts.connectionManager; cm != nil {
+			connectionManager := *cm
+			httpOpts.connectionManager = &connectionManager
+		}
+		return &filterChainOpts{
+			tlsContext: chains[0].tlsContext,
+			httpOpts:   &httpOpts,
+		}
+	}
+
+	return &filterChainOpts{
+		networkFilters: []*listener.Filter{buildFallthroughTCPFilter(node, util.BlackHoleCluster)},
+	}
+}
+
+// isCatchAllFilterChain returns whether the chain matches all the connections of its listener.
+func isCatchAllFilterChain(chain *filterChainOpts) bool {
+	if chain.match != nil || len(chain.destinationCIDRs) > 0 {
+		return false
+	}
+	if len(chain.sniHosts) == 0 {
+		return true
+	}
+	for _, h := range chain.sniHosts {
+		if h == "*" {
+			return true
+		}
+	}
+	return false
+}
+
 func (configgen *ConfigGeneratorImpl) buildGatewayHTTPRouteConfig(env *model.Environment, node *model.Proxy, push *model.PushContext,
 	proxyInstances []*model.ServiceInstance, routeName string) *xdsapi.RouteConfiguration {
 
@@ -340,13 +417,13 @@ func (configgen *ConfigGeneratorImpl) buildGatewayHTTPRouteConfig(env *model.Env
 
 // builds a HTTP connection manager for servers of type HTTP or HTTPS (mode: simple/mutual)
 func (configgen *ConfigGeneratorImpl) createGatewayHTTPFilterChainOpts(
-	node *model.Proxy, server *networking.Server, routeName string) *filterChainOpts {
+	node *model.Proxy, server *networking.Server, routeName string, sdsCa model.GatewaySdsCa) *filterChainOpts {
 
 	serverProto := protocol.Parse(server.Port.Protocol)
 
 	httpProtoOpts := &core.Http1ProtocolOptions{}
 
-	if features.HTTP10 || node.Metadata[model.NodeMetadataHTTP10] == "1" {
+	if features.HTTP10 || node.GetListenerMetadata().HTTP10 {
 		httpProtoOpts.AcceptHttp_10 = true
 	}
 
@@ -393,7 +470,7 @@ func (configgen *ConfigGeneratorImpl) createGatewayHTTPFilterChainOpts(
 		// and that no two non-HTTPS servers can be on same port or share port names.
 		// Validation is done per gateway and also during merging
 		sniHosts:   getSNIHostsForServer(server),
-		tlsContext: buildGatewayListenerTLSContext(server, enableIngressSdsAgent),
+		tlsContext: buildGatewayListenerTLSContext(server, enableIngressSdsAgent, sdsCa),
 		httpOpts: &httpListenerOpts{
 			rds:              routeName,
 			useRemoteAddress: true,
@@ -414,7 +491,10 @@ func (configgen *ConfigGeneratorImpl) createGatewayHTTPFilterChainOpts(
 	}
 }
 
-func buildGatewayListenerTLSContext(server *networking.Server, enableSds bool) *auth.DownstreamTlsContext {
+// buildGatewayListenerTLSContext builds the TLS context of the server. With SDS, the root CA of MUTUAL
+// servers is fetched from the SDS source sdsCa, set by the gateway annotations, if any.
+func buildGatewayListenerTLSContext(server *networking.Server, enableSds bool,
+	sdsCa model.GatewaySdsCa) *auth.DownstreamTlsContext {
 	// Server.TLS cannot be nil or passthrough. But as a safety guard, return nil
 	if server.Tls == nil || gateway.IsPassThroughServer(server) {
 		return nil // We don't need to setup TLS context for passthrough mode
@@ -443,8 +523,8 @@ func buildGatewayListenerTLSContext(server *networking.Server, enableSds bool) *
 			tls.CommonTlsContext.ValidationContextType = &auth.CommonTlsContext_CombinedValidationContext{
 				CombinedValidationContext: &auth.CommonTlsContext_CombinedCertificateValidationContext{
 					DefaultValidationContext: defaultValidationContext,
-					ValidationContextSdsSecretConfig: authn_model.ConstructSdsSecretConfigForGatewayListener(
-						server.Tls.CredentialName+authn_model.IngressGatewaySdsCaSuffix, authn_model.IngressGatewaySdsUdsPath),
+					ValidationContextSdsSecretConfig: authn_model.ConstructSdsCaSecretConfigForGatewayListener(
+						server.Tls.CredentialName, authn_model.IngressGatewaySdsUdsPath, sdsCa.Name, sdsCa.UdsPath),
 				},
 			}
 		} else if len(server.Tls.SubjectAltNames) > 0 {
@@ -519,7 +599,7 @@ func convertTLSProtocol(in networking.Server_TLSOptions_TLSProtocol) auth.TlsPar
 
 func (configgen *ConfigGeneratorImpl) createGatewayTCPFilterChainOpts(
 	node *model.Proxy, env *model.Environment, push *model.PushContext, server *networking.Server,
-	gatewaysForWorkload map[string]bool) []*filterChainOpts {
+	gatewaysForWorkload map[string]bool, sdsCa model.GatewaySdsCa) []*filterChainOpts {
 
 	// We have a TCP/TLS server. This could be TLS termination (user specifies server.TLS with simple/mutual)
 	// or opaque TCP (server.TLS is nil). or it could be a TLS passthrough with SNI based routing.
@@ -551,7 +631,7 @@ func (configgen *ConfigGeneratorImpl) createGatewayTCPFilterChainOpts(
 			return []*filterChainOpts{
 				{
 					sniHosts:       getSNIHostsForServer(server),
-					tlsContext:     buildGatewayListenerTLSContext(server, enableIngressSdsAgent),
+					tlsContext:     buildGatewayListenerTLSContext(server, enableIngressSdsAgent, sdsCa),
 					networkFilters: filters,
 				},
 			}
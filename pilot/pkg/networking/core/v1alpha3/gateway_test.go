@@ -18,9 +18,15 @@ import (
 	"reflect"
 	"testing"
 
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	accesslogconfig "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v2"
 	http_conn "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	tcp_proxy "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	xdsutil "github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/gogo/protobuf/types"
 
 	networking "istio.io/api/networking/v1alpha3"
 
@@ -450,7 +456,7 @@ func TestBuildGatewayListenerTlsContext(t *testing.T) {
 	}
 
 	for _, tc := range testCases {
-		ret := buildGatewayListenerTLSContext(tc.server, tc.enableSds)
+		ret := buildGatewayListenerTLSContext(tc.server, tc.enableSds, pilot_model.GatewaySdsCa{})
 		if !reflect.DeepEqual(tc.result, ret) {
 			t.Errorf("test case %s: expecting %v but got %v", tc.name, tc.result, ret)
 		}
@@ -503,7 +509,7 @@ func TestCreateGatewayHTTPFilterChainOpts(t *testing.T) {
 
 	for _, tc := range testCases {
 		cgi := NewConfigGenerator([]plugin.Plugin{})
-		ret := cgi.createGatewayHTTPFilterChainOpts(tc.node, tc.server, tc.routeName)
+		ret := cgi.createGatewayHTTPFilterChainOpts(tc.node, tc.server, tc.routeName, pilot_model.GatewaySdsCa{})
 		if !reflect.DeepEqual(tc.result, ret) {
 			t.Errorf("test case %s: expecting %v but got %v", tc.name, tc.result, ret)
 		}
@@ -671,3 +677,291 @@ func buildEnv(t *testing.T, gateways []pilot_model.Config, virtualServices []pil
 	}
 	return env
 }
+
+func TestGatewayAccessLogFormatAnnotation(t *testing.T) {
+	gateway := pilot_model.Config{
+		ConfigMeta: pilot_model.ConfigMeta{
+			Name:      "gateway",
+			Namespace: "default",
+			Annotations: map[string]string{
+				pilot_model.GatewayAccessLogFormatAnnotation + ".http-public": "[%START_TIME%] public\n",
+			},
+		},
+		Spec: &networking.Gateway{
+			Selector: map[string]string{"istio": "ingressgateway"},
+			Servers: []*networking.Server{
+				{
+					Hosts: []string{"public.example.org"},
+					Port:  &networking.Port{Name: "http-public", Number: 80, Protocol: "HTTP"},
+				},
+				{
+					Hosts: []string{"internal.example.org"},
+					Port:  &networking.Port{Name: "http-internal", Number: 8080, Protocol: "HTTP"},
+				},
+			},
+		},
+	}
+	expected := map[string]string{
+		"0.0.0.0_80":   "[%START_TIME%] public\n",
+		"0.0.0.0_8080": EnvoyTextLogFormat,
+	}
+
+	env := buildEnv(t, []pilot_model.Config{gateway}, nil)
+	env.Mesh.AccessLogFile = "/dev/stdout"
+	node := &pilot_model.Proxy{Type: pilot_model.Router, ID: "gateway", IPAddresses: []string{"1.1.1.1"}}
+	builder := NewConfigGenerator([]plugin.Plugin{}).buildGatewayListeners(&env, node, env.PushContext, &ListenerBuilder{})
+	if len(builder.gatewayListeners) != len(expected) {
+		t.Fatalf("expected %d listeners, found %d", len(expected), len(builder.gatewayListeners))
+	}
+	for _, l := range builder.gatewayListeners {
+		hcm := &http_conn.HttpConnectionManager{}
+		if err := getFilterConfig(l.FilterChains[0].Filters[0], hcm); err != nil {
+			t.Fatalf("failed to get HTTP connection manager config: %s", err)
+		}
+		if len(hcm.AccessLog) != 1 {
+			t.Fatalf("expected one access log on listener %s, found %d", l.Name, len(hcm.AccessLog))
+		}
+		fl := &accesslogconfig.FileAccessLog{}
+		if err := types.UnmarshalAny(hcm.AccessLog[0].GetTypedConfig(), fl); err != nil {
+			t.Fatalf("failed to get file access log config: %s", err)
+		}
+		if fl.GetFormat() != expected[l.Name] {
+			t.Errorf("expected access log format %q on listener %s, got %q", expected[l.Name], l.Name, fl.GetFormat())
+		}
+	}
+}
+
+func TestGatewaySdsCaAnnotations(t *testing.T) {
+	mutual := func(name string, port uint32, host string) *networking.Server {
+		return &networking.Server{
+			Hosts: []string{host},
+			Port:  &networking.Port{Name: name, Number: port, Protocol: "HTTPS"},
+			Tls: &networking.Server_TLSOptions{
+				Mode:           networking.Server_TLSOptions_MUTUAL,
+				CredentialName: name + "-credential",
+			},
+		}
+	}
+	gateway := pilot_model.Config{
+		ConfigMeta: pilot_model.ConfigMeta{
+			Name:      "gateway",
+			Namespace: "default",
+			Annotations: map[string]string{
+				pilot_model.GatewaySdsCaNameAnnotation + ".https-tenant":    "tenant-ca",
+				pilot_model.GatewaySdsCaUdsPathAnnotation + ".https-tenant": "unix:/var/run/tenant/sds",
+			},
+		},
+		Spec: &networking.Gateway{
+			Selector: map[string]string{"istio": "ingressgateway"},
+			Servers: []*networking.Server{
+				mutual("https-tenant", 443, "tenant.example.org"),
+				mutual("https-default", 8443, "default.example.org"),
+			},
+		},
+	}
+	expected := map[string]struct {
+		name    string
+		udsPath string
+	}{
+		"0.0.0.0_443":  {"tenant-ca", "unix:/var/run/tenant/sds"},
+		"0.0.0.0_8443": {"https-default-credential" + model.IngressGatewaySdsCaSuffix, model.IngressGatewaySdsUdsPath},
+	}
+
+	env := buildEnv(t, []pilot_model.Config{gateway}, nil)
+	node := &pilot_model.Proxy{
+		Type:        pilot_model.Router,
+		ID:          "gateway",
+		IPAddresses: []string{"1.1.1.1"},
+		Metadata:    map[string]string{"USER_SDS": "true"},
+	}
+	builder := NewConfigGenerator([]plugin.Plugin{}).buildGatewayListeners(&env, node, env.PushContext, &ListenerBuilder{})
+	if len(builder.gatewayListeners) != len(expected) {
+		t.Fatalf("expected %d listeners, found %d", len(expected), len(builder.gatewayListeners))
+	}
+	for _, l := range builder.gatewayListeners {
+		ca := l.FilterChains[0].GetTlsContext().GetCommonTlsContext().GetCombinedValidationContext().
+			GetValidationContextSdsSecretConfig()
+		if ca == nil {
+			t.Fatalf("expected an SDS root CA on listener %s", l.Name)
+		}
+		udsPath := ca.GetSdsConfig().GetApiConfigSource().GetGrpcServices()[0].GetGoogleGrpc().GetTargetUri()
+		if ca.Name != expected[l.Name].name || udsPath != expected[l.Name].udsPath {
+			t.Errorf("expected SDS root CA %s from %s on listener %s, got %s from %s",
+				expected[l.Name].name, expected[l.Name].udsPath, l.Name, ca.Name, udsPath)
+		}
+	}
+}
+
+func TestBuildGatewayFallthroughFilterChainOpts(t *testing.T) {
+	tlsContext := &auth.DownstreamTlsContext{}
+	tcpChain := func(hosts ...string) *filterChainOpts {
+		return &filterChainOpts{sniHosts: hosts}
+	}
+	httpsChain := func(hosts ...string) *filterChainOpts {
+		return &filterChainOpts{
+			sniHosts:   hosts,
+			tlsContext: tlsContext,
+			httpOpts: &httpListenerOpts{
+				rds:               "https.443.https.gateway.default",
+				connectionManager: &http_conn.HttpConnectionManager{ServerName: EnvoyServerName},
+			},
+		}
+	}
+	cases := []struct {
+		name     string
+		mode     string
+		chains   []*filterChainOpts
+		expected string // cluster of the TCP fallthrough chain, "404" for HTTP, empty for none
+	}{
+		{"disabled", "", []*filterChainOpts{tcpChain("a.example.org")}, ""},
+		{"reset", "reset", []*filterChainOpts{tcpChain("a.example.org"), tcpChain("b.example.org")}, util.BlackHoleCluster},
+		// Gateways have no redirect, forwarding to the original destination would loop.
+		{"passthrough", "passthrough", []*filterChainOpts{tcpChain("a.example.org")}, ""},
+		{"wildcard server", "reset", []*filterChainOpts{tcpChain("a.example.org"), tcpChain("*")}, ""},
+		{"server without sni", "reset", []*filterChainOpts{tcpChain()}, ""},
+		{"https", "reset", []*filterChainOpts{httpsChain("a.example.org"), httpsChain("b.example.org")}, "404"},
+		{"https and tls", "reset", []*filterChainOpts{httpsChain("a.example.org"), tcpChain("b.example.org")},
+			util.BlackHoleCluster},
+	}
+	env := buildEnv(t, nil, nil)
+	gateway := &pilot_model.Proxy{Type: pilot_model.Router, ID: "gateway", IPAddresses: []string{"1.1.1.1"}}
+	clusters := map[string]*xdsapi.Cluster{}
+	for _, c := range NewConfigGenerator([]plugin.Plugin{}).BuildClusters(&env, gateway, env.PushContext) {
+		clusters[c.Name] = c
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &pilot_model.Proxy{Metadata: map[string]string{pilot_model.NodeMetadataGatewaySNIFallthrough: tt.mode}}
+			got := buildGatewayFallthroughFilterChainOpts(node, tt.chains)
+			switch {
+			case tt.expected == "":
+				if got != nil {
+					t.Fatalf("expected no fallthrough chain, got %+v", got)
+				}
+			case tt.expected == "404":
+				if got == nil || got.httpOpts == nil || got.httpOpts.rds != "" || got.httpOpts.routeConfig == nil ||
+					len(got.httpOpts.routeConfig.VirtualHosts) != 0 || got.tlsContext != tlsContext {
+					t.Fatalf("expected a 404 HTTPS fallthrough chain, got %+v", got)
+				}
+				if got.httpOpts.connectionManager == tt.chains[0].httpOpts.connectionManager {
+					t.Fatalf("expected the connection manager not to be shared")
+				}
+				if !isCatchAllFilterChain(got) {
+					t.Fatalf("expected the fallthrough chain to match all connections")
+				}
+			default:
+				if got == nil || got.httpOpts != nil || len(got.networkFilters) != 1 {
+					t.Fatalf("expected a TCP fallthrough chain, got %+v", got)
+				}
+				if !isCatchAllFilterChain(got) {
+					t.Fatalf("expected the fallthrough chain to match all connections")
+				}
+				tcpProxy := &tcp_proxy.TcpProxy{}
+				if err := getFilterConfig(got.networkFilters[0], tcpProxy); err != nil {
+					t.Fatal(err)
+				}
+				if tcpProxy.GetCluster() != tt.expected {
+					t.Fatalf("expected fallthrough to %s, got %s", tt.expected, tcpProxy.GetCluster())
+				}
+				c := clusters[tcpProxy.GetCluster()]
+				if c == nil {
+					t.Fatalf("expected cluster %s in the gateway clusters", tcpProxy.GetCluster())
+				}
+				if c.GetType() == xdsapi.Cluster_ORIGINAL_DST {
+					t.Fatalf("expected the fallthrough cluster not to be ORIGINAL_DST")
+				}
+			}
+		})
+	}
+}
+
+func TestGatewaySNIFallthroughListener(t *testing.T) {
+	server := func(name, host string) *networking.Server {
+		return &networking.Server{
+			Hosts: []string{host},
+			Port:  &networking.Port{Name: name, Number: 443, Protocol: "HTTPS"},
+			Tls: &networking.Server_TLSOptions{
+				Mode:              networking.Server_TLSOptions_SIMPLE,
+				ServerCertificate: "/etc/certs/cert.pem",
+				PrivateKey:        "/etc/certs/key.pem",
+			},
+		}
+	}
+	gateway := pilot_model.Config{
+		ConfigMeta: pilot_model.ConfigMeta{Name: "gateway", Namespace: "default"},
+		Spec: &networking.Gateway{
+			Selector: map[string]string{"istio": "ingressgateway"},
+			Servers:  []*networking.Server{server("https-a", "a.example.org"), server("https-b", "b.example.org")},
+		},
+	}
+
+	for _, mode := range []string{"", "reset"} {
+		t.Run(mode, func(t *testing.T) {
+			env := buildEnv(t, []pilot_model.Config{gateway}, nil)
+			node := &pilot_model.Proxy{Type: pilot_model.Router, ID: "gateway", IPAddresses: []string{"1.1.1.1"},
+				Metadata: map[string]string{pilot_model.NodeMetadataGatewaySNIFallthrough: mode}}
+			builder := NewConfigGenerator([]plugin.Plugin{}).buildGatewayListeners(&env, node, env.PushContext, &ListenerBuilder{})
+			if len(builder.gatewayListeners) != 1 {
+				t.Fatalf("expected one listener, found %d", len(builder.gatewayListeners))
+			}
+			l := builder.gatewayListeners[0]
+
+			var catchAll []*listener.FilterChain
+			for _, fc := range l.FilterChains {
+				if len(fc.FilterChainMatch.GetServerNames()) == 0 {
+					catchAll = append(catchAll, fc)
+				}
+			}
+			if mode == "" {
+				if len(l.FilterChains) != 2 || len(catchAll) != 0 {
+					t.Fatalf("expected only the server chains, got %v", l.FilterChains)
+				}
+				return
+			}
+			if len(l.FilterChains) != 3 || len(catchAll) != 1 {
+				t.Fatalf("expected the server chains and a single fallthrough chain, got %v", l.FilterChains)
+			}
+			hcm := &http_conn.HttpConnectionManager{}
+			if err := getFilterConfig(catchAll[0].Filters[0], hcm); err != nil {
+				t.Fatalf("failed to get HTTP connection manager config: %s", err)
+			}
+			if rc := hcm.GetRouteConfig(); rc == nil || rc.Name != gatewayFallthroughRouteName || len(rc.VirtualHosts) != 0 {
+				t.Fatalf("expected the 404 route configuration, got %v", hcm.RouteSpecifier)
+			}
+			if catchAll[0].TlsContext == nil {
+				t.Fatalf("expected the fallthrough chain to terminate TLS")
+			}
+		})
+	}
+}
+
+func TestGatewayProxyProtocol(t *testing.T) {
+	gateway := pilot_model.Config{
+		ConfigMeta: pilot_model.ConfigMeta{Name: "gateway", Namespace: "default"},
+		Spec: &networking.Gateway{
+			Selector: map[string]string{"istio": "ingressgateway"},
+			Servers: []*networking.Server{{
+				Hosts: []string{"example.org"},
+				Port:  &networking.Port{Name: "http", Number: 80, Protocol: "HTTP"},
+			}},
+		},
+	}
+	for _, enabled := range []string{"", "1"} {
+		t.Run(enabled, func(t *testing.T) {
+			env := buildEnv(t, []pilot_model.Config{gateway}, nil)
+			node := &pilot_model.Proxy{Type: pilot_model.Router, ID: "gateway", IPAddresses: []string{"1.1.1.1"},
+				Metadata: map[string]string{pilot_model.NodeMetadataProxyProtocol: enabled}}
+			builder := NewConfigGenerator([]plugin.Plugin{}).buildGatewayListeners(&env, node, env.PushContext, &ListenerBuilder{})
+			if len(builder.gatewayListeners) != 1 {
+				t.Fatalf("expected one listener, found %d", len(builder.gatewayListeners))
+			}
+			filters := builder.gatewayListeners[0].ListenerFilters
+			if enabled == "" && len(filters) != 0 {
+				t.Fatalf("expected no listener filters, got %v", filters)
+			}
+			if enabled != "" && (len(filters) != 1 || filters[0].Name != xdsutil.ProxyProtocol) {
+				t.Fatalf("expected the PROXY protocol listener filter, got %v", filters)
+			}
+		})
+	}
+}
@@ -75,6 +75,15 @@ func (configgen *ConfigGeneratorImpl) buildSidecarInboundHTTPRouteConfig(env *mo
 		instance.Service.Hostname, instance.Endpoint.ServicePort.Port)
 	traceOperation := fmt.Sprintf("%s:%d/*", instance.Service.Hostname, instance.Endpoint.ServicePort.Port)
 	defaultRoute := istio_route.BuildDefaultHTTPInboundRoute(node, clusterName, traceOperation)
+	if instance.Service.Attributes.HTTPSRedirectPorts[instance.Endpoint.ServicePort.Port] {
+		// Plain HTTP is not served on this port, redirect the client to HTTPS instead.
+		defaultRoute.Action = &route.Route_Redirect{
+			Redirect: &route.RedirectAction{
+				SchemeRewriteSpecifier: &route.RedirectAction_HttpsRedirect{HttpsRedirect: true},
+				ResponseCode:           route.RedirectAction_MOVED_PERMANENTLY,
+			},
+		}
+	}
 
 	inboundVHost := &route.VirtualHost{
 		Name:    fmt.Sprintf("%s|http|%d", model.TrafficDirectionInbound, instance.Endpoint.ServicePort.Port),
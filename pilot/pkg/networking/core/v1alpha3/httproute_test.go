@@ -601,6 +601,32 @@ func testSidecarRDSVHosts(t *testing.T, services []*model.Service,
 	}
 }
 
+func TestSidecarInboundHTTPRouteConfigHTTPSRedirect(t *testing.T) {
+	service := buildHTTPService("test.com", visibility.Public, wildcardIP, "default", 80, 8080)
+	service.Attributes.HTTPSRedirectPorts = map[int]bool{80: true}
+	env := buildListenerEnv([]*model.Service{service})
+	if err := env.PushContext.InitContext(&env); err != nil {
+		t.Fatalf("init push context error: %s", err.Error())
+	}
+	configgen := NewConfigGenerator([]plugin.Plugin{})
+
+	for _, port := range service.Ports {
+		instance := &model.ServiceInstance{
+			Service:  service,
+			Endpoint: model.NetworkEndpoint{ServicePort: port, Port: port.Port},
+		}
+		r := configgen.buildSidecarInboundHTTPRouteConfig(&env, &proxy, env.PushContext, instance)
+		defaultRoute := r.VirtualHosts[0].Routes[0]
+		redirect := defaultRoute.GetRedirect()
+		if expected := port.Port == 80; (redirect != nil) != expected {
+			t.Fatalf("port %d: expected https redirect %v, got route %v", port.Port, expected, defaultRoute)
+		}
+		if redirect != nil && !redirect.GetHttpsRedirect() {
+			t.Fatalf("port %d: expected redirect to https, got %v", port.Port, redirect)
+		}
+	}
+}
+
 func buildHTTPService(hostname string, v visibility.Instance, ip, namespace string, ports ...int) *model.Service {
 	service := &model.Service{
 		CreationTime: tnow,
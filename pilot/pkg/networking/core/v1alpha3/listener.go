@@ -17,10 +17,12 @@ package v1alpha3
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"net"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
@@ -33,6 +35,7 @@ import (
 	tcp_proxy "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
 	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type"
 	xdsutil "github.com/envoyproxy/go-control-plane/pkg/util"
+	gogoproto "github.com/gogo/protobuf/proto"
 	google_protobuf "github.com/gogo/protobuf/types"
 
 	meshconfig "istio.io/api/mesh/v1alpha1"
@@ -48,6 +51,7 @@ import (
 	authn_model "istio.io/istio/pilot/pkg/security/model"
 	"istio.io/istio/pkg/config/constants"
 	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/kube"
 	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/protocol"
 	"istio.io/istio/pkg/proto"
@@ -75,26 +79,49 @@ const (
 	// LocalhostIPv6Address for local binding
 	LocalhostIPv6Address = "::1"
 
-	// EnvoyTextLogFormat format for envoy text based access logs
-	EnvoyTextLogFormat = "[%START_TIME%] \"%REQ(:METHOD)% %REQ(X-ENVOY-ORIGINAL-PATH?:PATH)% " +
+	// envoyTextLogFormatFields are the fields of the envoy text based access logs, without the gRPC
+	// status and the trailing newline.
+	envoyTextLogFormatFields = "[%START_TIME%] \"%REQ(:METHOD)% %REQ(X-ENVOY-ORIGINAL-PATH?:PATH)% " +
 		"%PROTOCOL%\" %RESPONSE_CODE% %RESPONSE_FLAGS% \"%DYNAMIC_METADATA(istio.mixer:status)%\" " +
 		"\"%UPSTREAM_TRANSPORT_FAILURE_REASON%\" %BYTES_RECEIVED% %BYTES_SENT% " +
 		"%DURATION% %RESP(X-ENVOY-UPSTREAM-SERVICE-TIME)% \"%REQ(X-FORWARDED-FOR)%\" " +
 		"\"%REQ(USER-AGENT)%\" \"%REQ(X-REQUEST-ID)%\" \"%REQ(:AUTHORITY)%\" \"%UPSTREAM_HOST%\" " +
 		"%UPSTREAM_CLUSTER% %UPSTREAM_LOCAL_ADDRESS% %DOWNSTREAM_LOCAL_ADDRESS% " +
-		"%DOWNSTREAM_REMOTE_ADDRESS% %REQUESTED_SERVER_NAME%\n"
+		"%DOWNSTREAM_REMOTE_ADDRESS% %REQUESTED_SERVER_NAME%"
+
+	// EnvoyTextLogFormat format for envoy text based access logs
+	// The gRPC status is the last field, so that parsers of the previous format keep working.
+	EnvoyTextLogFormat = envoyTextLogFormatFields + " %GRPC_STATUS%\n"
+
+	// envoyTextLogFormatWithoutGRPCStatus is EnvoyTextLogFormat without the gRPC status, used when
+	// features.EnableAccessLogGRPCStatus is not set.
+	envoyTextLogFormatWithoutGRPCStatus = envoyTextLogFormatFields + "\n"
+
+	// grpcStatusLogField is the name of the gRPC status field of the JSON access log format.
+	grpcStatusLogField = "grpc_status"
 
 	// EnvoyServerName for istio's envoy
 	EnvoyServerName = "istio-envoy"
 
 	httpEnvoyAccessLogName = "http_envoy_accesslog"
 
+	// tcpEnvoyAccessLogName is the log name of the TCP access log entries sent to the access log service.
+	tcpEnvoyAccessLogName = "tcp_envoy_accesslog"
+
+	// tcpGrpcAccessLog is the name of the Envoy TCP gRPC access log, which is not a well known name of the
+	// vendored Envoy API.
+	tcpGrpcAccessLog = "envoy.tcp_grpc_access_log"
+
+	// accessLogMinResponseCodeRuntimeKey is the runtime key that overrides the minimum response code
+	// of the HTTP file access log filter.
+	accessLogMinResponseCodeRuntimeKey = "access_log.min_response_code"
+
 	// EnvoyAccessLogCluster is the cluster name that has details for server implementing Envoy ALS.
 	// This cluster is created in bootstrap.
 	EnvoyAccessLogCluster = "envoy_accesslog_service"
 
 	// ProxyInboundListenPort is the port on which all inbound traffic to the pod/vm will be captured to
-	// TODO: allow configuration through mesh config
+	// TODO: allow configuration through mesh config, which requires a MeshConfig field in istio.io/api
 	ProxyInboundListenPort = 15006
 
 	// Used in xds config. Metavalue bind to this key is used by pilot as xds server but not by envoy.
@@ -104,6 +131,10 @@ const (
 
 var (
 	// EnvoyJSONLogFormat map of values for envoy json based access logs
+	// Port-only fields (%DOWNSTREAM_LOCAL_PORT%, %DOWNSTREAM_REMOTE_PORT%) are not supported by the
+	// Envoy version shipped with this release and would get the listener rejected, so ports are
+	// only available as part of the downstream address fields.
+	// The downstream TLS fields are empty for connections that are not terminated with TLS by the proxy.
 	EnvoyJSONLogFormat = &google_protobuf.Struct{
 		Fields: map[string]*google_protobuf.Value{
 			"start_time":                        {Kind: &google_protobuf.Value_StringValue{StringValue: "%START_TIME%"}},
@@ -128,50 +159,198 @@ var (
 			"requested_server_name":             {Kind: &google_protobuf.Value_StringValue{StringValue: "%REQUESTED_SERVER_NAME%"}},
 			"istio_policy_status":               {Kind: &google_protobuf.Value_StringValue{StringValue: "%DYNAMIC_METADATA(istio.mixer:status)%"}},
 			"upstream_transport_failure_reason": {Kind: &google_protobuf.Value_StringValue{StringValue: "%UPSTREAM_TRANSPORT_FAILURE_REASON%"}},
+			"downstream_tls_version":            {Kind: &google_protobuf.Value_StringValue{StringValue: "%DOWNSTREAM_TLS_VERSION%"}},
+			"downstream_tls_cipher":             {Kind: &google_protobuf.Value_StringValue{StringValue: "%DOWNSTREAM_TLS_CIPHER%"}},
+			grpcStatusLogField:                  {Kind: &google_protobuf.Value_StringValue{StringValue: "%GRPC_STATUS%"}},
 		},
 	}
+
+	// envoyJSONLogFormatWithAttemptDetails is EnvoyJSONLogFormat with the retry and connection
+	// termination fields, used when features.EnableAccessLogAttemptDetails is set.
+	envoyJSONLogFormatWithAttemptDetails = withJSONLogFields(EnvoyJSONLogFormat, map[string]*google_protobuf.Value{
+		"upstream_request_attempt_count": {Kind: &google_protobuf.Value_StringValue{StringValue: "%UPSTREAM_REQUEST_ATTEMPT_COUNT%"}},
+		"connection_termination_details": {Kind: &google_protobuf.Value_StringValue{StringValue: "%CONNECTION_TERMINATION_DETAILS%"}},
+	})
 )
 
-func buildAccessLog(fl *accesslogconfig.FileAccessLog, env *model.Environment) {
-	switch env.Mesh.AccessLogEncoding {
+// withJSONLogFields returns a copy of the JSON log format with the given fields added.
+func withJSONLogFields(format *google_protobuf.Struct, fields map[string]*google_protobuf.Value) *google_protobuf.Struct {
+	out := &google_protobuf.Struct{Fields: make(map[string]*google_protobuf.Value, len(format.Fields)+len(fields))}
+	for name, v := range format.Fields {
+		out.Fields[name] = v
+	}
+	for name, v := range fields {
+		out.Fields[name] = v
+	}
+	return out
+}
+
+// defaultTextLogFormat returns the text access log format used when the mesh does not set one.
+func defaultTextLogFormat() string {
+	if !features.EnableAccessLogGRPCStatus.Get() {
+		return envoyTextLogFormatWithoutGRPCStatus
+	}
+	return EnvoyTextLogFormat
+}
+
+// defaultJSONLogFormat returns the JSON access log format used when the mesh does not set one.
+func defaultJSONLogFormat() *google_protobuf.Struct {
+	format := EnvoyJSONLogFormat
+	if features.EnableAccessLogAttemptDetails.Get() {
+		format = envoyJSONLogFormatWithAttemptDetails
+	}
+	if !features.EnableAccessLogGRPCStatus.Get() {
+		fields := make(map[string]*google_protobuf.Value, len(format.Fields))
+		for name, v := range format.Fields {
+			if name != grpcStatusLogField {
+				fields[name] = v
+			}
+		}
+		format = &google_protobuf.Struct{Fields: fields}
+	}
+	return format
+}
+
+// buildAccessLog sets the access log format for the encoding. A non empty format takes precedence over
+// the mesh access log format, and both fall back to the default format of the encoding.
+func buildAccessLog(node *model.Proxy, fl *accesslogconfig.FileAccessLog, env *model.Environment,
+	encoding meshconfig.MeshConfig_AccessLogEncoding, format string) {
+	// The mesh access log format is written for the mesh encoding, so it is not used
+	// when the proxy overrides the encoding.
+	if format == "" && encoding == env.Mesh.AccessLogEncoding {
+		format = env.Mesh.AccessLogFormat
+	}
+
+	switch encoding {
 	case meshconfig.MeshConfig_TEXT:
-		formatString := EnvoyTextLogFormat
-		if env.Mesh.AccessLogFormat != "" {
-			formatString = env.Mesh.AccessLogFormat
+		formatString := defaultTextLogFormat()
+		if format != "" {
+			formatString = format
 		}
 		fl.AccessLogFormat = &accesslogconfig.FileAccessLog_Format{
 			Format: formatString,
 		}
 	case meshconfig.MeshConfig_JSON:
 		var jsonLog *google_protobuf.Struct
-		// TODO potential optimization to avoid recomputing the user provided format for every listener
-		// mesh AccessLogFormat field could change so need a way to have a cached value that can be cleared
-		// on changes
-		if env.Mesh.AccessLogFormat != "" {
-			jsonFields := map[string]string{}
-			err := json.Unmarshal([]byte(env.Mesh.AccessLogFormat), &jsonFields)
-			if err == nil {
-				jsonLog = &google_protobuf.Struct{
-					Fields: make(map[string]*google_protobuf.Value, len(jsonFields)),
-				}
-				fmt.Println(jsonFields)
-				for key, value := range jsonFields {
-					jsonLog.Fields[key] = &google_protobuf.Value{Kind: &google_protobuf.Value_StringValue{StringValue: value}}
-				}
-			} else {
-				fmt.Println(env.Mesh.AccessLogFormat)
-				log.Errorf("error parsing provided json log format, default log format will be used: %v", err)
-			}
+		if format != "" {
+			jsonLog = getJSONLogFormat(format)
 		}
 		if jsonLog == nil {
-			jsonLog = EnvoyJSONLogFormat
+			jsonLog = filterJSONLogFormat(defaultJSONLogFormat(), node)
 		}
 		fl.AccessLogFormat = &accesslogconfig.FileAccessLog_JsonFormat{
 			JsonFormat: jsonLog,
 		}
 	default:
-		log.Warnf("unsupported access log format %v", env.Mesh.AccessLogEncoding)
+		log.Warnf("unsupported access log format %v", encoding)
+	}
+}
+
+// buildFileAccessLog returns the access log writing to the mesh access log file with the encoding. A non
+// empty format takes precedence over the mesh access log format, see buildAccessLog.
+func buildFileAccessLog(node *model.Proxy, env *model.Environment, encoding meshconfig.MeshConfig_AccessLogEncoding,
+	format string) *accesslog.AccessLog {
+	fl := &accesslogconfig.FileAccessLog{
+		Path: env.Mesh.AccessLogFile,
+	}
+	buildAccessLog(node, fl, env, encoding, format)
+	return buildAccessLogConfig(node, xdsutil.FileAccessLog, fl)
+}
+
+// buildAccessLogConfig returns the access log with the name and configuration, marshaled for the proxy.
+func buildAccessLogConfig(node *model.Proxy, name string, config gogoproto.Message) *accesslog.AccessLog {
+	acc := &accesslog.AccessLog{
+		Name: name,
+	}
+	if util.IsXDSMarshalingToAnyEnabled(node) {
+		acc.ConfigType = &accesslog.AccessLog_TypedConfig{TypedConfig: util.MessageToAny(config)}
+	} else {
+		acc.ConfigType = &accesslog.AccessLog_Config{Config: util.MessageToStruct(config)}
+	}
+	return acc
+}
+
+// maxJSONLogFormats bounds the number of cached JSON access log formats. The cache is reset when
+// it is full, which drops the formats that are no longer used.
+const maxJSONLogFormats = 100
+
+// jsonLogFormatCache holds the parsed form of the user provided JSON access log formats, keyed by
+// format, so that each format is unmarshaled once rather than for every listener. Formats come from
+// the mesh config, gateway annotations and Sidecars, so several are used within a push. Invalid
+// formats are cached as nil, so the parse error is logged once.
+var jsonLogFormatCache = struct {
+	sync.Mutex
+	formats map[string]*google_protobuf.Struct
+}{formats: map[string]*google_protobuf.Struct{}}
+
+// getJSONLogFormat returns the parsed user provided JSON access log format, or nil if it is invalid.
+// The returned struct is shared and must not be modified.
+func getJSONLogFormat(format string) *google_protobuf.Struct {
+	jsonLogFormatCache.Lock()
+	defer jsonLogFormatCache.Unlock()
+	jsonLog, f := jsonLogFormatCache.formats[format]
+	if !f {
+		if len(jsonLogFormatCache.formats) >= maxJSONLogFormats {
+			jsonLogFormatCache.formats = map[string]*google_protobuf.Struct{}
+		}
+		jsonLog = parseJSONLogFormat(format)
+		jsonLogFormatCache.formats[format] = jsonLog
+	}
+	return jsonLog
+}
+
+// parseJSONLogFormat parses a user provided JSON access log format. It is a variable so that tests
+// can count the calls.
+var parseJSONLogFormat = func(format string) *google_protobuf.Struct {
+	jsonFields := map[string]string{}
+	if err := json.Unmarshal([]byte(format), &jsonFields); err != nil {
+		log.Debugf("invalid json log format: %s", format)
+		log.Errorf("error parsing provided json log format, default log format will be used: %v", err)
+		return nil
+	}
+	jsonLog := &google_protobuf.Struct{
+		Fields: make(map[string]*google_protobuf.Value, len(jsonFields)),
 	}
+	log.Debugf("parsed json log format: %v", jsonFields)
+	for key, value := range jsonFields {
+		jsonLog.Fields[key] = &google_protobuf.Value{Kind: &google_protobuf.Value_StringValue{StringValue: value}}
+	}
+	return jsonLog
+}
+
+// getAccessLogEncoding returns the access log encoding override from the proxy metadata, or the
+// mesh access log encoding if the proxy does not override it.
+func getAccessLogEncoding(env *model.Environment, override *meshconfig.MeshConfig_AccessLogEncoding) meshconfig.MeshConfig_AccessLogEncoding {
+	if override == nil {
+		return env.Mesh.AccessLogEncoding
+	}
+	return *override
+}
+
+// filterJSONLogFormat returns the JSON log format restricted to the fields selected by the proxy
+// metadata. The format is returned as is if the proxy does not select fields.
+func filterJSONLogFormat(format *google_protobuf.Struct, node *model.Proxy) *google_protobuf.Struct {
+	lm := node.GetListenerMetadata()
+	if len(lm.AccessLogJSONIncludeFields) == 0 && len(lm.AccessLogJSONExcludeFields) == 0 {
+		return format
+	}
+
+	fields := make(map[string]*google_protobuf.Value, len(format.Fields))
+	if len(lm.AccessLogJSONIncludeFields) > 0 {
+		for _, name := range lm.AccessLogJSONIncludeFields {
+			if v, f := format.Fields[name]; f {
+				fields[name] = v
+			}
+		}
+	} else {
+		for name, v := range format.Fields {
+			fields[name] = v
+		}
+	}
+	for _, name := range lm.AccessLogJSONExcludeFields {
+		delete(fields, name)
+	}
+	return &google_protobuf.Struct{Fields: fields}
 }
 
 var (
@@ -191,6 +370,14 @@ func init() {
 // BuildListeners produces a list of listeners and referenced clusters for all proxies
 func (configgen *ConfigGeneratorImpl) BuildListeners(env *model.Environment, node *model.Proxy,
 	push *model.PushContext) []*xdsapi.Listener {
+	// Bind addresses are derived from the proxy IPs, building listeners for a proxy with
+	// bad IPs would either panic or silently fall back to wildcard binds.
+	if err := node.ValidateIPAddresses(); err != nil {
+		log.Errorf("BuildListeners: %v", err)
+		push.Add(model.ProxyStatusInvalidIPAddresses, node.ID, node, err.Error())
+		return nil
+	}
+
 	builder := NewListenerBuilder(node)
 
 	switch node.Type {
@@ -201,7 +388,13 @@ func (configgen *ConfigGeneratorImpl) BuildListeners(env *model.Environment, nod
 	}
 
 	builder.patchListeners(push)
-	return builder.getListeners()
+	listeners := builder.getListeners()
+	if features.EnableListenerVersionMetadata.Get() {
+		for _, l := range listeners {
+			insertPilotVersion(l)
+		}
+	}
+	return listeners
 }
 
 // buildSidecarListeners produces a list of listeners for sidecar proxies
@@ -218,7 +411,7 @@ func (configgen *ConfigGeneratorImpl) buildSidecarListeners(
 			buildSidecarOutboundListeners(configgen, env, node, push).
 			buildManagementListeners(configgen, env, node, push).
 			buildVirtualOutboundListener(configgen, env, node, push).
-			buildVirtualInboundListener(env, node)
+			buildVirtualInboundListener(configgen, env, node, push)
 	}
 
 	return builder
@@ -261,6 +454,11 @@ func (configgen *ConfigGeneratorImpl) buildSidecarInboundListeners(
 			endpoint := instance.Endpoint
 			bind := endpoint.Address
 
+			if endpoint.ServicePort.Protocol == protocol.Unsupported {
+				addUnknownProtocolStatus(push, node, "service "+string(instance.Service.Hostname), endpoint.ServicePort, "")
+				continue
+			}
+
 			// Local service instances can be accessed through one of three
 			// addresses: localhost, endpoint IP, and service
 			// VIP. Localhost bypasses the proxy and doesn't need any TCP
@@ -270,12 +468,14 @@ func (configgen *ConfigGeneratorImpl) buildSidecarInboundListeners(
 			// services' kubeproxy to our specific endpoint IP.
 			listenerOpts := buildListenerOpts{
 				env:            env,
+				push:           push,
 				proxy:          node,
 				proxyInstances: node.ServiceInstances,
 				proxyLabels:    proxyLabels,
 				bind:           bind,
 				port:           endpoint.Port,
 				bindToPort:     false,
+				proxyProtocol:  node.GetListenerMetadata().ProxyProtocol,
 			}
 
 			pluginParams := &plugin.InputParams{
@@ -314,9 +514,14 @@ func (configgen *ConfigGeneratorImpl) buildSidecarInboundListeners(
 
 			listenPort := &model.Port{
 				Port:     int(ingressListener.Port.Number),
-				Protocol: protocol.Parse(ingressListener.Port.Protocol),
+				Protocol: sidecarIngressProtocol(ingressListener.Port),
 				Name:     ingressListener.Port.Name,
 			}
+			if listenPort.Protocol == protocol.Unsupported {
+				addUnknownProtocolStatus(push, node, "Sidecar "+sidecarScope.Config.Namespace+"/"+sidecarScope.Config.Name+" ingress",
+					listenPort, ingressListener.Port.Protocol)
+				continue
+			}
 
 			// if app doesn't have a declared ServicePort, but a sidecar ingress is defined - we can't generate a listener
 			// for that port since we don't know what policies or configs apply to it ( many are based on service matching).
@@ -325,6 +530,9 @@ func (configgen *ConfigGeneratorImpl) buildSidecarInboundListeners(
 
 			if instance == nil {
 				// We didn't find a matching service instance. Skip this ingress listener
+				push.Add(model.ProxyStatusSidecarIngressNoInstance, fmt.Sprintf("%s:%d", node.ID, listenPort.Port), node,
+					fmt.Sprintf("Skipped Sidecar ingress listener on port %d: no service instance of the proxy declares "+
+						"this port. A Service with a matching ServicePort is required.", listenPort.Port))
 				continue
 			}
 
@@ -342,12 +550,14 @@ func (configgen *ConfigGeneratorImpl) buildSidecarInboundListeners(
 
 			listenerOpts := buildListenerOpts{
 				env:            env,
+				push:           push,
 				proxy:          node,
 				proxyInstances: node.ServiceInstances,
 				proxyLabels:    proxyLabels,
 				bind:           bind,
 				port:           listenPort.Port,
 				bindToPort:     bindToPort,
+				proxyProtocol:  node.GetListenerMetadata().ProxyProtocol,
 			}
 
 			// Update the values here so that the plugins use the right ports
@@ -388,25 +598,32 @@ func (configgen *ConfigGeneratorImpl) buildSidecarInboundHTTPListenerOptsForPort
 		useRemoteAddress: false,
 		direction:        http_conn.INGRESS,
 		connectionManager: &http_conn.HttpConnectionManager{
-			// Append and forward client cert to backend.
-			ForwardClientCertDetails: http_conn.APPEND_FORWARD,
-			SetCurrentClientCertDetails: &http_conn.HttpConnectionManager_SetCurrentClientCertDetails{
-				Subject: &google_protobuf.BoolValue{Value: true},
-				Uri:     true,
-				Dns:     true,
-			},
 			ServerName: EnvoyServerName,
 		},
+		disableAccessLog:        pluginParams.ServiceInstance.Service.Attributes.DisableAccessLog,
+		idleTimeout:             sidecarIdleTimeout(node),
+		disableWebsocketUpgrade: node.GetListenerMetadata().DisableWebsocketUpgrade,
 	}
+	setInboundClientCertDetails(node, httpOpts.connectionManager)
 	// See https://github.com/grpc/grpc-web/tree/master/net/grpc/gateway/examples/helloworld#configure-the-proxy
 	if pluginParams.ServiceInstance.Endpoint.ServicePort.Protocol.IsHTTP2() {
 		httpOpts.connectionManager.Http2ProtocolOptions = &core.Http2ProtocolOptions{}
-		if pluginParams.ServiceInstance.Endpoint.ServicePort.Protocol == protocol.GRPCWeb {
+		if streams := node.GetListenerMetadata().InboundHTTP2MaxConcurrentStreams; streams > 0 {
+			httpOpts.connectionManager.Http2ProtocolOptions.MaxConcurrentStreams = &google_protobuf.UInt32Value{Value: streams}
+		}
+		switch pluginParams.ServiceInstance.Endpoint.ServicePort.Protocol {
+		case protocol.GRPCWeb:
 			httpOpts.addGRPCWebFilter = true
+		case protocol.GRPC:
+			// gRPC is carried over HTTP/2, so protocol detection can be skipped when the ports
+			// do not also serve HTTP/1 requests.
+			if features.InboundGRPCHTTP2Codec {
+				httpOpts.codecType = http_conn.HTTP2
+			}
 		}
 	}
 
-	if features.HTTP10 || node.Metadata[model.NodeMetadataHTTP10] == "1" {
+	if features.HTTP10 || node.GetListenerMetadata().HTTP10 {
 		httpOpts.connectionManager.HttpProtocolOptions = &core.Http1ProtocolOptions{
 			AcceptHttp_10: true,
 		}
@@ -415,6 +632,30 @@ func (configgen *ConfigGeneratorImpl) buildSidecarInboundHTTPListenerOptsForPort
 	return httpOpts
 }
 
+// sidecarIngressProtocol returns the protocol of a Sidecar ingress listener port. If the protocol is
+// not set, it is inferred from the port name like for Kubernetes service ports, e.g. http-foo or
+// grpc-web-bar. Protocols and port names that are not known return protocol.Unsupported.
+func sidecarIngressProtocol(port *networking.Port) protocol.Instance {
+	if port.Protocol != "" {
+		return protocol.Parse(port.Protocol)
+	}
+	return kube.ParsePortName(port.Name)
+}
+
+// addUnknownProtocolStatus records a push status warning for a listener port whose protocol does
+// not parse to a known protocol, so no listener is built for it. value is the protocol as written by
+// the user, empty when it was already lost by the service registry.
+func addUnknownProtocolStatus(push *model.PushContext, node *model.Proxy, owner string, port *model.Port, value string) {
+	msg := fmt.Sprintf("Skipped listener for port %d (%s) of %s: ", port.Port, port.Name, owner)
+	if value != "" {
+		msg += fmt.Sprintf("unknown protocol %q.", value)
+	} else {
+		msg += "the port protocol is not a known protocol."
+	}
+	// Keyed by port rather than proxy: every proxy hits the same broken service port.
+	push.Add(model.ProxyStatusUnknownListenerProtocol, fmt.Sprintf("%s:%d", owner, port.Port), node, msg)
+}
+
 // buildSidecarInboundListenerForPortOrUDS creates a single listener on the server-side (inbound)
 // for a given port or unix domain socket
 func (configgen *ConfigGeneratorImpl) buildSidecarInboundListenerForPortOrUDS(node *model.Proxy, listenerOpts buildListenerOpts,
@@ -428,15 +669,20 @@ func (configgen *ConfigGeneratorImpl) buildSidecarInboundListenerForPortOrUDS(no
 	// remote services' kubeproxy to our specific endpoint IP.
 	listenerMapKey := fmt.Sprintf("%s:%d", listenerOpts.bind, listenerOpts.port)
 
-	if old, exists := listenerMap[listenerMapKey]; exists {
+	old, exists := listenerMap[listenerMapKey]
+	if exists {
 		// For sidecar specified listeners, the caller is expected to supply a dummy service instance
 		// with the right port and a hostname constructed from the sidecar config's name+namespace
-		pluginParams.Push.Add(model.ProxyStatusConflictInboundListener, pluginParams.Node.ID, pluginParams.Node,
-			fmt.Sprintf("Conflicting inbound listener:%s. existing: %s, incoming: %s", listenerMapKey,
-				old.instanceHostname, pluginParams.ServiceInstance.Service.Hostname))
-
-		// Skip building listener for the same ip port
-		return nil
+		msg := fmt.Sprintf("Conflicting inbound listener:%s. existing: %s, incoming: %s", listenerMapKey,
+			old.instanceHostname, pluginParams.ServiceInstance.Service.Hostname)
+		pluginParams.Push.Add(model.ProxyStatusConflictInboundListener, pluginParams.Node.ID, pluginParams.Node, msg)
+		pluginParams.Push.Add(model.ProxyStatusConflictInboundListeners, pluginParams.Node.ID+"/"+listenerMapKey,
+			pluginParams.Node, msg)
+
+		if !inboundListenerConflictPrefersNew(old, pluginParams.ServiceInstance.Service) {
+			// Skip building listener for the same ip port
+			return nil
+		}
 	}
 
 	var allChains []plugin.FilterChain
@@ -483,6 +729,7 @@ func (configgen *ConfigGeneratorImpl) buildSidecarInboundListenerForPortOrUDS(no
 	// call plugins
 	l := buildListener(listenerOpts)
 	l.TrafficDirection = core.TrafficDirection_INBOUND
+	l.SocketOptions = buildInboundSocketOptions(node)
 
 	mutable := &plugin.MutableObjects{
 		Listener:     l,
@@ -490,6 +737,10 @@ func (configgen *ConfigGeneratorImpl) buildSidecarInboundListenerForPortOrUDS(no
 	}
 	for _, p := range configgen.Plugins {
 		if err := p.OnInboundListener(pluginParams, mutable); err != nil {
+			if err == plugin.ErrDropListener {
+				log.Debugf("buildSidecarInboundListeners: listener %s dropped by plugin", l.Name)
+				return nil
+			}
 			log.Warn(err.Error())
 		}
 	}
@@ -499,16 +750,39 @@ func (configgen *ConfigGeneratorImpl) buildSidecarInboundListenerForPortOrUDS(no
 		return nil
 	}
 
+	if exists {
+		// Replace the existing listener in place, so it keeps its position in the caller's list.
+		log.Debugf("buildSidecarInboundListeners: %s replaces %s on listener %s for %s",
+			pluginParams.ServiceInstance.Service.Hostname, old.instanceHostname, listenerMapKey, node.ID)
+		*old.listener = *mutable.Listener
+		old.instanceHostname = pluginParams.ServiceInstance.Service.Hostname
+		old.creationTime = pluginParams.ServiceInstance.Service.CreationTime
+		return nil
+	}
+
 	listenerMap[listenerMapKey] = &inboundListenerEntry{
 		bind:             listenerOpts.bind,
 		instanceHostname: pluginParams.ServiceInstance.Service.Hostname,
+		creationTime:     pluginParams.ServiceInstance.Service.CreationTime,
+		listener:         mutable.Listener,
 	}
 	return mutable.Listener
 }
 
+// inboundListenerConflictPrefersNew returns true if the NEWEST_WINS conflict policy is in use and
+// the new service was created after the service of the existing inbound listener.
+func inboundListenerConflictPrefersNew(existing *inboundListenerEntry, newService *model.Service) bool {
+	if features.InboundListenerConflictPolicy.Get() != "NEWEST_WINS" {
+		return false
+	}
+	return newService.CreationTime.After(existing.creationTime)
+}
+
 type inboundListenerEntry struct {
 	bind             string
 	instanceHostname host.Name // could be empty if generated via Sidecar CRD
+	creationTime     time.Time
+	listener         *xdsapi.Listener
 }
 
 type outboundListenerEntry struct {
@@ -541,11 +815,7 @@ type outboundListenerConflict struct {
 }
 
 func (c outboundListenerConflict) addMetric(push *model.PushContext) {
-	currentHostnames := make([]string, len(c.currentServices))
-	for i, s := range c.currentServices {
-		currentHostnames[i] = string(s.Hostname)
-	}
-	concatHostnames := strings.Join(currentHostnames, ",")
+	concatHostnames := joinServiceHostnames(c.currentServices)
 	push.Add(c.metric,
 		c.listenerName,
 		c.node,
@@ -559,6 +829,64 @@ func (c outboundListenerConflict) addMetric(push *model.PushContext) {
 			len(c.currentServices)))
 }
 
+// resolve records the conflict and reports whether the new service should replace the current
+// listener (or filter chain), based on the configured conflict policy.
+func (c outboundListenerConflict) resolve(push *model.PushContext, newService *model.Service) bool {
+	if newService == nil || !outboundListenerConflictPrefersNew(c.currentServices, newService) {
+		c.addMetric(push)
+		return false
+	}
+
+	log.Debugf("buildSidecarOutboundListeners: %s replaces %s on listener %s for %s",
+		newService.Hostname, joinServiceHostnames(c.currentServices), c.listenerName, c.node.ID)
+	outboundListenerConflict{
+		metric:          c.metric,
+		node:            c.node,
+		listenerName:    c.listenerName,
+		currentProtocol: c.newProtocol,
+		currentServices: []*model.Service{newService},
+		newHostname:     host.Name(joinServiceHostnames(c.currentServices)),
+		newProtocol:     c.currentProtocol,
+	}.addMetric(push)
+	return true
+}
+
+// outboundListenerConflictPrefersNew returns true if the NAMESPACE_PRIORITY conflict policy is in use
+// and the namespace of the new service has a strictly higher priority than all current services.
+func outboundListenerConflictPrefersNew(currentServices []*model.Service, newService *model.Service) bool {
+	if features.OutboundListenerConflictPolicy.Get() != "NAMESPACE_PRIORITY" {
+		return false
+	}
+
+	namespaces := strings.Split(features.OutboundListenerPriorityNamespaces.Get(), ",")
+	priority := func(svc *model.Service) int {
+		for i, ns := range namespaces {
+			if strings.TrimSpace(ns) == svc.Attributes.Namespace {
+				return i
+			}
+		}
+		return len(namespaces)
+	}
+
+	newPriority := priority(newService)
+	for _, svc := range currentServices {
+		if svc != nil && priority(svc) <= newPriority {
+			return false
+		}
+	}
+	return true
+}
+
+func joinServiceHostnames(services []*model.Service) string {
+	hostnames := make([]string, 0, len(services))
+	for _, s := range services {
+		if s != nil {
+			hostnames = append(hostnames, string(s.Hostname))
+		}
+	}
+	return strings.Join(hostnames, ",")
+}
+
 // buildSidecarOutboundListeners generates http and tcp listeners for
 // outbound connections from the proxy based on the sidecar scope associated with the proxy.
 // TODO(github.com/istio/pilot/issues/237)
@@ -585,6 +913,7 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListeners(env *model.E
 	noneMode := node.GetInterceptionMode() == model.InterceptionNone
 
 	actualWildcard, actualLocalHostAddress := getActualWildcardAndLocalHost(node)
+	loopbackBindAddress := getLoopbackBindAddress(node, actualLocalHostAddress)
 
 	var tcpListeners, httpListeners []*xdsapi.Listener
 	// For conflict resolution
@@ -638,6 +967,14 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListeners(env *model.E
 				Protocol: protocol.Parse(egressListener.IstioListener.Port.Protocol),
 				Name:     egressListener.IstioListener.Port.Name,
 			}
+			if listenPort.Protocol == protocol.Unsupported {
+				owner := "Sidecar egress"
+				if node.SidecarScope.Config != nil {
+					owner = "Sidecar " + node.SidecarScope.Config.Namespace + "/" + node.SidecarScope.Config.Name + " egress"
+				}
+				addUnknownProtocolStatus(push, node, owner, listenPort, egressListener.IstioListener.Port.Protocol)
+				continue
+			}
 
 			// If capture mode is NONE i.e., bindToPort is true, and
 			// Bind IP + Port is specified, we will bind to the specified IP and Port.
@@ -656,7 +993,7 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListeners(env *model.E
 			// this egress listener.
 			bind := egressListener.IstioListener.Bind
 			if bindToPort && bind == "" {
-				bind = actualLocalHostAddress
+				bind = loopbackBindAddress
 			} else if len(bind) == 0 {
 				bind = actualWildcard
 			}
@@ -664,6 +1001,7 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListeners(env *model.E
 			for _, service := range services {
 				listenerOpts := buildListenerOpts{
 					env:            env,
+					push:           push,
 					proxy:          node,
 					proxyInstances: node.ServiceInstances,
 					proxyLabels:    proxyLabels,
@@ -716,7 +1054,7 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListeners(env *model.E
 				bind = egressListener.IstioListener.Bind
 			}
 			if bindToPort && bind == "" {
-				bind = actualLocalHostAddress
+				bind = loopbackBindAddress
 			}
 			for _, service := range services {
 				for _, servicePort := range service.Ports {
@@ -725,9 +1063,14 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListeners(env *model.E
 					if !validatePort(node, servicePort.Port, bindToPort) {
 						continue
 					}
+					if servicePort.Protocol == protocol.Unsupported {
+						addUnknownProtocolStatus(push, node, "service "+string(service.Hostname), servicePort, "")
+						continue
+					}
 
 					listenerOpts := buildListenerOpts{
 						env:            env,
+						push:           push,
 						proxy:          node,
 						proxyInstances: node.ServiceInstances,
 						proxyLabels:    proxyLabels,
@@ -755,10 +1098,9 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListeners(env *model.E
 	}
 
 	// Now validate all the listeners. Collate the tcp listeners first and then the HTTP listeners
-	// TODO: This is going to be bad for caching as the order of listeners in tcpListeners or httpListeners is not
-	// guaranteed.
 	invalid := 0.0
 	for name, l := range listenerMap {
+		l.listener.FilterChains = mergeCIDRFilterChains(l.listener.FilterChains)
 		if err := l.listener.Validate(); err != nil {
 			log.Warnf("buildSidecarOutboundListeners: error validating listener %s (type %v): %v", name, l.servicePort.Protocol, err)
 			invalid++
@@ -772,6 +1114,9 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListeners(env *model.E
 		}
 	}
 
+	// The listener map has no order, sort the listeners so that the same config results in the same output.
+	sort.SliceStable(tcpListeners, func(i, j int) bool { return listenerLess(tcpListeners[i], tcpListeners[j]) })
+	sort.SliceStable(httpListeners, func(i, j int) bool { return listenerLess(httpListeners[i], httpListeners[j]) })
 	tcpListeners = append(tcpListeners, httpListeners...)
 	httpProxy := configgen.buildHTTPProxy(env, node, push, node.ServiceInstances)
 	if httpProxy != nil {
@@ -802,12 +1147,13 @@ func (configgen *ConfigGeneratorImpl) buildHTTPProxy(env *model.Environment, nod
 	httpOpts := &core.Http1ProtocolOptions{
 		AllowAbsoluteUrl: proto.BoolTrue,
 	}
-	if features.HTTP10 || node.Metadata[model.NodeMetadataHTTP10] == "1" {
+	if features.HTTP10 || node.GetListenerMetadata().HTTP10 {
 		httpOpts.AcceptHttp_10 = true
 	}
 
 	opts := buildListenerOpts{
 		env:            env,
+		push:           push,
 		proxy:          node,
 		proxyInstances: proxyInstances,
 		bind:           listenAddress,
@@ -859,8 +1205,7 @@ func validatePort(node *model.Proxy, i int, bindToPort bool) bool {
 		return true
 	}
 
-	proxyProcessUID := node.Metadata[model.NodeMetadataSidecarUID]
-	return proxyProcessUID == "0"
+	return node.GetListenerMetadata().SidecarUID == "0"
 }
 
 func (configgen *ConfigGeneratorImpl) buildSidecarOutboundHTTPListenerOptsForPortOrUDS(listenerMapKey *string,
@@ -897,9 +1242,10 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundHTTPListenerOptsForPor
 		if (*currentListenerEntry).locked {
 			return false, nil
 		}
+		replaced := false
 		if pluginParams.Service != nil {
 			if !(*currentListenerEntry).servicePort.Protocol.IsHTTP() {
-				outboundListenerConflict{
+				replaced = outboundListenerConflict{
 					metric:          model.ProxyStatusConflictOutboundListenerTCPOverHTTP,
 					node:            pluginParams.Node,
 					listenerName:    *listenerMapKey,
@@ -907,13 +1253,20 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundHTTPListenerOptsForPor
 					currentProtocol: (*currentListenerEntry).servicePort.Protocol,
 					newHostname:     pluginParams.Service.Hostname,
 					newProtocol:     pluginParams.Port.Protocol,
-				}.addMetric(pluginParams.Push)
+				}.resolve(pluginParams.Push, pluginParams.Service)
 			}
 
-			// Skip building listener for the same http port
-			(*currentListenerEntry).services = append((*currentListenerEntry).services, pluginParams.Service)
+			if !replaced {
+				// Skip building listener for the same http port
+				(*currentListenerEntry).services = append((*currentListenerEntry).services, pluginParams.Service)
+			}
 		}
-		return false, nil
+		if !replaced {
+			return false, nil
+		}
+		// The conflict policy prefers this service, drop the existing TCP listener
+		delete(listenerMap, *listenerMapKey)
+		*currentListenerEntry = nil
 	}
 
 	// No conflicts. Add a http filter chain option to the listenerOpts
@@ -927,12 +1280,14 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundHTTPListenerOptsForPor
 		// Set useRemoteAddress to true for side car outbound listeners so that it picks up the localhost address of the sender,
 		// which is an internal address, so that trusted headers are not sanitized. This helps to retain the timeout headers
 		// such as "x-envoy-upstream-rq-timeout-ms" set by the calling application.
-		useRemoteAddress: features.UseRemoteAddress.Get(),
-		direction:        http_conn.EGRESS,
-		rds:              rdsName,
+		useRemoteAddress:        features.UseRemoteAddress.Get(),
+		direction:               http_conn.EGRESS,
+		rds:                     rdsName,
+		idleTimeout:             sidecarIdleTimeout(pluginParams.Node),
+		disableWebsocketUpgrade: pluginParams.Node.GetListenerMetadata().DisableWebsocketUpgrade,
 	}
 
-	if features.HTTP10 || pluginParams.Node.Metadata[model.NodeMetadataHTTP10] == "1" {
+	if features.HTTP10 || pluginParams.Node.GetListenerMetadata().HTTP10 {
 		httpOpts.connectionManager = &http_conn.HttpConnectionManager{
 			HttpProtocolOptions: &core.Http1ProtocolOptions{
 				AcceptHttp_10: true,
@@ -1017,7 +1372,7 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundTCPListenerOptsForPort
 				newHostname = "sidecar-config-egress-http-listener"
 			}
 
-			outboundListenerConflict{
+			if !(outboundListenerConflict{
 				metric:          model.ProxyStatusConflictOutboundListenerHTTPOverTCP,
 				node:            pluginParams.Node,
 				listenerName:    *listenerMapKey,
@@ -1025,8 +1380,12 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundTCPListenerOptsForPort
 				currentProtocol: (*currentListenerEntry).servicePort.Protocol,
 				newHostname:     newHostname,
 				newProtocol:     pluginParams.Port.Protocol,
-			}.addMetric(pluginParams.Push)
-			return false, nil
+			}.resolve(pluginParams.Push, pluginParams.Service)) {
+				return false, nil
+			}
+			// The conflict policy prefers this service, drop the existing HTTP listener
+			delete(listenerMap, *listenerMapKey)
+			*currentListenerEntry = nil
 		}
 
 		// We have a collision with another TCP port. This can happen
@@ -1080,19 +1439,27 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListenerForPortOrUDS(l
 		return
 	}
 
+	if max := features.MaxOutboundListeners.Get(); currentListenerEntry == nil && max > 0 && len(listenerMap) >= max {
+		// Guard Pilot and Envoy against a pathological number of listeners, typically the result of
+		// a sidecar without egress scope in a very large mesh.
+		// The status is keyed by proxy, so it is reported once per push however many listeners are dropped.
+		pluginParams.Push.Add(model.ProxyStatusOutboundListenerLimit, pluginParams.Node.ID, pluginParams.Node,
+			fmt.Sprintf("Reached the maximum of %d outbound listeners, further listeners were dropped. "+
+				"Define a Sidecar with an egress scope to limit the services this proxy listens for.", max))
+		log.Debugf("buildSidecarOutboundListeners: dropping listener %s for %s, maximum of %d outbound listeners reached",
+			listenerMapKey, pluginParams.Node.ID, max)
+		return
+	}
+
 	// These wildcard listeners are intended for outbound traffic. However, there are cases where inbound traffic can hit these.
 	// This will happen when there is a no more specific inbound listener, either because Pilot hasn't sent it (race condition
 	// at startup), or because it never will (a port not specified in a service but captured by iptables).
 	// When this happens, Envoy will infinite loop sending requests to itself.
 	// To prevent this, we add a filter chain match that will match the pod ip and blackhole the traffic.
 	if listenerOpts.bind == actualWildcard && features.RestrictPodIPTrafficLoops.Get() {
-		blackhole := blackholeStructMarshalling
-		if util.IsXDSMarshalingToAnyEnabled(pluginParams.Node) {
-			blackhole = blackholeAnyMarshalling
-		}
 		listenerOpts.filterChainOpts = append([]*filterChainOpts{{
 			destinationCIDRs: pluginParams.Node.IPAddresses,
-			networkFilters:   []*listener.Filter{&blackhole},
+			networkFilters:   []*listener.Filter{newBlackholeFilterForNode(pluginParams.Env, pluginParams.Node)},
 		}}, listenerOpts.filterChainOpts...)
 	}
 
@@ -1109,6 +1476,10 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListenerForPortOrUDS(l
 
 	for _, p := range configgen.Plugins {
 		if err := p.OnOutboundListener(pluginParams, mutable); err != nil {
+			if err == plugin.ErrDropListener {
+				log.Debugf("buildSidecarOutboundListeners: listener %s dropped by plugin", l.Name)
+				return
+			}
 			log.Warn(err.Error())
 		}
 	}
@@ -1119,8 +1490,8 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListenerForPortOrUDS(l
 		return
 	}
 
-	// TODO(rshriram) merge multiple identical filter chains with just a single destination CIDR based
-	// filter chain match, into a single filter chain and array of destinationcidr matches
+	// Identical filter chains with just a destination CIDR based filter chain match are merged into a
+	// single filter chain once all services are processed, see mergeCIDRFilterChains.
 
 	// We checked TCP over HTTP, and HTTP over TCP conflicts above.
 	// The code below checks for TCP over TCP conflicts and merges listeners
@@ -1135,11 +1506,13 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListenerForPortOrUDS(l
 			len(currentListenerEntry.listener.FilterChains)+len(mutable.Listener.FilterChains))
 		newFilterChains = append(newFilterChains, currentListenerEntry.listener.FilterChains...)
 
+		// Set when the conflict policy lets the new service take over existing filter chains
+		replacedExisting := false
 		for _, incomingFilterChain := range mutable.Listener.FilterChains {
 			conflictFound := false
 
 		compareWithExisting:
-			for _, existingFilterChain := range currentListenerEntry.listener.FilterChains {
+			for i, existingFilterChain := range currentListenerEntry.listener.FilterChains {
 				if existingFilterChain.FilterChainMatch == nil {
 					// This is a catch all filter chain.
 					// We can only merge with a non-catch all filter chain
@@ -1159,7 +1532,7 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListenerForPortOrUDS(l
 						}
 
 						conflictFound = true
-						outboundListenerConflict{
+						if (outboundListenerConflict{
 							metric:          model.ProxyStatusConflictOutboundListenerTCPOverTCP,
 							node:            pluginParams.Node,
 							listenerName:    listenerMapKey,
@@ -1167,7 +1540,10 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListenerForPortOrUDS(l
 							currentProtocol: currentListenerEntry.servicePort.Protocol,
 							newHostname:     newHostname,
 							newProtocol:     pluginParams.Port.Protocol,
-						}.addMetric(pluginParams.Push)
+						}.resolve(pluginParams.Push, pluginParams.Service)) {
+							newFilterChains[i] = incomingFilterChain
+							replacedExisting = true
+						}
 						break compareWithExisting
 					} else {
 						continue
@@ -1188,7 +1564,7 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListenerForPortOrUDS(l
 					}
 
 					conflictFound = true
-					outboundListenerConflict{
+					if (outboundListenerConflict{
 						metric:          model.ProxyStatusConflictOutboundListenerTCPOverTCP,
 						node:            pluginParams.Node,
 						listenerName:    listenerMapKey,
@@ -1196,7 +1572,10 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListenerForPortOrUDS(l
 						currentProtocol: currentListenerEntry.servicePort.Protocol,
 						newHostname:     newHostname,
 						newProtocol:     pluginParams.Port.Protocol,
-					}.addMetric(pluginParams.Push)
+					}.resolve(pluginParams.Push, pluginParams.Service)) {
+						newFilterChains[i] = incomingFilterChain
+						replacedExisting = true
+					}
 					break compareWithExisting
 				}
 			}
@@ -1211,6 +1590,9 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListenerForPortOrUDS(l
 				}
 			}
 		}
+		if replacedExisting {
+			currentListenerEntry.services = append(currentListenerEntry.services, pluginParams.Service)
+		}
 		currentListenerEntry.listener.FilterChains = newFilterChains
 	} else {
 		listenerMap[listenerMapKey] = &outboundListenerEntry{
@@ -1232,6 +1614,76 @@ func (configgen *ConfigGeneratorImpl) buildSidecarOutboundListenerForPortOrUDS(l
 	}
 }
 
+// listenerLess orders listeners by bind address, then port, then name. Listeners on a unix domain
+// socket have no bind address nor port and are ordered by name.
+func listenerLess(a, b *xdsapi.Listener) bool {
+	as, bs := a.Address.GetSocketAddress(), b.Address.GetSocketAddress()
+	if as.GetAddress() != bs.GetAddress() {
+		return as.GetAddress() < bs.GetAddress()
+	}
+	if as.GetPortValue() != bs.GetPortValue() {
+		return as.GetPortValue() < bs.GetPortValue()
+	}
+	return a.Name < b.Name
+}
+
+// mergeCIDRFilterChains merges filter chains that only differ by their destination CIDRs into the
+// first of them, with the union of the CIDRs. Services with many addresses otherwise get one
+// identical TCP filter chain per address. The order of the remaining filter chains is preserved.
+func mergeCIDRFilterChains(chains []*listener.FilterChain) []*listener.FilterChain {
+	if len(chains) < 2 {
+		return chains
+	}
+	out := make([]*listener.FilterChain, 0, len(chains))
+	for _, chain := range chains {
+		merged := false
+		for i, existing := range out {
+			if !sameFilterChainExceptCIDRs(existing, chain) {
+				continue
+			}
+			// Copy before updating, the filter chain may be shared with the plugins.
+			fc := *existing
+			match := *existing.FilterChainMatch
+			match.PrefixRanges = append([]*core.CidrRange{}, match.PrefixRanges...)
+			for _, cidr := range chain.FilterChainMatch.PrefixRanges {
+				if !containsCIDR(match.PrefixRanges, cidr) {
+					match.PrefixRanges = append(match.PrefixRanges, cidr)
+				}
+			}
+			fc.FilterChainMatch = &match
+			out[i] = &fc
+			merged = true
+			break
+		}
+		if !merged {
+			out = append(out, chain)
+		}
+	}
+	return out
+}
+
+// sameFilterChainExceptCIDRs returns true if both filter chains match on destination CIDRs and are
+// identical otherwise.
+func sameFilterChainExceptCIDRs(a, b *listener.FilterChain) bool {
+	if len(a.GetFilterChainMatch().GetPrefixRanges()) == 0 || len(b.GetFilterChainMatch().GetPrefixRanges()) == 0 {
+		return false
+	}
+	ac, bc := *a, *b
+	am, bm := *a.FilterChainMatch, *b.FilterChainMatch
+	am.PrefixRanges, bm.PrefixRanges = nil, nil
+	ac.FilterChainMatch, bc.FilterChainMatch = &am, &bm
+	return gogoproto.Equal(&ac, &bc)
+}
+
+func containsCIDR(cidrs []*core.CidrRange, cidr *core.CidrRange) bool {
+	for _, c := range cidrs {
+		if gogoproto.Equal(c, cidr) {
+			return true
+		}
+	}
+	return false
+}
+
 // TODO(silentdai): duplicate with listener_builder.go. Remove this one once split is verified.
 func (configgen *ConfigGeneratorImpl) generateManagementListeners(node *model.Proxy, noneMode bool,
 	env *model.Environment, listeners []*xdsapi.Listener) []*xdsapi.Listener {
@@ -1239,7 +1691,8 @@ func (configgen *ConfigGeneratorImpl) generateManagementListeners(node *model.Pr
 	// with ingress listeners. Specifying the ingress listener implies that the user wants
 	// to only have those specific listeners and nothing else, in the inbound path.
 	generateManagementListeners := true
-	if node.SidecarScope.HasCustomIngressListeners || noneMode {
+	if node.SidecarScope.HasCustomIngressListeners || noneMode ||
+		node.GetListenerMetadata().DisableManagementListeners {
 		generateManagementListeners = false
 	}
 	if generateManagementListeners {
@@ -1331,9 +1784,43 @@ func (configgen *ConfigGeneratorImpl) onVirtualOutboundListener(env *model.Envir
 	return ipTablesListener
 }
 
+// onVirtualInboundListener lets plugins customize the filter chains of the virtual inbound listener
+// once its default chains have been built.
+func (configgen *ConfigGeneratorImpl) onVirtualInboundListener(env *model.Environment,
+	node *model.Proxy,
+	push *model.PushContext,
+	virtualInboundListener *xdsapi.Listener) *xdsapi.Listener {
+
+	port := &model.Port{
+		Port:     int(ProxyInboundListenPort),
+		Protocol: protocol.TCP,
+	}
+	pluginParams := &plugin.InputParams{
+		ListenerProtocol:           plugin.ListenerProtocolTCP,
+		DeprecatedListenerCategory: networking.EnvoyFilter_DeprecatedListenerMatch_SIDECAR_INBOUND,
+		Env:                        env,
+		Node:                       node,
+		Push:                       push,
+		Port:                       port,
+	}
+
+	mutable := &plugin.MutableObjects{
+		Listener:     virtualInboundListener,
+		FilterChains: make([]plugin.FilterChain, len(virtualInboundListener.FilterChains)),
+	}
+
+	for _, p := range configgen.Plugins {
+		if err := p.OnVirtualInboundListener(pluginParams, mutable); err != nil {
+			log.Warn(err.Error())
+		}
+	}
+	return virtualInboundListener
+}
+
 // buildSidecarInboundMgmtListeners creates inbound TCP only listeners for the management ports on
 // server (inbound). Management port listeners are slightly different from standard Inbound listeners
-// in that, they do not have mixer filters nor do they have inbound auth.
+// in that, they do not have mixer filters nor do they have inbound auth. Protocol specific network
+// filters, such as the MySQL proxy, are installed as for any inbound TCP port.
 // N.B. If a given management port is same as the service instance's endpoint port
 // the pod will fail to start in Kubernetes, because the mixer service tries to
 // lookup the service associated with the Pod. Since the pod is yet to be started
@@ -1349,9 +1836,11 @@ func buildSidecarInboundMgmtListeners(node *model.Proxy, env *model.Environment,
 
 	if managementIP == "" {
 		managementIP = "127.0.0.1"
-		addr := net.ParseIP(node.IPAddresses[0])
-		if addr != nil && addr.To4() == nil {
-			managementIP = "::1"
+		if len(node.IPAddresses) > 0 {
+			addr := net.ParseIP(node.IPAddresses[0])
+			if addr != nil && addr.To4() == nil {
+				managementIP = "::1"
+			}
 		}
 	}
 
@@ -1428,6 +1917,21 @@ type httpListenerOpts struct {
 	// should be added.
 	addGRPCWebFilter bool
 	useRemoteAddress bool
+	// codecType is the codec used by the http connection manager. Defaults to AUTO, which
+	// detects the protocol; set it only when the protocol of the listener is known.
+	codecType http_conn.HttpConnectionManager_CodecType
+	// disableAccessLog skips the access logs configured in mesh config. Outbound listeners
+	// are shared by all services on a port, so only inbound listeners set it.
+	disableAccessLog bool
+	// accessLogFormat overrides the mesh access log format. Only gateway listeners set it.
+	accessLogFormat string
+	// idleTimeout is the idle timeout set by the Sidecar resource of the proxy, zero if unset.
+	idleTimeout time.Duration
+	// disableWebsocketUpgrade skips the websocket upgrade config, so Upgrade requests are rejected.
+	disableWebsocketUpgrade bool
+	// beforeRouterFilters are inserted after the Fault filter, just before the Router filter. Plugins add
+	// theirs through plugin.FilterChain.HTTPBeforeRouter.
+	beforeRouterFilters []*http_conn.HttpFilter
 }
 
 // filterChainOpts describes a filter chain: a set of filters with the same TLS context
@@ -1446,6 +1950,7 @@ type filterChainOpts struct {
 type buildListenerOpts struct {
 	// nolint: maligned
 	env             *model.Environment
+	push            *model.PushContext
 	proxy           *model.Proxy
 	proxyInstances  []*model.ServiceInstance
 	proxyLabels     labels.Collection
@@ -1454,8 +1959,153 @@ type buildListenerOpts struct {
 	filterChainOpts []*filterChainOpts
 	bindToPort      bool
 	skipUserFilters bool
+	// skipTLSInspector omits the TLS inspector even if the filter chains match on SNI or ALPN, to save
+	// its per connection latency when the matches are known to be unnecessary. The SNI and ALPN matches
+	// then never match. Also set by the NodeMetadataDisableTLSInspector proxy metadata.
+	skipTLSInspector bool
+	// proxyProtocol adds the PROXY protocol listener filter, to recover the client addresses of the
+	// connections forwarded by a load balancer. Only set on listeners accepting external connections.
+	proxyProtocol bool
 }
 
+// buildAccessLogFilter returns the filter of the HTTP file access log, which only logs the requests with a
+// response code of at least the minimum set in the proxy metadata, or nil to log all requests.
+func buildAccessLogFilter(node *model.Proxy) *accesslog.AccessLogFilter {
+	code := node.GetListenerMetadata().AccessLogMinResponseCode
+	if code == 0 {
+		return nil
+	}
+	return &accesslog.AccessLogFilter{
+		FilterSpecifier: &accesslog.AccessLogFilter_StatusCodeFilter{
+			StatusCodeFilter: &accesslog.StatusCodeFilter{
+				Comparison: &accesslog.ComparisonFilter{
+					Op: accesslog.ComparisonFilter_GE,
+					Value: &core.RuntimeUInt32{
+						DefaultValue: code,
+						RuntimeKey:   accessLogMinResponseCodeRuntimeKey,
+					},
+				},
+			},
+		},
+	}
+}
+
+// buildAccessLogGrpcService returns the gRPC service access logs are sent to. By default this is the
+// in-cluster ALS reached through the bootstrap cluster; a remote ALS is dialed directly, over TLS
+// when a root certificate is configured.
+func buildAccessLogGrpcService() *core.GrpcService {
+	address := features.AccessLogServiceAddress.Get()
+	if address == "" {
+		return &core.GrpcService{
+			TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+				EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
+					ClusterName: EnvoyAccessLogCluster,
+				},
+			},
+		}
+	}
+
+	return &core.GrpcService{
+		TargetSpecifier: &core.GrpcService_GoogleGrpc_{
+			GoogleGrpc: &core.GrpcService_GoogleGrpc{
+				TargetUri:  address,
+				StatPrefix: httpEnvoyAccessLogName,
+				ChannelCredentials: authn_model.ConstructgRPCSslCredentials(features.AccessLogServiceRootCert.Get(),
+					features.AccessLogServiceCertChain.Get(), features.AccessLogServicePrivateKey.Get()),
+			},
+		},
+	}
+}
+
+// solTCP is the SOL_TCP (IPPROTO_TCP) socket option level.
+const solTCP = 6
+
+// buildInboundSocketOptions returns the TCP socket options the proxy metadata enables on inbound
+// listeners. Envoy sets them on the listening socket, and the accepted connections inherit them.
+func buildInboundSocketOptions(node *model.Proxy) []*core.SocketOption {
+	var out []*core.SocketOption
+	for _, name := range node.GetListenerMetadata().InboundSocketOptions {
+		out = append(out, &core.SocketOption{
+			Description: name,
+			Level:       solTCP,
+			Name:        model.TCPSocketOptions[name],
+			Value:       &core.SocketOption_IntValue{IntValue: 1},
+			State:       core.STATE_PREBIND,
+		})
+	}
+	return out
+}
+
+var (
+	// defaultMaxRequestHeadersKb and defaultHTTP2MaxConcurrentStreams are the mesh wide limits of the
+	// HTTP listeners set by features.MaxRequestHeadersKb and features.HTTP2MaxConcurrentStreams, zero if
+	// unset or invalid.
+	defaultMaxRequestHeadersKb       = getDefaultMaxRequestHeadersKb()
+	defaultHTTP2MaxConcurrentStreams = getDefaultHTTP2MaxConcurrentStreams()
+)
+
+func getDefaultMaxRequestHeadersKb() uint32 {
+	kb := features.MaxRequestHeadersKb
+	if kb == 0 {
+		return 0
+	}
+	if !model.IsValidMaxRequestHeadersKb(kb) {
+		log.Warnf("PILOT_MAX_REQUEST_HEADERS_KB out of range: %d", kb)
+		return 0
+	}
+	return uint32(kb)
+}
+
+func getDefaultHTTP2MaxConcurrentStreams() uint32 {
+	streams := features.HTTP2MaxConcurrentStreams
+	if streams == 0 {
+		return 0
+	}
+	if streams < 0 || streams > math.MaxInt32 {
+		log.Warnf("PILOT_HTTP2_MAX_CONCURRENT_STREAMS out of range: %d", streams)
+		return 0
+	}
+	return uint32(streams)
+}
+
+// maxRequestHeadersKb returns the maximum request headers size of the HTTP listeners of the proxy,
+// zero for the Envoy default.
+func maxRequestHeadersKb(node *model.Proxy) uint32 {
+	if kb := node.GetListenerMetadata().MaxRequestHeadersKb; kb > 0 {
+		return kb
+	}
+	return defaultMaxRequestHeadersKb
+}
+
+// http2MaxConcurrentStreams returns the maximum number of concurrent streams of the HTTP/2 listeners
+// of the proxy, zero for the Envoy default.
+func http2MaxConcurrentStreams(node *model.Proxy) uint32 {
+	if streams := node.GetListenerMetadata().HTTP2MaxConcurrentStreams; streams > 0 {
+		return streams
+	}
+	return defaultHTTP2MaxConcurrentStreams
+}
+
+// sidecarIdleTimeout returns the idle timeout set by the Sidecar resource of the proxy, if any.
+func sidecarIdleTimeout(node *model.Proxy) time.Duration {
+	if node.SidecarScope == nil {
+		return 0
+	}
+	return node.SidecarScope.IdleTimeout
+}
+
+// sidecarAccessLog returns the access log settings of the Sidecar resource of the proxy, if any.
+func sidecarAccessLog(node *model.Proxy) (disabled bool, format string) {
+	if node.SidecarScope == nil {
+		return false, ""
+	}
+	return node.SidecarScope.AccessLogDisabled, node.SidecarScope.AccessLogFormat
+}
+
+// buildHTTPConnectionManager builds the HTTP connection manager of a listener. The idle timeout is
+// taken from, in order of precedence: the Sidecar resource of the proxy (httpOpts.idleTimeout), the
+// IDLE_TIMEOUT proxy metadata, and otherwise no idle timeout is set. The access log format is taken
+// from the gateway (httpOpts.accessLogFormat), the Sidecar resource of the proxy, and the mesh config.
 func buildHTTPConnectionManager(node *model.Proxy, env *model.Environment, httpOpts *httpListenerOpts,
 	httpFilters []*http_conn.HttpFilter) *http_conn.HttpConnectionManager {
 
@@ -1469,19 +2119,25 @@ func buildHTTPConnectionManager(node *model.Proxy, env *model.Environment, httpO
 	filters = append(filters,
 		&http_conn.HttpFilter{Name: xdsutil.CORS},
 		&http_conn.HttpFilter{Name: xdsutil.Fault},
-		&http_conn.HttpFilter{Name: xdsutil.Router},
 	)
+	filters = append(filters, httpOpts.beforeRouterFilters...)
+	filters = append(filters, &http_conn.HttpFilter{Name: xdsutil.Router})
 
 	if httpOpts.connectionManager == nil {
 		httpOpts.connectionManager = &http_conn.HttpConnectionManager{}
 	}
 
 	connectionManager := httpOpts.connectionManager
-	connectionManager.CodecType = http_conn.AUTO
+	connectionManager.CodecType = httpOpts.codecType
 	connectionManager.AccessLog = []*accesslog.AccessLog{}
 	connectionManager.HttpFilters = filters
 	connectionManager.StatPrefix = httpOpts.statPrefix
-	connectionManager.NormalizePath = proto.BoolTrue
+	if lm := node.GetListenerMetadata(); lm.DisablePathNormalization {
+		connectionManager.NormalizePath = proto.BoolFalse
+	} else {
+		connectionManager.NormalizePath = proto.BoolTrue
+		connectionManager.MergeSlashes = lm.MergeSlashes
+	}
 	if httpOpts.useRemoteAddress {
 		connectionManager.UseRemoteAddress = proto.BoolTrue
 	} else {
@@ -1489,16 +2145,32 @@ func buildHTTPConnectionManager(node *model.Proxy, env *model.Environment, httpO
 	}
 
 	// Allow websocket upgrades
-	websocketUpgrade := &http_conn.HttpConnectionManager_UpgradeConfig{UpgradeType: "websocket"}
-	connectionManager.UpgradeConfigs = []*http_conn.HttpConnectionManager_UpgradeConfig{websocketUpgrade}
+	if !httpOpts.disableWebsocketUpgrade {
+		websocketUpgrade := &http_conn.HttpConnectionManager_UpgradeConfig{UpgradeType: "websocket"}
+		connectionManager.UpgradeConfigs = []*http_conn.HttpConnectionManager_UpgradeConfig{websocketUpgrade}
+	}
 
-	idleTimeout, err := time.ParseDuration(node.Metadata[model.NodeMetadataIdleTimeout])
-	if idleTimeout > 0 && err == nil {
+	idleTimeout := httpOpts.idleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = node.GetListenerMetadata().IdleTimeout
+	}
+	if idleTimeout > 0 {
 		connectionManager.IdleTimeout = &idleTimeout
 	}
 
-	notimeout := 0 * time.Second
-	connectionManager.StreamIdleTimeout = &notimeout
+	// Stream idle timeouts are disabled unless the proxy sets one.
+	streamIdleTimeout := node.GetListenerMetadata().StreamIdleTimeout
+	connectionManager.StreamIdleTimeout = &streamIdleTimeout
+
+	if kb := maxRequestHeadersKb(node); kb > 0 {
+		connectionManager.MaxRequestHeadersKb = &google_protobuf.UInt32Value{Value: kb}
+	}
+	// Listener specific limits, like the inbound one, take precedence.
+	if opts := connectionManager.Http2ProtocolOptions; opts != nil && opts.MaxConcurrentStreams == nil {
+		if streams := http2MaxConcurrentStreams(node); streams > 0 {
+			opts.MaxConcurrentStreams = &google_protobuf.UInt32Value{Value: streams}
+		}
+	}
 
 	if httpOpts.rds != "" {
 		rds := &http_conn.HttpConnectionManager_Rds{
@@ -1517,55 +2189,41 @@ func buildHTTPConnectionManager(node *model.Proxy, env *model.Environment, httpO
 		connectionManager.RouteSpecifier = &http_conn.HttpConnectionManager_RouteConfig{RouteConfig: httpOpts.routeConfig}
 	}
 
-	if env.Mesh.AccessLogFile != "" {
-		fl := &accesslogconfig.FileAccessLog{
-			Path: env.Mesh.AccessLogFile,
-		}
-
-		acc := &accesslog.AccessLog{
-			Name: xdsutil.FileAccessLog,
-		}
-
-		buildAccessLog(fl, env)
-
-		if util.IsXDSMarshalingToAnyEnabled(node) {
-			acc.ConfigType = &accesslog.AccessLog_TypedConfig{TypedConfig: util.MessageToAny(fl)}
-		} else {
-			acc.ConfigType = &accesslog.AccessLog_Config{Config: util.MessageToStruct(fl)}
-		}
+	sidecarLogDisabled, accessLogFormat := sidecarAccessLog(node)
+	disableAccessLog := httpOpts.disableAccessLog || sidecarLogDisabled
+	if httpOpts.accessLogFormat != "" {
+		accessLogFormat = httpOpts.accessLogFormat
+	}
 
+	if env.Mesh.AccessLogFile != "" && !disableAccessLog {
+		acc := buildFileAccessLog(node, env, getAccessLogEncoding(env, node.GetListenerMetadata().HTTPAccessLogEncoding),
+			accessLogFormat)
+		acc.Filter = buildAccessLogFilter(node)
 		connectionManager.AccessLog = append(connectionManager.AccessLog, acc)
 	}
 
-	if env.Mesh.EnableEnvoyAccessLogService {
+	if env.Mesh.EnableEnvoyAccessLogService && !disableAccessLog {
 		fl := &accesslogconfig.HttpGrpcAccessLogConfig{
 			CommonConfig: &accesslogconfig.CommonGrpcAccessLogConfig{
-				LogName: httpEnvoyAccessLogName,
-				GrpcService: &core.GrpcService{
-					TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
-						EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
-							ClusterName: EnvoyAccessLogCluster,
-						},
-					},
-				},
+				LogName:     httpEnvoyAccessLogName,
+				GrpcService: buildAccessLogGrpcService(),
 			},
 		}
-
-		acc := &accesslog.AccessLog{
-			Name: xdsutil.HTTPGRPCAccessLog,
-		}
-
-		if util.IsXDSMarshalingToAnyEnabled(node) {
-			acc.ConfigType = &accesslog.AccessLog_TypedConfig{TypedConfig: util.MessageToAny(fl)}
-		} else {
-			acc.ConfigType = &accesslog.AccessLog_Config{Config: util.MessageToStruct(fl)}
-		}
-
-		connectionManager.AccessLog = append(connectionManager.AccessLog, acc)
+		connectionManager.AccessLog = append(connectionManager.AccessLog, buildAccessLogConfig(node, xdsutil.HTTPGRPCAccessLog, fl))
 	}
 
 	if env.Mesh.EnableTracing {
 		tc := authn_model.GetTraceConfig()
+		lm := node.GetListenerMetadata()
+		if lm.TraceClientSampling != nil {
+			tc.ClientSampling = *lm.TraceClientSampling
+		}
+		if lm.TraceRandomSampling != nil {
+			tc.RandomSampling = *lm.TraceRandomSampling
+		}
+		if lm.TraceOverallSampling != nil {
+			tc.OverallSampling = *lm.TraceOverallSampling
+		}
 		connectionManager.Tracing = &http_conn.HttpConnectionManager_Tracing{
 			OperationName: httpOpts.direction,
 			ClientSampling: &envoy_type.Percent{
@@ -1578,6 +2236,8 @@ func buildHTTPConnectionManager(node *model.Proxy, env *model.Environment, httpO
 				Value: tc.OverallSampling,
 			},
 		}
+		// The request ID is generated by Envoy's built-in UUID generator. Custom request ID formats
+		// require the request_id_extension, which is not available in the vendored Envoy API.
 		connectionManager.GenerateRequestId = proto.BoolTrue
 	}
 
@@ -1586,15 +2246,173 @@ func buildHTTPConnectionManager(node *model.Proxy, env *model.Environment, httpO
 
 // buildListener builds and initializes a Listener proto based on the provided opts. It does not set any filters.
 func buildListener(opts buildListenerOpts) *xdsapi.Listener {
-	filterChains := make([]*listener.FilterChain, 0, len(opts.filterChainOpts))
+	filterChains, listenerFilters := buildListenerFilterChains(opts.filterChainOpts)
+	listenerName := buildListenerName(opts.bind, opts.port)
+	if opts.skipTLSInspector || (opts.proxy != nil && opts.proxy.GetListenerMetadata().DisableTLSInspector) {
+		listenerFilters = removeTLSInspector(listenerName, listenerFilters)
+	}
+	if opts.proxyProtocol {
+		// The client addresses are recovered before any other listener filter runs, the PROXY protocol
+		// header precedes the TLS handshake.
+		listenerFilters = append([]*listener.ListenerFilter{{Name: xdsutil.ProxyProtocol}}, listenerFilters...)
+	}
+	if opts.bindToPort && needsOriginalDstListenerFilter(opts.proxy) {
+		// The original destination is restored before any other listener filter inspects the connection,
+		// as on the virtual inbound listener.
+		listenerFilters = append([]*listener.ListenerFilter{{Name: xdsutil.OriginalDestination}}, listenerFilters...)
+	}
+	if overlaps := serverNameOverlaps(filterChains); len(overlaps) > 0 {
+		msgs := make([]string, 0, len(overlaps))
+		for _, o := range overlaps {
+			msgs = append(msgs, o[0]+" and "+o[1])
+		}
+		msg := fmt.Sprintf("Filter chains of listener %s have overlapping server names: %s", listenerName, strings.Join(msgs, ", "))
+		if opts.proxy != nil {
+			log.Warnf("%s, proxy %s", msg, opts.proxy.ID)
+			if opts.push != nil {
+				opts.push.Add(model.ProxyStatusSNIOverlap, opts.proxy.ID+"/"+listenerName, opts.proxy, msg)
+			}
+		} else {
+			log.Warnf("%s", msg)
+		}
+	}
+
+	var deprecatedV1 *xdsapi.Listener_DeprecatedV1
+	if !opts.bindToPort {
+		deprecatedV1 = &xdsapi.Listener_DeprecatedV1{
+			BindToPort: proto.BoolFalse,
+		}
+	}
+	return &xdsapi.Listener{
+		Name:            listenerName,
+		Address:         util.BuildAddress(opts.bind, uint32(opts.port)),
+		ListenerFilters: listenerFilters,
+		FilterChains:    filterChains,
+		DeprecatedV1:    deprecatedV1,
+	}
+}
+
+// buildListenerName returns the name of the listener for the bind address and port. Unix domain socket
+// binds are escaped, as their paths can contain characters Envoy does not accept in listener names.
+func buildListenerName(bind string, port int) string {
+	if !strings.HasPrefix(bind, model.UnixAddressPrefix) {
+		return fmt.Sprintf("%s_%d", bind, port)
+	}
+	return fmt.Sprintf("unix_%s_%d", escapeListenerName(strings.TrimPrefix(bind, model.UnixAddressPrefix)), port)
+}
+
+// escapeListenerName replaces every byte other than ASCII letters, digits, '.' and '-' with '_' followed
+// by its two digit hex code. The escaping is injective, so distinct paths never share a listener name.
+func escapeListenerName(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '.', c == '-':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "_%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// serverNameOverlaps returns the pairs of overlapping server names of the filter chains that otherwise
+// match the same connections, such as foo.example.com and *.example.com. Connections for these names
+// are only routed to one of the chains.
+func serverNameOverlaps(chains []*listener.FilterChain) [][2]string {
+	var overlaps [][2]string
+	for i, a := range chains {
+		if len(a.GetFilterChainMatch().GetServerNames()) == 0 {
+			continue
+		}
+		for _, b := range chains[i+1:] {
+			if len(b.GetFilterChainMatch().GetServerNames()) == 0 || !sameFilterChainMatchExceptServerNames(a, b) {
+				continue
+			}
+			for _, an := range a.FilterChainMatch.ServerNames {
+				for _, bn := range b.FilterChainMatch.ServerNames {
+					if host.Name(an).Matches(host.Name(bn)) {
+						overlaps = append(overlaps, [2]string{an, bn})
+					}
+				}
+			}
+		}
+	}
+	return overlaps
+}
+
+// sameFilterChainMatchExceptServerNames returns true if the filter chain matches are identical
+// other than the server names.
+func sameFilterChainMatchExceptServerNames(a, b *listener.FilterChain) bool {
+	am, bm := *a.FilterChainMatch, *b.FilterChainMatch
+	am.ServerNames, bm.ServerNames = nil, nil
+	return gogoproto.Equal(&am, &bm)
+}
+
+// needsOriginalDstListenerFilter returns whether the listeners of the proxy need the original destination
+// listener filter: sidecars in NONE interception mode deployed behind a transparent proxy, as set by
+// NodeMetadataTransparentProxy. Sidecars capturing the traffic with iptables use the virtual listeners.
+func needsOriginalDstListenerFilter(node *model.Proxy) bool {
+	return node != nil && node.Type == model.SidecarProxy && node.GetInterceptionMode() == model.InterceptionNone &&
+		node.GetListenerMetadata().TransparentProxy
+}
+
+// removeTLSInspector removes the TLS inspector from the listener filters, warning that the SNI and ALPN
+// filter chain matches of the listener will not work.
+func removeTLSInspector(listenerName string, listenerFilters []*listener.ListenerFilter) []*listener.ListenerFilter {
+	out := listenerFilters[:0]
+	for _, f := range listenerFilters {
+		if f.Name == xdsutil.TlsInspector {
+			log.Warnf("buildListener: TLS inspector disabled on listener %s, its SNI and ALPN filter chain matches will not work",
+				listenerName)
+			continue
+		}
+		out = append(out, f)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// isSimpleFilterChain returns true if there is a single filter chain that needs neither a filter chain
+// match nor any listener filters, in which case the generic filter chain construction can be skipped.
+func isSimpleFilterChain(chains []*filterChainOpts) bool {
+	if len(chains) != 1 {
+		return false
+	}
+	chain := chains[0]
+	return chain.match == nil && len(chain.sniHosts) == 0 && len(chain.destinationCIDRs) == 0 &&
+		len(chain.listenerFilters) == 0 && !needsALPN(chain)
+}
+
+// needsALPN returns true if the filter chain's TLS context negotiates ALPN, which requires the TLS inspector.
+func needsALPN(chain *filterChainOpts) bool {
+	return chain.tlsContext != nil && chain.tlsContext.CommonTlsContext != nil &&
+		len(chain.tlsContext.CommonTlsContext.AlpnProtocols) > 0
+}
+
+// buildListenerFilterChains builds the filter chains and the deduplicated listener filters for the given filter chain opts.
+func buildListenerFilterChains(chains []*filterChainOpts) ([]*listener.FilterChain, []*listener.ListenerFilter) {
+	if isSimpleFilterChain(chains) {
+		// Fast path for the common case of a single filter chain that needs no match and no listener filters.
+		return []*listener.FilterChain{{TlsContext: chains[0].tlsContext}}, nil
+	}
+	return buildMatchingFilterChains(chains)
+}
+
+// buildMatchingFilterChains builds the filter chains along with their filter chain matches, adding
+// the TLS inspector when any chain matches on SNI or negotiates ALPN.
+func buildMatchingFilterChains(chains []*filterChainOpts) ([]*listener.FilterChain, []*listener.ListenerFilter) {
+	filterChains := make([]*listener.FilterChain, 0, len(chains))
 	listenerFiltersMap := make(map[string]bool)
 	var listenerFilters []*listener.ListenerFilter
 
 	// add a TLS inspector if we need to detect ServerName or ALPN
 	needTLSInspector := false
-	for _, chain := range opts.filterChainOpts {
-		needsALPN := chain.tlsContext != nil && chain.tlsContext.CommonTlsContext != nil && len(chain.tlsContext.CommonTlsContext.AlpnProtocols) > 0
-		if len(chain.sniHosts) > 0 || needsALPN {
+	for _, chain := range chains {
+		if len(chain.sniHosts) > 0 || needsALPN(chain) {
 			needTLSInspector = true
 			break
 		}
@@ -1604,7 +2422,7 @@ func buildListener(opts buildListenerOpts) *xdsapi.Listener {
 		listenerFilters = append(listenerFilters, &listener.ListenerFilter{Name: xdsutil.TlsInspector})
 	}
 
-	for _, chain := range opts.filterChainOpts {
+	for _, chain := range chains {
 		for _, filter := range chain.listenerFilters {
 			if _, exist := listenerFiltersMap[filter.Name]; !exist {
 				listenerFiltersMap[filter.Name] = true
@@ -1653,22 +2471,7 @@ func buildListener(opts buildListenerOpts) *xdsapi.Listener {
 			TlsContext:       chain.tlsContext,
 		})
 	}
-
-	var deprecatedV1 *xdsapi.Listener_DeprecatedV1
-	if !opts.bindToPort {
-		deprecatedV1 = &xdsapi.Listener_DeprecatedV1{
-			BindToPort: proto.BoolFalse,
-		}
-	}
-	return &xdsapi.Listener{
-		// TODO: need to sanitize the opts.bind if its a UDS socket, as it could have colons, that envoy
-		// doesn't like
-		Name:            fmt.Sprintf("%s_%d", opts.bind, opts.port),
-		Address:         util.BuildAddress(opts.bind, uint32(opts.port)),
-		ListenerFilters: listenerFilters,
-		FilterChains:    filterChains,
-		DeprecatedV1:    deprecatedV1,
-	}
+	return filterChains, listenerFilters
 }
 
 // appendListenerFallthroughRoute adds a filter that will match all traffic and direct to the
@@ -1698,27 +2501,31 @@ func appendListenerFallthroughRoute(l *xdsapi.Listener, opts *buildListenerOpts,
 			}
 		}
 
-		tcpFilter := &listener.Filter{
-			Name: xdsutil.TCPProxy,
-		}
-		tcpProxy := &tcp_proxy.TcpProxy{
-			StatPrefix:       util.PassthroughCluster,
-			ClusterSpecifier: &tcp_proxy.TcpProxy_Cluster{Cluster: util.PassthroughCluster},
-		}
-		if util.IsXDSMarshalingToAnyEnabled(node) {
-			tcpFilter.ConfigType = &listener.Filter_TypedConfig{TypedConfig: util.MessageToAny(tcpProxy)}
-		} else {
-			tcpFilter.ConfigType = &listener.Filter_Config{Config: util.MessageToStruct(tcpProxy)}
-		}
-
 		opts.filterChainOpts = append(opts.filterChainOpts, &filterChainOpts{
-			networkFilters: []*listener.Filter{tcpFilter},
+			networkFilters: []*listener.Filter{buildFallthroughTCPFilter(node, util.PassthroughCluster)},
 		})
 		l.FilterChains = append(l.FilterChains, &listener.FilterChain{FilterChainMatch: wildcardMatch})
 
 	}
 }
 
+// buildFallthroughTCPFilter builds a TCP proxy filter forwarding all the traffic to cluster.
+func buildFallthroughTCPFilter(node *model.Proxy, cluster string) *listener.Filter {
+	tcpFilter := &listener.Filter{
+		Name: xdsutil.TCPProxy,
+	}
+	tcpProxy := &tcp_proxy.TcpProxy{
+		StatPrefix:       cluster,
+		ClusterSpecifier: &tcp_proxy.TcpProxy_Cluster{Cluster: cluster},
+	}
+	if util.IsXDSMarshalingToAnyEnabled(node) {
+		tcpFilter.ConfigType = &listener.Filter_TypedConfig{TypedConfig: util.MessageToAny(tcpProxy)}
+	} else {
+		tcpFilter.ConfigType = &listener.Filter_Config{Config: util.MessageToStruct(tcpProxy)}
+	}
+	return tcpFilter
+}
+
 // buildCompleteFilterChain adds the provided TCP and HTTP filters to the provided Listener and serializes them.
 //
 // TODO: should we change this from []plugins.FilterChains to [][]listener.Filter, [][]*http_conn.HttpFilter?
@@ -1760,7 +2567,15 @@ func buildCompleteFilterChain(pluginParams *plugin.InputParams, mutable *plugin.
 			mutable.Listener.FilterChains[i].Filters = append(mutable.Listener.FilterChains[i].Filters, chain.TCP...)
 
 			opt.httpOpts.statPrefix = mutable.Listener.Name
-			httpConnectionManagers[i] = buildHTTPConnectionManager(pluginParams.Node, opts.env, opt.httpOpts, chain.HTTP)
+			httpOpts := opt.httpOpts
+			if len(chain.HTTPBeforeRouter) > 0 {
+				// The options may be shared by several filter chains, the plugin filters only apply to this one.
+				withPluginFilters := *opt.httpOpts
+				withPluginFilters.beforeRouterFilters = append(
+					append([]*http_conn.HttpFilter{}, opt.httpOpts.beforeRouterFilters...), chain.HTTPBeforeRouter...)
+				httpOpts = &withPluginFilters
+			}
+			httpConnectionManagers[i] = buildHTTPConnectionManager(pluginParams.Node, opts.env, httpOpts, chain.HTTP)
 			filter := &listener.Filter{
 				Name: xdsutil.HTTPConnectionManager,
 			}
@@ -1790,7 +2605,28 @@ func buildCompleteFilterChain(pluginParams *plugin.InputParams, mutable *plugin.
 // depending on value of proxy's IPAddresses. This function checks each element
 // and if there is at least one ipv4 address other than 127.0.0.1, it will use ipv4 address,
 // if all addresses are ipv6  addresses then ipv6 address will be used to get wildcard and local host address.
+// If the proxy prefers IPv6, ipv6 addresses are used as soon as the proxy has one.
+// If none of the proxy's IPAddresses is valid, the error is logged and ipv4 addresses are used.
 func getActualWildcardAndLocalHost(node *model.Proxy) (string, string) {
+	wildcard, localHost, err := parseActualWildcardAndLocalHost(node)
+	if err != nil {
+		log.Warnf("%v, using the IPv4 wildcard and local host", err)
+	}
+	return wildcard, localHost
+}
+
+// parseActualWildcardAndLocalHost returns the wildcard and local host of the proxy as described in
+// getActualWildcardAndLocalHost, or the ipv4 ones along with an error if the proxy has IPAddresses
+// and none of them is valid.
+func parseActualWildcardAndLocalHost(node *model.Proxy) (string, string, error) {
+	if node.GetPreferredIPFamily() == model.IPFamilyIPv6 {
+		for _, ipAddr := range node.IPAddresses {
+			if addr := net.ParseIP(ipAddr); addr != nil && addr.To4() == nil {
+				return WildcardIPv6Address, LocalhostIPv6Address, nil
+			}
+		}
+	}
+	valid := false
 	for i := 0; i < len(node.IPAddresses); i++ {
 		addr := net.ParseIP(node.IPAddresses[i])
 		if addr == nil {
@@ -1798,18 +2634,71 @@ func getActualWildcardAndLocalHost(node *model.Proxy) (string, string) {
 			// skip it to prevent a panic.
 			continue
 		}
+		valid = true
 		if addr.To4() != nil {
-			return WildcardAddress, LocalhostAddress
+			return WildcardAddress, LocalhostAddress, nil
 		}
 	}
-	return WildcardIPv6Address, LocalhostIPv6Address
+	if !valid && len(node.IPAddresses) > 0 {
+		return WildcardAddress, LocalhostAddress, fmt.Errorf("no valid IP address in %v for proxy %s", node.IPAddresses, node.ID)
+	}
+	return WildcardIPv6Address, LocalhostIPv6Address, nil
+}
+
+// getLoopbackBindAddress returns the address egress listeners bound to a port listen on, which
+// is the loopback address from the proxy metadata if valid, or the given default otherwise.
+func getLoopbackBindAddress(node *model.Proxy, defaultAddress string) string {
+	if bind := node.GetListenerMetadata().LoopbackBindAddress; bind != "" {
+		return bind
+	}
+	return defaultAddress
+}
+
+// setInboundClientCertDetails sets how the inbound connection manager handles the x-forwarded-client-cert
+// header. By default the client cert subject, URI and DNS SANs are appended and forwarded to the backend.
+func setInboundClientCertDetails(node *model.Proxy, connectionManager *http_conn.HttpConnectionManager) {
+	lm := node.GetListenerMetadata()
+	connectionManager.ForwardClientCertDetails = http_conn.APPEND_FORWARD
+	if lm.InboundForwardClientCert != nil {
+		connectionManager.ForwardClientCertDetails = *lm.InboundForwardClientCert
+	}
+
+	// The client cert details are only used when the proxy sets the header.
+	switch connectionManager.ForwardClientCertDetails {
+	case http_conn.APPEND_FORWARD, http_conn.SANITIZE_SET:
+	default:
+		return
+	}
+	if lm.InboundClientCertDetails != nil {
+		connectionManager.SetCurrentClientCertDetails = lm.InboundClientCertDetails
+		return
+	}
+	connectionManager.SetCurrentClientCertDetails = &http_conn.HttpConnectionManager_SetCurrentClientCertDetails{
+		Subject: &google_protobuf.BoolValue{Value: true},
+		Uri:     true,
+		Dns:     true,
+	}
 }
 
 // getSidecarInboundBindIP returns the IP that the proxy can bind to along with the sidecar specified port.
 // It looks for an unicast address, if none found, then the default wildcard address is used.
 // This will make the inbound listener bind to instance_ip:port instead of 0.0.0.0:port where applicable.
+// If the proxy prefers IPv6, an ipv6 unicast address is picked first.
+// Proxies with NodeMetadataInboundBindLoopback set bind to the local host address instead, which is
+// also the address the inbound clusters forward to.
 func getSidecarInboundBindIP(node *model.Proxy) string {
-	defaultInboundIP, _ := getActualWildcardAndLocalHost(node)
+	defaultInboundIP, localHost := getActualWildcardAndLocalHost(node)
+	if node.GetListenerMetadata().InboundBindLoopback {
+		return localHost
+	}
+	if node.GetPreferredIPFamily() == model.IPFamilyIPv6 {
+		for _, ipAddr := range node.IPAddresses {
+			ip := net.ParseIP(ipAddr)
+			if ip != nil && ip.To4() == nil && ip.IsGlobalUnicast() {
+				return ip.String()
+			}
+		}
+	}
 	for _, ipAddr := range node.IPAddresses {
 		ip := net.ParseIP(ipAddr)
 		// Return the IP if its a global unicast address.
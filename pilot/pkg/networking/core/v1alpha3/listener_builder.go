@@ -29,6 +29,7 @@ import (
 	"istio.io/istio/pilot/pkg/networking/util"
 	"istio.io/istio/pkg/proto"
 	"istio.io/pkg/log"
+	"istio.io/pkg/version"
 )
 
 var (
@@ -66,6 +67,25 @@ func insertOriginalListenerName(chain *listener.FilterChain, listenerName string
 		&types.Value{Kind: &types.Value_StringValue{StringValue: listenerName}}
 }
 
+// insertPilotVersion records the version of the Pilot that generated the listener in the listener metadata.
+func insertPilotVersion(l *xdsapi.Listener) {
+	if l.Metadata == nil {
+		l.Metadata = &core.Metadata{
+			FilterMetadata: map[string]*types.Struct{},
+		}
+	}
+	if l.Metadata.FilterMetadata == nil {
+		l.Metadata.FilterMetadata = map[string]*types.Struct{}
+	}
+	if l.Metadata.FilterMetadata[PilotMetaKey] == nil {
+		l.Metadata.FilterMetadata[PilotMetaKey] = &types.Struct{
+			Fields: map[string]*types.Value{},
+		}
+	}
+	l.Metadata.FilterMetadata[PilotMetaKey].Fields["pilot_version"] =
+		&types.Value{Kind: &types.Value_StringValue{StringValue: version.Info.Version}}
+}
+
 // Setup the filter chain match so that the match should work under both
 // - bind_to_port == false listener
 // - virtual inbound listener
@@ -123,6 +143,14 @@ func (builder *ListenerBuilder) aggregateVirtualInboundListener() *ListenerBuild
 			Name: xdsutil.OriginalDestination,
 		},
 	)
+	if builder.node.GetListenerMetadata().ProxyProtocol {
+		// The client addresses are recovered before the TLS inspector runs.
+		builder.virtualInboundListener.ListenerFilters = append(builder.virtualInboundListener.ListenerFilters,
+			&listener.ListenerFilter{
+				Name: xdsutil.ProxyProtocol,
+			},
+		)
+	}
 	filterChains, needTLS := reduceInboundListenerToFilterChains(builder.inboundListeners)
 
 	builder.virtualInboundListener.FilterChains =
@@ -169,6 +197,10 @@ func (builder *ListenerBuilder) buildManagementListeners(_ *ConfigGeneratorImpl,
 	if node.SidecarScope.HasCustomIngressListeners || noneMode {
 		return builder
 	}
+	// The proxy explicitly asked to not get any management listeners.
+	if node.GetListenerMetadata().DisableManagementListeners {
+		return builder
+	}
 	// Let ServiceDiscovery decide which IP and Port are used for management if
 	// there are multiple IPs
 	mgmtListeners := make([]*xdsapi.Listener, 0)
@@ -236,15 +268,11 @@ func (builder *ListenerBuilder) buildVirtualOutboundListener(
 		for _, ip := range node.IPAddresses {
 			cidrRanges = append(cidrRanges, util.ConvertAddressToCidr(ip))
 		}
-		blackhole := &blackholeStructMarshalling
-		if util.IsXDSMarshalingToAnyEnabled(node) {
-			blackhole = &blackholeAnyMarshalling
-		}
 		filterChains = append([]*listener.FilterChain{{
 			FilterChainMatch: &listener.FilterChainMatch{
 				PrefixRanges: cidrRanges,
 			},
-			Filters: []*listener.Filter{blackhole},
+			Filters: []*listener.Filter{newBlackholeFilterForNode(env, node)},
 		}}, filterChains...)
 	}
 
@@ -265,7 +293,9 @@ func (builder *ListenerBuilder) buildVirtualOutboundListener(
 
 // TProxy uses only the virtual outbound listener on 15001 for both directions
 // but we still ship the no-op virtual inbound listener, so that the code flow is same across REDIRECT and TPROXY.
-func (builder *ListenerBuilder) buildVirtualInboundListener(env *model.Environment, node *model.Proxy) *ListenerBuilder {
+func (builder *ListenerBuilder) buildVirtualInboundListener(
+	configgen *ConfigGeneratorImpl,
+	env *model.Environment, node *model.Proxy, push *model.PushContext) *ListenerBuilder {
 	var isTransparentProxy *types.BoolValue
 	if node.GetInterceptionMode() == model.InterceptionTproxy {
 		isTransparentProxy = proto.BoolTrue
@@ -279,10 +309,12 @@ func (builder *ListenerBuilder) buildVirtualInboundListener(env *model.Environme
 		Transparent:    isTransparentProxy,
 		UseOriginalDst: proto.BoolTrue,
 		FilterChains:   newInboundPassthroughFilterChains(env, node),
+		SocketOptions:  buildInboundSocketOptions(node),
 	}
 	if builder.useInboundFilterChain {
 		builder.aggregateVirtualInboundListener()
 	}
+	configgen.onVirtualInboundListener(env, node, push, builder.virtualInboundListener)
 	return builder
 }
 
@@ -364,6 +396,22 @@ func newBlackholeFilter(enableAny bool) listener.Filter {
 	return filter
 }
 
+// newBlackholeFilterForNode returns the blackhole filter for the given node. The precomputed filters are
+// used unless blackhole access logging is enabled, in which case the filter carries the mesh access log.
+func newBlackholeFilterForNode(env *model.Environment, node *model.Proxy) *listener.Filter {
+	if !features.EnableBlackholeAccessLog.Get() || env.Mesh.AccessLogFile == "" {
+		blackhole := blackholeStructMarshalling
+		if util.IsXDSMarshalingToAnyEnabled(node) {
+			blackhole = blackholeAnyMarshalling
+		}
+		return &blackhole
+	}
+	return setAccessLogAndBuildTCPFilter(env, node, &tcp_proxy.TcpProxy{
+		StatPrefix:       util.BlackHoleCluster,
+		ClusterSpecifier: &tcp_proxy.TcpProxy_Cluster{Cluster: util.BlackHoleCluster},
+	})
+}
+
 // Create pass through filter chains matching ipv4 address and ipv6 address independently.
 func newInboundPassthroughFilterChains(env *model.Environment, node *model.Proxy) []*listener.FilterChain {
 	// ipv4 and ipv6
@@ -416,6 +464,9 @@ func newTCPProxyOutboundListenerFilter(env *model.Environment, node *model.Proxy
 		StatPrefix:       util.BlackHoleCluster,
 		ClusterSpecifier: &tcp_proxy.TcpProxy_Cluster{Cluster: util.BlackHoleCluster},
 	}
+	if features.EnableBlackholeAccessLog.Get() {
+		setAccessLog(env, node, tcpProxy)
+	}
 	if isAllowAnyOutbound(node) {
 		// We need a passthrough filter to fill in the filter stack for orig_dst listener
 		tcpProxy = &tcp_proxy.TcpProxy{
@@ -15,12 +15,21 @@
 package v1alpha3
 
 import (
+	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	http_conn "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	xdsutil "github.com/envoyproxy/go-control-plane/pkg/util"
+
 	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/core/v1alpha3/fakes"
 	"istio.io/istio/pilot/pkg/networking/plugin"
 	"istio.io/istio/pkg/config/protocol"
+	"istio.io/pkg/version"
 )
 
 type LdsEnv struct {
@@ -172,7 +181,7 @@ func TestVirtualInboundListenerBuilder(t *testing.T) {
 	builder := NewListenerBuilder(&proxy)
 	listeners := builder.buildSidecarInboundListeners(ldsEnv.configgen, &env, &proxy, env.PushContext).
 		buildVirtualOutboundListener(ldsEnv.configgen, &env, &proxy, env.PushContext).
-		buildVirtualInboundListener(&env, &proxy).
+		buildVirtualInboundListener(ldsEnv.configgen, &env, &proxy, env.PushContext).
 		getListeners()
 
 	// app port listener and virtual inbound listener
@@ -217,3 +226,199 @@ func TestVirtualInboundListenerBuilder(t *testing.T) {
 		}
 	}
 }
+
+func TestVirtualInboundListenerHTTP2MaxConcurrentStreams(t *testing.T) {
+	for _, streams := range []string{"", "500"} {
+		t.Run(streams, func(t *testing.T) {
+			services := []*model.Service{buildService("test.com", wildcardIP, protocol.GRPC, tnow)}
+			env := buildListenerEnv(services)
+			if err := env.PushContext.InitContext(&env); err != nil {
+				t.Fatalf("init push context error: %s", err.Error())
+			}
+			proxy := getDefaultProxy()
+			proxy.ServiceInstances = []*model.ServiceInstance{{Service: services[0], Endpoint: buildEndpoint(services[0])}}
+			if streams != "" {
+				proxy.Metadata[model.NodeMetadataInboundHTTP2MaxConcurrentStreams] = streams
+			}
+			setInboundCaptureAllOnThisNode(&proxy)
+			setNilSidecarOnProxy(&proxy, env.PushContext)
+
+			ldsEnv := getDefaultLdsEnv()
+			l := NewListenerBuilder(&proxy).
+				buildSidecarInboundListeners(ldsEnv.configgen, &env, &proxy, env.PushContext).
+				buildVirtualInboundListener(ldsEnv.configgen, &env, &proxy, env.PushContext).
+				virtualInboundListener
+
+			found := false
+			for _, fc := range l.FilterChains {
+				if fc.Filters[0].Name != xdsutil.HTTPConnectionManager {
+					continue
+				}
+				found = true
+				cm := &http_conn.HttpConnectionManager{}
+				if err := getFilterConfig(fc.Filters[0], cm); err != nil {
+					t.Fatal(err)
+				}
+				got := cm.GetHttp2ProtocolOptions().GetMaxConcurrentStreams()
+				if streams == "" && got != nil {
+					t.Fatalf("expected default max concurrent streams, found %v", got)
+				}
+				if streams != "" && got.GetValue() != 500 {
+					t.Fatalf("expected max concurrent streams 500, found %v", got)
+				}
+			}
+			if !found {
+				t.Fatal("expected an HTTP filter chain on the virtual inbound listener")
+			}
+		})
+	}
+}
+
+func TestVirtualInboundListenerProxyProtocol(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			services := []*model.Service{buildService("test.com", wildcardIP, protocol.HTTP, tnow)}
+			env := buildListenerEnv(services)
+			if err := env.PushContext.InitContext(&env); err != nil {
+				t.Fatalf("init push context error: %s", err.Error())
+			}
+			proxy := getDefaultProxy()
+			proxy.ServiceInstances = []*model.ServiceInstance{{Service: services[0], Endpoint: buildEndpoint(services[0])}}
+			if enabled {
+				proxy.Metadata[model.NodeMetadataProxyProtocol] = "1"
+			}
+			setInboundCaptureAllOnThisNode(&proxy)
+			setNilSidecarOnProxy(&proxy, env.PushContext)
+
+			ldsEnv := getDefaultLdsEnv()
+			l := NewListenerBuilder(&proxy).
+				buildSidecarInboundListeners(ldsEnv.configgen, &env, &proxy, env.PushContext).
+				buildVirtualInboundListener(ldsEnv.configgen, &env, &proxy, env.PushContext).
+				virtualInboundListener
+
+			var names []string
+			for _, f := range l.ListenerFilters {
+				if f.Name != xdsutil.TlsInspector {
+					names = append(names, f.Name)
+				}
+			}
+			expected := []string{xdsutil.OriginalDestination}
+			if enabled {
+				expected = append(expected, xdsutil.ProxyProtocol)
+			}
+			if !reflect.DeepEqual(names, expected) {
+				t.Fatalf("expected listener filters %v, found %v", expected, names)
+			}
+			if n := len(l.ListenerFilters); n > len(expected) && l.ListenerFilters[n-1].Name != xdsutil.TlsInspector {
+				t.Fatalf("expected the TLS inspector to run last, found %v", l.ListenerFilters)
+			}
+		})
+	}
+}
+
+func TestManagementListenerBuilder(t *testing.T) {
+	ldsEnv := getDefaultLdsEnv()
+	env := buildListenerEnv(nil)
+	env.ServiceDiscovery.(*fakes.ServiceDiscovery).ManagementPortsReturns(model.PortList{
+		{Name: "health", Port: 15020, Protocol: protocol.HTTP},
+	})
+	if err := env.PushContext.InitContext(&env); err != nil {
+		t.Fatalf("init push context error: %s", err.Error())
+	}
+
+	tests := []struct {
+		name     string
+		metadata string
+		expected int
+	}{
+		{"default", "", 1},
+		{"disabled", "1", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := getDefaultProxy()
+			if tt.metadata != "" {
+				proxy.Metadata[model.NodeMetadataDisableManagementListeners] = tt.metadata
+			}
+			setNilSidecarOnProxy(&proxy, env.PushContext)
+
+			listeners := NewListenerBuilder(&proxy).
+				buildManagementListeners(ldsEnv.configgen, &env, &proxy, env.PushContext).
+				getListeners()
+			if len(listeners) != tt.expected {
+				t.Fatalf("expected %d management listeners, found %d", tt.expected, len(listeners))
+			}
+		})
+	}
+}
+
+func TestBuildListenersInvalidIPAddresses(t *testing.T) {
+	ldsEnv := getDefaultLdsEnv()
+	env := buildListenerEnv(nil)
+	if err := env.PushContext.InitContext(&env); err != nil {
+		t.Fatalf("init push context error: %s", err.Error())
+	}
+
+	for _, ips := range [][]string{nil, {"1.1.1"}} {
+		proxy := getDefaultProxy()
+		proxy.IPAddresses = ips
+		setNilSidecarOnProxy(&proxy, env.PushContext)
+
+		if listeners := ldsEnv.configgen.BuildListeners(&env, &proxy, env.PushContext); len(listeners) != 0 {
+			t.Fatalf("expected no listeners for proxy with IP addresses %v, found %d", ips, len(listeners))
+		}
+		if _, f := env.PushContext.ProxyStatus[model.ProxyStatusInvalidIPAddresses.Name()][proxy.ID]; !f {
+			t.Fatalf("expected push status for proxy with IP addresses %v", ips)
+		}
+	}
+}
+
+// virtualInboundChainPlugin appends a filter chain to the virtual inbound listener.
+type virtualInboundChainPlugin struct {
+	fakePlugin
+}
+
+func (p *virtualInboundChainPlugin) OnVirtualInboundListener(in *plugin.InputParams, mutable *plugin.MutableObjects) error {
+	mutable.Listener.FilterChains = append(mutable.Listener.FilterChains, &listener.FilterChain{
+		FilterChainMatch: &listener.FilterChainMatch{TransportProtocol: "custom"},
+	})
+	return nil
+}
+
+func TestVirtualInboundListenerPluginHook(t *testing.T) {
+	env := buildListenerEnv(nil)
+	if err := env.PushContext.InitContext(&env); err != nil {
+		t.Fatalf("init push context error: %s", err.Error())
+	}
+	proxy := getDefaultProxy()
+	setNilSidecarOnProxy(&proxy, env.PushContext)
+
+	defaultListener := NewListenerBuilder(&proxy).
+		buildVirtualInboundListener(getDefaultLdsEnv().configgen, &env, &proxy, env.PushContext).
+		virtualInboundListener
+
+	configgen := NewConfigGenerator([]plugin.Plugin{&virtualInboundChainPlugin{}})
+	l := NewListenerBuilder(&proxy).
+		buildVirtualInboundListener(configgen, &env, &proxy, env.PushContext).
+		virtualInboundListener
+
+	if len(l.FilterChains) != len(defaultListener.FilterChains)+1 {
+		t.Fatalf("expected %d filter chains, found %d", len(defaultListener.FilterChains)+1, len(l.FilterChains))
+	}
+	if last := l.FilterChains[len(l.FilterChains)-1]; last.FilterChainMatch.GetTransportProtocol() != "custom" {
+		t.Fatalf("expected plugin filter chain to be appended last, found %v", last)
+	}
+}
+
+func TestInsertPilotVersion(t *testing.T) {
+	l := &xdsapi.Listener{Name: "test"}
+	insertPilotVersion(l)
+
+	meta := l.Metadata.GetFilterMetadata()[PilotMetaKey]
+	if meta == nil {
+		t.Fatalf("expected %s filter metadata on listener", PilotMetaKey)
+	}
+	if got := meta.Fields["pilot_version"].GetStringValue(); got != version.Info.Version {
+		t.Fatalf("expected pilot_version %q, got %q", version.Info.Version, got)
+	}
+}
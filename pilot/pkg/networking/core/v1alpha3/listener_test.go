@@ -16,25 +16,38 @@ package v1alpha3
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	accesslogconfig "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v2"
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/filter/accesslog/v2"
+	http_conn "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
 	tcp_proxy "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
 	"github.com/envoyproxy/go-control-plane/pkg/util"
 	xdsutil "github.com/envoyproxy/go-control-plane/pkg/util"
 	"github.com/gogo/protobuf/proto"
 	"github.com/gogo/protobuf/types"
+	"go.opencensus.io/stats/view"
 
+	meshconfig "istio.io/api/mesh/v1alpha1"
 	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/pkg/log"
 
 	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/core/v1alpha3/fakes"
 	"istio.io/istio/pilot/pkg/networking/plugin"
+	authn_model "istio.io/istio/pilot/pkg/security/model"
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/mesh"
@@ -171,6 +184,126 @@ func TestOutboundListenerConflict_TCPWithCurrentTCP(t *testing.T) {
 	}
 }
 
+func TestOutboundListenerConflictNamespacePriority(t *testing.T) {
+	_ = os.Setenv(features.OutboundListenerConflictPolicy.Name, "NAMESPACE_PRIORITY")
+	_ = os.Setenv(features.OutboundListenerPriorityNamespaces.Name, "priority")
+	defer func() {
+		_ = os.Unsetenv(features.OutboundListenerConflictPolicy.Name)
+		_ = os.Unsetenv(features.OutboundListenerPriorityNamespaces.Name)
+	}()
+
+	inNamespace := func(svc *model.Service, ns string) *model.Service {
+		svc.Attributes.Namespace = ns
+		return svc
+	}
+
+	t.Run("TCP over HTTP", func(t *testing.T) {
+		listeners := buildOutboundListeners(&fakePlugin{}, nil, nil,
+			buildService("test1.com", wildcardIP, protocol.HTTP, tnow),
+			inNamespace(buildService("test2.com", wildcardIP, protocol.TCP, tnow.Add(1*time.Second)), "priority"))
+		if len(listeners) != 1 {
+			t.Fatalf("expected %d listeners, found %d", 1, len(listeners))
+		}
+		if isHTTPListener(listeners[0]) {
+			t.Fatal("expected TCP listener of the priority namespace, found HTTP")
+		}
+	})
+
+	t.Run("HTTP over TCP", func(t *testing.T) {
+		listeners := buildOutboundListeners(&fakePlugin{}, nil, nil,
+			buildService("test1.com", wildcardIP, protocol.TCP, tnow),
+			inNamespace(buildService("test2.com", wildcardIP, protocol.HTTP, tnow.Add(1*time.Second)), "priority"))
+		if len(listeners) != 1 {
+			t.Fatalf("expected %d listeners, found %d", 1, len(listeners))
+		}
+		if !isHTTPListener(listeners[0]) {
+			t.Fatal("expected HTTP listener of the priority namespace, found TCP")
+		}
+	})
+
+	t.Run("TCP over TCP", func(t *testing.T) {
+		listeners := buildOutboundListeners(&fakePlugin{}, nil, nil,
+			buildService("test1.com", "1.2.3.4", protocol.TCP, tnow),
+			inNamespace(buildService("test2.com", "1.2.3.4", protocol.TCP, tnow.Add(1*time.Second)), "priority"),
+			buildService("test3.com", "1.2.3.4", protocol.TCP, tnow.Add(2*time.Second)))
+		if len(listeners) != 1 {
+			t.Fatalf("expected %d listeners, found %d", 1, len(listeners))
+		}
+		if len(listeners[0].FilterChains) != 1 {
+			t.Fatalf("expected %d filter chains, found %d", 1, len(listeners[0].FilterChains))
+		}
+		verifyOutboundTCPListenerHostname(t, listeners[0], "test2.com")
+	})
+}
+
+func TestOutboundListenersSorted(t *testing.T) {
+	listeners := buildOutboundListeners(&fakePlugin{}, nil, nil,
+		buildService("test3.com", "3.3.3.3", protocol.TCP, tnow),
+		buildService("test1.com", "1.1.1.1", protocol.TCP, tnow),
+		buildService("test2.com", "2.2.2.2", protocol.TCP, tnow))
+	if len(listeners) != 3 {
+		t.Fatalf("expected %d listeners, found %d", 3, len(listeners))
+	}
+	for i := 1; i < len(listeners); i++ {
+		if listenerLess(listeners[i], listeners[i-1]) {
+			t.Fatalf("expected listeners sorted by address, found %s before %s", listeners[i-1].Name, listeners[i].Name)
+		}
+	}
+}
+
+func TestOutboundListenersDeterministic(t *testing.T) {
+	services := []*model.Service{
+		buildService("test1.com", "1.1.1.1", protocol.TCP, tnow),
+		buildService("test2.com", "2.2.2.2", protocol.TCP, tnow),
+		buildService("test3.com", wildcardIP, protocol.HTTP, tnow),
+		buildService("test4.com", "4.4.4.4", protocol.MySQL, tnow),
+	}
+	services[2].Ports[0].Port = 10000
+	services[3].Ports[0].Port = 9000
+
+	names := func() []string {
+		var out []string
+		for _, l := range buildOutboundListeners(&fakePlugin{}, nil, nil, services...) {
+			out = append(out, l.Name)
+		}
+		return out
+	}
+	expected := names()
+	if len(expected) != len(services) {
+		t.Fatalf("expected %d listeners, found %v", len(services), expected)
+	}
+	for i := 0; i < 10; i++ {
+		if got := names(); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected listeners %v, found %v", expected, got)
+		}
+	}
+}
+
+func TestListenerLess(t *testing.T) {
+	address := func(ip string, port uint32) *core.Address {
+		return &core.Address{Address: &core.Address_SocketAddress{SocketAddress: &core.SocketAddress{
+			Address:       ip,
+			PortSpecifier: &core.SocketAddress_PortValue{PortValue: port},
+		}}}
+	}
+	listeners := []*xdsapi.Listener{
+		{Name: "b", Address: address("2.2.2.2", 80)},
+		{Name: "0.0.0.0_10000", Address: address(wildcardIP, 10000)},
+		{Name: "uds", Address: &core.Address{Address: &core.Address_Pipe{Pipe: &core.Pipe{Path: "/var/run/uds.sock"}}}},
+		{Name: "0.0.0.0_9000", Address: address(wildcardIP, 9000)},
+		{Name: "a", Address: address("2.2.2.2", 80)},
+	}
+	sort.SliceStable(listeners, func(i, j int) bool { return listenerLess(listeners[i], listeners[j]) })
+	var got []string
+	for _, l := range listeners {
+		got = append(got, l.Name)
+	}
+	expected := []string{"uds", "0.0.0.0_9000", "0.0.0.0_10000", "a", "b"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected listeners %v, found %v", expected, got)
+	}
+}
+
 func TestOutboundListenerTCPWithVS(t *testing.T) {
 	_ = os.Setenv("PILOT_ENABLE_FALLTHROUGH_ROUTE", "false")
 
@@ -243,6 +376,237 @@ func TestInboundListenerConfig_HTTP(t *testing.T) {
 	}
 }
 
+func TestInboundListenerCodecType(t *testing.T) {
+	defer func(enabled bool) { features.InboundGRPCHTTP2Codec = enabled }(features.InboundGRPCHTTP2Codec)
+
+	cases := []struct {
+		protocol protocol.Instance
+		http2    bool
+		expected string
+	}{
+		{protocol.HTTP, true, ""},
+		{protocol.HTTP2, true, ""},
+		{protocol.GRPCWeb, true, ""},
+		{protocol.GRPC, false, ""},
+		{protocol.GRPC, true, "HTTP2"},
+	}
+	for _, tt := range cases {
+		t.Run(fmt.Sprintf("%s/%v", tt.protocol, tt.http2), func(t *testing.T) {
+			features.InboundGRPCHTTP2Codec = tt.http2
+			listeners := buildInboundListeners(&fakePlugin{}, &proxy, nil,
+				buildService("test.com", wildcardIP, tt.protocol, tnow))
+			if len(listeners) != 1 {
+				t.Fatalf("expected %d listeners, found %d", 1, len(listeners))
+			}
+			cfg, _ := xdsutil.MessageToStruct(listeners[0].FilterChains[0].Filters[0].GetTypedConfig())
+			if codec := cfg.Fields["codec_type"].GetStringValue(); codec != tt.expected {
+				t.Fatalf("expected codec_type %q, found %q", tt.expected, codec)
+			}
+		})
+	}
+}
+
+func TestInboundListenerConflictNewestWins(t *testing.T) {
+	older := buildService("older.com", wildcardIP, protocol.HTTP, tnow.Add(-time.Hour))
+	newer := buildService("newer.com", wildcardIP, protocol.TCP, tnow)
+
+	cases := []struct {
+		name       string
+		policy     string
+		services   []*model.Service
+		expectHTTP bool
+	}{
+		{"first wins", "", []*model.Service{older, newer}, true},
+		{"newest wins replaces older", "NEWEST_WINS", []*model.Service{older, newer}, false},
+		{"newest wins keeps newer", "NEWEST_WINS", []*model.Service{newer, older}, false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = os.Setenv(features.InboundListenerConflictPolicy.Name, tt.policy)
+			defer func() { _ = os.Unsetenv(features.InboundListenerConflictPolicy.Name) }()
+
+			listeners := buildInboundListeners(&fakePlugin{}, &proxy, nil, tt.services...)
+			if len(listeners) != 1 {
+				t.Fatalf("expected %d listeners, found %d", 1, len(listeners))
+			}
+			if isHTTPListener(listeners[0]) != tt.expectHTTP {
+				t.Fatalf("expected HTTP listener: %v, found %v", tt.expectHTTP, listeners[0])
+			}
+		})
+	}
+}
+
+func TestInboundListenerConflictMetric(t *testing.T) {
+	older := buildService("older.com", wildcardIP, protocol.HTTP, tnow.Add(-time.Hour))
+	newer := buildService("conflict.com", wildcardIP, protocol.TCP, tnow)
+
+	p := &fakePlugin{}
+	buildInboundListeners(p, &proxy, nil, older, newer)
+	push := p.inboundListenerParams[0].Push
+	if conflicts := push.ProxyStatus[model.ProxyStatusConflictInboundListeners.Name()]; len(conflicts) != 1 {
+		t.Fatalf("expected one conflicting inbound listener, got %v", conflicts)
+	}
+
+	push.UpdateMetrics()
+	data, err := view.RetrieveData("pilot_conflict_inbound_listeners")
+	if err != nil {
+		t.Fatalf("failed to retrieve conflict metric: %v", err)
+	}
+	if len(data) != 1 || data[0].Data.(*view.LastValueData).Value != 1 {
+		t.Fatalf("expected conflict gauge to be 1, found %v", data)
+	}
+}
+
+func TestInboundListenerDisableAccessLog(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(disabled), func(t *testing.T) {
+			service := buildService("test.com", wildcardIP, protocol.HTTP, tnow)
+			service.Attributes.DisableAccessLog = disabled
+			listeners := buildInboundListeners(&fakePlugin{}, &proxy, nil, service)
+			if len(listeners) != 1 {
+				t.Fatalf("expected %d listeners, found %d", 1, len(listeners))
+			}
+			cfg, _ := xdsutil.MessageToStruct(listeners[0].FilterChains[0].Filters[0].GetTypedConfig())
+			logs := len(cfg.Fields["access_log"].GetListValue().GetValues())
+			if disabled && logs != 0 {
+				t.Fatalf("expected no access logs, found %d", logs)
+			}
+			if !disabled && logs == 0 {
+				t.Fatal("expected access log configuration")
+			}
+		})
+	}
+}
+
+func TestWebsocketUpgrade(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(disabled), func(t *testing.T) {
+			if disabled {
+				proxy.Metadata[model.NodeMetadataDisableWebsocketUpgrade] = "1"
+				defer delete(proxy.Metadata, model.NodeMetadataDisableWebsocketUpgrade)
+			}
+			inbound := buildInboundListeners(&fakePlugin{}, &proxy, nil,
+				buildService("test.com", wildcardIP, protocol.HTTP, tnow))
+			outbound := buildOutboundListeners(&fakePlugin{}, nil, nil,
+				buildService("test.com", wildcardIP, protocol.HTTP, tnow))
+			for _, l := range []*xdsapi.Listener{findListenerByPort(inbound, 8080), findListenerByPort(outbound, 8080)} {
+				if !isHTTPListener(l) {
+					t.Fatalf("expected HTTP listener, found %v", l)
+				}
+				cm := &http_conn.HttpConnectionManager{}
+				for _, fc := range l.FilterChains {
+					if fc.Filters[0].Name == xdsutil.HTTPConnectionManager {
+						if err := getFilterConfig(fc.Filters[0], cm); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+				if disabled && len(cm.UpgradeConfigs) != 0 {
+					t.Fatalf("expected no upgrade configs, found %v", cm.UpgradeConfigs)
+				}
+				if !disabled && (len(cm.UpgradeConfigs) != 1 || cm.UpgradeConfigs[0].UpgradeType != "websocket") {
+					t.Fatalf("expected websocket upgrade config, found %v", cm.UpgradeConfigs)
+				}
+			}
+		})
+	}
+}
+
+func TestInboundListenerForwardClientCert(t *testing.T) {
+	defaultDetails := &http_conn.HttpConnectionManager_SetCurrentClientCertDetails{
+		Subject: &types.BoolValue{Value: true},
+		Uri:     true,
+		Dns:     true,
+	}
+	cases := []struct {
+		name            string
+		metadata        map[string]string
+		expectedMode    http_conn.HttpConnectionManager_ForwardClientCertDetails
+		expectedDetails *http_conn.HttpConnectionManager_SetCurrentClientCertDetails
+	}{
+		{"default", nil, http_conn.APPEND_FORWARD, defaultDetails},
+		{
+			name:         "sanitize",
+			metadata:     map[string]string{model.NodeMetadataInboundForwardClientCert: "SANITIZE"},
+			expectedMode: http_conn.SANITIZE,
+		},
+		{
+			name: "sanitize set with details",
+			metadata: map[string]string{
+				model.NodeMetadataInboundForwardClientCert: "SANITIZE_SET",
+				model.NodeMetadataInboundClientCertDetails: "URI,Cert",
+			},
+			expectedMode:    http_conn.SANITIZE_SET,
+			expectedDetails: &http_conn.HttpConnectionManager_SetCurrentClientCertDetails{Uri: true, Cert: true},
+		},
+		{
+			name:            "no details",
+			metadata:        map[string]string{model.NodeMetadataInboundClientCertDetails: ""},
+			expectedMode:    http_conn.APPEND_FORWARD,
+			expectedDetails: &http_conn.HttpConnectionManager_SetCurrentClientCertDetails{},
+		},
+		{
+			name: "invalid",
+			metadata: map[string]string{
+				model.NodeMetadataInboundForwardClientCert: "DROP",
+				model.NodeMetadataInboundClientCertDetails: "Issuer",
+			},
+			expectedMode:    http_conn.APPEND_FORWARD,
+			expectedDetails: defaultDetails,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			p := proxy
+			p.Metadata = map[string]string{model.NodeMetadataConfigNamespace: "not-default"}
+			for k, v := range tt.metadata {
+				p.Metadata[k] = v
+			}
+			listeners := buildInboundListeners(&fakePlugin{}, &p, nil, buildService("test.com", wildcardIP, protocol.HTTP, tnow))
+			if len(listeners) != 1 || !isHTTPListener(listeners[0]) {
+				t.Fatalf("expected one HTTP listener, found %v", listeners)
+			}
+			cm := &http_conn.HttpConnectionManager{}
+			if err := getFilterConfig(listeners[0].FilterChains[0].Filters[0], cm); err != nil {
+				t.Fatal(err)
+			}
+			if cm.ForwardClientCertDetails != tt.expectedMode {
+				t.Fatalf("expected forward_client_cert_details %v, found %v", tt.expectedMode, cm.ForwardClientCertDetails)
+			}
+			if !reflect.DeepEqual(cm.SetCurrentClientCertDetails, tt.expectedDetails) {
+				t.Fatalf("expected set_current_client_cert_details %v, found %v", tt.expectedDetails, cm.SetCurrentClientCertDetails)
+			}
+		})
+	}
+}
+
+func TestInboundListenerSocketOptions(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			p := proxy
+			p.Metadata = map[string]string{model.NodeMetadataConfigNamespace: "not-default"}
+			if enabled {
+				p.Metadata[model.NodeMetadataInboundSocketOptions] = "TCP_NODELAY"
+			}
+			listeners := buildInboundListeners(&fakePlugin{}, &p, nil, buildService("test.com", wildcardIP, protocol.TCP, tnow))
+			if len(listeners) != 1 {
+				t.Fatalf("expected %d listeners, found %d", 1, len(listeners))
+			}
+			options := listeners[0].SocketOptions
+			if !enabled {
+				if len(options) != 0 {
+					t.Fatalf("expected no socket options, found %v", options)
+				}
+				return
+			}
+			// TCP_NODELAY is option 1 at the SOL_TCP (6) level.
+			if len(options) != 1 || options[0].Level != 6 || options[0].Name != 1 || options[0].GetIntValue() != 1 {
+				t.Fatalf("expected TCP_NODELAY socket option, found %v", options)
+			}
+		})
+	}
+}
+
 func TestOutboundListenerConfig_WithSidecar(t *testing.T) {
 	// Add a service and verify it's config
 	services := []*model.Service{
@@ -254,11 +618,68 @@ func TestOutboundListenerConfig_WithSidecar(t *testing.T) {
 	testOutboundListenerConfigWithSidecarWithUseRemoteAddress(t, services...)
 }
 
+func TestOutboundListenerLimit(t *testing.T) {
+	services := []*model.Service{
+		buildService("test1.com", "1.1.1.1", protocol.TCP, tnow),
+		buildService("test2.com", "2.2.2.2", protocol.TCP, tnow.Add(1*time.Second)),
+	}
+	defer func() { _ = os.Unsetenv(features.MaxOutboundListeners.Name) }()
+	for _, tt := range []struct {
+		max      string
+		expected int
+	}{{"", 2}, {"2", 2}, {"1", 1}} {
+		t.Run(tt.max, func(t *testing.T) {
+			_ = os.Setenv(features.MaxOutboundListeners.Name, tt.max)
+			p := &fakePlugin{}
+			if listeners := buildOutboundListeners(p, nil, nil, services...); len(listeners) != tt.expected {
+				t.Fatalf("expected %d listeners, found %d", tt.expected, len(listeners))
+			}
+			status := p.outboundListenerParams[0].Push.ProxyStatus[model.ProxyStatusOutboundListenerLimit.Name()]
+			if dropped := len(services) - tt.expected; dropped > 0 && len(status) != 1 {
+				t.Fatalf("expected the dropped listeners to be reported once, got %v", status)
+			} else if dropped == 0 && len(status) != 0 {
+				t.Fatalf("expected no dropped listeners to be reported, got %v", status)
+			}
+		})
+	}
+}
+
+func TestPluginDropListener(t *testing.T) {
+	service := buildService("test.com", wildcardIP, protocol.HTTP, tnow)
+	if listeners := buildInboundListeners(&fakePlugin{dropListeners: true}, &proxy, nil, service); len(listeners) != 0 {
+		t.Fatalf("expected %d inbound listeners, found %d", 0, len(listeners))
+	}
+	if listeners := buildOutboundListeners(&fakePlugin{dropListeners: true}, nil, nil, service); len(listeners) != 0 {
+		t.Fatalf("expected %d outbound listeners, found %d", 0, len(listeners))
+	}
+}
+
+func TestBuildAccessLogGrpcService(t *testing.T) {
+	if svc := buildAccessLogGrpcService(); svc.GetEnvoyGrpc().GetClusterName() != EnvoyAccessLogCluster {
+		t.Fatalf("expected access logs to be sent to cluster %s, got %v", EnvoyAccessLogCluster, svc)
+	}
+
+	_ = os.Setenv(features.AccessLogServiceAddress.Name, "als.example.com:443")
+	_ = os.Setenv(features.AccessLogServiceRootCert.Name, "/etc/certs/root-cert.pem")
+	defer func() {
+		_ = os.Unsetenv(features.AccessLogServiceAddress.Name)
+		_ = os.Unsetenv(features.AccessLogServiceRootCert.Name)
+	}()
+	grpc := buildAccessLogGrpcService().GetGoogleGrpc()
+	if grpc.GetTargetUri() != "als.example.com:443" {
+		t.Fatalf("expected remote access log service target, got %v", grpc)
+	}
+	if grpc.GetChannelCredentials().GetSslCredentials() == nil {
+		t.Fatalf("expected TLS credentials for the remote access log service, got %v", grpc.GetChannelCredentials())
+	}
+}
+
 func TestGetActualWildcardAndLocalHost(t *testing.T) {
 	tests := []struct {
-		name     string
-		proxy    *model.Proxy
-		expected [2]string
+		name      string
+		proxy     *model.Proxy
+		expected  [2]string
+		expectErr bool
 	}{
 		{
 			name: "ipv4 only",
@@ -281,15 +702,166 @@ func TestGetActualWildcardAndLocalHost(t *testing.T) {
 			},
 			expected: [2]string{WildcardAddress, LocalhostAddress},
 		},
+		{
+			name: "mixed ipv4 and ipv6 preferring ipv6",
+			proxy: &model.Proxy{
+				IPAddresses: []string{"127.0.0.1", "2.2.2.2", "2222:3333::1"},
+				Metadata:    map[string]string{model.NodeMetadataPreferredIPFamily: "IPV6"},
+			},
+			expected: [2]string{WildcardIPv6Address, LocalhostIPv6Address},
+		},
+		{
+			name: "ipv4 only preferring ipv6",
+			proxy: &model.Proxy{
+				IPAddresses: []string{"1.1.1.1", "127.0.0.1"},
+				Metadata:    map[string]string{model.NodeMetadataPreferredIPFamily: "IPV6"},
+			},
+			expected: [2]string{WildcardAddress, LocalhostAddress},
+		},
+		{
+			name: "mixed ipv4 and ipv6 dual stack",
+			proxy: &model.Proxy{
+				IPAddresses: []string{"1111:2222::1", "2.2.2.2"},
+				Metadata:    map[string]string{model.NodeMetadataPreferredIPFamily: "DUAL"},
+			},
+			expected: [2]string{WildcardAddress, LocalhostAddress},
+		},
+		{
+			name: "all invalid",
+			proxy: &model.Proxy{
+				IPAddresses: []string{"1.1.1", "not-an-ip"},
+			},
+			expected:  [2]string{WildcardAddress, LocalhostAddress},
+			expectErr: true,
+		},
+		{
+			name: "invalid and ipv6",
+			proxy: &model.Proxy{
+				IPAddresses: []string{"1.1.1", "2222:3333::1"},
+			},
+			expected: [2]string{WildcardIPv6Address, LocalhostIPv6Address},
+		},
+		{
+			name: "invalid and ipv4",
+			proxy: &model.Proxy{
+				IPAddresses: []string{"2222:3333::1:", "2.2.2.2"},
+			},
+			expected: [2]string{WildcardAddress, LocalhostAddress},
+		},
 	}
 	for _, tt := range tests {
-		wm, lh := getActualWildcardAndLocalHost(tt.proxy)
-		if wm != tt.expected[0] && lh != tt.expected[1] {
+		wm, lh, err := parseActualWildcardAndLocalHost(tt.proxy)
+		if (err != nil) != tt.expectErr {
+			t.Errorf("Test %s failed, expected error: %v got: %v", tt.name, tt.expectErr, err)
+		}
+		if wm != tt.expected[0] || lh != tt.expected[1] {
+			t.Errorf("Test %s failed, expected: %s / %s got: %s / %s", tt.name, tt.expected[0], tt.expected[1], wm, lh)
+		}
+		if wm, lh = getActualWildcardAndLocalHost(tt.proxy); wm != tt.expected[0] || lh != tt.expected[1] {
 			t.Errorf("Test %s failed, expected: %s / %s got: %s / %s", tt.name, tt.expected[0], tt.expected[1], wm, lh)
 		}
 	}
 }
 
+func TestGetLoopbackBindAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		bind     string
+		expected string
+	}{
+		{"default", "", LocalhostAddress},
+		{"loopback alias", "127.0.0.2", "127.0.0.2"},
+		{"ipv6 loopback", "::1", "::1"},
+		{"not loopback", "10.0.0.1", LocalhostAddress},
+		{"malformed", "127.0.0", LocalhostAddress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := &model.Proxy{Metadata: map[string]string{model.NodeMetadataLoopbackBindAddress: tt.bind}}
+			if got := getLoopbackBindAddress(proxy, LocalhostAddress); got != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestGetSidecarInboundBindIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		proxy    *model.Proxy
+		expected string
+	}{
+		{
+			name: "dual stack",
+			proxy: &model.Proxy{
+				IPAddresses: []string{"2222:3333::1", "2.2.2.2"},
+			},
+			expected: "2222:3333::1",
+		},
+		{
+			name: "dual stack preferring ipv6",
+			proxy: &model.Proxy{
+				IPAddresses: []string{"2.2.2.2", "2222:3333::1"},
+				Metadata:    map[string]string{model.NodeMetadataPreferredIPFamily: "IPV6"},
+			},
+			expected: "2222:3333::1",
+		},
+		{
+			name: "no unicast address",
+			proxy: &model.Proxy{
+				IPAddresses: []string{"127.0.0.1"},
+			},
+			expected: WildcardAddress,
+		},
+		{
+			name: "loopback ipv4",
+			proxy: &model.Proxy{
+				IPAddresses: []string{"2.2.2.2"},
+				Metadata:    map[string]string{model.NodeMetadataInboundBindLoopback: "1"},
+			},
+			expected: LocalhostAddress,
+		},
+		{
+			name: "loopback ipv6",
+			proxy: &model.Proxy{
+				IPAddresses: []string{"2222:3333::1"},
+				Metadata:    map[string]string{model.NodeMetadataInboundBindLoopback: "1"},
+			},
+			expected: LocalhostIPv6Address,
+		},
+		{
+			name: "loopback dual stack",
+			proxy: &model.Proxy{
+				IPAddresses: []string{"2222:3333::1", "2.2.2.2"},
+				Metadata:    map[string]string{model.NodeMetadataInboundBindLoopback: "1"},
+			},
+			expected: LocalhostAddress,
+		},
+		{
+			name: "loopback dual stack preferring ipv6",
+			proxy: &model.Proxy{
+				IPAddresses: []string{"2.2.2.2", "2222:3333::1"},
+				Metadata: map[string]string{
+					model.NodeMetadataInboundBindLoopback: "1",
+					model.NodeMetadataPreferredIPFamily:   "IPV6",
+				},
+			},
+			expected: LocalhostIPv6Address,
+		},
+	}
+	for _, tt := range tests {
+		if got := getSidecarInboundBindIP(tt.proxy); got != tt.expected {
+			t.Errorf("Test %s failed, expected: %s got: %s", tt.name, tt.expected, got)
+		}
+		if tt.proxy.GetListenerMetadata().InboundBindLoopback {
+			// The inbound clusters must forward to the address the listeners are bound to.
+			if _, localHost := getActualWildcardAndLocalHost(tt.proxy); localHost != tt.expected {
+				t.Errorf("Test %s failed, expected cluster endpoint %s got: %s", tt.name, tt.expected, localHost)
+			}
+		}
+	}
+}
+
 func testOutboundListenerConflict(t *testing.T, services ...*model.Service) {
 	t.Helper()
 
@@ -415,204 +987,1447 @@ func testInboundListenerConfigWithSidecarWithoutServices(t *testing.T, proxy *mo
 	}
 }
 
-func testOutboundListenerConfigWithSidecar(t *testing.T, services ...*model.Service) {
-	t.Helper()
-	p := &fakePlugin{}
+func TestInboundListenerSidecarIngressWithoutInstance(t *testing.T) {
 	sidecarConfig := &model.Config{
 		ConfigMeta: model.ConfigMeta{
-			Name:      "foo",
+			Name:      "foo-without-service",
 			Namespace: "not-default",
 		},
 		Spec: &networking.Sidecar{
-			Egress: []*networking.IstioEgressListener{
+			Ingress: []*networking.IstioIngressListener{
 				{
 					Port: &networking.Port{
-						Number:   9000,
+						Number:   8080,
 						Protocol: "HTTP",
 						Name:     "uds",
 					},
-					Bind:  "1.1.1.1",
-					Hosts: []string{"*/*"},
-				},
-				{
-					Port: &networking.Port{
-						Number:   3306,
-						Protocol: string(protocol.MySQL),
-						Name:     "MySQL",
-					},
-					Bind:  "8.8.8.8",
-					Hosts: []string{"*/*"},
-				},
-				{
-					Hosts: []string{"*/*"},
+					Bind:            "1.1.1.1",
+					DefaultEndpoint: "127.0.0.1:80",
 				},
 			},
 		},
 	}
-
-	// enable mysql filter that is used here
-	_ = os.Setenv(features.EnableMysqlFilter.Name, "true")
-
-	defer func() { _ = os.Unsetenv(features.EnableMysqlFilter.Name) }()
-
-	listeners := buildOutboundListeners(p, sidecarConfig, nil, services...)
-	if len(listeners) != 3 {
-		t.Fatalf("expected %d listeners, found %d", 3, len(listeners))
+	configgen := NewConfigGenerator([]plugin.Plugin{&fakePlugin{}})
+	env := buildListenerEnv(nil)
+	if err := env.PushContext.InitContext(&env); err != nil {
+		t.Fatalf("init push context error: %s", err.Error())
+	}
+	p := proxy
+	p.ServiceInstances = nil
+	p.SidecarScope = model.ConvertToSidecarScope(env.PushContext, sidecarConfig, sidecarConfig.Namespace)
+
+	if listeners := configgen.buildSidecarInboundListeners(&env, &p, env.PushContext); len(listeners) != 0 {
+		t.Fatalf("expected %d listeners, found %d", 0, len(listeners))
+	}
+	status := env.PushContext.ProxyStatus[model.ProxyStatusSidecarIngressNoInstance.Name()]
+	if _, f := status[p.ID+":8080"]; !f {
+		t.Fatalf("expected a push status warning for the skipped ingress listener, found %v", status)
+	}
+}
+
+func TestSidecarIngressProtocol(t *testing.T) {
+	cases := []struct {
+		name     string
+		port     *networking.Port
+		expected protocol.Instance
+	}{
+		{"explicit", &networking.Port{Number: 8080, Protocol: "HTTP", Name: "grpc-foo"}, protocol.HTTP},
+		{"explicit unknown", &networking.Port{Number: 8080, Protocol: "htttp", Name: "http-foo"}, protocol.Unsupported},
+		{"name prefix", &networking.Port{Number: 8080, Name: "http-foo"}, protocol.HTTP},
+		{"name only", &networking.Port{Number: 8080, Name: "grpc"}, protocol.GRPC},
+		{"grpc-web name prefix", &networking.Port{Number: 8080, Name: "grpc-web-foo"}, protocol.GRPCWeb},
+		{"udp name prefix", &networking.Port{Number: 8080, Name: "udp-foo"}, protocol.Unsupported},
+		{"unknown name", &networking.Port{Number: 8080, Name: "foo"}, protocol.Unsupported},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sidecarIngressProtocol(tt.port); got != tt.expected {
+				t.Fatalf("expected protocol %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestInboundListenerSidecarIngressProtocolFromName(t *testing.T) {
+	for _, name := range []string{"http-foo", "foo"} {
+		t.Run(name, func(t *testing.T) {
+			sidecarConfig := &model.Config{
+				ConfigMeta: model.ConfigMeta{Name: "sidecar", Namespace: "not-default"},
+				Spec: &networking.Sidecar{
+					Ingress: []*networking.IstioIngressListener{{
+						Port:            &networking.Port{Number: 8080, Name: name},
+						DefaultEndpoint: "127.0.0.1:80",
+					}},
+				},
+			}
+			p := proxy
+			services := []*model.Service{buildService("test.com", wildcardIP, protocol.HTTP, tnow)}
+			listeners := buildInboundListeners(&fakePlugin{}, &p, sidecarConfig, services...)
+			if name == "foo" {
+				if len(listeners) != 0 {
+					t.Fatalf("expected no listeners for an unknown protocol, found %d", len(listeners))
+				}
+				return
+			}
+			if len(listeners) != 1 || !isHTTPListener(listeners[0]) {
+				t.Fatalf("expected one HTTP listener, found %v", listeners)
+			}
+		})
+	}
+}
+
+func TestListenerUnknownProtocolStatus(t *testing.T) {
+	sidecarConfig := &model.Config{
+		ConfigMeta: model.ConfigMeta{
+			Name:      "typo",
+			Namespace: "not-default",
+		},
+		Spec: &networking.Sidecar{
+			Ingress: []*networking.IstioIngressListener{
+				{
+					Port:            &networking.Port{Number: 8080, Protocol: "htttp", Name: "http"},
+					DefaultEndpoint: "127.0.0.1:80",
+				},
+			},
+			Egress: []*networking.IstioEgressListener{
+				{
+					Port:  &networking.Port{Number: 9000, Protocol: "htttp", Name: "http"},
+					Hosts: []string{"*/*"},
+				},
+			},
+		},
+	}
+	services := []*model.Service{buildService("test.com", wildcardIP, protocol.Unsupported, tnow)}
+	configgen := NewConfigGenerator([]plugin.Plugin{&fakePlugin{}})
+	env := buildListenerEnv(services)
+	if err := env.PushContext.InitContext(&env); err != nil {
+		t.Fatalf("init push context error: %s", err.Error())
+	}
+
+	p := proxy
+	p.ServiceInstances = []*model.ServiceInstance{{Service: services[0], Endpoint: buildEndpoint(services[0])}}
+	p.SidecarScope = model.DefaultSidecarScopeForNamespace(env.PushContext, "not-default")
+	if listeners := configgen.buildSidecarInboundListeners(&env, &p, env.PushContext); len(listeners) != 0 {
+		t.Fatalf("expected %d listeners, found %d", 0, len(listeners))
+	}
+	if listeners := configgen.buildSidecarOutboundListeners(&env, &p, env.PushContext); len(listeners) != 0 {
+		t.Fatalf("expected %d listeners, found %d", 0, len(listeners))
+	}
+	p.SidecarScope = model.ConvertToSidecarScope(env.PushContext, sidecarConfig, sidecarConfig.Namespace)
+	if listeners := configgen.buildSidecarInboundListeners(&env, &p, env.PushContext); len(listeners) != 0 {
+		t.Fatalf("expected %d listeners, found %d", 0, len(listeners))
+	}
+	if listeners := configgen.buildSidecarOutboundListeners(&env, &p, env.PushContext); len(listeners) != 0 {
+		t.Fatalf("expected %d listeners, found %d", 0, len(listeners))
+	}
+
+	status := env.PushContext.ProxyStatus[model.ProxyStatusUnknownListenerProtocol.Name()]
+	expected := map[string]string{
+		"service test.com:8080":                 "the port protocol is not a known protocol",
+		"Sidecar not-default/typo ingress:8080": `unknown protocol "htttp"`,
+		"Sidecar not-default/typo egress:9000":  `unknown protocol "htttp"`,
+	}
+	if len(status) != len(expected) {
+		t.Fatalf("expected %d push status warnings, found %v", len(expected), status)
+	}
+	for key, msg := range expected {
+		if !strings.Contains(status[key].Message, msg) {
+			t.Fatalf("expected push status warning %q to contain %q, found %v", key, msg, status)
+		}
+	}
+}
+
+func TestInboundMgmtListenerMySQL(t *testing.T) {
+	_ = os.Setenv(features.EnableMysqlFilter.Name, "true")
+	defer func() { _ = os.Unsetenv(features.EnableMysqlFilter.Name) }()
+
+	env := buildListenerEnv(nil)
+	p := proxy
+	ports := model.PortList{{Name: "mysql", Port: 3306, Protocol: protocol.MySQL}}
+	listeners := buildSidecarInboundMgmtListeners(&p, &env, ports, "1.1.1.1")
+	if len(listeners) != 1 {
+		t.Fatalf("expected %d listeners, found %d", 1, len(listeners))
+	}
+	filters := listeners[0].FilterChains[0].Filters
+	if len(filters) != 2 || filters[0].Name != xdsutil.MySQLProxy || filters[1].Name != xdsutil.TCPProxy {
+		t.Fatalf("expected MySQL proxy followed by TCP proxy, found %v", filters)
+	}
+}
+
+func testOutboundListenerConfigWithSidecar(t *testing.T, services ...*model.Service) {
+	t.Helper()
+	p := &fakePlugin{}
+	sidecarConfig := &model.Config{
+		ConfigMeta: model.ConfigMeta{
+			Name:      "foo",
+			Namespace: "not-default",
+		},
+		Spec: &networking.Sidecar{
+			Egress: []*networking.IstioEgressListener{
+				{
+					Port: &networking.Port{
+						Number:   9000,
+						Protocol: "HTTP",
+						Name:     "uds",
+					},
+					Bind:  "1.1.1.1",
+					Hosts: []string{"*/*"},
+				},
+				{
+					Port: &networking.Port{
+						Number:   3306,
+						Protocol: string(protocol.MySQL),
+						Name:     "MySQL",
+					},
+					Bind:  "8.8.8.8",
+					Hosts: []string{"*/*"},
+				},
+				{
+					Hosts: []string{"*/*"},
+				},
+			},
+		},
+	}
+
+	// enable mysql filter that is used here
+	_ = os.Setenv(features.EnableMysqlFilter.Name, "true")
+
+	defer func() { _ = os.Unsetenv(features.EnableMysqlFilter.Name) }()
+
+	listeners := buildOutboundListeners(p, sidecarConfig, nil, services...)
+	if len(listeners) != 3 {
+		t.Fatalf("expected %d listeners, found %d", 3, len(listeners))
+	}
+
+	if l := findListenerByPort(listeners, 8080); isHTTPListener(l) {
+		t.Fatalf("expected TCP listener on port 8080, found HTTP: %v", l)
+	}
+
+	if l := findListenerByPort(listeners, 3306); !isMysqlListener(l) {
+		t.Fatalf("expected MySQL listener on port 3306, found %v", l)
+	}
+
+	if l := findListenerByPort(listeners, 9000); !isHTTPListener(l) {
+		t.Fatalf("expected HTTP listener on port 9000, found TCP\n%v", l)
+	} else {
+		f := l.FilterChains[0].Filters[0]
+		cfg, _ := xdsutil.MessageToStruct(f.GetTypedConfig())
+		if useRemoteAddress, exists := cfg.Fields["use_remote_address"]; exists {
+			if exists && useRemoteAddress.GetBoolValue() {
+				t.Fatalf("expected useRemoteAddress false, found true %v", l)
+			}
+		}
+	}
+}
+
+func testOutboundListenerConfigWithSidecarWithUseRemoteAddress(t *testing.T, services ...*model.Service) {
+	t.Helper()
+	p := &fakePlugin{}
+	sidecarConfig := &model.Config{
+		ConfigMeta: model.ConfigMeta{
+			Name:      "foo",
+			Namespace: "not-default",
+		},
+		Spec: &networking.Sidecar{
+			Egress: []*networking.IstioEgressListener{
+				{
+					Port: &networking.Port{
+						Number:   9000,
+						Protocol: "HTTP",
+						Name:     "uds",
+					},
+					Bind:  "1.1.1.1",
+					Hosts: []string{"*/*"},
+				},
+			},
+		},
+	}
+
+	// enable use remote address to true
+	_ = os.Setenv(features.UseRemoteAddress.Name, "true")
+
+	defer func() { _ = os.Unsetenv(features.UseRemoteAddress.Name) }()
+
+	listeners := buildOutboundListeners(p, sidecarConfig, nil, services...)
+
+	if l := findListenerByPort(listeners, 9000); !isHTTPListener(l) {
+		t.Fatalf("expected HTTP listener on port 9000, found TCP\n%v", l)
+	} else {
+		f := l.FilterChains[0].Filters[0]
+		cfg, _ := xdsutil.MessageToStruct(f.GetTypedConfig())
+		if useRemoteAddress, exists := cfg.Fields["use_remote_address"]; exists {
+			if !exists || !useRemoteAddress.GetBoolValue() {
+				t.Fatalf("expected useRemoteAddress true, found false %v", l)
+			}
+		}
+	}
+}
+
+func testOutboundListenerConfigWithSidecarWithCaptureModeNone(t *testing.T, services ...*model.Service) {
+	t.Helper()
+	p := &fakePlugin{}
+	sidecarConfig := &model.Config{
+		ConfigMeta: model.ConfigMeta{
+			Name:      "foo",
+			Namespace: "not-default",
+		},
+		Spec: &networking.Sidecar{
+			Egress: []*networking.IstioEgressListener{
+				{
+					// Bind + Port
+					CaptureMode: networking.CaptureMode_NONE,
+					Port: &networking.Port{
+						Number:   9090,
+						Protocol: "HTTP",
+						Name:     "grpc",
+					},
+					Bind:  "127.1.1.2",
+					Hosts: []string{"*/*"},
+				},
+				{
+					// Bind Only
+					CaptureMode: networking.CaptureMode_NONE,
+					Bind:        "127.1.1.2",
+					Hosts:       []string{"*/*"},
+				},
+				{
+					// Port Only
+					CaptureMode: networking.CaptureMode_NONE,
+					Port: &networking.Port{
+						Number:   9090,
+						Protocol: "HTTP",
+						Name:     "grpc",
+					},
+					Hosts: []string{"*/*"},
+				},
+				{
+					// None
+					CaptureMode: networking.CaptureMode_NONE,
+					Hosts:       []string{"*/*"},
+				},
+			},
+		},
+	}
+	listeners := buildOutboundListeners(p, sidecarConfig, nil, services...)
+	if len(listeners) != 4 {
+		t.Fatalf("expected %d listeners, found %d", 4, len(listeners))
+	}
+
+	expectedListeners := map[string]string{
+		"127.1.1.2_9090": "HTTP",
+		"127.1.1.2_8080": "TCP",
+		"127.0.0.1_9090": "HTTP",
+		"127.0.0.1_8080": "TCP",
+	}
+
+	for _, l := range listeners {
+		listenerName := l.Name
+		expectedListenerType := expectedListeners[listenerName]
+		if expectedListenerType == "" {
+			t.Fatalf("listener %s not expected", listenerName)
+		}
+		if expectedListenerType == "TCP" && isHTTPListener(l) {
+			t.Fatalf("expected TCP listener %s, but found HTTP", listenerName)
+		}
+		if expectedListenerType == "HTTP" && !isHTTPListener(l) {
+			t.Fatalf("expected HTTP listener %s, but found TCP", listenerName)
+		}
+	}
+}
+
+func TestOutboundListenerAccessLogs(t *testing.T) {
+	t.Helper()
+	p := &fakePlugin{}
+	listeners := buildAllListeners(p, nil)
+	for _, l := range listeners {
+		if l.Name == "virtual" {
+			fc := &tcp_proxy.TcpProxy{}
+			if err := getFilterConfig(l.FilterChains[0].Filters[0], fc); err != nil {
+				t.Fatalf("failed to get TCP Proxy config: %s", err)
+			}
+			if fc.AccessLog == nil {
+				t.Fatal("expected access log configuration")
+			}
+		}
+	}
+}
+
+func TestBlackholeAccessLog(t *testing.T) {
+	env := buildListenerEnv(nil)
+	proxy := getDefaultProxy()
+
+	fc := &tcp_proxy.TcpProxy{}
+	if err := getFilterConfig(newBlackholeFilterForNode(&env, &proxy), fc); err != nil {
+		t.Fatalf("failed to get TCP Proxy config: %s", err)
+	}
+	if fc.AccessLog != nil {
+		t.Fatal("expected no access log on blackhole filter by default")
+	}
+
+	_ = os.Setenv(features.EnableBlackholeAccessLog.Name, "true")
+	defer func() { _ = os.Unsetenv(features.EnableBlackholeAccessLog.Name) }()
+
+	fc = &tcp_proxy.TcpProxy{}
+	if err := getFilterConfig(newBlackholeFilterForNode(&env, &proxy), fc); err != nil {
+		t.Fatalf("failed to get TCP Proxy config: %s", err)
+	}
+	if fc.AccessLog == nil {
+		t.Fatal("expected access log on blackhole filter")
+	}
+	if fc.StatPrefix != "BlackHoleCluster" {
+		t.Fatalf("expected stat prefix BlackHoleCluster, got %s", fc.StatPrefix)
+	}
+}
+
+func TestFilterJSONLogFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		expected []string
+	}{
+		{
+			name:     "include",
+			metadata: map[string]string{model.NodeMetadataAccessLogJSONIncludeFields: "start_time, response_code,unknown"},
+			expected: []string{"response_code", "start_time"},
+		},
+		{
+			name: "include and exclude",
+			metadata: map[string]string{
+				model.NodeMetadataAccessLogJSONIncludeFields: "start_time,response_code",
+				model.NodeMetadataAccessLogJSONExcludeFields: "start_time",
+			},
+			expected: []string{"response_code"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filterJSONLogFormat(EnvoyJSONLogFormat, &model.Proxy{Metadata: tt.metadata})
+			fields := make([]string, 0, len(got.Fields))
+			for name := range got.Fields {
+				fields = append(fields, name)
+			}
+			sort.Strings(fields)
+			if !reflect.DeepEqual(fields, tt.expected) {
+				t.Fatalf("expected fields %v, got %v", tt.expected, fields)
+			}
+		})
+	}
+
+	if got := filterJSONLogFormat(EnvoyJSONLogFormat, &model.Proxy{}); got != EnvoyJSONLogFormat {
+		t.Fatalf("expected the default format when no fields are selected")
+	}
+	excluded := filterJSONLogFormat(EnvoyJSONLogFormat,
+		&model.Proxy{Metadata: map[string]string{model.NodeMetadataAccessLogJSONExcludeFields: "user_agent,x_forwarded_for"}})
+	if len(excluded.Fields) != len(EnvoyJSONLogFormat.Fields)-2 || excluded.Fields["user_agent"] != nil {
+		t.Fatalf("expected user_agent and x_forwarded_for to be excluded, got %v", excluded.Fields)
+	}
+}
+
+func TestAccessLogEncodingOverride(t *testing.T) {
+	tests := []struct {
+		name         string
+		meshEncoding meshconfig.MeshConfig_AccessLogEncoding
+		meshFormat   string
+		metadata     map[string]string
+		key          string
+		expectJSON   bool
+	}{
+		{
+			name:         "text default",
+			meshEncoding: meshconfig.MeshConfig_TEXT,
+			key:          model.NodeMetadataHTTPAccessLogEncoding,
+		},
+		{
+			name:         "text default with json override",
+			meshEncoding: meshconfig.MeshConfig_TEXT,
+			meshFormat:   "%START_TIME%\n",
+			metadata:     map[string]string{model.NodeMetadataHTTPAccessLogEncoding: "JSON"},
+			key:          model.NodeMetadataHTTPAccessLogEncoding,
+			expectJSON:   true,
+		},
+		{
+			name:         "json default with text override",
+			meshEncoding: meshconfig.MeshConfig_JSON,
+			metadata:     map[string]string{model.NodeMetadataTCPAccessLogEncoding: "TEXT"},
+			key:          model.NodeMetadataTCPAccessLogEncoding,
+		},
+		{
+			name:         "override for other listener type",
+			meshEncoding: meshconfig.MeshConfig_JSON,
+			metadata:     map[string]string{model.NodeMetadataTCPAccessLogEncoding: "TEXT"},
+			key:          model.NodeMetadataHTTPAccessLogEncoding,
+			expectJSON:   true,
+		},
+		{
+			name:         "invalid override",
+			meshEncoding: meshconfig.MeshConfig_JSON,
+			metadata:     map[string]string{model.NodeMetadataHTTPAccessLogEncoding: "XML"},
+			key:          model.NodeMetadataHTTPAccessLogEncoding,
+			expectJSON:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := mesh.DefaultMeshConfig()
+			m.AccessLogEncoding = tt.meshEncoding
+			m.AccessLogFormat = tt.meshFormat
+			env := &model.Environment{Mesh: &m}
+			node := &model.Proxy{Metadata: tt.metadata}
+
+			fl := &accesslogconfig.FileAccessLog{}
+			override := node.GetListenerMetadata().HTTPAccessLogEncoding
+			if tt.key == model.NodeMetadataTCPAccessLogEncoding {
+				override = node.GetListenerMetadata().TCPAccessLogEncoding
+			}
+			buildAccessLog(node, fl, env, getAccessLogEncoding(env, override), "")
+			switch format := fl.AccessLogFormat.(type) {
+			case *accesslogconfig.FileAccessLog_JsonFormat:
+				if !tt.expectJSON {
+					t.Fatalf("expected text format, got %v", format)
+				}
+				if !reflect.DeepEqual(format.JsonFormat, EnvoyJSONLogFormat) {
+					t.Fatalf("expected default json format, got %v", format.JsonFormat)
+				}
+			case *accesslogconfig.FileAccessLog_Format:
+				if tt.expectJSON {
+					t.Fatalf("expected json format, got %v", format)
+				}
+				if format.Format != EnvoyTextLogFormat {
+					t.Fatalf("expected default text format, got %v", format.Format)
+				}
+			default:
+				t.Fatalf("unexpected access log format %v", format)
+			}
+		})
+	}
+}
+
+func TestDefaultLogFormatGRPCStatus(t *testing.T) {
+	for _, encoding := range []meshconfig.MeshConfig_AccessLogEncoding{meshconfig.MeshConfig_TEXT, meshconfig.MeshConfig_JSON} {
+		t.Run(encoding.String(), func(t *testing.T) {
+			m := mesh.DefaultMeshConfig()
+			m.AccessLogEncoding = encoding
+			env := &model.Environment{Mesh: &m}
+			hasGRPCStatus := func() bool {
+				fl := &accesslogconfig.FileAccessLog{}
+				buildAccessLog(&model.Proxy{}, fl, env, encoding, "")
+				if encoding == meshconfig.MeshConfig_JSON {
+					return fl.GetJsonFormat().Fields["grpc_status"].GetStringValue() == "%GRPC_STATUS%"
+				}
+				return strings.Contains(fl.GetFormat(), "%GRPC_STATUS%")
+			}
+
+			if !hasGRPCStatus() {
+				t.Fatalf("expected the gRPC status in the default format")
+			}
+
+			_ = os.Setenv(features.EnableAccessLogGRPCStatus.Name, "false")
+			defer func() { _ = os.Unsetenv(features.EnableAccessLogGRPCStatus.Name) }()
+			if hasGRPCStatus() {
+				t.Fatalf("expected no gRPC status in the default format when disabled")
+			}
+			if len(EnvoyJSONLogFormat.Fields["grpc_status"].GetStringValue()) == 0 {
+				t.Fatalf("expected the default JSON format not to be modified")
+			}
+		})
+	}
+}
+
+func TestDefaultJSONLogFormatAttemptDetails(t *testing.T) {
+	m := mesh.DefaultMeshConfig()
+	m.AccessLogEncoding = meshconfig.MeshConfig_JSON
+	env := &model.Environment{Mesh: &m}
+	attemptFields := []string{"upstream_request_attempt_count", "connection_termination_details"}
+
+	fl := &accesslogconfig.FileAccessLog{}
+	buildAccessLog(&model.Proxy{}, fl, env, m.AccessLogEncoding, "")
+	for _, name := range attemptFields {
+		if fl.GetJsonFormat().Fields[name] != nil {
+			t.Fatalf("expected no %s field by default", name)
+		}
+	}
+
+	_ = os.Setenv(features.EnableAccessLogAttemptDetails.Name, "true")
+	defer func() { _ = os.Unsetenv(features.EnableAccessLogAttemptDetails.Name) }()
+
+	fl = &accesslogconfig.FileAccessLog{}
+	buildAccessLog(&model.Proxy{}, fl, env, m.AccessLogEncoding, "")
+	if len(fl.GetJsonFormat().Fields) != len(EnvoyJSONLogFormat.Fields)+len(attemptFields) {
+		t.Fatalf("expected default fields and attempt details, got %v", fl.GetJsonFormat().Fields)
+	}
+	if got := fl.GetJsonFormat().Fields["upstream_request_attempt_count"].GetStringValue(); got != "%UPSTREAM_REQUEST_ATTEMPT_COUNT%" {
+		t.Fatalf("unexpected upstream_request_attempt_count format %q", got)
+	}
+	if got := fl.GetJsonFormat().Fields["connection_termination_details"].GetStringValue(); got != "%CONNECTION_TERMINATION_DETAILS%" {
+		t.Fatalf("unexpected connection_termination_details format %q", got)
+	}
+}
+
+func TestJSONLogFormatCache(t *testing.T) {
+	parses := 0
+	parse := parseJSONLogFormat
+	parseJSONLogFormat = func(format string) *types.Struct {
+		parses++
+		return parse(format)
+	}
+	defer func() { parseJSONLogFormat = parse }()
+	jsonLogFormatCache.Lock()
+	jsonLogFormatCache.formats = map[string]*types.Struct{}
+	jsonLogFormatCache.Unlock()
+
+	m := mesh.DefaultMeshConfig()
+	m.AccessLogEncoding = meshconfig.MeshConfig_JSON
+	m.AccessLogFormat = `{"start_time": "%START_TIME%"}`
+	env := &model.Environment{Mesh: &m}
+	node := &model.Proxy{}
+
+	first := &accesslogconfig.FileAccessLog{}
+	buildAccessLog(node, first, env, m.AccessLogEncoding, "")
+	second := &accesslogconfig.FileAccessLog{}
+	buildAccessLog(node, second, env, m.AccessLogEncoding, "")
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("expected identical access logs, got %v and %v", first, second)
+	}
+	if first.GetJsonFormat().Fields["start_time"].GetStringValue() != "%START_TIME%" {
+		t.Fatalf("expected user provided json format, got %v", first.GetJsonFormat())
+	}
+	if parses != 1 {
+		t.Fatalf("expected format to be parsed once, parsed %d times", parses)
+	}
+
+	m.AccessLogFormat = `{"duration": "%DURATION%"}`
+	third := &accesslogconfig.FileAccessLog{}
+	buildAccessLog(node, third, env, m.AccessLogEncoding, "")
+	if third.GetJsonFormat().Fields["duration"] == nil {
+		t.Fatalf("expected updated json format, got %v", third.GetJsonFormat())
+	}
+	if parses != 2 {
+		t.Fatalf("expected format change to be parsed, parsed %d times", parses)
+	}
+
+	// Formats alternating within a push, from gateway servers or Sidecars, are each parsed once,
+	// including invalid ones.
+	for i := 0; i < 3; i++ {
+		for _, format := range []string{`{"start_time": "%START_TIME%"}`, `{"duration": "%DURATION%"}`, `{"invalid"`} {
+			m.AccessLogFormat = format
+			buildAccessLog(node, &accesslogconfig.FileAccessLog{}, env, m.AccessLogEncoding, "")
+		}
+	}
+	if parses != 3 {
+		t.Fatalf("expected each format to be parsed once, parsed %d times", parses)
+	}
+}
+
+func TestParseJSONLogFormatNoStdout(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	jsonLog := parseJSONLogFormat(`{"start_time": "%START_TIME%"}`)
+	os.Stdout = stdout
+	_ = w.Close()
+
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("expected no output on stdout, got %q", out)
+	}
+	if jsonLog.Fields["start_time"].GetStringValue() != "%START_TIME%" {
+		t.Fatalf("expected parsed json format, got %v", jsonLog)
+	}
+}
+
+func TestHTTPConnectionManagerIdleTimeout(t *testing.T) {
+	cases := []struct {
+		name     string
+		sidecar  time.Duration
+		metadata map[string]string
+		expected time.Duration
+	}{
+		{"default", 0, nil, 0},
+		{"metadata", 0, map[string]string{model.NodeMetadataIdleTimeout: "10s"}, 10 * time.Second},
+		{"sidecar over metadata", 30 * time.Second, map[string]string{model.NodeMetadataIdleTimeout: "10s"}, 30 * time.Second},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			env := buildListenerEnv(nil)
+			node := &model.Proxy{Metadata: tt.metadata, SidecarScope: &model.SidecarScope{IdleTimeout: tt.sidecar}}
+			cm := buildHTTPConnectionManager(node, &env, &httpListenerOpts{idleTimeout: sidecarIdleTimeout(node)}, nil)
+			if tt.expected == 0 {
+				if cm.IdleTimeout != nil {
+					t.Fatalf("expected no idle timeout, got %v", *cm.IdleTimeout)
+				}
+				return
+			}
+			if cm.IdleTimeout == nil || *cm.IdleTimeout != tt.expected {
+				t.Fatalf("expected idle timeout %v, got %v", tt.expected, cm.IdleTimeout)
+			}
+		})
+	}
+}
+
+func TestSidecarAccessLog(t *testing.T) {
+	cases := []struct {
+		name          string
+		scope         *model.SidecarScope
+		gatewayFormat string
+		expectedHTTP  string
+		expectedTCP   string
+	}{
+		{"no sidecar", nil, "", EnvoyTextLogFormat, EnvoyTextLogFormat},
+		{"sidecar format", &model.SidecarScope{AccessLogFormat: "sidecar\n"}, "", "sidecar\n", "sidecar\n"},
+		{"gateway format over sidecar", &model.SidecarScope{AccessLogFormat: "sidecar\n"}, "gateway\n", "gateway\n", "sidecar\n"},
+		{"sidecar disabled", &model.SidecarScope{AccessLogDisabled: true}, "", "", ""},
+	}
+	fileAccessLogFormat := func(logs []*accesslog.AccessLog) string {
+		for _, l := range logs {
+			if l.Name != xdsutil.FileAccessLog {
+				continue
+			}
+			fl := &accesslogconfig.FileAccessLog{}
+			if err := types.UnmarshalAny(l.GetTypedConfig(), fl); err != nil {
+				t.Fatal(err)
+			}
+			return fl.GetFormat()
+		}
+		return ""
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			env := buildListenerEnv(nil)
+			node := &model.Proxy{SidecarScope: tt.scope}
+
+			cm := buildHTTPConnectionManager(node, &env, &httpListenerOpts{accessLogFormat: tt.gatewayFormat}, nil)
+			if got := fileAccessLogFormat(cm.AccessLog); got != tt.expectedHTTP {
+				t.Fatalf("expected HTTP access log format %q, got %q", tt.expectedHTTP, got)
+			}
+			if tt.scope != nil && tt.scope.AccessLogDisabled && len(cm.AccessLog) != 0 {
+				t.Fatalf("expected no HTTP access logs, got %v", cm.AccessLog)
+			}
+			tcp := setAccessLog(&env, node, &tcp_proxy.TcpProxy{})
+			if got := fileAccessLogFormat(tcp.AccessLog); got != tt.expectedTCP {
+				t.Fatalf("expected TCP access log format %q, got %q", tt.expectedTCP, got)
+			}
+		})
+	}
+}
+
+func TestHTTPConnectionManagerAccessLogFilter(t *testing.T) {
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		expected uint32
+	}{
+		{"default", nil, 0},
+		{"errors only", map[string]string{model.NodeMetadataAccessLogMinResponseCode: "400"}, 400},
+		{"invalid", map[string]string{model.NodeMetadataAccessLogMinResponseCode: "1000"}, 0},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			env := buildListenerEnv(nil)
+			node := &model.Proxy{Metadata: tt.metadata}
+			cm := buildHTTPConnectionManager(node, &env, &httpListenerOpts{}, nil)
+			var fileLog *accesslog.AccessLog
+			for _, l := range cm.AccessLog {
+				if l.Name == xdsutil.FileAccessLog {
+					fileLog = l
+				} else if l.Filter != nil {
+					t.Fatalf("expected no filter on access log %s, got %v", l.Name, l.Filter)
+				}
+			}
+			if fileLog == nil {
+				t.Fatalf("expected a file access log, got %v", cm.AccessLog)
+			}
+			if tt.expected == 0 {
+				if fileLog.Filter != nil {
+					t.Fatalf("expected no access log filter, got %v", fileLog.Filter)
+				}
+				return
+			}
+			comparison := fileLog.Filter.GetStatusCodeFilter().GetComparison()
+			if comparison.GetOp() != accesslog.ComparisonFilter_GE || comparison.GetValue().GetDefaultValue() != tt.expected {
+				t.Fatalf("expected status code filter >= %d, got %v", tt.expected, fileLog.Filter)
+			}
+			if err := fileLog.Validate(); err != nil {
+				t.Fatalf("invalid access log: %v", err)
+			}
+		})
+	}
+}
+
+func TestHTTPConnectionManagerNormalizePath(t *testing.T) {
+	cases := []struct {
+		name          string
+		metadata      map[string]string
+		normalizePath bool
+		mergeSlashes  bool
+	}{
+		{"default", nil, true, false},
+		{"on", map[string]string{model.NodeMetadataNormalizePath: "on"}, true, false},
+		{"off", map[string]string{model.NodeMetadataNormalizePath: "off"}, false, false},
+		{"merge slashes", map[string]string{model.NodeMetadataNormalizePath: "merge-slashes"}, true, true},
+		{"invalid", map[string]string{model.NodeMetadataNormalizePath: "raw"}, true, false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			env := buildListenerEnv(nil)
+			node := &model.Proxy{Metadata: tt.metadata}
+			cm := buildHTTPConnectionManager(node, &env, &httpListenerOpts{}, nil)
+			if cm.NormalizePath == nil || cm.NormalizePath.Value != tt.normalizePath {
+				t.Fatalf("expected normalize_path %v, got %v", tt.normalizePath, cm.NormalizePath)
+			}
+			if cm.MergeSlashes != tt.mergeSlashes {
+				t.Fatalf("expected merge_slashes %v, got %v", tt.mergeSlashes, cm.MergeSlashes)
+			}
+		})
+	}
+}
+
+func TestHTTPConnectionManagerStreamIdleTimeout(t *testing.T) {
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		expected time.Duration
+	}{
+		{"default", nil, 0},
+		{"valid", map[string]string{model.NodeMetadataStreamIdleTimeout: "5m"}, 5 * time.Minute},
+		{"invalid", map[string]string{model.NodeMetadataStreamIdleTimeout: "five minutes"}, 0},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			env := buildListenerEnv(nil)
+			node := &model.Proxy{Metadata: tt.metadata}
+			cm := buildHTTPConnectionManager(node, &env, &httpListenerOpts{}, nil)
+			if cm.StreamIdleTimeout == nil || *cm.StreamIdleTimeout != tt.expected {
+				t.Fatalf("expected stream idle timeout %v, got %v", tt.expected, cm.StreamIdleTimeout)
+			}
+		})
+	}
+}
+
+func TestHTTPConnectionManagerTraceSampling(t *testing.T) {
+	defaults := authn_model.GetTraceConfig()
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		expected authn_model.TraceConfig
+	}{
+		{"default", nil, defaults},
+		{
+			"overrides",
+			map[string]string{
+				model.NodeMetadataTraceClientSampling:  "50",
+				model.NodeMetadataTraceRandomSampling:  "100",
+				model.NodeMetadataTraceOverallSampling: "0.5",
+			},
+			authn_model.TraceConfig{ClientSampling: 50, RandomSampling: 100, OverallSampling: 0.5},
+		},
+		{
+			"partial override",
+			map[string]string{model.NodeMetadataTraceRandomSampling: "25"},
+			authn_model.TraceConfig{ClientSampling: defaults.ClientSampling, RandomSampling: 25, OverallSampling: defaults.OverallSampling},
+		},
+		{
+			"out of range values are ignored",
+			map[string]string{
+				model.NodeMetadataTraceClientSampling:  "101",
+				model.NodeMetadataTraceRandomSampling:  "-5",
+				model.NodeMetadataTraceOverallSampling: "half",
+			},
+			defaults,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			env := buildListenerEnv(nil)
+			env.Mesh.EnableTracing = true
+			node := &model.Proxy{Metadata: tt.metadata}
+			cm := buildHTTPConnectionManager(node, &env, &httpListenerOpts{}, nil)
+			if cm.Tracing == nil {
+				t.Fatalf("expected tracing to be enabled")
+			}
+			got := authn_model.TraceConfig{
+				ClientSampling:  cm.Tracing.ClientSampling.Value,
+				RandomSampling:  cm.Tracing.RandomSampling.Value,
+				OverallSampling: cm.Tracing.OverallSampling.Value,
+			}
+			if got != tt.expected {
+				t.Fatalf("expected sampling %+v, got %+v", tt.expected, got)
+			}
+			if cm.GenerateRequestId == nil || !cm.GenerateRequestId.Value {
+				t.Fatalf("expected request IDs to be generated when tracing")
+			}
+		})
+	}
+}
+
+func TestHTTPConnectionManagerBeforeRouterFilters(t *testing.T) {
+	env := buildListenerEnv(nil)
+	cm := buildHTTPConnectionManager(&model.Proxy{}, &env, &httpListenerOpts{
+		addGRPCWebFilter:    true,
+		beforeRouterFilters: []*http_conn.HttpFilter{{Name: "envoy.ext_authz"}, {Name: "envoy.wasm"}},
+	}, []*http_conn.HttpFilter{{Name: "mixer"}})
+	expected := []string{"mixer", xdsutil.GRPCWeb, xdsutil.CORS, xdsutil.Fault, "envoy.ext_authz", "envoy.wasm", xdsutil.Router}
+	if got := httpFilterNames(cm); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected HTTP filters %v, got %v", expected, got)
+	}
+}
+
+func TestOutboundListenerBeforeRouterFilters(t *testing.T) {
+	p := &fakePlugin{httpBeforeRouter: []*http_conn.HttpFilter{{Name: "envoy.ext_authz"}}}
+	listeners := buildOutboundListeners(p, nil, nil, buildService("test.com", wildcardIP, protocol.HTTP, tnow))
+	if len(listeners) != 1 {
+		t.Fatalf("expected one listener, got %d", len(listeners))
+	}
+	found := false
+	for _, fc := range listeners[0].FilterChains {
+		filters := fc.Filters
+		if filters[len(filters)-1].Name != xdsutil.HTTPConnectionManager {
+			continue
+		}
+		found = true
+		cm := &http_conn.HttpConnectionManager{}
+		if err := getFilterConfig(filters[len(filters)-1], cm); err != nil {
+			t.Fatalf("failed to get HTTP connection manager config: %s", err)
+		}
+		// The test EnvoyFilter inserts envoy.lua first.
+		expected := []string{"envoy.lua", xdsutil.CORS, xdsutil.Fault, "envoy.ext_authz", xdsutil.Router}
+		if got := httpFilterNames(cm); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected HTTP filters %v, got %v", expected, got)
+		}
+	}
+	if !found {
+		t.Fatal("expected an HTTP filter chain")
+	}
+}
+
+func httpFilterNames(cm *http_conn.HttpConnectionManager) []string {
+	names := make([]string, 0, len(cm.HttpFilters))
+	for _, f := range cm.HttpFilters {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestHTTPConnectionManagerRequestLimits(t *testing.T) {
+	defer func(kb, streams uint32) {
+		defaultMaxRequestHeadersKb, defaultHTTP2MaxConcurrentStreams = kb, streams
+	}(defaultMaxRequestHeadersKb, defaultHTTP2MaxConcurrentStreams)
+
+	cases := []struct {
+		name            string
+		metadata        map[string]string
+		defaultKb       uint32
+		defaultStreams  uint32
+		http2Options    *core.Http2ProtocolOptions
+		expectedKb      uint32
+		expectedStreams uint32
+	}{
+		{name: "default", http2Options: &core.Http2ProtocolOptions{}},
+		{
+			name:            "mesh defaults",
+			defaultKb:       32,
+			defaultStreams:  100,
+			http2Options:    &core.Http2ProtocolOptions{},
+			expectedKb:      32,
+			expectedStreams: 100,
+		},
+		{
+			name: "metadata overrides",
+			metadata: map[string]string{
+				model.NodeMetadataMaxRequestHeadersKb:       "16",
+				model.NodeMetadataHTTP2MaxConcurrentStreams: "10",
+			},
+			defaultKb:       32,
+			defaultStreams:  100,
+			http2Options:    &core.Http2ProtocolOptions{},
+			expectedKb:      16,
+			expectedStreams: 10,
+		},
+		{
+			name: "invalid metadata",
+			metadata: map[string]string{
+				model.NodeMetadataMaxRequestHeadersKb:       "128",
+				model.NodeMetadataHTTP2MaxConcurrentStreams: "-1",
+			},
+			defaultKb:       32,
+			http2Options:    &core.Http2ProtocolOptions{},
+			expectedKb:      32,
+			expectedStreams: 0,
+		},
+		{
+			name:           "http/1 listener",
+			defaultKb:      32,
+			defaultStreams: 100,
+			expectedKb:     32,
+		},
+		{
+			name:            "listener limit takes precedence",
+			defaultStreams:  100,
+			http2Options:    &core.Http2ProtocolOptions{MaxConcurrentStreams: &types.UInt32Value{Value: 5}},
+			expectedStreams: 5,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			defaultMaxRequestHeadersKb, defaultHTTP2MaxConcurrentStreams = tt.defaultKb, tt.defaultStreams
+			env := buildListenerEnv(nil)
+			node := &model.Proxy{Metadata: tt.metadata}
+			cm := buildHTTPConnectionManager(node, &env, &httpListenerOpts{
+				connectionManager: &http_conn.HttpConnectionManager{Http2ProtocolOptions: tt.http2Options},
+			}, nil)
+			if got := cm.MaxRequestHeadersKb.GetValue(); got != tt.expectedKb || (tt.expectedKb == 0) != (cm.MaxRequestHeadersKb == nil) {
+				t.Fatalf("expected max request headers %d KiB, got %v", tt.expectedKb, cm.MaxRequestHeadersKb)
+			}
+			if tt.http2Options == nil {
+				if cm.Http2ProtocolOptions != nil {
+					t.Fatalf("expected no HTTP/2 options, got %v", cm.Http2ProtocolOptions)
+				}
+				return
+			}
+			streams := cm.Http2ProtocolOptions.MaxConcurrentStreams
+			if streams.GetValue() != tt.expectedStreams || (tt.expectedStreams == 0) != (streams == nil) {
+				t.Fatalf("expected %d max concurrent streams, got %v", tt.expectedStreams, streams)
+			}
+		})
 	}
+}
 
-	if l := findListenerByPort(listeners, 8080); isHTTPListener(l) {
-		t.Fatalf("expected TCP listener on port 8080, found HTTP: %v", l)
+func TestMergeCIDRFilterChains(t *testing.T) {
+	chain := func(cluster string, cidrs ...string) *listener.FilterChain {
+		match := &listener.FilterChainMatch{}
+		for _, cidr := range cidrs {
+			match.PrefixRanges = append(match.PrefixRanges, &core.CidrRange{AddressPrefix: cidr, PrefixLen: &types.UInt32Value{Value: 32}})
+		}
+		return &listener.FilterChain{
+			FilterChainMatch: match,
+			Filters: []*listener.Filter{{
+				Name: xdsutil.TCPProxy,
+				ConfigType: &listener.Filter_Config{Config: &types.Struct{Fields: map[string]*types.Value{
+					"cluster": {Kind: &types.Value_StringValue{StringValue: cluster}},
+				}}},
+			}},
+		}
 	}
+	blackhole := chain("BlackHoleCluster", "1.1.1.1")
 
-	if l := findListenerByPort(listeners, 3306); !isMysqlListener(l) {
-		t.Fatalf("expected MySQL listener on port 3306, found %v", l)
+	cases := []struct {
+		name     string
+		in       []*listener.FilterChain
+		expected []*listener.FilterChain
+	}{
+		{
+			name:     "identical filters",
+			in:       []*listener.FilterChain{chain("a", "10.0.0.1"), chain("a", "10.0.0.2")},
+			expected: []*listener.FilterChain{chain("a", "10.0.0.1", "10.0.0.2")},
+		},
+		{
+			name:     "different filters",
+			in:       []*listener.FilterChain{chain("a", "10.0.0.1"), chain("b", "10.0.0.2")},
+			expected: []*listener.FilterChain{chain("a", "10.0.0.1"), chain("b", "10.0.0.2")},
+		},
+		{
+			name:     "duplicate CIDRs",
+			in:       []*listener.FilterChain{chain("a", "10.0.0.1", "10.0.0.2"), chain("a", "10.0.0.2")},
+			expected: []*listener.FilterChain{chain("a", "10.0.0.1", "10.0.0.2")},
+		},
+		{
+			name: "blackhole chain stays first",
+			in: []*listener.FilterChain{blackhole, chain("a", "10.0.0.1"), chain("b", "10.0.0.2"),
+				chain("a", "10.0.0.3"), {Filters: chain("a").Filters}},
+			expected: []*listener.FilterChain{blackhole, chain("a", "10.0.0.1", "10.0.0.3"), chain("b", "10.0.0.2"),
+				{Filters: chain("a").Filters}},
+		},
 	}
-
-	if l := findListenerByPort(listeners, 9000); !isHTTPListener(l) {
-		t.Fatalf("expected HTTP listener on port 9000, found TCP\n%v", l)
-	} else {
-		f := l.FilterChains[0].Filters[0]
-		cfg, _ := xdsutil.MessageToStruct(f.GetTypedConfig())
-		if useRemoteAddress, exists := cfg.Fields["use_remote_address"]; exists {
-			if exists && useRemoteAddress.GetBoolValue() {
-				t.Fatalf("expected useRemoteAddress false, found true %v", l)
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeCIDRFilterChains(tt.in)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
 			}
-		}
+		})
 	}
 }
 
-func testOutboundListenerConfigWithSidecarWithUseRemoteAddress(t *testing.T, services ...*model.Service) {
-	t.Helper()
-	p := &fakePlugin{}
-	sidecarConfig := &model.Config{
-		ConfigMeta: model.ConfigMeta{
-			Name:      "foo",
-			Namespace: "not-default",
+func TestBuildListenerSingleFilterChain(t *testing.T) {
+	tlsContext := &auth.DownstreamTlsContext{RequireClientCertificate: &types.BoolValue{Value: true}}
+	cases := []struct {
+		name string
+		opts buildListenerOpts
+	}{
+		{
+			name: "plain",
+			opts: buildListenerOpts{bind: wildcardIP, port: 8080, bindToPort: true,
+				filterChainOpts: []*filterChainOpts{{}}},
 		},
-		Spec: &networking.Sidecar{
-			Egress: []*networking.IstioEgressListener{
-				{
-					Port: &networking.Port{
-						Number:   9000,
-						Protocol: "HTTP",
-						Name:     "uds",
-					},
-					Bind:  "1.1.1.1",
-					Hosts: []string{"*/*"},
-				},
-			},
+		{
+			name: "tls without bind to port",
+			opts: buildListenerOpts{bind: wildcardIP, port: 8443,
+				filterChainOpts: []*filterChainOpts{{tlsContext: tlsContext}}},
 		},
 	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if !isSimpleFilterChain(tt.opts.filterChainOpts) {
+				t.Fatal("expected the single filter chain fast path to be taken")
+			}
+			got := buildListener(tt.opts)
+			filterChains, listenerFilters := buildMatchingFilterChains(tt.opts.filterChainOpts)
+			if !reflect.DeepEqual(got.FilterChains, filterChains) || !reflect.DeepEqual(got.ListenerFilters, listenerFilters) {
+				t.Fatalf("fast path differs from generic path: got %v %v, want %v %v",
+					got.FilterChains, got.ListenerFilters, filterChains, listenerFilters)
+			}
+		})
+	}
+}
 
-	// enable use remote address to true
-	_ = os.Setenv(features.UseRemoteAddress.Name, "true")
-
-	defer func() { _ = os.Unsetenv(features.UseRemoteAddress.Name) }()
+func TestBuildListenerSkipTLSInspector(t *testing.T) {
+	originalDst := &listener.ListenerFilter{Name: xdsutil.OriginalDestination}
+	chains := func() []*filterChainOpts {
+		return []*filterChainOpts{
+			{sniHosts: []string{"a.example.org"}, listenerFilters: []*listener.ListenerFilter{originalDst}},
+			{sniHosts: []string{"b.example.org"}},
+		}
+	}
+	cases := []struct {
+		name      string
+		skip      bool
+		metadata  map[string]string
+		inspector bool
+	}{
+		{name: "default", inspector: true},
+		{name: "option", skip: true},
+		{name: "metadata", metadata: map[string]string{model.NodeMetadataDisableTLSInspector: "1"}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			l := buildListener(buildListenerOpts{
+				bind:             wildcardIP,
+				port:             443,
+				proxy:            &model.Proxy{Metadata: tt.metadata},
+				filterChainOpts:  chains(),
+				skipTLSInspector: tt.skip,
+			})
+			var names []string
+			for _, f := range l.ListenerFilters {
+				names = append(names, f.Name)
+			}
+			expected := []string{xdsutil.OriginalDestination}
+			if tt.inspector {
+				expected = []string{xdsutil.TlsInspector, xdsutil.OriginalDestination}
+			}
+			if !reflect.DeepEqual(names, expected) {
+				t.Fatalf("expected listener filters %v, got %v", expected, names)
+			}
+			// The filter chain matches are kept.
+			if len(l.FilterChains) != 2 || len(l.FilterChains[0].FilterChainMatch.GetServerNames()) != 1 {
+				t.Fatalf("expected the SNI filter chain matches to be kept, got %v", l.FilterChains)
+			}
+		})
+	}
+}
 
-	listeners := buildOutboundListeners(p, sidecarConfig, nil, services...)
+func TestBuildListenerOriginalDst(t *testing.T) {
+	transparent := map[string]string{
+		model.NodeMetadataInterceptionMode: string(model.InterceptionNone),
+		model.NodeMetadataTransparentProxy: "1",
+	}
+	cases := []struct {
+		name       string
+		proxy      *model.Proxy
+		bindToPort bool
+		sni        bool
+		expected   []string
+	}{
+		{
+			name:       "transparent none mode",
+			proxy:      &model.Proxy{Type: model.SidecarProxy, Metadata: transparent},
+			bindToPort: true,
+			expected:   []string{xdsutil.OriginalDestination},
+		},
+		{
+			name:       "before tls inspector",
+			proxy:      &model.Proxy{Type: model.SidecarProxy, Metadata: transparent},
+			bindToPort: true,
+			sni:        true,
+			expected:   []string{xdsutil.OriginalDestination, xdsutil.TlsInspector},
+		},
+		{
+			name: "none mode",
+			proxy: &model.Proxy{Type: model.SidecarProxy, Metadata: map[string]string{
+				model.NodeMetadataInterceptionMode: string(model.InterceptionNone)}},
+			bindToPort: true,
+			sni:        true,
+			expected:   []string{xdsutil.TlsInspector},
+		},
+		{
+			name: "redirect mode",
+			proxy: &model.Proxy{Type: model.SidecarProxy, Metadata: map[string]string{
+				model.NodeMetadataTransparentProxy: "1"}},
+			bindToPort: true,
+		},
+		{
+			name:       "router",
+			proxy:      &model.Proxy{Type: model.Router, Metadata: transparent},
+			bindToPort: true,
+		},
+		{
+			name:  "not bound to port",
+			proxy: &model.Proxy{Type: model.SidecarProxy, Metadata: transparent},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := &filterChainOpts{}
+			if tt.sni {
+				chain.sniHosts = []string{"a.example.org"}
+			}
+			l := buildListener(buildListenerOpts{
+				bind:            "127.0.0.1",
+				port:            8080,
+				proxy:           tt.proxy,
+				bindToPort:      tt.bindToPort,
+				filterChainOpts: []*filterChainOpts{chain},
+			})
+			var names []string
+			for _, f := range l.ListenerFilters {
+				names = append(names, f.Name)
+			}
+			if !reflect.DeepEqual(names, tt.expected) {
+				t.Fatalf("expected listener filters %v, got %v", tt.expected, names)
+			}
+		})
+	}
+}
 
-	if l := findListenerByPort(listeners, 9000); !isHTTPListener(l) {
-		t.Fatalf("expected HTTP listener on port 9000, found TCP\n%v", l)
-	} else {
-		f := l.FilterChains[0].Filters[0]
-		cfg, _ := xdsutil.MessageToStruct(f.GetTypedConfig())
-		if useRemoteAddress, exists := cfg.Fields["use_remote_address"]; exists {
-			if !exists || !useRemoteAddress.GetBoolValue() {
-				t.Fatalf("expected useRemoteAddress true, found false %v", l)
+func TestBuildListenerName(t *testing.T) {
+	cases := []struct {
+		bind     string
+		port     int
+		expected string
+	}{
+		{"0.0.0.0", 80, "0.0.0.0_80"},
+		{"10.0.0.1", 9080, "10.0.0.1_9080"},
+		{"unix:///var/run/app.sock", 0, "unix__2Fvar_2Frun_2Fapp.sock_0"},
+		{"unix://foo/bar/baz", 0, "unix_foo_2Fbar_2Fbaz_0"},
+		{"unix://foo:bar", 0, "unix_foo_3Abar_0"},
+		{"unix://foo_3Abar", 0, "unix_foo_5F3Abar_0"},
+		{"unix://foo/bar_baz", 0, "unix_foo_2Fbar_5Fbaz_0"},
+		{"unix://foo_bar/baz", 0, "unix_foo_5Fbar_2Fbaz_0"},
+	}
+	names := map[string]string{}
+	for _, tt := range cases {
+		t.Run(tt.bind, func(t *testing.T) {
+			got := buildListenerName(tt.bind, tt.port)
+			if got != tt.expected {
+				t.Fatalf("expected listener name %q, got %q", tt.expected, got)
 			}
-		}
+			if again := buildListenerName(tt.bind, tt.port); again != got {
+				t.Fatalf("listener name is not stable: %q and %q", got, again)
+			}
+			if other, f := names[got]; f {
+				t.Fatalf("binds %q and %q map to the same listener name %q", other, tt.bind, got)
+			}
+			names[got] = tt.bind
+			if strings.HasPrefix(tt.bind, model.UnixAddressPrefix) && strings.ContainsAny(got, "/:") {
+				t.Fatalf("listener name %q contains characters that are not sanitized", got)
+			}
+		})
 	}
 }
 
-func testOutboundListenerConfigWithSidecarWithCaptureModeNone(t *testing.T, services ...*model.Service) {
-	t.Helper()
-	p := &fakePlugin{}
-	sidecarConfig := &model.Config{
-		ConfigMeta: model.ConfigMeta{
-			Name:      "foo",
-			Namespace: "not-default",
+func TestBuildListenerProxyProtocol(t *testing.T) {
+	transparent := &model.Proxy{Type: model.SidecarProxy, Metadata: map[string]string{
+		model.NodeMetadataInterceptionMode: string(model.InterceptionNone),
+		model.NodeMetadataTransparentProxy: "1",
+	}}
+	cases := []struct {
+		name          string
+		proxy         *model.Proxy
+		proxyProtocol bool
+		expected      []string
+	}{
+		{
+			name:     "disabled",
+			proxy:    &model.Proxy{Type: model.Router},
+			expected: []string{xdsutil.TlsInspector},
 		},
-		Spec: &networking.Sidecar{
-			Egress: []*networking.IstioEgressListener{
-				{
-					// Bind + Port
-					CaptureMode: networking.CaptureMode_NONE,
-					Port: &networking.Port{
-						Number:   9090,
-						Protocol: "HTTP",
-						Name:     "grpc",
-					},
-					Bind:  "127.1.1.2",
-					Hosts: []string{"*/*"},
-				},
-				{
-					// Bind Only
-					CaptureMode: networking.CaptureMode_NONE,
-					Bind:        "127.1.1.2",
-					Hosts:       []string{"*/*"},
-				},
-				{
-					// Port Only
-					CaptureMode: networking.CaptureMode_NONE,
-					Port: &networking.Port{
-						Number:   9090,
-						Protocol: "HTTP",
-						Name:     "grpc",
-					},
-					Hosts: []string{"*/*"},
-				},
-				{
-					// None
-					CaptureMode: networking.CaptureMode_NONE,
-					Hosts:       []string{"*/*"},
-				},
-			},
+		{
+			name:          "enabled",
+			proxy:         &model.Proxy{Type: model.Router},
+			proxyProtocol: true,
+			expected:      []string{xdsutil.ProxyProtocol, xdsutil.TlsInspector},
+		},
+		{
+			name:          "after original destination",
+			proxy:         transparent,
+			proxyProtocol: true,
+			expected:      []string{xdsutil.OriginalDestination, xdsutil.ProxyProtocol, xdsutil.TlsInspector},
 		},
 	}
-	listeners := buildOutboundListeners(p, sidecarConfig, nil, services...)
-	if len(listeners) != 4 {
-		t.Fatalf("expected %d listeners, found %d", 4, len(listeners))
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			l := buildListener(buildListenerOpts{
+				bind:            wildcardIP,
+				port:            443,
+				proxy:           tt.proxy,
+				bindToPort:      true,
+				proxyProtocol:   tt.proxyProtocol,
+				filterChainOpts: []*filterChainOpts{{sniHosts: []string{"a.example.org"}}},
+			})
+			var names []string
+			for _, f := range l.ListenerFilters {
+				names = append(names, f.Name)
+			}
+			if !reflect.DeepEqual(names, tt.expected) {
+				t.Fatalf("expected listener filters %v, got %v", tt.expected, names)
+			}
+		})
 	}
+}
 
-	expectedListeners := map[string]string{
-		"127.1.1.2_9090": "HTTP",
-		"127.1.1.2_8080": "TCP",
-		"127.0.0.1_9090": "HTTP",
-		"127.0.0.1_8080": "TCP",
+func TestHTTPProxyOriginalDst(t *testing.T) {
+	env := buildListenerEnv(nil)
+	if err := env.PushContext.InitContext(&env); err != nil {
+		t.Fatal(err)
+	}
+	proxy := &model.Proxy{
+		Type:        model.SidecarProxy,
+		IPAddresses: []string{"1.1.1.1"},
+		Metadata: map[string]string{
+			model.NodeMetadataInterceptionMode: string(model.InterceptionNone),
+			model.NodeMetadataTransparentProxy: "1",
+		},
+	}
+	l := NewConfigGenerator(nil).buildHTTPProxy(&env, proxy, env.PushContext, nil)
+	if l == nil {
+		t.Fatal("expected the HTTP proxy listener")
 	}
+	if len(l.ListenerFilters) != 1 || l.ListenerFilters[0].Name != xdsutil.OriginalDestination {
+		t.Fatalf("expected the original destination listener filter, got %v", l.ListenerFilters)
+	}
+}
 
-	for _, l := range listeners {
-		listenerName := l.Name
-		expectedListenerType := expectedListeners[listenerName]
-		if expectedListenerType == "" {
-			t.Fatalf("listener %s not expected", listenerName)
-		}
-		if expectedListenerType == "TCP" && isHTTPListener(l) {
-			t.Fatalf("expected TCP listener %s, but found HTTP", listenerName)
-		}
-		if expectedListenerType == "HTTP" && !isHTTPListener(l) {
-			t.Fatalf("expected HTTP listener %s, but found TCP", listenerName)
-		}
+func TestServerNameOverlaps(t *testing.T) {
+	chain := func(port uint32, serverNames ...string) *listener.FilterChain {
+		return &listener.FilterChain{FilterChainMatch: &listener.FilterChainMatch{
+			DestinationPort: &types.UInt32Value{Value: port},
+			ServerNames:     serverNames,
+		}}
+	}
+	cases := []struct {
+		name     string
+		chains   []*listener.FilterChain
+		expected [][2]string
+	}{
+		{
+			name:     "same server name",
+			chains:   []*listener.FilterChain{chain(443, "a.example.com", "foo.example.com"), chain(443, "foo.example.com")},
+			expected: [][2]string{{"foo.example.com", "foo.example.com"}},
+		},
+		{
+			name:     "wildcard",
+			chains:   []*listener.FilterChain{chain(443, "*.example.com"), chain(443, "foo.example.com")},
+			expected: [][2]string{{"*.example.com", "foo.example.com"}},
+		},
+		{
+			name:     "nested wildcards",
+			chains:   []*listener.FilterChain{chain(443, "*.foo.example.com"), chain(443, "*.example.com")},
+			expected: [][2]string{{"*.foo.example.com", "*.example.com"}},
+		},
+		{
+			name:   "disjoint",
+			chains: []*listener.FilterChain{chain(443, "*.example.com", "foo.example.org"), chain(443, "example.com", "bar.example.org")},
+		},
+		{
+			name:   "other match differs",
+			chains: []*listener.FilterChain{chain(443, "*.example.com"), chain(8443, "foo.example.com")},
+		},
+		{
+			name:   "no server names",
+			chains: []*listener.FilterChain{chain(443), {}, chain(443, "foo.example.com")},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serverNameOverlaps(tt.chains); !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected overlaps %v, got %v", tt.expected, got)
+			}
+		})
 	}
 }
 
-func TestOutboundListenerAccessLogs(t *testing.T) {
-	t.Helper()
-	p := &fakePlugin{}
-	listeners := buildAllListeners(p, nil)
-	for _, l := range listeners {
-		if l.Name == "virtual" {
-			fc := &tcp_proxy.TcpProxy{}
-			if err := getFilterConfig(l.FilterChains[0].Filters[0], fc); err != nil {
-				t.Fatalf("failed to get TCP Proxy config: %s", err)
+func TestBuildListenerServerNameOverlapStatus(t *testing.T) {
+	cases := []struct {
+		name     string
+		sniHosts [][]string
+		expected int
+	}{
+		{"disjoint", [][]string{{"foo.example.com"}, {"bar.example.com"}}, 0},
+		{"wildcard overlap", [][]string{{"foo.example.com"}, {"*.example.com"}}, 1},
+	}
+	dir, err := ioutil.TempDir("", "overlap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	logFile := filepath.Join(dir, "pilot.log")
+	o := log.DefaultOptions()
+	o.OutputPaths = []string{logFile}
+	if err := log.Configure(o); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = log.Configure(log.DefaultOptions()) }()
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			push := model.NewPushContext()
+			opts := buildListenerOpts{
+				push:  push,
+				proxy: &model.Proxy{ID: "gateway", Type: model.Router},
+				bind:  wildcardIP,
+				port:  443,
 			}
-			if fc.AccessLog == nil {
-				t.Fatal("expected access log configuration")
+			for _, hosts := range tt.sniHosts {
+				opts.filterChainOpts = append(opts.filterChainOpts, &filterChainOpts{sniHosts: hosts})
 			}
-		}
+			// Listeners are built on every push, the overlap is only reported once.
+			buildListener(opts)
+			buildListener(opts)
+			if status := push.ProxyStatus[model.ProxyStatusSNIOverlap.Name()]; len(status) != tt.expected {
+				t.Fatalf("expected %d listeners with overlapping server names, got %v", tt.expected, status)
+			}
+
+			_ = log.Sync()
+			out, err := ioutil.ReadFile(logFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			warned := strings.Contains(string(out), "Filter chains of listener 0.0.0.0_443 have overlapping server names")
+			if warned != (tt.expected > 0) {
+				t.Fatalf("expected overlap warning %v, got log %q", tt.expected > 0, out)
+			}
+		})
 	}
 }
 
+func BenchmarkBuildListenerFilterChains(b *testing.B) {
+	chains := []*filterChainOpts{{}}
+	b.Run("single chain fast path", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			buildListenerFilterChains(chains)
+		}
+	})
+	b.Run("single chain generic path", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			buildMatchingFilterChains(chains)
+		}
+	})
+}
+
 func verifyOutboundTCPListenerHostname(t *testing.T, l *xdsapi.Listener, hostname host.Name) {
 	t.Helper()
 	if len(l.FilterChains) != 1 {
@@ -836,16 +2651,33 @@ func buildInboundListeners(p plugin.Plugin, proxy *model.Proxy, sidecarConfig *m
 
 type fakePlugin struct {
 	outboundListenerParams []*plugin.InputParams
+	inboundListenerParams  []*plugin.InputParams
+	// dropListeners makes the plugin veto all inbound and outbound listeners
+	dropListeners bool
+	// httpBeforeRouter are added before the Router filter of the outbound HTTP filter chains
+	httpBeforeRouter []*http_conn.HttpFilter
 }
 
 var _ plugin.Plugin = (*fakePlugin)(nil)
 
 func (p *fakePlugin) OnOutboundListener(in *plugin.InputParams, mutable *plugin.MutableObjects) error {
 	p.outboundListenerParams = append(p.outboundListenerParams, in)
+	if p.dropListeners {
+		return plugin.ErrDropListener
+	}
+	if in.ListenerProtocol == plugin.ListenerProtocolHTTP {
+		for i := range mutable.FilterChains {
+			mutable.FilterChains[i].HTTPBeforeRouter = append(mutable.FilterChains[i].HTTPBeforeRouter, p.httpBeforeRouter...)
+		}
+	}
 	return nil
 }
 
 func (p *fakePlugin) OnInboundListener(in *plugin.InputParams, mutable *plugin.MutableObjects) error {
+	p.inboundListenerParams = append(p.inboundListenerParams, in)
+	if p.dropListeners {
+		return plugin.ErrDropListener
+	}
 	return nil
 }
 
@@ -853,6 +2685,10 @@ func (p *fakePlugin) OnVirtualListener(in *plugin.InputParams, mutable *plugin.M
 	return nil
 }
 
+func (p *fakePlugin) OnVirtualInboundListener(in *plugin.InputParams, mutable *plugin.MutableObjects) error {
+	return nil
+}
+
 func (p *fakePlugin) OnOutboundCluster(in *plugin.InputParams, cluster *xdsapi.Cluster) {
 }
 
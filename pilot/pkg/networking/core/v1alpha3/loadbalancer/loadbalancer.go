@@ -27,6 +27,10 @@ import (
 	"istio.io/istio/pilot/pkg/networking/util"
 )
 
+// ApplyLocalityLBSetting applies the mesh wide locality load balancer setting to the given
+// ClusterLoadAssignment, relative to the locality of the proxy receiving it. When failover
+// is applied, endpoints in the proxy's zone get the highest priority (0), followed by the
+// same region and finally other regions, as configured by the failover settings.
 func ApplyLocalityLBSetting(
 	locality *core.Locality,
 	loadAssignment *apiv2.ClusterLoadAssignment,
@@ -20,7 +20,6 @@ import (
 
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
 	accesslogconfig "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v2"
-	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/filter/accesslog/v2"
 	mongo_proxy "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/mongo_proxy/v2"
 	mysql_proxy "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/mysql_proxy/v1alpha1"
 	redis_proxy "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/redis_proxy/v2"
@@ -48,32 +47,42 @@ func buildInboundNetworkFilters(env *model.Environment, node *model.Proxy, insta
 		StatPrefix:       clusterName,
 		ClusterSpecifier: &tcp_proxy.TcpProxy_Cluster{Cluster: clusterName},
 	}
-	tcpFilter := setAccessLogAndBuildTCPFilter(env, node, tcpProxy)
+	// The TcpProxy has no maximum connection duration in the vendored Envoy API, idle connections are
+	// closed instead so that they are reestablished against the current configuration.
+	if idleTimeout := node.GetListenerMetadata().InboundTCPIdleTimeout; idleTimeout > 0 {
+		tcpProxy.IdleTimeout = &idleTimeout
+	}
+	var tcpFilter *listener.Filter
+	if instance.Service.Attributes.DisableAccessLog {
+		// The service opted out of the access logs of its inbound listeners, as for the HTTP ones.
+		tcpFilter = buildTCPProxyFilter(node, tcpProxy)
+	} else {
+		tcpFilter = setAccessLogAndBuildTCPFilter(env, node, tcpProxy)
+	}
 	return buildNetworkFiltersStack(node, instance.Endpoint.ServicePort, tcpFilter, clusterName, clusterName)
 }
 
-// setAccessLog sets the AccessLog configuration in the given TcpProxy instance.
+// setAccessLog sets the AccessLog configuration in the given TcpProxy instance, honoring the access
+// log settings of the Sidecar resource of the proxy.
+// The TcpProxy emits a single entry per connection, when the connection is closed. Flushing on
+// connect or on an interval requires a newer TcpProxy API than the one vendored here.
 func setAccessLog(env *model.Environment, node *model.Proxy, config *tcp_proxy.TcpProxy) *tcp_proxy.TcpProxy {
-	if env.Mesh.AccessLogFile != "" {
-		fl := &accesslogconfig.FileAccessLog{
-			Path: env.Mesh.AccessLogFile,
-		}
-
-		acc := &accesslog.AccessLog{
-			Name: xdsutil.FileAccessLog,
-		}
-		buildAccessLog(fl, env)
+	disabled, format := sidecarAccessLog(node)
+	if env.Mesh.AccessLogFile != "" && !disabled {
+		config.AccessLog = append(config.AccessLog,
+			buildFileAccessLog(node, env, getAccessLogEncoding(env, node.GetListenerMetadata().TCPAccessLogEncoding), format))
+	}
 
-		if util.IsXDSMarshalingToAnyEnabled(node) {
-			acc.ConfigType = &accesslog.AccessLog_TypedConfig{TypedConfig: util.MessageToAny(fl)}
-		} else {
-			acc.ConfigType = &accesslog.AccessLog_Config{Config: util.MessageToStruct(fl)}
+	if env.Mesh.EnableEnvoyAccessLogService && !disabled {
+		fl := &accesslogconfig.TcpGrpcAccessLogConfig{
+			CommonConfig: &accesslogconfig.CommonGrpcAccessLogConfig{
+				LogName:     tcpEnvoyAccessLogName,
+				GrpcService: buildAccessLogGrpcService(),
+			},
 		}
-
-		config.AccessLog = append(config.AccessLog, acc)
+		config.AccessLog = append(config.AccessLog, buildAccessLogConfig(node, tcpGrpcAccessLog, fl))
 	}
 
-	// envoy als is not enabled for tcp
 	return config
 }
 
@@ -81,7 +90,11 @@ func setAccessLog(env *model.Environment, node *model.Proxy, config *tcp_proxy.T
 // TcpProxy instance and builds a TCP filter out of it.
 func setAccessLogAndBuildTCPFilter(env *model.Environment, node *model.Proxy, config *tcp_proxy.TcpProxy) *listener.Filter {
 	setAccessLog(env, node, config)
+	return buildTCPProxyFilter(node, config)
+}
 
+// buildTCPProxyFilter builds a TCP filter out of the given TcpProxy instance.
+func buildTCPProxyFilter(node *model.Proxy, config *tcp_proxy.TcpProxy) *listener.Filter {
 	tcpFilter := &listener.Filter{
 		Name: xdsutil.TCPProxy,
 	}
@@ -104,8 +117,7 @@ func buildOutboundNetworkFiltersWithSingleDestination(env *model.Environment, no
 		// TODO: Need to set other fields such as Idle timeouts
 	}
 
-	idleTimeout, err := time.ParseDuration(node.Metadata[model.NodeMetadataIdleTimeout])
-	if idleTimeout > 0 && err == nil {
+	if idleTimeout := node.GetListenerMetadata().IdleTimeout; idleTimeout > 0 {
 		tcpProxy.IdleTimeout = &idleTimeout
 	}
 
@@ -129,8 +141,7 @@ func buildOutboundNetworkFiltersWithWeightedClusters(env *model.Environment, nod
 		// TODO: Need to set other fields such as Idle timeouts
 	}
 
-	idleTimeout, err := time.ParseDuration(node.Metadata[model.NodeMetadataIdleTimeout])
-	if idleTimeout > 0 && err == nil {
+	if idleTimeout := node.GetListenerMetadata().IdleTimeout; idleTimeout > 0 {
 		proxyConfig.IdleTimeout = &idleTimeout
 	}
 
@@ -15,12 +15,21 @@
 package v1alpha3
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	accesslogconfig "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v2"
 	redis_proxy "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/redis_proxy/v2"
+	tcp_proxy "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
 	xdsutil "github.com/envoyproxy/go-control-plane/pkg/util"
 	"github.com/gogo/protobuf/types"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/protocol"
 )
 
 func TestBuildRedisFilter(t *testing.T) {
@@ -54,3 +63,117 @@ func TestBuildRedisFilter(t *testing.T) {
 		t.Errorf("redis filter type is %T not listener.Filter_Config ", redisFilter.ConfigType)
 	}
 }
+
+func TestBuildInboundNetworkFiltersIdleTimeout(t *testing.T) {
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		expected time.Duration
+	}{
+		{"unset", map[string]string{}, 0},
+		{"outbound idle timeout", map[string]string{model.NodeMetadataIdleTimeout: "10s"}, 0},
+		{"inbound idle timeout", map[string]string{model.NodeMetadataInboundTCPIdleTimeout: "1h"}, time.Hour},
+	}
+	service := buildService("mysql.example.org", "10.0.0.1", protocol.MySQL, tnow)
+	instance := &model.ServiceInstance{Service: service, Endpoint: buildEndpoint(service)}
+	env := buildListenerEnv(nil)
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &model.Proxy{Type: model.SidecarProxy, Metadata: tt.metadata}
+			filters := buildInboundNetworkFilters(&env, node, instance)
+			if len(filters) == 0 || filters[len(filters)-1].Name != xdsutil.TCPProxy {
+				t.Fatalf("expected a TCP proxy filter, got %v", filters)
+			}
+			tcpProxy := &tcp_proxy.TcpProxy{}
+			if err := getFilterConfig(filters[len(filters)-1], tcpProxy); err != nil {
+				t.Fatalf("failed to get TCP proxy config: %s", err)
+			}
+			if tt.expected == 0 {
+				if tcpProxy.IdleTimeout != nil {
+					t.Fatalf("expected no idle timeout, got %v", *tcpProxy.IdleTimeout)
+				}
+				return
+			}
+			if tcpProxy.IdleTimeout == nil || *tcpProxy.IdleTimeout != tt.expected {
+				t.Fatalf("expected idle timeout %v, got %v", tt.expected, tcpProxy.IdleTimeout)
+			}
+		})
+	}
+}
+
+func TestBuildInboundNetworkFiltersAccessLog(t *testing.T) {
+	service := buildService("mysql.example.org", "10.0.0.1", protocol.MySQL, tnow)
+	instance := &model.ServiceInstance{Service: service, Endpoint: buildEndpoint(service)}
+	node := &model.Proxy{Type: model.SidecarProxy, Metadata: map[string]string{}}
+	for _, encoding := range []meshconfig.MeshConfig_AccessLogEncoding{meshconfig.MeshConfig_TEXT, meshconfig.MeshConfig_JSON} {
+		t.Run(encoding.String(), func(t *testing.T) {
+			env := buildListenerEnv(nil)
+			env.Mesh.AccessLogFile = "/dev/stdout"
+			env.Mesh.AccessLogEncoding = encoding
+			env.Mesh.EnableEnvoyAccessLogService = true
+
+			filters := buildInboundNetworkFilters(&env, node, instance)
+			tcpProxy := &tcp_proxy.TcpProxy{}
+			if err := getFilterConfig(filters[len(filters)-1], tcpProxy); err != nil {
+				t.Fatalf("failed to get TCP proxy config: %s", err)
+			}
+			if len(tcpProxy.AccessLog) != 2 {
+				t.Fatalf("expected file and access log service access logs, got %v", tcpProxy.AccessLog)
+			}
+
+			if tcpProxy.AccessLog[0].Name != xdsutil.FileAccessLog {
+				t.Fatalf("expected the file access log first, got %s", tcpProxy.AccessLog[0].Name)
+			}
+			fl := &accesslogconfig.FileAccessLog{}
+			if err := types.UnmarshalAny(tcpProxy.AccessLog[0].GetTypedConfig(), fl); err != nil {
+				t.Fatalf("failed to get file access log config: %s", err)
+			}
+			if fl.Path != env.Mesh.AccessLogFile {
+				t.Errorf("expected access log path %s, got %s", env.Mesh.AccessLogFile, fl.Path)
+			}
+			if encoding == meshconfig.MeshConfig_JSON && fl.GetJsonFormat() == nil {
+				t.Errorf("expected a JSON access log format, got %v", fl.AccessLogFormat)
+			}
+			if encoding == meshconfig.MeshConfig_TEXT && fl.GetFormat() == "" {
+				t.Errorf("expected a text access log format, got %v", fl.AccessLogFormat)
+			}
+
+			if tcpProxy.AccessLog[1].Name != tcpGrpcAccessLog {
+				t.Fatalf("expected the TCP gRPC access log second, got %s", tcpProxy.AccessLog[1].Name)
+			}
+			als := &accesslogconfig.TcpGrpcAccessLogConfig{}
+			if err := types.UnmarshalAny(tcpProxy.AccessLog[1].GetTypedConfig(), als); err != nil {
+				t.Fatalf("failed to get TCP gRPC access log config: %s", err)
+			}
+			if als.CommonConfig.LogName != tcpEnvoyAccessLogName ||
+				als.CommonConfig.GrpcService.GetEnvoyGrpc().GetClusterName() != EnvoyAccessLogCluster {
+				t.Errorf("unexpected TCP gRPC access log config %v", als)
+			}
+		})
+	}
+}
+
+func TestBuildInboundNetworkFiltersDisableAccessLog(t *testing.T) {
+	node := &model.Proxy{Type: model.SidecarProxy, Metadata: map[string]string{}}
+	for _, disabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(disabled), func(t *testing.T) {
+			service := buildService("mysql.example.org", "10.0.0.1", protocol.TCP, tnow)
+			service.Attributes.DisableAccessLog = disabled
+			instance := &model.ServiceInstance{Service: service, Endpoint: buildEndpoint(service)}
+			env := buildListenerEnv(nil)
+			env.Mesh.AccessLogFile = "/dev/stdout"
+
+			filters := buildInboundNetworkFilters(&env, node, instance)
+			tcpProxy := &tcp_proxy.TcpProxy{}
+			if err := getFilterConfig(filters[len(filters)-1], tcpProxy); err != nil {
+				t.Fatalf("failed to get TCP proxy config: %s", err)
+			}
+			if disabled && len(tcpProxy.AccessLog) != 0 {
+				t.Fatalf("expected no access logs, got %v", tcpProxy.AccessLog)
+			}
+			if !disabled && len(tcpProxy.AccessLog) == 0 {
+				t.Fatal("expected access logs")
+			}
+		})
+	}
+}
@@ -35,7 +35,7 @@ func NewPlugin() plugin.Plugin {
 
 // OnInboundFilterChains setups filter chains based on the authentication policy.
 func (Plugin) OnInboundFilterChains(in *plugin.InputParams) []plugin.FilterChain {
-	return factory.NewPolicyApplier(in.Env.IstioConfigStore,
+	return factory.NewPolicyApplier(in.Push, in.Env.IstioConfigStore,
 		in.ServiceInstance).InboundFilterChain(in.Env.Mesh.SdsUdsPath, in.Node.Metadata)
 }
 
@@ -63,7 +63,7 @@ func (Plugin) OnInboundListener(in *plugin.InputParams, mutable *plugin.MutableO
 }
 
 func buildFilter(in *plugin.InputParams, mutable *plugin.MutableObjects) error {
-	applier := factory.NewPolicyApplier(in.Env.IstioConfigStore, in.ServiceInstance)
+	applier := factory.NewPolicyApplier(in.Push, in.Env.IstioConfigStore, in.ServiceInstance)
 	if mutable.Listener == nil || (len(mutable.Listener.FilterChains) != len(mutable.FilterChains)) {
 		return fmt.Errorf("expected same number of filter chains in listener (%d) and mutable (%d)", len(mutable.Listener.FilterChains), len(mutable.FilterChains))
 	}
@@ -87,6 +87,11 @@ func (Plugin) OnVirtualListener(in *plugin.InputParams, mutable *plugin.MutableO
 	return nil
 }
 
+// OnVirtualInboundListener implements the Plugin interface method.
+func (Plugin) OnVirtualInboundListener(in *plugin.InputParams, mutable *plugin.MutableObjects) error {
+	return nil
+}
+
 // OnInboundCluster implements the Plugin interface method.
 func (Plugin) OnInboundCluster(in *plugin.InputParams, cluster *xdsapi.Cluster) {
 }
@@ -125,6 +125,11 @@ func (Plugin) OnVirtualListener(in *plugin.InputParams, mutable *plugin.MutableO
 	return nil
 }
 
+// OnVirtualInboundListener implements the Plugin interface method.
+func (Plugin) OnVirtualInboundListener(in *plugin.InputParams, mutable *plugin.MutableObjects) error {
+	return nil
+}
+
 // OnInboundCluster implements the Plugin interface method.
 func (Plugin) OnInboundCluster(in *plugin.InputParams, cluster *xdsapi.Cluster) {
 }
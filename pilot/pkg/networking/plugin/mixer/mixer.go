@@ -210,6 +210,11 @@ func (mixerplugin) OnVirtualListener(in *plugin.InputParams, mutable *plugin.Mut
 	return nil
 }
 
+// OnVirtualInboundListener implements the Plugin interface method.
+func (mixerplugin) OnVirtualInboundListener(in *plugin.InputParams, mutable *plugin.MutableObjects) error {
+	return nil
+}
+
 // OnOutboundCluster implements the Plugin interface method.
 func (mixerplugin) OnOutboundCluster(in *plugin.InputParams, cluster *xdsapi.Cluster) {
 	if !in.Env.Mesh.SidecarToTelemetrySessionAffinity {
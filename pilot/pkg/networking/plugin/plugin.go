@@ -15,6 +15,8 @@
 package plugin
 
 import (
+	"errors"
+
 	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
@@ -111,6 +113,9 @@ type FilterChain struct {
 	ListenerProtocol ListenerProtocol
 	// HTTP is the set of HTTP filters for this filter chain
 	HTTP []*http_conn.HttpFilter
+	// HTTPBeforeRouter is the set of HTTP filters inserted after the Fault filter, just before the
+	// Router filter of this filter chain.
+	HTTPBeforeRouter []*http_conn.HttpFilter
 	// TCP is the set of network (TCP) filters for this filter chain.
 	TCP []*listener.Filter
 }
@@ -127,16 +132,20 @@ type MutableObjects struct {
 	FilterChains []FilterChain
 }
 
+// ErrDropListener can be returned by OnInboundListener and OnOutboundListener to veto the listener
+// being built. The listener is then not added to the LDS output, and remaining plugins are not called.
+var ErrDropListener = errors.New("listener dropped by plugin")
+
 // Plugin is called during the construction of a xdsapi.Listener which may alter the Listener in any
 // way. Examples include AuthenticationPlugin that sets up mTLS authentication on the inbound Listener
 // and outbound Cluster, the mixer plugin that sets up policy checks on the inbound listener, etc.
 type Plugin interface {
 	// OnOutboundListener is called whenever a new outbound listener is added to the LDS output for a given service.
-	// Can be used to add additional filters on the outbound path.
+	// Can be used to add additional filters on the outbound path. Returning ErrDropListener drops the listener.
 	OnOutboundListener(in *InputParams, mutable *MutableObjects) error
 
 	// OnInboundListener is called whenever a new listener is added to the LDS output for a given service
-	// Can be used to add additional filters.
+	// Can be used to add additional filters. Returning ErrDropListener drops the listener.
 	OnInboundListener(in *InputParams, mutable *MutableObjects) error
 
 	// OnVirtualListener is called whenever a new virtual listener is added to the
@@ -144,6 +153,10 @@ type Plugin interface {
 	// Can be used to add additional filters.
 	OnVirtualListener(in *InputParams, mutable *MutableObjects) error
 
+	// OnVirtualInboundListener is called once the virtual inbound listener has been built with
+	// its default filter chains. Can be used to append or modify the filter chains of mutable.Listener.
+	OnVirtualInboundListener(in *InputParams, mutable *MutableObjects) error
+
 	// OnOutboundCluster is called whenever a new cluster is added to the CDS output.
 	// This is called once per push cycle, and not for every sidecar/gateway, except for gateways with non-standard
 	// operating modes.
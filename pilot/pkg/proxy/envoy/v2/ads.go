@@ -19,6 +19,7 @@ import (
 	"io"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -34,6 +35,7 @@ import (
 	"istio.io/istio/pilot/pkg/features"
 
 	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/core/v1alpha3"
 	"istio.io/istio/pilot/pkg/networking/util"
 	istiolog "istio.io/pkg/log"
 )
@@ -117,6 +119,11 @@ type XdsConnection struct {
 	// added will be true if at least one discovery request was received, and the connection
 	// is added to the map of active.
 	added bool
+
+	// warmup is set until the first full push to a connection that asked for a warmup push.
+	// While set, CDS and LDS requests are answered with the essential config of the sidecar. Only accessed by the
+	// connection goroutine. See model.NodeMetadataWarmupPush.
+	warmup bool
 }
 
 // configDump converts the connection internal state into an Envoy Admin API config dump proto
@@ -183,6 +190,10 @@ type XdsEvent struct {
 
 	// function to call once a push is finished. This must be called or future changes may be blocked.
 	done func()
+
+	// drain is set when the server is shutting down: the connection is closed, so that the proxy
+	// reconnects to another instance.
+	drain bool
 }
 
 func newXdsConnection(peerAddr string, stream DiscoveryStream) *XdsConnection {
@@ -291,7 +302,11 @@ func (s *DiscoveryServer) StreamAggregatedResources(stream ads.AggregatedDiscove
 				// soon as the CDS push is returned.
 				adsLog.Infof("ADS:CDS: REQ %v %s %v version:%s", peerAddr, con.ConID, time.Since(t0), discReq.VersionInfo)
 				con.CDSWatch = true
-				err := s.pushCds(con, s.globalPushContext(), versionInfo())
+				if con.warmup {
+					err = s.pushWarmup(con, ClusterType)
+				} else {
+					err = s.pushCds(con, s.globalPushContext(), versionInfo())
+				}
 				if err != nil {
 					return err
 				}
@@ -312,7 +327,11 @@ func (s *DiscoveryServer) StreamAggregatedResources(stream ads.AggregatedDiscove
 				// too verbose - sent immediately after EDS response is received
 				adsLog.Debugf("ADS:LDS: REQ %s %v", con.ConID, peerAddr)
 				con.LDSWatch = true
-				err := s.pushLds(con, s.globalPushContext(), versionInfo())
+				if con.warmup {
+					err = s.pushWarmup(con, ListenerType)
+				} else {
+					err = s.pushLds(con, s.globalPushContext(), versionInfo())
+				}
 				if err != nil {
 					return err
 				}
@@ -443,6 +462,12 @@ func (s *DiscoveryServer) StreamAggregatedResources(stream ads.AggregatedDiscove
 				con.mu.Unlock()
 			}
 		case pushEv := <-con.pushChannel:
+			if pushEv.drain {
+				pushEv.done()
+				adsLog.Infof("ADS: closing connection %s, server is shutting down", con.ConID)
+				return status.Error(codes.Unavailable, "server is shutting down")
+			}
+
 			// It is called when config changes.
 			// This is not optimized yet - we should detect what changed based on event and only
 			// push resources that need to be pushed.
@@ -481,6 +506,7 @@ func (s *DiscoveryServer) initConnectionNode(discReq *xdsapi.DiscoveryRequest, c
 	}
 	// Update the config namespace associated with this proxy
 	nt.ConfigNamespace = model.GetProxyConfigNamespace(nt)
+	nt.SetListenerMetadata()
 
 	if err := nt.SetServiceInstances(s.Env); err != nil {
 		return err
@@ -511,6 +537,10 @@ func (s *DiscoveryServer) initConnectionNode(discReq *xdsapi.DiscoveryRequest, c
 	if con.ConID == "" {
 		// first request
 		con.ConID = connectionID(discReq.Node.Id)
+		// Gateways have no smaller config that serves their traffic, and a reconnecting proxy already
+		// has a config, which the warmup config would partly remove.
+		con.warmup = nt.Metadata[model.NodeMetadataWarmupPush] == "1" && nt.Type == model.SidecarProxy &&
+			discReq.VersionInfo == ""
 	}
 	con.mu.Unlock()
 
@@ -541,6 +571,8 @@ func (s *DiscoveryServer) pushConnection(con *XdsConnection, pushEv *XdsEvent) e
 	if err := con.modelNode.SetWorkloadLabels(s.Env); err != nil {
 		return err
 	}
+	// This is a full push, the connection is done warming up.
+	con.warmup = false
 
 	if err := con.modelNode.SetServiceInstances(pushEv.push.Env); err != nil {
 		return err
@@ -597,6 +629,69 @@ func (s *DiscoveryServer) pushConnection(con *XdsConnection, pushEv *XdsEvent) e
 	return nil
 }
 
+// pushWarmup answers the first CDS or LDS request of a warming up connection with the essential
+// config of the sidecar, and queues a full push for the connection. The queue merges the events of
+// both requests, and a full push sent between them ends the warmup, so the proxy always ends up
+// with the full config.
+func (s *DiscoveryServer) pushWarmup(con *XdsConnection, typeURL string) error {
+	push := s.globalPushContext()
+	var response *xdsapi.DiscoveryResponse
+	switch typeURL {
+	case ClusterType:
+		response = con.clusters(warmupClusters(s.generateRawClusters(con.modelNode, push)))
+	case ListenerType:
+		response = ldsDiscoveryResponse(warmupListeners(con.modelNode, s.generateRawListeners(con, push)), versionInfo())
+	}
+	if err := con.send(response); err != nil {
+		adsLog.Warnf("ADS: warmup send failure %s %s: %v", typeURL, con.ConID, err)
+		return err
+	}
+	adsLog.Infof("ADS: warmup PUSH %s for node:%s resources:%d", typeURL, con.modelNode.ID, len(response.Resources))
+
+	s.pushQueue.Enqueue(con, &PushEvent{push: push, start: time.Now(), full: true})
+	return nil
+}
+
+// warmupClusters returns the clusters needed by the warmup listeners: the inbound clusters of the
+// sidecar, which are static, and the passthrough and blackhole clusters.
+func warmupClusters(clusters []*xdsapi.Cluster) []*xdsapi.Cluster {
+	out := make([]*xdsapi.Cluster, 0)
+	for _, c := range clusters {
+		switch c.Name {
+		case util.BlackHoleCluster, util.PassthroughCluster,
+			util.InboundPassthroughClusterIpv4, util.InboundPassthroughClusterIpv6:
+			out = append(out, c)
+		default:
+			if strings.HasPrefix(c.Name, string(model.TrafficDirectionInbound)+"|") {
+				out = append(out, c)
+			}
+		}
+	}
+	return out
+}
+
+// warmupListeners returns the listeners serving the traffic to the workload: the virtual listeners,
+// and the inbound listeners, which listen on the addresses of the sidecar. Inbound HTTP listeners
+// have their routes inline, so they do not depend on RDS. Until the full push, outbound traffic goes
+// through the virtual outbound listener to the passthrough or blackhole cluster.
+func warmupListeners(node *model.Proxy, listeners []*xdsapi.Listener) []*xdsapi.Listener {
+	addresses := make(map[string]bool, len(node.IPAddresses))
+	for _, ip := range node.IPAddresses {
+		addresses[ip] = true
+	}
+	out := make([]*xdsapi.Listener, 0)
+	for _, l := range listeners {
+		if l == nil {
+			continue
+		}
+		if l.Name == v1alpha3.VirtualOutboundListenerName || l.Name == v1alpha3.VirtualInboundListenerName ||
+			addresses[l.Address.GetSocketAddress().GetAddress()] {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
 func adsClientCount() int {
 	var n int
 	adsClientsMutex.RLock()
@@ -619,6 +714,14 @@ func (s *DiscoveryServer) AdsPushAll(version string, push *model.PushContext, re
 		return
 	}
 
+	if len(req.TargetProxies) > 0 {
+		// The push context is unchanged, so the cluster load assignments are up to date.
+		adsLog.Infof("XDS: Pushing:%s TargetProxies:%d", version, len(req.TargetProxies))
+		req.EdsUpdates = nil
+		s.startPush(push, req)
+		return
+	}
+
 	adsLog.Infof("XDS: Pushing:%s Services:%d ConnectedEndpoints:%d",
 		version, len(push.Services(nil)), adsClientCount())
 	monServices.Record(float64(len(push.Services(nil))))
@@ -651,14 +754,26 @@ func (s *DiscoveryServer) AdsPushAll(version string, push *model.PushContext, re
 
 // Send a signal to all connections, with a push event.
 func (s *DiscoveryServer) startPush(push *model.PushContext, req *model.PushRequest) {
+	if s.shuttingDown.Load() {
+		adsLog.Infof("XDS: Skipping push during shutdown")
+		return
+	}
 
 	// Push config changes, iterating over connected envoys. This cover ADS and EDS(0.7), both share
 	// the same connection table
 	adsClientsMutex.RLock()
 	// Create a temp map to avoid locking the add/remove
 	pending := []*XdsConnection{}
-	for _, v := range adsClients {
-		pending = append(pending, v)
+	if len(req.TargetProxies) > 0 {
+		for id := range req.TargetProxies {
+			for _, v := range adsSidecarIDConnectionsMap[id] {
+				pending = append(pending, v)
+			}
+		}
+	} else {
+		for _, v := range adsClients {
+			pending = append(pending, v)
+		}
 	}
 	adsClientsMutex.RUnlock()
 
@@ -16,6 +16,7 @@ package v2_test
 import (
 	"fmt"
 	"io/ioutil"
+	"strings"
 	"testing"
 	"time"
 
@@ -26,6 +27,7 @@ import (
 	"istio.io/istio/tests/util"
 
 	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	proto "github.com/gogo/protobuf/types"
 )
 
 const (
@@ -113,6 +115,57 @@ func TestAdsReconnect(t *testing.T) {
 	t.Log("Received ", m)
 }
 
+func TestAdsWarmupPush(t *testing.T) {
+	_, tearDown := initLocalPilotTestEnv(t)
+	defer tearDown()
+
+	edsstr, cancel, err := connectADS(util.MockPilotGrpcAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	metadata := &proto.Struct{Fields: map[string]*proto.Value{
+		"ISTIO_VERSION":              {Kind: &proto.Value_StringValue{StringValue: "1.3"}},
+		model.NodeMetadataWarmupPush: {Kind: &proto.Value_StringValue{StringValue: "1"}},
+	}}
+	err = sendCDSReqWithMetadata(sidecarID(app3Ip, "app3"), metadata, edsstr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first response is the essential warmup config, followed by the full push.
+	res, err := adsReceive(edsstr, 5*time.Second)
+	if err != nil {
+		t.Fatal("Recv failed", err)
+	}
+	if res.TypeUrl != v2.ClusterType {
+		t.Fatalf("expected a CDS warmup response, got %s", res.TypeUrl)
+	}
+	warmup := map[string]bool{}
+	for _, r := range res.Resources {
+		c := &xdsapi.Cluster{}
+		if err := proto.UnmarshalAny(r, c); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(c.Name, "inbound|") && c.Name != "PassthroughCluster" && c.Name != "BlackHoleCluster" &&
+			!strings.HasPrefix(c.Name, "InboundPassthroughCluster") {
+			t.Errorf("unexpected cluster %s in the warmup config", c.Name)
+		}
+		warmup[c.Name] = true
+	}
+	if !warmup["PassthroughCluster"] {
+		t.Errorf("expected the passthrough cluster in the warmup config, got %v", warmup)
+	}
+	res, err = adsReceive(edsstr, 5*time.Second)
+	if err != nil {
+		t.Fatal("Recv failed", err)
+	}
+	if res.TypeUrl != v2.ClusterType || len(res.Resources) <= len(warmup) {
+		t.Fatalf("expected a full CDS push, got %d %s resources", len(res.Resources), res.TypeUrl)
+	}
+}
+
 func TestTLS(t *testing.T) {
 	_, tearDown := initLocalPilotTestEnv(t)
 	defer tearDown()
@@ -18,7 +18,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/gogo/protobuf/jsonpb"
 
@@ -59,12 +63,15 @@ func (s *DiscoveryServer) InitDebug(mux *http.ServeMux, sctl *aggregate.Controll
 	mux.HandleFunc("/debug/registryz", s.registryz)
 	mux.HandleFunc("/debug/endpointz", s.endpointz)
 	mux.HandleFunc("/debug/endpointShardz", s.endpointShardz)
+	mux.HandleFunc("/debug/endpointShardStatusz", s.endpointShardStatusz)
 	mux.HandleFunc("/debug/workloadz", s.workloadz)
 	mux.HandleFunc("/debug/configz", s.configz)
 
 	mux.HandleFunc("/debug/authenticationz", s.authenticationz)
 	mux.HandleFunc("/debug/config_dump", s.ConfigDump)
 	mux.HandleFunc("/debug/push_status", s.PushStatusHandler)
+	mux.HandleFunc("/debug/debounce", s.debounceHandler)
+	mux.HandleFunc("/debug/pushThrottle", s.pushThrottleHandler)
 }
 
 // SyncStatus is the synchronization status between Pilot and a given Envoy
@@ -152,6 +159,61 @@ func (s *DiscoveryServer) endpointShardz(w http.ResponseWriter, req *http.Reques
 	_, _ = w.Write(out)
 }
 
+// endpointShardStatus summarizes the EDS shards of a service in a namespace, for /debug/endpointShardStatusz.
+type endpointShardStatus struct {
+	Shards          map[string]shardStatus `json:"shards"`
+	ServiceAccounts []string               `json:"serviceAccounts"`
+}
+
+// shardStatus summarizes a single EDS shard.
+type shardStatus struct {
+	Endpoints int `json:"endpoints"`
+	// LastUpdate is the last time the registry updated the shard, see features.EndpointShardStaleness.
+	LastUpdate time.Time `json:"lastUpdate"`
+}
+
+// endpointShardStatusz dumps, for each service and namespace, the endpoint count and last update
+// time of each shard, along with the service accounts. Unlike endpointShardz it doesn't dump the
+// endpoints, making it usable to find missing shards in multicluster setups.
+func (s *DiscoveryServer) endpointShardStatusz(w http.ResponseWriter, req *http.Request) {
+	_ = req.ParseForm()
+	w.Header().Add("Content-Type", "application/json")
+
+	out := map[string]map[string]*endpointShardStatus{}
+	s.mutex.RLock()
+	for svc, byNamespace := range s.EndpointShardsByService {
+		out[svc] = map[string]*endpointShardStatus{}
+		for ns, ep := range byNamespace {
+			status := &endpointShardStatus{
+				Shards:          map[string]shardStatus{},
+				ServiceAccounts: []string{},
+			}
+			ep.mutex.RLock()
+			for shard, endpoints := range ep.Shards {
+				status.Shards[shard] = shardStatus{
+					Endpoints:  len(endpoints),
+					LastUpdate: ep.ShardUpdateTimes[shard],
+				}
+			}
+			for sa := range ep.ServiceAccounts {
+				status.ServiceAccounts = append(status.ServiceAccounts, sa)
+			}
+			ep.mutex.RUnlock()
+			sort.Strings(status.ServiceAccounts)
+			out[svc][ns] = status
+		}
+	}
+	s.mutex.RUnlock()
+
+	b, err := json.MarshalIndent(out, " ", " ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = fmt.Fprintf(w, "unable to marshal endpoint shards: %v", err)
+		return
+	}
+	_, _ = w.Write(b)
+}
+
 // Tracks info about workloads. Currently only K8S serviceregistry populates this, based
 // on pod labels and annotations. This is used to detect label changes and push.
 func (s *DiscoveryServer) workloadz(w http.ResponseWriter, req *http.Request) {
@@ -434,6 +496,125 @@ func (s *DiscoveryServer) ConfigDump(w http.ResponseWriter, req *http.Request) {
 	_, _ = w.Write([]byte("You must provide a proxyID in the query string"))
 }
 
+// debounceStatus is the representation of the debounce settings used by /debug/debounce.
+type debounceStatus struct {
+	After string `json:"after"`
+	Max   string `json:"max"`
+}
+
+// isRequestFromLocalhost returns true if the request comes from the loopback interface. The debug
+// handlers are not authenticated, so the ones changing the server settings only accept local requests.
+func isRequestFromLocalhost(req *http.Request) bool {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	return net.ParseIP(ip).IsLoopback()
+}
+
+// debounceHandler shows the debounce settings of the server, and allows changing them at runtime.
+// It is mapped to /debug/debounce on the monitor port. A POST with "after" and/or "max" durations
+// updates the settings, a missing value keeps its current setting. Updates are only accepted from
+// localhost, for example through a port-forward.
+func (s *DiscoveryServer) debounceHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		if !isRequestFromLocalhost(req) {
+			http.Error(w, "Only requests from localhost are allowed", http.StatusForbidden)
+			return
+		}
+		if err := req.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "unable to parse form: %v", err)
+			return
+		}
+		after, max := s.DebounceSettings()
+		var err error
+		if v := req.Form.Get("after"); v != "" {
+			if after, err = time.ParseDuration(v); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = fmt.Fprintf(w, "invalid after: %v", err)
+				return
+			}
+		}
+		if v := req.Form.Get("max"); v != "" {
+			if max, err = time.ParseDuration(v); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = fmt.Fprintf(w, "invalid max: %v", err)
+				return
+			}
+		}
+		if err := s.SetDebounce(after, max); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	after, max := s.DebounceSettings()
+	out, err := json.MarshalIndent(debounceStatus{After: after.String(), Max: max.String()}, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = fmt.Fprintf(w, "unable to marshal debounce settings: %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(out)
+}
+
+// pushThrottleStatus is the representation of the push throttle used by /debug/pushThrottle.
+type pushThrottleStatus struct {
+	Limit    int `json:"limit"`
+	InFlight int `json:"inFlight"`
+}
+
+// pushThrottleHandler shows the number of concurrent pushes allowed and in flight, and allows
+// changing the limit at runtime. It is mapped to /debug/pushThrottle on the monitor port.
+// A POST with a "limit" value updates the limit. Updates are only accepted from localhost.
+func (s *DiscoveryServer) pushThrottleHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		if !isRequestFromLocalhost(req) {
+			http.Error(w, "Only requests from localhost are allowed", http.StatusForbidden)
+			return
+		}
+		if err := req.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "unable to parse form: %v", err)
+			return
+		}
+		limit, err := strconv.Atoi(req.Form.Get("limit"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "invalid limit: %v", err)
+			return
+		}
+		if err := s.SetPushThrottle(limit); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, inFlight := s.concurrentPushLimit.Limit()
+	out, err := json.MarshalIndent(pushThrottleStatus{Limit: limit, InFlight: inFlight}, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = fmt.Fprintf(w, "unable to marshal push throttle: %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(out)
+}
+
 // PushStatusHandler dumps the last PushContext
 func (s *DiscoveryServer) PushStatusHandler(w http.ResponseWriter, req *http.Request) {
 	if model.LastPushStatus == nil {
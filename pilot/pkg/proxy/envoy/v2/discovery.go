@@ -15,6 +15,9 @@
 package v2
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
 	"strconv"
 	"sync"
 	"time"
@@ -92,7 +95,9 @@ type DiscoveryServer struct {
 	// KubeController provides readiness info (if initial sync is complete)
 	KubeController *controller.Controller
 
-	concurrentPushLimit chan struct{}
+	// concurrentPushLimit limits the number of concurrent pushes, see features.PushThrottle.
+	// It can be changed at runtime with SetPushThrottle.
+	concurrentPushLimit *PushSemaphore
 
 	// DebugConfigs controls saving snapshots of configs for /debug/adsz.
 	// Defaults to false, can be enabled with PILOT_DEBUG_ADSZ_CONFIG=1
@@ -118,11 +123,26 @@ type DiscoveryServer struct {
 	// mutex used for protecting proxyUpdates
 	proxyUpdatesMutex sync.RWMutex
 	// proxies that need full push during the new push epoch
-	// the key is the proxy ip address
-	proxyUpdates map[string]struct{}
+	// the key is the proxy ip address, the value is the reason the full push was requested
+	proxyUpdates map[string]pushReason
 
 	// pushQueue is the buffer that used after debounce and before the real xds push.
 	pushQueue *PushQueue
+
+	// mutex protecting debounceAfter and debounceMax, which can be updated at runtime
+	// through /debug/debounce.
+	debounceMutex sync.RWMutex
+	// debounceAfter and debounceMax override DebounceAfter and DebounceMax for this server.
+	// Zero values fall back to the package defaults.
+	debounceAfter time.Duration
+	debounceMax   time.Duration
+
+	// shuttingDown is set by Shutdown, new pushes are no longer accepted once it is set.
+	shuttingDown atomic.Bool
+
+	// lastPushTime is the time of the last full push to all proxies triggered by an update, in
+	// nanoseconds since the epoch. It is used to skip periodic refreshes, see features.RefreshDuration.
+	lastPushTime atomic.Int64
 }
 
 // EndpointShards holds the set of endpoint shards of a service. Registries update
@@ -137,6 +157,15 @@ type EndpointShards struct {
 	// name of the k8s cluster, derived from the config (secret).
 	Shards map[string][]*model.IstioEndpoint
 
+	// ShardHashes holds a hash of the content of each shard, keyed by shard. It is used to
+	// detect updates that re-send an unchanged list of endpoints, so they can be skipped.
+	ShardHashes map[string]uint64
+
+	// ShardUpdateTimes holds the time each shard was last updated by its registry, including
+	// updates that re-send unchanged endpoints. It is used to evict stale shards, see
+	// features.EndpointShardStaleness.
+	ShardUpdateTimes map[string]time.Time
+
 	// ServiceAccounts has the concatenation of all service accounts seen so far in endpoints.
 	// This is updated on push, based on shards. If the previous list is different than
 	// current list, a full push will be forced, to trigger a secure naming update.
@@ -166,19 +195,19 @@ func NewDiscoveryServer(
 		KubeController:          kubeController,
 		EndpointShardsByService: map[string]map[string]*EndpointShards{},
 		WorkloadsByID:           map[string]*Workload{},
-		proxyUpdates:            map[string]struct{}{},
-		concurrentPushLimit:     make(chan struct{}, features.PushThrottle),
-		pushChannel:             make(chan *model.PushRequest, 10),
+		proxyUpdates:            map[string]pushReason{},
+		concurrentPushLimit:     NewPushSemaphore(features.PushThrottle),
+		pushChannel:             make(chan *model.PushRequest, features.PushChannelSize),
 		pushQueue:               NewPushQueue(),
 	}
 
 	// Flush cached discovery responses whenever services, service
 	// instances, or routing configuration changes.
-	serviceHandler := func(*model.Service, model.Event) { out.clearCache() }
+	serviceHandler := func(*model.Service, model.Event) { out.clearCache(model.ServiceUpdate) }
 	if err := ctl.AppendServiceHandler(serviceHandler); err != nil {
 		return nil
 	}
-	instanceHandler := func(*model.ServiceInstance, model.Event) { out.clearCache() }
+	instanceHandler := func(*model.ServiceInstance, model.Event) { out.clearCache(model.EndpointUpdate) }
 	if err := ctl.AppendInstanceHandler(instanceHandler); err != nil {
 		return nil
 	}
@@ -189,7 +218,7 @@ func NewDiscoveryServer(
 	if configCache != nil {
 		// TODO: changes should not trigger a full recompute of LDS/RDS/CDS/EDS
 		// (especially mixerclient HTTP and quota)
-		configHandler := func(model.Config, model.Event) { out.clearCache() }
+		configHandler := func(model.Config, model.Event) { out.clearCache(model.ConfigUpdate) }
 		for _, descriptor := range model.IstioConfigTypes {
 			configCache.RegisterEventHandler(descriptor.Type, configHandler)
 		}
@@ -216,6 +245,7 @@ func (s *DiscoveryServer) Start(stopCh <-chan struct{}) {
 	go s.periodicRefresh(stopCh)
 	go s.periodicRefreshMetrics(stopCh)
 	go s.sendPushes(stopCh)
+	go s.periodicEvictStaleShards(stopCh)
 }
 
 // Singleton, refresh the cache - may not be needed if events work properly, just a failsafe
@@ -226,19 +256,55 @@ func (s *DiscoveryServer) periodicRefresh(stopCh <-chan struct{}) {
 	if periodicRefreshDuration == 0 {
 		return
 	}
-	ticker := time.NewTicker(periodicRefreshDuration)
-	defer ticker.Stop()
+	timer := time.NewTimer(nextRefreshDelay(periodicRefreshDuration, features.RefreshJitter))
+	defer timer.Stop()
 	for {
 		select {
-		case <-ticker.C:
-			adsLog.Debugf("ADS: Periodic push of envoy configs version:%s", versionInfo())
-			s.AdsPushAll(versionInfo(), s.globalPushContext(), &model.PushRequest{Full: true})
+		case now := <-timer.C:
+			timer.Reset(nextRefreshDelay(periodicRefreshDuration, features.RefreshJitter))
+			s.refresh(now, periodicRefreshDuration)
 		case <-stopCh:
 			return
 		}
 	}
 }
 
+// refresh runs a periodic refresh: it pushes the current config to all proxies, unless a push
+// happened within the refresh interval.
+func (s *DiscoveryServer) refresh(now time.Time, refresh time.Duration) {
+	push := s.globalPushContext()
+	needed := s.refreshNeeded(now, refresh)
+	// The shards of the registries other than Kubernetes are only updated by updateServiceShards,
+	// and are evicted if stale: keep them updated even when the push is skipped.
+	if needed || features.EndpointShardStaleness > 0 {
+		if err := s.updateServiceShards(push); err != nil {
+			adsLog.Warnf("ADS: Failed to update the endpoint shards on periodic refresh: %v", err)
+		}
+	}
+	if !needed {
+		adsLog.Debugf("ADS: Skipping periodic push, a push happened within %v", refresh)
+		return
+	}
+	adsLog.Debugf("ADS: Periodic push of envoy configs version:%s", versionInfo())
+	s.AdsPushAll(versionInfo(), push, &model.PushRequest{Full: true})
+}
+
+// nextRefreshDelay returns the delay until the next periodic refresh: the refresh duration,
+// randomly advanced or delayed by up to jitter times the duration.
+func nextRefreshDelay(refresh time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return refresh
+	}
+	return refresh + time.Duration((rand.Float64()*2-1)*jitter*float64(refresh))
+}
+
+// refreshNeeded returns false if a push was triggered by an update within the refresh interval,
+// in which case the periodic refresh is not needed.
+func (s *DiscoveryServer) refreshNeeded(now time.Time, refresh time.Duration) bool {
+	last := s.lastPushTime.Load()
+	return last == 0 || now.Sub(time.Unix(0, last)) >= refresh
+}
+
 // Push metrics are updated periodically (10s default)
 func (s *DiscoveryServer) periodicRefreshMetrics(stopCh <-chan struct{}) {
 	ticker := time.NewTicker(periodicRefreshMetrics)
@@ -268,7 +334,10 @@ func (s *DiscoveryServer) periodicRefreshMetrics(stopCh <-chan struct{}) {
 // Push is called to push changes on config updates using ADS. This is set in DiscoveryService.Push,
 // to avoid direct dependencies.
 func (s *DiscoveryServer) Push(req *model.PushRequest) {
-	if !req.Full {
+	// Incremental (EDS only) pushes don't affect LDS/RDS/CDS, and targeted pushes are for changes
+	// that only affect the named proxies: both reuse the current push context and only recompute
+	// the updated endpoints.
+	if !req.Full || len(req.TargetProxies) > 0 {
 		go s.AdsPushAll(versionInfo(), s.globalPushContext(), req)
 		return
 	}
@@ -293,6 +362,10 @@ func (s *DiscoveryServer) Push(req *model.PushRequest) {
 		return
 	}
 
+	if features.EnablePushContextPrewarm.Get() {
+		push.PrewarmSidecarScopes(connectedConfigNamespaces())
+	}
+
 	s.updateMutex.Lock()
 	s.Env.PushContext = push
 	s.updateMutex.Unlock()
@@ -306,9 +379,29 @@ func (s *DiscoveryServer) Push(req *model.PushRequest) {
 	version = versionLocal
 	versionMutex.Unlock()
 
+	// Only full pushes to all proxies replace the periodic refresh, which is a full push failsafe.
+	s.lastPushTime.Store(time.Now().UnixNano())
 	go s.AdsPushAll(versionLocal, push, req)
 }
 
+// connectedConfigNamespaces returns the config namespaces of the connected proxies.
+func connectedConfigNamespaces() []string {
+	adsClientsMutex.RLock()
+	defer adsClientsMutex.RUnlock()
+	seen := make(map[string]struct{})
+	namespaces := make([]string, 0)
+	for _, con := range adsClients {
+		if con.modelNode == nil {
+			continue
+		}
+		if _, f := seen[con.modelNode.ConfigNamespace]; !f {
+			seen[con.modelNode.ConfigNamespace] = struct{}{}
+			namespaces = append(namespaces, con.modelNode.ConfigNamespace)
+		}
+	}
+	return namespaces
+}
+
 func nonce() string {
 	return uuid.New().String()
 }
@@ -329,20 +422,38 @@ func (s *DiscoveryServer) globalPushContext() *model.PushContext {
 // ClearCache is wrapper for clearCache method, used when new controller gets
 // instantiated dynamically
 func (s *DiscoveryServer) ClearCache() {
-	s.clearCache()
+	s.clearCache(model.GlobalUpdate)
 }
 
 // clearCache will clear all envoy caches. Called by service, instance and config handlers.
 // This will impact the performance, since envoy will need to recalculate.
-func (s *DiscoveryServer) clearCache() {
-	s.ConfigUpdate(&model.PushRequest{Full: true})
+func (s *DiscoveryServer) clearCache(reason model.TriggerReason) {
+	s.ConfigUpdate(&model.PushRequest{Full: true, Reason: []model.TriggerReason{reason}})
 }
 
 // ConfigUpdate implements ConfigUpdater interface, used to request pushes.
 // It replaces the 'clear cache' from v1.
 func (s *DiscoveryServer) ConfigUpdate(req *model.PushRequest) {
+	if s.shuttingDown.Load() {
+		adsLog.Debugf("Ignoring config update during shutdown")
+		return
+	}
 	inboundConfigUpdates.Increment()
-	s.pushChannel <- req
+	if len(req.Reason) == 0 {
+		req.Reason = []model.TriggerReason{model.UnknownTrigger}
+	}
+	for _, reason := range req.Reason {
+		pushTriggers.With(typeTag.Value(string(reason))).Increment()
+	}
+	select {
+	case s.pushChannel <- req:
+	default:
+		// The debounce queue is full, record it before waiting for room.
+		pushChannelBlocked.Increment()
+		adsLog.Debugf("Push channel full (%d requests), blocking config update", cap(s.pushChannel))
+		s.pushChannel <- req
+	}
+	pushChannelDepth.Record(float64(len(s.pushChannel)))
 }
 
 // Debouncing and push request happens in a separate thread, it uses locks
@@ -352,13 +463,46 @@ func (s *DiscoveryServer) ConfigUpdate(req *model.PushRequest) {
 // It also ensures that at most maxDelay is elapsed between receiving an event and processing it.
 func (s *DiscoveryServer) handleUpdates(stopCh <-chan struct{}) {
 	// Note: it is for test to not pass s.Push directly.
-	debounce(s.pushChannel, stopCh, func(req *model.PushRequest) {
+	debounce(s.pushChannel, stopCh, s.DebounceSettings, func(req *model.PushRequest) {
 		go s.Push(req)
 	})
 }
 
-// The debounce helper function is implemented to enable mocking
-func debounce(ch chan *model.PushRequest, stopCh <-chan struct{}, fn func(req *model.PushRequest)) {
+// DebounceSettings returns the debounce delay and the maximum debounce time currently used
+// by the server.
+func (s *DiscoveryServer) DebounceSettings() (after time.Duration, max time.Duration) {
+	s.debounceMutex.RLock()
+	after, max = s.debounceAfter, s.debounceMax
+	s.debounceMutex.RUnlock()
+	if after == 0 {
+		after = DebounceAfter
+	}
+	if max == 0 {
+		max = DebounceMax
+	}
+	return after, max
+}
+
+// SetDebounce updates the debounce delay and the maximum debounce time used by the server.
+// The new values are picked up by the next debounced event, pending pushes are not affected.
+func (s *DiscoveryServer) SetDebounce(after, max time.Duration) error {
+	if after <= 0 {
+		return fmt.Errorf("debounce after must be positive, got %v", after)
+	}
+	if max < after {
+		return fmt.Errorf("debounce max %v must not be lower than debounce after %v", max, after)
+	}
+	s.debounceMutex.Lock()
+	s.debounceAfter, s.debounceMax = after, max
+	s.debounceMutex.Unlock()
+	adsLog.Infof("Push debounce updated: after=%v, max=%v", after, max)
+	return nil
+}
+
+// The debounce helper function is implemented to enable mocking.
+// settings is called on every event, so that updated debounce times are used without a restart.
+func debounce(ch chan *model.PushRequest, stopCh <-chan struct{},
+	settings func() (time.Duration, time.Duration), fn func(req *model.PushRequest)) {
 	var timeChan <-chan time.Time
 	var startDebounce time.Time
 	var lastConfigUpdateTime time.Time
@@ -373,6 +517,7 @@ func debounce(ch chan *model.PushRequest, stopCh <-chan struct{}, fn func(req *m
 	for {
 		select {
 		case r := <-ch:
+			pushChannelDepth.Record(float64(len(ch)))
 
 			if !features.EnableEDSDebounce.Get() && !r.Full {
 				// trigger push now, just for EDS
@@ -382,7 +527,8 @@ func debounce(ch chan *model.PushRequest, stopCh <-chan struct{}, fn func(req *m
 
 			lastConfigUpdateTime = time.Now()
 			if debouncedEvents == 0 {
-				timeChan = time.After(DebounceAfter)
+				debounceAfter, _ := settings()
+				timeChan = time.After(debounceAfter)
 				startDebounce = lastConfigUpdateTime
 			}
 			debouncedEvents++
@@ -394,12 +540,13 @@ func debounce(ch chan *model.PushRequest, stopCh <-chan struct{}, fn func(req *m
 
 			eventDelay := now.Sub(startDebounce)
 			quietTime := now.Sub(lastConfigUpdateTime)
+			debounceAfter, debounceMax := settings()
 			// it has been too long or quiet enough
-			if eventDelay >= DebounceMax || quietTime >= DebounceAfter {
+			if eventDelay >= debounceMax || quietTime >= debounceAfter {
 				pushCounter++
-				adsLog.Infof("Push debounce stable[%d] %d: %v since last change, %v since last push, full=%v",
+				adsLog.Infof("Push debounce stable[%d] %d: %v since last change, %v since last push, full=%v, reason=%v",
 					pushCounter, debouncedEvents,
-					quietTime, eventDelay, req)
+					quietTime, eventDelay, req.Full, req.Reason)
 
 				fn(req)
 				req = nil
@@ -407,69 +554,170 @@ func debounce(ch chan *model.PushRequest, stopCh <-chan struct{}, fn func(req *m
 				continue
 			}
 
-			timeChan = time.After(DebounceAfter - quietTime)
+			timeChan = time.After(debounceAfter - quietTime)
 		case <-stopCh:
 			return
 		}
 	}
 }
 
-func (s *DiscoveryServer) checkProxyNeedsFullPush(node *model.Proxy) bool {
-	full := false
+// pushReason records why a proxy was marked for a full push in the next push epoch.
+type pushReason string
+
+const (
+	// pushReasonNewWorkload is used when a workload backing a connected proxy is seen for the first time.
+	pushReasonNewWorkload pushReason = "new workload"
+)
+
+// checkProxyNeedsFullPush returns whether the proxy was marked for a full push, along with
+// the reason it was marked. The mark is cleared once checked.
+func (s *DiscoveryServer) checkProxyNeedsFullPush(node *model.Proxy) (pushReason, bool) {
+	if len(node.IPAddresses) == 0 {
+		// Gateways may connect without an IP, they are never marked since marks are keyed by IP.
+		return "", false
+	}
 	s.proxyUpdatesMutex.Lock()
-	if _, ok := s.proxyUpdates[node.IPAddresses[0]]; ok {
-		full = true
+	defer s.proxyUpdatesMutex.Unlock()
+	reason, ok := s.proxyUpdates[node.IPAddresses[0]]
+	if ok {
 		delete(s.proxyUpdates, node.IPAddresses[0])
 	}
-	s.proxyUpdatesMutex.Unlock()
-	return full
+	return reason, ok
 }
 
-func doSendPushes(stopCh <-chan struct{}, semaphore chan struct{}, queue *PushQueue, checkProxyNeedsFullPush func(node *model.Proxy) bool) {
-	// Signals that a push is done by reading from the semaphore, allowing another send on it.
-	doneFunc := func() {
-		<-semaphore
-	}
+func doSendPushes(stopCh <-chan struct{}, semaphore *PushSemaphore, queue *PushQueue, checkProxyNeedsFullPush func(node *model.Proxy) (pushReason, bool)) {
+	// Signals that a push is done by releasing the semaphore, allowing another push to start.
+	doneFunc := semaphore.Release
 	for {
 		select {
 		case <-stopCh:
 			return
 		default:
-			// We can send to it until it is full, then it will block until a pushes finishes and reads from it.
+			// Wait for a proxy to push. This will block if there are no updates required.
+			// No slot is held while idle, so that Shutdown can drain the queue.
+			queue.WaitPending()
+
+			// We can acquire it until the limit is reached, then it will block until a push finishes and releases it.
 			// This limits the number of pushes that can happen concurrently
-			semaphore <- struct{}{}
-
-			// Get the next proxy to push. This will block if there are no updates required.
-			client, info := queue.Dequeue()
-
-			proxiesQueueTime.Record(time.Since(info.start).Seconds())
-
-			go func() {
-				edsUpdates := info.edsUpdatedServices
-				proxyFull := info.full || checkProxyNeedsFullPush(client.modelNode)
-
-				if proxyFull {
-					// Setting this to nil will trigger a full push
-					edsUpdates = nil
-				}
-
-				select {
-				case client.pushChannel <- &XdsEvent{
-					push:               info.push,
-					edsUpdatedServices: edsUpdates,
-					done:               doneFunc,
-					start:              info.start,
-				}:
-					return
-				case <-client.stream.Context().Done(): // grpc stream was closed
-					doneFunc()
-					adsLog.Infof("Client closed connection %v", client.ConID)
-				}
-			}()
+			if !semaphore.Acquire(stopCh) {
+				return
+			}
+
+			// The queue may have been drained by Shutdown in the meantime.
+			client, info := queue.TryDequeue()
+			if client == nil {
+				doneFunc()
+				continue
+			}
+
+			go sendPush(client, info, doneFunc, checkProxyNeedsFullPush)
+		}
+	}
+}
+
+// sendPush hands a dequeued push over to the connection. doneFunc is called once the push
+// is finished, or the connection was closed.
+func sendPush(client *XdsConnection, info *PushEvent, doneFunc func(), checkProxyNeedsFullPush func(node *model.Proxy) (pushReason, bool)) {
+	proxiesQueueTime.Record(time.Since(info.start).Seconds())
+
+	edsUpdates := info.edsUpdatedServices
+	proxyFull := info.full
+	if !proxyFull {
+		var reason pushReason
+		if reason, proxyFull = checkProxyNeedsFullPush(client.modelNode); proxyFull {
+			adsLog.Infof("Full push to %s requested: %s", client.ConID, reason)
 		}
 	}
+
+	if proxyFull {
+		// Setting this to nil will trigger a full push
+		edsUpdates = nil
+	}
+
+	select {
+	case client.pushChannel <- &XdsEvent{
+		push:               info.push,
+		edsUpdatedServices: edsUpdates,
+		done:               doneFunc,
+		start:              info.start,
+	}:
+		return
+	case <-client.stream.Context().Done(): // grpc stream was closed
+		doneFunc()
+		adsLog.Infof("Client closed connection %v", client.ConID)
+	}
 }
 
 func (s *DiscoveryServer) sendPushes(stopCh <-chan struct{}) {
 	doSendPushes(stopCh, s.concurrentPushLimit, s.pushQueue, s.checkProxyNeedsFullPush)
 }
+
+// SetPushThrottle changes the number of concurrent pushes allowed, see features.PushThrottle.
+// Pushes already in flight are not interrupted when the limit is lowered.
+func (s *DiscoveryServer) SetPushThrottle(limit int) error {
+	if limit <= 0 {
+		return fmt.Errorf("push throttle must be positive, got %d", limit)
+	}
+	s.concurrentPushLimit.Resize(limit)
+	adsLog.Infof("Push throttle updated: %d", limit)
+	return nil
+}
+
+// Shutdown stops accepting new pushes, drains the push queue and then asks the connected proxies
+// to reconnect, so that they can move to another Pilot instance. It returns once the queue is
+// drained and all connections were signaled, or with the context error if the context is done first.
+// If the queue could not be drained in time, the idle connections are still signaled.
+func (s *DiscoveryServer) Shutdown(ctx context.Context) error {
+	s.shuttingDown.Store(true)
+	adsLog.Infof("XDS: Shutting down, draining %d pending pushes", s.pushQueue.Pending())
+
+	if err := s.drainPushQueue(ctx); err != nil {
+		adsLog.Warnf("XDS: Push queue not drained, %d pending pushes: %v", s.pushQueue.Pending(), err)
+	}
+
+	adsClientsMutex.RLock()
+	connections := make([]*XdsConnection, 0, len(adsClients))
+	for _, con := range adsClients {
+		connections = append(connections, con)
+	}
+	adsClientsMutex.RUnlock()
+
+	wg := sync.WaitGroup{}
+	for _, con := range connections {
+		wg.Add(1)
+		go func(con *XdsConnection) {
+			defer wg.Done()
+			ev := &XdsEvent{drain: true, done: func() {}}
+			// Idle connections are signaled even if the context is already done.
+			select {
+			case con.pushChannel <- ev:
+				return
+			default:
+			}
+			select {
+			case con.pushChannel <- ev:
+			case <-con.stream.Context().Done():
+			case <-ctx.Done():
+			}
+		}(con)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// drainPushQueue sends the pending pushes, within the push throttle. sendPushes keeps running
+// during the drain, and may send some of them.
+func (s *DiscoveryServer) drainPushQueue(ctx context.Context) error {
+	doneFunc := s.concurrentPushLimit.Release
+	for {
+		if !s.concurrentPushLimit.Acquire(ctx.Done()) {
+			return ctx.Err()
+		}
+		client, info := s.pushQueue.TryDequeue()
+		if client == nil {
+			doneFunc()
+			return nil
+		}
+		go sendPush(client, info, doneFunc, s.checkProxyNeedsFullPush)
+	}
+}
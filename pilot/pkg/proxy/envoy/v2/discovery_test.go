@@ -16,7 +16,10 @@ package v2
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"sync"
@@ -25,14 +28,22 @@ import (
 	"time"
 
 	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"go.opencensus.io/stats/view"
 	"google.golang.org/grpc"
 
+	"istio.io/istio/pilot/pkg/config/memory"
 	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/aggregate"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/mesh"
+	"istio.io/istio/pkg/config/protocol"
 )
 
-func mockNeedsPush(node *model.Proxy) bool {
-	return true
+func mockNeedsPush(node *model.Proxy) (pushReason, bool) {
+	return "test", true
 }
 
 func createProxies(n int) []*XdsConnection {
@@ -63,7 +74,7 @@ func wgDoneOrTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
 
 func TestSendPushesManyPushes(t *testing.T) {
 	stopCh := make(chan struct{})
-	semaphore := make(chan struct{}, 2)
+	semaphore := NewPushSemaphore(2)
 	queue := NewPushQueue()
 
 	proxies := createProxies(5)
@@ -106,7 +117,7 @@ func TestSendPushesManyPushes(t *testing.T) {
 
 func TestSendPushesSinglePush(t *testing.T) {
 	stopCh := make(chan struct{})
-	semaphore := make(chan struct{}, 2)
+	semaphore := NewPushSemaphore(2)
 	queue := NewPushQueue()
 
 	proxies := createProxies(5)
@@ -276,7 +287,9 @@ func TestDebounce(t *testing.T) {
 
 			wg.Add(1)
 			go func() {
-				debounce(updateCh, stopCh, fakePush)
+				debounce(updateCh, stopCh, func() (time.Duration, time.Duration) {
+					return DebounceAfter, DebounceMax
+				}, fakePush)
 				wg.Done()
 			}()
 
@@ -292,3 +305,963 @@ func TestDebounce(t *testing.T) {
 		})
 	}
 }
+
+func TestSetDebounce(t *testing.T) {
+	tests := []struct {
+		name      string
+		after     time.Duration
+		max       time.Duration
+		expectErr bool
+	}{
+		{name: "valid", after: 100 * time.Millisecond, max: time.Second},
+		{name: "max equal to after", after: time.Second, max: time.Second},
+		{name: "zero after", after: 0, max: time.Second, expectErr: true},
+		{name: "negative after", after: -time.Second, max: time.Second, expectErr: true},
+		{name: "max lower than after", after: time.Second, max: 100 * time.Millisecond, expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &DiscoveryServer{}
+			err := s.SetDebounce(tt.after, tt.max)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("SetDebounce(%v, %v) got error %v, expected error %v", tt.after, tt.max, err, tt.expectErr)
+			}
+			after, max := s.DebounceSettings()
+			if tt.expectErr {
+				if after != DebounceAfter || max != DebounceMax {
+					t.Fatalf("expected defaults %v/%v to be kept, got %v/%v", DebounceAfter, DebounceMax, after, max)
+				}
+				return
+			}
+			if after != tt.after || max != tt.max {
+				t.Fatalf("expected %v/%v, got %v/%v", tt.after, tt.max, after, max)
+			}
+		})
+	}
+}
+
+func TestDebounceSettingsUpdatedWhileRunning(t *testing.T) {
+	s := &DiscoveryServer{}
+	if err := s.SetDebounce(time.Millisecond*25, time.Millisecond*50); err != nil {
+		t.Fatal(err)
+	}
+
+	stopCh := make(chan struct{})
+	updateCh := make(chan *model.PushRequest)
+	var fullPushes int32
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		debounce(updateCh, stopCh, s.DebounceSettings, func(req *model.PushRequest) {
+			atomic.AddInt32(&fullPushes, 1)
+		})
+		wg.Done()
+	}()
+	defer func() {
+		close(stopCh)
+		wg.Wait()
+	}()
+
+	updateCh <- &model.PushRequest{Full: true}
+	time.Sleep(time.Millisecond * 100)
+	if got := atomic.LoadInt32(&fullPushes); got != 1 {
+		t.Fatalf("expected 1 full push with the initial settings, got %v", got)
+	}
+
+	// Raise the debounce time, the next event must not be pushed before it elapses.
+	if err := s.SetDebounce(time.Hour, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	updateCh <- &model.PushRequest{Full: true}
+	time.Sleep(time.Millisecond * 100)
+	if got := atomic.LoadInt32(&fullPushes); got != 1 {
+		t.Fatalf("expected the push to be delayed by the updated settings, got %v full pushes", got)
+	}
+}
+
+func TestDebounceHandler(t *testing.T) {
+	s := &DiscoveryServer{}
+	tests := []struct {
+		name      string
+		method    string
+		query     string
+		remote    bool
+		wantCode  int
+		wantAfter time.Duration
+		wantMax   time.Duration
+	}{
+		{name: "get defaults", method: http.MethodGet, wantCode: http.StatusOK, wantAfter: DebounceAfter, wantMax: DebounceMax},
+		{name: "update both", method: http.MethodPost, query: "after=50ms&max=5s", wantCode: http.StatusOK,
+			wantAfter: 50 * time.Millisecond, wantMax: 5 * time.Second},
+		{name: "update max only", method: http.MethodPost, query: "max=3s", wantCode: http.StatusOK,
+			wantAfter: 50 * time.Millisecond, wantMax: 3 * time.Second},
+		{name: "invalid duration", method: http.MethodPost, query: "after=fast", wantCode: http.StatusBadRequest,
+			wantAfter: 50 * time.Millisecond, wantMax: 3 * time.Second},
+		{name: "max lower than after", method: http.MethodPut, query: "after=10s", wantCode: http.StatusBadRequest,
+			wantAfter: 50 * time.Millisecond, wantMax: 3 * time.Second},
+		{name: "unsupported method", method: http.MethodDelete, wantCode: http.StatusMethodNotAllowed,
+			wantAfter: 50 * time.Millisecond, wantMax: 3 * time.Second},
+		{name: "remote update", method: http.MethodPost, query: "after=1s&max=10s", remote: true,
+			wantCode: http.StatusForbidden, wantAfter: 50 * time.Millisecond, wantMax: 3 * time.Second},
+		{name: "remote get", method: http.MethodGet, remote: true, wantCode: http.StatusOK,
+			wantAfter: 50 * time.Millisecond, wantMax: 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/debug/debounce?"+tt.query, nil)
+			if !tt.remote {
+				req.RemoteAddr = "127.0.0.1:1234"
+			}
+			rr := httptest.NewRecorder()
+			s.debounceHandler(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Fatalf("expected code %v, got %v: %s", tt.wantCode, rr.Code, rr.Body.String())
+			}
+			if rr.Code == http.StatusOK {
+				got := debounceStatus{}
+				if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+				if got.After != tt.wantAfter.String() || got.Max != tt.wantMax.String() {
+					t.Fatalf("expected response %v/%v, got %v/%v", tt.wantAfter, tt.wantMax, got.After, got.Max)
+				}
+			}
+			if after, max := s.DebounceSettings(); after != tt.wantAfter || max != tt.wantMax {
+				t.Fatalf("expected settings %v/%v, got %v/%v", tt.wantAfter, tt.wantMax, after, max)
+			}
+		})
+	}
+}
+
+func TestPushThrottleHandler(t *testing.T) {
+	s := &DiscoveryServer{concurrentPushLimit: NewPushSemaphore(10)}
+	tests := []struct {
+		name      string
+		method    string
+		query     string
+		remote    bool
+		wantCode  int
+		wantLimit int
+	}{
+		{name: "get", method: http.MethodGet, wantCode: http.StatusOK, wantLimit: 10},
+		{name: "update", method: http.MethodPost, query: "limit=5", wantCode: http.StatusOK, wantLimit: 5},
+		{name: "invalid limit", method: http.MethodPost, query: "limit=0", wantCode: http.StatusBadRequest, wantLimit: 5},
+		{name: "remote update", method: http.MethodPost, query: "limit=1", remote: true,
+			wantCode: http.StatusForbidden, wantLimit: 5},
+		{name: "remote get", method: http.MethodGet, remote: true, wantCode: http.StatusOK, wantLimit: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/debug/pushThrottle?"+tt.query, nil)
+			if !tt.remote {
+				req.RemoteAddr = "127.0.0.1:1234"
+			}
+			rr := httptest.NewRecorder()
+			s.pushThrottleHandler(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Fatalf("expected code %v, got %v: %s", tt.wantCode, rr.Code, rr.Body.String())
+			}
+			if limit, _ := s.concurrentPushLimit.Limit(); limit != tt.wantLimit {
+				t.Fatalf("expected limit %v, got %v", tt.wantLimit, limit)
+			}
+		})
+	}
+}
+
+func TestEndpointShardStatusz(t *testing.T) {
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 10),
+	}
+	svc := &model.Service{
+		Hostname: "a.default.svc.cluster.local",
+		Ports:    model.PortList{{Name: "http", Port: 80, Protocol: protocol.HTTP}},
+	}
+	registry := func(cluster string) *MemServiceDiscovery {
+		sd := NewMemServiceDiscovery(map[host.Name]*model.Service{svc.Hostname: svc}, 0)
+		sd.ClusterID = cluster
+		sd.EDSUpdater = s
+		return sd
+	}
+	endpoint := func(address, sa string) *model.IstioEndpoint {
+		return &model.IstioEndpoint{Address: address, EndpointPort: 8080, ServicePortName: "http", ServiceAccount: sa}
+	}
+	registry("cluster1").SetEndpoints(string(svc.Hostname), "default", []*model.IstioEndpoint{
+		endpoint("10.0.0.1", "spiffe://cluster.local/ns/default/sa/a"),
+		endpoint("10.0.0.2", "spiffe://cluster.local/ns/default/sa/a"),
+	})
+	registry("cluster2").SetEndpoints(string(svc.Hostname), "default", []*model.IstioEndpoint{
+		endpoint("10.1.0.1", "spiffe://cluster.local/ns/default/sa/b"),
+	})
+
+	rr := httptest.NewRecorder()
+	s.endpointShardStatusz(rr, httptest.NewRequest(http.MethodGet, "/debug/endpointShardStatusz", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code 200, got %v", rr.Code)
+	}
+	got := map[string]map[string]*endpointShardStatus{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	status := got[string(svc.Hostname)]["default"]
+	if status == nil {
+		t.Fatalf("expected status for %s/default, got %v", svc.Hostname, rr.Body.String())
+	}
+	if len(status.Shards) != 2 || status.Shards["cluster1"].Endpoints != 2 || status.Shards["cluster2"].Endpoints != 1 {
+		t.Fatalf("unexpected shards %+v", status.Shards)
+	}
+	for shard, st := range status.Shards {
+		if st.LastUpdate.IsZero() {
+			t.Fatalf("expected last update time for shard %s", shard)
+		}
+	}
+	expectedSAs := []string{"spiffe://cluster.local/ns/default/sa/a", "spiffe://cluster.local/ns/default/sa/b"}
+	if !reflect.DeepEqual(status.ServiceAccounts, expectedSAs) {
+		t.Fatalf("expected service accounts %v, got %v", expectedSAs, status.ServiceAccounts)
+	}
+}
+
+func TestEdsUpdateServiceAccountFullPush(t *testing.T) {
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 10),
+	}
+	endpoint := func(address, sa string) *model.IstioEndpoint {
+		return &model.IstioEndpoint{Address: address, EndpointPort: 8080, ServicePortName: "http", ServiceAccount: sa}
+	}
+	saA := "spiffe://cluster.local/ns/default/sa/a"
+	saB := "spiffe://cluster.local/ns/default/sa/b"
+	// Register the service first, so that the updates below are incremental.
+	s.edsUpdate("cluster1", "a.default.svc.cluster.local", "default", []*model.IstioEndpoint{endpoint("10.0.0.1", saA)}, true)
+
+	tests := []struct {
+		name      string
+		endpoints []*model.IstioEndpoint
+		full      bool
+	}{
+		{
+			name:      "endpoint with an existing service account",
+			endpoints: []*model.IstioEndpoint{endpoint("10.0.0.1", saA), endpoint("10.0.0.2", saA)},
+			full:      false,
+		},
+		{
+			name:      "endpoint with a new service account",
+			endpoints: []*model.IstioEndpoint{endpoint("10.0.0.1", saA), endpoint("10.0.0.2", saA), endpoint("10.0.0.3", saB)},
+			full:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := sumMetricValue(t, "pilot_secure_naming_full_pushes")
+			s.edsUpdate("cluster1", "a.default.svc.cluster.local", "default", tt.endpoints, false)
+
+			req := <-s.pushChannel
+			if req.Full != tt.full {
+				t.Fatalf("expected full push %v, got %v", tt.full, req.Full)
+			}
+			expected := before
+			if tt.full {
+				expected++
+			}
+			if got := sumMetricValue(t, "pilot_secure_naming_full_pushes"); got != expected {
+				t.Fatalf("expected secure naming full pushes %v, got %v", expected, got)
+			}
+		})
+	}
+}
+
+func TestEdsUpdateSkipsUnchangedShard(t *testing.T) {
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 10),
+	}
+	endpoints := func(address string) []*model.IstioEndpoint {
+		return []*model.IstioEndpoint{{
+			Address:         address,
+			EndpointPort:    8080,
+			ServicePortName: "http",
+			Labels:          map[string]string{"app": "a", "version": "v1"},
+		}}
+	}
+	// Register the service first, so that the updates below are incremental.
+	s.edsUpdate("cluster1", "a.default.svc.cluster.local", "default", endpoints("10.0.0.1"), true)
+
+	s.edsUpdate("cluster1", "a.default.svc.cluster.local", "default", endpoints("10.0.0.1"), false)
+	if n := len(s.pushChannel); n != 0 {
+		t.Fatalf("expected unchanged endpoints not to trigger a push, got %d pushes", n)
+	}
+
+	s.edsUpdate("cluster1", "a.default.svc.cluster.local", "default", endpoints("10.0.0.2"), false)
+	if n := len(s.pushChannel); n != 1 {
+		t.Fatalf("expected changed endpoints to trigger a push, got %d pushes", n)
+	}
+	if req := <-s.pushChannel; req.Full {
+		t.Fatalf("expected an incremental push, got a full push")
+	}
+
+	// The same endpoints in another shard are a change to that shard.
+	s.edsUpdate("cluster2", "a.default.svc.cluster.local", "default", endpoints("10.0.0.2"), false)
+	if n := len(s.pushChannel); n != 1 {
+		t.Fatalf("expected a new shard to trigger a push, got %d pushes", n)
+	}
+}
+
+func TestConfigUpdateReason(t *testing.T) {
+	s := &DiscoveryServer{pushChannel: make(chan *model.PushRequest, 10)}
+
+	s.ConfigUpdate(&model.PushRequest{Full: true})
+	if req := <-s.pushChannel; !reflect.DeepEqual(req.Reason, []model.TriggerReason{model.UnknownTrigger}) {
+		t.Fatalf("expected unknown reason, got %v", req.Reason)
+	}
+
+	s.clearCache(model.ConfigUpdate)
+	if req := <-s.pushChannel; !reflect.DeepEqual(req.Reason, []model.TriggerReason{model.ConfigUpdate}) {
+		t.Fatalf("expected config reason, got %v", req.Reason)
+	}
+}
+
+func pushChannelBlockedCount(t *testing.T) float64 {
+	t.Helper()
+	return sumMetricValue(t, "pilot_push_channel_blocked")
+}
+
+// sumMetricValue returns the value of an untagged sum metric.
+func sumMetricValue(t *testing.T, name string) float64 {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 {
+		return 0
+	}
+	return rows[0].Data.(*view.SumData).Value
+}
+
+func TestConfigUpdateBlockedMetric(t *testing.T) {
+	s := &DiscoveryServer{pushChannel: make(chan *model.PushRequest, 1)}
+	before := pushChannelBlockedCount(t)
+
+	// Fill the channel, this update must not be reported as blocked.
+	s.ConfigUpdate(&model.PushRequest{Full: true})
+	if got := pushChannelBlockedCount(t); got != before {
+		t.Fatalf("expected no blocked send, got %v", got-before)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.ConfigUpdate(&model.PushRequest{Full: true})
+		close(done)
+	}()
+
+	// The metric is recorded before the send blocks.
+	for deadline := time.Now().Add(time.Second); pushChannelBlockedCount(t) != before+1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected blocked send to be recorded, got %v", pushChannelBlockedCount(t)-before)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	select {
+	case <-done:
+		t.Fatal("expected config update to block while the channel is full")
+	default:
+	}
+
+	<-s.pushChannel
+	<-done
+	<-s.pushChannel
+}
+
+func TestEvictStaleShards(t *testing.T) {
+	registries := aggregate.NewController()
+	registries.AddRegistry(aggregate.Registry{Name: serviceregistry.KubernetesRegistry, ClusterID: "kube"})
+	s := &DiscoveryServer{
+		Env:                     &model.Environment{ServiceDiscovery: registries},
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 10),
+	}
+	endpoints := []*model.IstioEndpoint{{Address: "10.0.0.1", EndpointPort: 8080, ServicePortName: "http"}}
+	// Kubernetes registries do not re-send unchanged endpoints, their shards are never evicted.
+	s.edsUpdate("kube", "a.default.svc.cluster.local", "default", endpoints, true)
+	s.edsUpdate("cluster1", "a.default.svc.cluster.local", "default", endpoints, true)
+	s.edsUpdate("cluster2", "a.default.svc.cluster.local", "default", endpoints, true)
+	s.edsUpdate("cluster1", "b.default.svc.cluster.local", "default", endpoints, true)
+
+	// Nothing was updated before the start of the test.
+	s.evictStaleShards(time.Now().Add(-time.Hour))
+	if n := len(s.pushChannel); n != 0 {
+		t.Fatalf("expected no push without stale shards, got %d pushes", n)
+	}
+
+	// Re-sending unchanged endpoints refreshes the shard.
+	mid := time.Now()
+	time.Sleep(time.Millisecond)
+	s.edsUpdate("cluster2", "a.default.svc.cluster.local", "default", endpoints, true)
+	s.evictStaleShards(mid)
+
+	if shards := s.EndpointShardsByService["a.default.svc.cluster.local"]["default"].Shards; len(shards) != 2 ||
+		shards["cluster2"] == nil || shards["kube"] == nil {
+		t.Fatalf("expected only the refreshed and Kubernetes shards to be kept, got %v", shards)
+	}
+	if _, f := s.EndpointShardsByService["b.default.svc.cluster.local"]["default"]; f {
+		t.Fatalf("expected service without shards to be removed")
+	}
+	if n := len(s.pushChannel); n != 1 {
+		t.Fatalf("expected eviction to trigger a push, got %d pushes", n)
+	}
+	req := <-s.pushChannel
+	if req.Full {
+		t.Fatalf("expected an incremental push, got a full push")
+	}
+	expected := map[string]struct{}{"a.default.svc.cluster.local": {}, "b.default.svc.cluster.local": {}}
+	if !reflect.DeepEqual(req.EdsUpdates, expected) {
+		t.Fatalf("expected EDS updates %v, got %v", expected, req.EdsUpdates)
+	}
+}
+
+func TestWorkloadUpdateFastPush(t *testing.T) {
+	cases := []struct {
+		name           string
+		metadata       map[string]string
+		expectedQueued int
+		expectedFull   bool
+	}{
+		{
+			name:           "default proxy waits for the next push",
+			metadata:       map[string]string{},
+			expectedQueued: 0,
+			expectedFull:   true,
+		},
+		{
+			name:           "fast push proxy is pushed right away",
+			metadata:       map[string]string{model.NodeMetadataFastPush: "1"},
+			expectedQueued: 1,
+			expectedFull:   false,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &DiscoveryServer{
+				Env:           &model.Environment{PushContext: model.NewPushContext()},
+				WorkloadsByID: map[string]*Workload{},
+				pushQueue:     NewPushQueue(),
+			}
+			con := &XdsConnection{
+				ConID:     "fast-push-proxy",
+				modelNode: &model.Proxy{IPAddresses: []string{"10.0.0.1"}, Metadata: tt.metadata},
+			}
+			adsClientsMutex.Lock()
+			adsClients[con.ConID] = con
+			adsClientsMutex.Unlock()
+			defer func() {
+				adsClientsMutex.Lock()
+				delete(adsClients, con.ConID)
+				adsClientsMutex.Unlock()
+			}()
+
+			s.WorkloadUpdate("10.0.0.1", map[string]string{"app": "a"}, nil)
+
+			if tt.expectedQueued > 0 {
+				_, info := s.pushQueue.Dequeue()
+				if !info.full {
+					t.Fatalf("expected a full push for the proxy")
+				}
+			} else if n := s.pushQueue.Pending(); n != 0 {
+				t.Fatalf("expected no queued pushes, got %d", n)
+			}
+			reason, full := s.checkProxyNeedsFullPush(con.modelNode)
+			if full != tt.expectedFull {
+				t.Fatalf("expected proxy to be marked for a full push in the next epoch: %v, got %v", tt.expectedFull, full)
+			}
+			if full && reason != pushReasonNewWorkload {
+				t.Fatalf("expected full push reason %q, got %q", pushReasonNewWorkload, reason)
+			}
+		})
+	}
+}
+
+func TestWorkloadLabelChangeFastPush(t *testing.T) {
+	for _, fast := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fast push %v", fast), func(t *testing.T) {
+			s := &DiscoveryServer{
+				Env:           &model.Environment{PushContext: model.NewPushContext()},
+				WorkloadsByID: map[string]*Workload{"10.0.0.1": {Labels: map[string]string{"app": "a"}}},
+				pushQueue:     NewPushQueue(),
+				pushChannel:   make(chan *model.PushRequest, 10),
+			}
+			metadata := map[string]string{}
+			if fast {
+				metadata[model.NodeMetadataFastPush] = "1"
+			}
+			con := &XdsConnection{
+				ConID:     "label-change-proxy",
+				modelNode: &model.Proxy{IPAddresses: []string{"10.0.0.1"}, Metadata: metadata},
+			}
+			adsClientsMutex.Lock()
+			adsClients[con.ConID] = con
+			adsClientsMutex.Unlock()
+			defer func() {
+				adsClientsMutex.Lock()
+				delete(adsClients, con.ConID)
+				adsClientsMutex.Unlock()
+			}()
+
+			s.WorkloadUpdate("10.0.0.1", map[string]string{"app": "b"}, nil)
+
+			// The label change may affect other proxies, so all of them are pushed after the debounce.
+			if n := len(s.pushChannel); n != 1 {
+				t.Fatalf("expected a debounced push, got %d", n)
+			}
+			if req := <-s.pushChannel; !req.Full {
+				t.Fatalf("expected a full push, got %+v", req)
+			}
+			if fast {
+				if _, info := s.pushQueue.Dequeue(); !info.full {
+					t.Fatalf("expected a full push for the proxy")
+				}
+			} else if n := s.pushQueue.Pending(); n != 0 {
+				t.Fatalf("expected no queued pushes, got %d", n)
+			}
+		})
+	}
+}
+
+func TestPushEdsOnlyBatchReusesPushContext(t *testing.T) {
+	pc := model.NewPushContext()
+	s := &DiscoveryServer{
+		Env:       &model.Environment{PushContext: pc},
+		pushQueue: NewPushQueue(),
+	}
+
+	var req *model.PushRequest
+	req = req.Merge(&model.PushRequest{EdsUpdates: map[string]struct{}{"a.default.svc.cluster.local": {}}})
+	req = req.Merge(&model.PushRequest{EdsUpdates: map[string]struct{}{"b.default.svc.cluster.local": {}}})
+	if req.Full {
+		t.Fatalf("expected a batch of EDS updates to stay incremental")
+	}
+
+	versionBefore := versionNum.Load()
+	s.Push(req)
+	// InitContext replaces the global push context and bumps the version.
+	if s.globalPushContext() != pc {
+		t.Fatalf("expected the push context to be reused for an EDS only push")
+	}
+	if v := versionNum.Load(); v != versionBefore {
+		t.Fatalf("expected the version to be unchanged for an EDS only push, got %v, was %v", v, versionBefore)
+	}
+}
+
+func TestShutdownDrainsPushQueue(t *testing.T) {
+	s := &DiscoveryServer{
+		pushChannel:         make(chan *model.PushRequest, 1),
+		concurrentPushLimit: NewPushSemaphore(2),
+		pushQueue:           NewPushQueue(),
+	}
+	proxies := createProxies(3)
+	pushed := make(chan string, len(proxies))
+	for _, p := range proxies {
+		s.pushQueue.Enqueue(p, &PushEvent{start: time.Now(), full: true})
+		go func(p *XdsConnection) {
+			ev := <-p.pushChannel
+			pushed <- p.ConID
+			ev.done()
+		}(p)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("expected shutdown to complete, got %v", err)
+	}
+	if n := s.pushQueue.Pending(); n != 0 {
+		t.Fatalf("expected the push queue to be drained, got %d pending", n)
+	}
+	for range proxies {
+		select {
+		case <-pushed:
+		case <-time.After(time.Second):
+			t.Fatalf("expected all queued proxies to be pushed")
+		}
+	}
+
+	s.ConfigUpdate(&model.PushRequest{Full: true})
+	if n := len(s.pushChannel); n != 0 {
+		t.Fatalf("expected config updates to be ignored after shutdown, got %d", n)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s := &DiscoveryServer{
+		concurrentPushLimit: NewPushSemaphore(1),
+		pushQueue:           NewPushQueue(),
+	}
+	// Nothing reads the push channels, so the first push never finishes.
+	for _, p := range createProxies(2) {
+		s.pushQueue.Enqueue(p, &PushEvent{start: time.Now(), full: true})
+	}
+	// An idle connection is still signaled once the deadline is reached.
+	idle := createProxies(1)[0]
+	idle.ConID = "shutdown-idle"
+	idle.modelNode = &model.Proxy{ID: "shutdown-idle"}
+	s.addCon(idle.ConID, idle)
+	defer s.removeCon(idle.ConID, idle)
+	received := make(chan *XdsEvent, 1)
+	go func() {
+		received <- <-idle.pushChannel
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected shutdown to stop at the deadline, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected shutdown to return at the deadline, took %v", d)
+	}
+	if n := s.pushQueue.Pending(); n != 1 {
+		t.Fatalf("expected the blocked push to stay queued, got %d pending", n)
+	}
+	select {
+	case ev := <-received:
+		if !ev.drain {
+			t.Fatalf("expected a drain event, got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the idle connection to be signaled")
+	}
+}
+
+func TestShutdownWithIdleSendPushes(t *testing.T) {
+	s := &DiscoveryServer{
+		concurrentPushLimit: NewPushSemaphore(1),
+		pushQueue:           NewPushQueue(),
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go s.sendPushes(stopCh)
+
+	con := createProxies(1)[0]
+	con.modelNode = &model.Proxy{ID: "shutdown-proxy"}
+	s.addCon(con.ConID, con)
+	defer s.removeCon(con.ConID, con)
+	received := make(chan *XdsEvent, 2)
+	go func() {
+		for ev := range con.pushChannel {
+			received <- ev
+			ev.done()
+		}
+	}()
+
+	// The idle sendPushes must not hold the only push slot.
+	time.Sleep(time.Millisecond * 10)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("expected shutdown to complete, got %v", err)
+	}
+	select {
+	case ev := <-received:
+		if !ev.drain {
+			t.Fatalf("expected a drain event, got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the connection to be signaled")
+	}
+}
+
+func TestShutdownClosesConnections(t *testing.T) {
+	s := &DiscoveryServer{
+		concurrentPushLimit: NewPushSemaphore(1),
+		pushQueue:           NewPushQueue(),
+	}
+	con := createProxies(1)[0]
+	con.modelNode = &model.Proxy{ID: "shutdown-proxy"}
+	s.addCon(con.ConID, con)
+	defer s.removeCon(con.ConID, con)
+
+	received := make(chan *XdsEvent, 1)
+	go func() {
+		received <- <-con.pushChannel
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("expected shutdown to complete, got %v", err)
+	}
+	select {
+	case ev := <-received:
+		if !ev.drain {
+			t.Fatalf("expected a drain event, got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the connection to be signaled")
+	}
+}
+
+func TestTargetedPush(t *testing.T) {
+	s := &DiscoveryServer{pushQueue: NewPushQueue()}
+	cons := []*XdsConnection{
+		{ConID: "targeted-a-1", modelNode: &model.Proxy{ID: "targeted-a"}},
+		{ConID: "targeted-b-1", modelNode: &model.Proxy{ID: "targeted-b"}},
+		{ConID: "targeted-b-2", modelNode: &model.Proxy{ID: "targeted-b"}},
+	}
+	for _, con := range cons {
+		s.addCon(con.ConID, con)
+	}
+	defer func() {
+		for _, con := range cons {
+			s.removeCon(con.ConID, con)
+		}
+	}()
+
+	s.AdsPushAll("v1", model.NewPushContext(), &model.PushRequest{
+		Full:          true,
+		TargetProxies: map[string]struct{}{"targeted-b": {}},
+	})
+
+	if n := s.pushQueue.Pending(); n != 2 {
+		t.Fatalf("expected 2 queued pushes, got %d", n)
+	}
+	for i := 0; i < 2; i++ {
+		con, info := s.pushQueue.Dequeue()
+		if con.modelNode.ID != "targeted-b" {
+			t.Fatalf("expected only targeted-b to be pushed, got %v", con.modelNode.ID)
+		}
+		if !info.full {
+			t.Fatalf("expected a full push for %v", con.ConID)
+		}
+	}
+}
+
+func TestCheckProxyNeedsFullPushWithoutIP(t *testing.T) {
+	s := &DiscoveryServer{proxyUpdates: map[string]pushReason{"10.0.0.1": pushReasonNewWorkload}}
+	if _, full := s.checkProxyNeedsFullPush(&model.Proxy{Type: model.Router}); full {
+		t.Fatalf("expected no full push for a proxy without IP addresses")
+	}
+	if _, full := s.checkProxyNeedsFullPush(&model.Proxy{IPAddresses: []string{"10.0.0.1"}}); !full {
+		t.Fatalf("expected full push for the marked proxy")
+	}
+}
+
+// newShardsTestServer builds a discovery server backed by an in-memory registry with the
+// given number of services, each with a few endpoints.
+func newShardsTestServer(t testing.TB, services int) (*DiscoveryServer, *model.PushContext) {
+	sd := NewMemServiceDiscovery(map[host.Name]*model.Service{}, 0)
+	for i := 0; i < services; i++ {
+		hostname := host.Name(fmt.Sprintf("svc-%d.default.svc.cluster.local", i))
+		sd.AddService(hostname, &model.Service{
+			Hostname: hostname,
+			Address:  fmt.Sprintf("10.1.%d.%d", i/256, i%256),
+			Ports:    model.PortList{{Name: "http", Port: 80, Protocol: protocol.HTTP}},
+			Attributes: model.ServiceAttributes{
+				Name:      fmt.Sprintf("svc-%d", i),
+				Namespace: "default",
+			},
+		})
+		for j := 0; j < 5; j++ {
+			sd.AddEndpoint(hostname, "http", 80, fmt.Sprintf("10.2.%d.%d", i%256, j), 8080)
+		}
+	}
+
+	meshConfig := mesh.DefaultMeshConfig()
+	env := &model.Environment{
+		ServiceDiscovery: sd,
+		IstioConfigStore: model.MakeIstioStore(memory.Make(model.IstioConfigTypes)),
+		Mesh:             &meshConfig,
+	}
+	push := model.NewPushContext()
+	if err := push.InitContext(env); err != nil {
+		t.Fatal(err)
+	}
+	env.PushContext = push
+
+	s := &DiscoveryServer{
+		Env:                     env,
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 10),
+	}
+	return s, push
+}
+
+func TestUpdateServiceShards(t *testing.T) {
+	for _, concurrency := range []string{"1", "4"} {
+		t.Run(concurrency, func(t *testing.T) {
+			_ = os.Setenv(features.UpdateServiceShardsConcurrency.Name, concurrency)
+			defer func() { _ = os.Unsetenv(features.UpdateServiceShardsConcurrency.Name) }()
+
+			s, push := newShardsTestServer(t, 50)
+			if err := s.updateServiceShards(push); err != nil {
+				t.Fatal(err)
+			}
+			if len(s.EndpointShardsByService) != 50 {
+				t.Fatalf("expected shards for %d services, got %d", 50, len(s.EndpointShardsByService))
+			}
+			for name, byNamespace := range s.EndpointShardsByService {
+				shards := byNamespace["default"]
+				if shards == nil || len(shards.Shards[""]) != 5 {
+					t.Fatalf("expected %d endpoints for service %s, got %v", 5, name, shards)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUpdateServiceShards(b *testing.B) {
+	for _, concurrency := range []string{"1", "8"} {
+		b.Run("concurrency-"+concurrency, func(b *testing.B) {
+			_ = os.Setenv(features.UpdateServiceShardsConcurrency.Name, concurrency)
+			defer func() { _ = os.Unsetenv(features.UpdateServiceShardsConcurrency.Name) }()
+
+			s, push := newShardsTestServer(b, 2000)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := s.updateServiceShards(push); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildLocalityLbEndpointsFromShardsWeights(t *testing.T) {
+	endpoints := func(locality string, n int) []*model.IstioEndpoint {
+		out := make([]*model.IstioEndpoint, 0, n)
+		for i := 0; i < n; i++ {
+			out = append(out, &model.IstioEndpoint{
+				Address:         fmt.Sprintf("10.0.%d.%d", len(locality), i),
+				EndpointPort:    8080,
+				ServicePortName: "http",
+				Locality:        locality,
+			})
+		}
+		return out
+	}
+	// Zones are spread over two shards, with uneven endpoint counts.
+	shards := &EndpointShards{Shards: map[string][]*model.IstioEndpoint{
+		"cluster1": append(endpoints("region1/zone1", 3), endpoints("region1/zone22", 1)...),
+		"cluster2": append(append(endpoints("region1/zone22", 1), endpoints("region1/zone333", 1)...), endpoints("", 2)...),
+	}}
+
+	locEps := buildLocalityLbEndpointsFromShards(shards, &model.Port{Name: "http"}, nil, "outbound|80||a.default.svc.cluster.local", model.NewPushContext())
+
+	got := map[string]uint32{}
+	for _, locEp := range locEps {
+		got[locEp.GetLocality().GetZone()] = locEp.GetLoadBalancingWeight().GetValue()
+		if n := uint32(len(locEp.LbEndpoints)); n != locEp.GetLoadBalancingWeight().GetValue() {
+			t.Errorf("expected weight of zone %q to match its %d endpoints, got %d",
+				locEp.GetLocality().GetZone(), n, locEp.GetLoadBalancingWeight().GetValue())
+		}
+	}
+	// Endpoints without a locality are grouped in the default locality.
+	expected := map[string]uint32{"zone1": 3, "zone22": 2, "zone333": 1, "": 2}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected locality weights %v, got %v", expected, got)
+	}
+}
+
+func TestNextRefreshDelay(t *testing.T) {
+	refresh := 10 * time.Second
+	if d := nextRefreshDelay(refresh, 0); d != refresh {
+		t.Fatalf("expected no jitter, got %v", d)
+	}
+
+	seen := map[time.Duration]struct{}{}
+	for i := 0; i < 1000; i++ {
+		d := nextRefreshDelay(refresh, 0.1)
+		if d < 9*time.Second || d > 11*time.Second {
+			t.Fatalf("expected delay within 10%% of %v, got %v", refresh, d)
+		}
+		seen[d] = struct{}{}
+	}
+	if len(seen) < 2 {
+		t.Fatalf("expected the delay to vary, got %v", seen)
+	}
+}
+
+func TestRefreshNeeded(t *testing.T) {
+	s, _ := newShardsTestServer(t, 1)
+	s.pushQueue = NewPushQueue()
+	refresh := time.Minute
+	if !s.refreshNeeded(time.Now(), refresh) {
+		t.Fatalf("expected a refresh without previous push")
+	}
+
+	s.Push(&model.PushRequest{EdsUpdates: map[string]struct{}{}})
+	if !s.refreshNeeded(time.Now(), refresh) {
+		t.Fatalf("expected an EDS only push not to suppress the refresh")
+	}
+	s.Push(&model.PushRequest{Full: true, TargetProxies: map[string]struct{}{"test": {}}})
+	if !s.refreshNeeded(time.Now(), refresh) {
+		t.Fatalf("expected a targeted push not to suppress the refresh")
+	}
+
+	s.Push(&model.PushRequest{Full: true})
+	if s.refreshNeeded(time.Now(), refresh) {
+		t.Fatalf("expected a recent full push to suppress the refresh")
+	}
+	if !s.refreshNeeded(time.Now().Add(refresh), refresh) {
+		t.Fatalf("expected a refresh once the interval elapsed since the last push")
+	}
+}
+
+func TestPeriodicRefreshKeepsShards(t *testing.T) {
+	staleness := features.EndpointShardStaleness
+	features.EndpointShardStaleness = time.Minute
+	defer func() { features.EndpointShardStaleness = staleness }()
+
+	s, push := newShardsTestServer(t, 2)
+	s.pushQueue = NewPushQueue()
+	if err := s.updateServiceShards(push); err != nil {
+		t.Fatal(err)
+	}
+	refresh := time.Minute
+	for _, recentPush := range []bool{false, true} {
+		if recentPush {
+			s.lastPushTime.Store(time.Now().UnixNano())
+		}
+		before := time.Now()
+		time.Sleep(time.Millisecond)
+		// No config change: the registry endpoints are unchanged.
+		s.refresh(time.Now(), refresh)
+		s.evictStaleShards(before)
+
+		if len(s.EndpointShardsByService) != 2 {
+			t.Fatalf("recent push %v: expected the shards of %d services to be kept, got %d",
+				recentPush, 2, len(s.EndpointShardsByService))
+		}
+		if n := len(s.pushChannel); n != 0 {
+			t.Fatalf("recent push %v: expected no eviction push, got %d pushes", recentPush, n)
+		}
+	}
+}
+
+func TestWarmupListeners(t *testing.T) {
+	listener := func(name, address string) *xdsapi.Listener {
+		return &xdsapi.Listener{
+			Name: name,
+			Address: &core.Address{Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{Address: address},
+			}},
+		}
+	}
+	node := &model.Proxy{Type: model.SidecarProxy, IPAddresses: []string{"10.0.0.1"}}
+	listeners := []*xdsapi.Listener{
+		listener("virtualOutbound", "0.0.0.0"),
+		listener("virtualInbound", "0.0.0.0"),
+		listener("10.0.0.1_8080", "10.0.0.1"),
+		listener("0.0.0.0_80", "0.0.0.0"),
+		listener("10.96.0.1_443", "10.96.0.1"),
+		nil,
+	}
+	var got []string
+	for _, l := range warmupListeners(node, listeners) {
+		got = append(got, l.Name)
+	}
+	expected := []string{"virtualOutbound", "virtualInbound", "10.0.0.1_8080"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected warmup listeners %v, got %v", expected, got)
+	}
+}
@@ -15,7 +15,10 @@
 package v2
 
 import (
+	"fmt"
+	"hash/fnv"
 	"reflect"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -28,6 +31,7 @@ import (
 
 	networkingapi "istio.io/api/networking/v1alpha3"
 
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	networking "istio.io/istio/pilot/pkg/networking/core/v1alpha3"
 	"istio.io/istio/pilot/pkg/networking/core/v1alpha3/loadbalancer"
@@ -286,46 +290,85 @@ func (s *DiscoveryServer) updateServiceShards(push *model.PushContext) error {
 		}
 	}
 
+	if len(nonK8sRegistries) == 0 {
+		return nil
+	}
+
+	workers := features.UpdateServiceShardsConcurrency.Get()
+	if workers < 1 {
+		workers = 1
+	}
+
+	// Fetching the endpoints from the registries is the expensive part, and is done by a bounded
+	// pool of workers. The shards themselves are updated under s.mutex by edsUpdate.
+	var wg sync.WaitGroup
+	var errMutex sync.Mutex
+	var firstErr error
+	services := make(chan *model.Service)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for svc := range services {
+				if err := s.updateServiceShard(svc, nonK8sRegistries); err != nil {
+					errMutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMutex.Unlock()
+				}
+			}
+		}()
+	}
+	for _, svc := range push.Services(nil) {
+		services <- svc
+	}
+	close(services)
+	wg.Wait()
+
+	return firstErr
+}
+
+// updateServiceShard updates the shards of a single service, one per registry.
+func (s *DiscoveryServer) updateServiceShard(svc *model.Service, registries []aggregate.Registry) error {
 	// Each registry acts as a shard - we don't want to combine them because some
 	// may individually update their endpoints incrementally
-	for _, svc := range push.Services(nil) {
-		for _, registry := range nonK8sRegistries {
-			// in case this svc does not belong to the registry
-			if svc, _ := registry.GetService(svc.Hostname); svc == nil {
+	for _, registry := range registries {
+		// in case this svc does not belong to the registry
+		if svc, _ := registry.GetService(svc.Hostname); svc == nil {
+			continue
+		}
+
+		entries := make([]*model.IstioEndpoint, 0)
+		for _, port := range svc.Ports {
+			if port.Protocol == protocol.UDP {
 				continue
 			}
 
-			entries := make([]*model.IstioEndpoint, 0)
-			for _, port := range svc.Ports {
-				if port.Protocol == protocol.UDP {
-					continue
-				}
-
-				// This loses track of grouping (shards)
-				endpoints, err := registry.InstancesByPort(svc, port.Port, labels.Collection{})
-				if err != nil {
-					return err
-				}
-
-				for _, ep := range endpoints {
-					entries = append(entries, &model.IstioEndpoint{
-						Family:          ep.Endpoint.Family,
-						Address:         ep.Endpoint.Address,
-						EndpointPort:    uint32(ep.Endpoint.Port),
-						ServicePortName: port.Name,
-						Labels:          ep.Labels,
-						UID:             ep.Endpoint.UID,
-						ServiceAccount:  ep.ServiceAccount,
-						Network:         ep.Endpoint.Network,
-						Locality:        ep.GetLocality(),
-						LbWeight:        ep.Endpoint.LbWeight,
-						Attributes:      ep.Service.Attributes,
-					})
-				}
+			// This loses track of grouping (shards)
+			endpoints, err := registry.InstancesByPort(svc, port.Port, labels.Collection{})
+			if err != nil {
+				return err
 			}
 
-			s.edsUpdate(registry.ClusterID, string(svc.Hostname), svc.Attributes.Namespace, entries, true)
+			for _, ep := range endpoints {
+				entries = append(entries, &model.IstioEndpoint{
+					Family:          ep.Endpoint.Family,
+					Address:         ep.Endpoint.Address,
+					EndpointPort:    uint32(ep.Endpoint.Port),
+					ServicePortName: port.Name,
+					Labels:          ep.Labels,
+					UID:             ep.Endpoint.UID,
+					ServiceAccount:  ep.ServiceAccount,
+					Network:         ep.Endpoint.Network,
+					Locality:        ep.GetLocality(),
+					LbWeight:        ep.Endpoint.LbWeight,
+					Attributes:      ep.Service.Attributes,
+				})
+			}
 		}
+
+		s.edsUpdate(registry.ClusterID, string(svc.Hostname), svc.Attributes.Namespace, entries, true)
 	}
 
 	return nil
@@ -445,29 +488,23 @@ func (s *DiscoveryServer) WorkloadUpdate(id string, workloadLabels map[string]st
 			Labels: workloadLabels,
 		}
 
-		fullPush := false
-		adsClientsMutex.RLock()
-		for _, connection := range adsClients {
-			// if the workload has envoy proxy and connected to server,
-			// then do a full xDS push for this proxy;
-			// otherwise:
-			//   case 1: the workload has no sidecar proxy, no need xDS push at all.
-			//   case 2: the workload xDS connection has not been established,
-			//           also no need to trigger a full push here.
-			if connection.modelNode.IPAddresses[0] == id {
-				fullPush = true
-			}
-		}
-		adsClientsMutex.RUnlock()
+		// if the workload has envoy proxy and connected to server,
+		// then do a full xDS push for this proxy;
+		// otherwise:
+		//   case 1: the workload has no sidecar proxy, no need xDS push at all.
+		//   case 2: the workload xDS connection has not been established,
+		//           also no need to trigger a full push here.
+		fastPushConnections, fullPush := workloadConnections(id)
+		s.fastPush(fastPushConnections)
 
 		if fullPush {
 			// First time this workload has been seen. Maybe after the first connect,
 			// do a full push for this proxy in the next push epoch.
 			s.proxyUpdatesMutex.Lock()
 			if s.proxyUpdates == nil {
-				s.proxyUpdates = make(map[string]struct{})
+				s.proxyUpdates = make(map[string]pushReason)
 			}
-			s.proxyUpdates[id] = struct{}{}
+			s.proxyUpdates[id] = pushReasonNewWorkload
 			s.proxyUpdatesMutex.Unlock()
 		}
 		return
@@ -482,8 +519,48 @@ func (s *DiscoveryServer) WorkloadUpdate(id string, workloadLabels map[string]st
 	// TODO: we can do a push for the affected workload only, but we need to confirm
 	// no other workload can be affected. Safer option is to fallback to full push.
 
+	// The proxies of the workload asking for fast pushes get their new config right away, the
+	// config of the other proxies is updated by the debounced full push.
+	fastPushConnections, _ := workloadConnections(id)
+	s.fastPush(fastPushConnections)
+
 	adsLog.Infof("Label change, full push %s ", id)
-	s.ConfigUpdate(&model.PushRequest{Full: true})
+	s.ConfigUpdate(&model.PushRequest{Full: true, Reason: []model.TriggerReason{model.ProxyUpdate}})
+}
+
+// workloadConnections returns the connections of the proxies of the workload with the given IP
+// that asked for fast pushes, see model.NodeMetadataFastPush, and whether the workload has other
+// connected proxies.
+func workloadConnections(id string) ([]*XdsConnection, bool) {
+	var fastPushConnections []*XdsConnection
+	others := false
+	adsClientsMutex.RLock()
+	defer adsClientsMutex.RUnlock()
+	for _, connection := range adsClients {
+		if len(connection.modelNode.IPAddresses) > 0 && connection.modelNode.IPAddresses[0] == id {
+			if connection.modelNode.Metadata[model.NodeMetadataFastPush] == "1" {
+				fastPushConnections = append(fastPushConnections, connection)
+			} else {
+				others = true
+			}
+		}
+	}
+	return fastPushConnections, others
+}
+
+// fastPush queues a full push to the connections right away, instead of waiting for the next push
+// epoch. This is done asynchronously since the push context is guarded by updateMutex, which must
+// not be taken while holding s.mutex.
+func (s *DiscoveryServer) fastPush(connections []*XdsConnection) {
+	if len(connections) == 0 {
+		return
+	}
+	go func() {
+		push := s.globalPushContext()
+		for _, connection := range connections {
+			s.pushQueue.Enqueue(connection, &PushEvent{push: push, start: time.Now(), full: true})
+		}
+	}()
 }
 
 // EDSUpdate computes destination address membership across all clusters and networks.
@@ -505,6 +582,8 @@ func (s *DiscoveryServer) edsUpdate(shard, serviceName string, namespace string,
 	// update. The endpoint updates may be grouped by K8S clusters, other service registries
 	// or by deployment. Multiple updates are debounced, to avoid too frequent pushes.
 	// After debounce, the services are merged and pushed.
+	// The hash of the shard content is computed before taking the lock, as it is comparatively expensive.
+	hash := endpointsHash(istioEndpoints)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	requireFull := false
@@ -515,6 +594,8 @@ func (s *DiscoveryServer) edsUpdate(shard, serviceName string, namespace string,
 		if s.EndpointShardsByService[serviceName][namespace] != nil {
 			s.EndpointShardsByService[serviceName][namespace].mutex.Lock()
 			delete(s.EndpointShardsByService[serviceName][namespace].Shards, shard)
+			delete(s.EndpointShardsByService[serviceName][namespace].ShardHashes, shard)
+			delete(s.EndpointShardsByService[serviceName][namespace].ShardUpdateTimes, shard)
 			svcShards := len(s.EndpointShardsByService[serviceName][namespace].Shards)
 			s.EndpointShardsByService[serviceName][namespace].mutex.Unlock()
 			if svcShards == 0 {
@@ -535,8 +616,10 @@ func (s *DiscoveryServer) edsUpdate(shard, serviceName string, namespace string,
 		// Return an error to force a full sync, which will also cause the
 		// EndpointsShardsByService to be initialized with all services.
 		ep = &EndpointShards{
-			Shards:          map[string][]*model.IstioEndpoint{},
-			ServiceAccounts: map[string]bool{},
+			Shards:           map[string][]*model.IstioEndpoint{},
+			ShardHashes:      map[string]uint64{},
+			ShardUpdateTimes: map[string]time.Time{},
+			ServiceAccounts:  map[string]bool{},
 		}
 		s.EndpointShardsByService[serviceName][namespace] = ep
 		if !internal {
@@ -547,26 +630,24 @@ func (s *DiscoveryServer) edsUpdate(shard, serviceName string, namespace string,
 
 	// 2. Update data for the specific cluster. Each cluster gets independent
 	// updates containing the full list of endpoints for the service in that cluster.
-	for _, e := range istioEndpoints {
-		if e.ServiceAccount != "" {
-			ep.mutex.Lock()
-			_, f = ep.ServiceAccounts[e.ServiceAccount]
-			if !f {
-				ep.ServiceAccounts[e.ServiceAccount] = true
-			}
-			ep.mutex.Unlock()
-
-			if !f && !internal {
-				// The entry has a service account that was not previously associated.
-				// Requires a CDS push and full sync.
-				adsLog.Infof("Endpoint updating service account %s %s", e.ServiceAccount, serviceName)
-				requireFull = true
-				break
-			}
-		}
+	if added := ep.addServiceAccounts(istioEndpoints); len(added) > 0 && !internal {
+		// The endpoints have service accounts that were not previously associated with the service.
+		// Requires a CDS push and full sync, to update secure naming.
+		adsLog.Debugf("Full push, service accounts %v added to service %s", added, serviceName)
+		secureNamingFullPushes.Increment()
+		requireFull = true
 	}
+	// 3. Skip the update if the registry re-sent the same endpoints for the shard, unless
+	// a full push is already required.
 	ep.mutex.Lock()
+	ep.ShardUpdateTimes[shard] = time.Now()
+	if old, f := ep.ShardHashes[shard]; f && old == hash && !requireFull {
+		ep.mutex.Unlock()
+		adsLog.Debugf("Skipping unchanged endpoints for shard %s of service %s", shard, serviceName)
+		return
+	}
 	ep.Shards[shard] = istioEndpoints
+	ep.ShardHashes[shard] = hash
 	ep.mutex.Unlock()
 
 	// for internal update: this called by DiscoveryServer.Push --> updateServiceShards,
@@ -581,10 +662,116 @@ func (s *DiscoveryServer) edsUpdate(shard, serviceName string, namespace string,
 			Full:             requireFull,
 			TargetNamespaces: map[string]struct{}{namespace: {}},
 			EdsUpdates:       edsUpdates,
+			Reason:           []model.TriggerReason{model.EndpointUpdate},
+		})
+	}
+}
+
+// addServiceAccounts adds the service accounts of the endpoints to the service accounts of the
+// service, and returns the ones that were not previously part of it.
+func (ep *EndpointShards) addServiceAccounts(endpoints []*model.IstioEndpoint) []string {
+	var added []string
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+	for _, e := range endpoints {
+		if e.ServiceAccount == "" {
+			continue
+		}
+		if _, f := ep.ServiceAccounts[e.ServiceAccount]; !f {
+			ep.ServiceAccounts[e.ServiceAccount] = true
+			added = append(added, e.ServiceAccount)
+		}
+	}
+	return added
+}
+
+// periodicEvictStaleShards evicts the shards that were not updated within
+// features.EndpointShardStaleness, if set. The shards of registries other than Kubernetes are
+// refreshed by full pushes and by the periodic refresh, so it requires the periodic refresh to be enabled.
+func (s *DiscoveryServer) periodicEvictStaleShards(stopCh <-chan struct{}) {
+	staleness := features.EndpointShardStaleness
+	if staleness == 0 {
+		return
+	}
+	if features.RefreshDuration == 0 {
+		adsLog.Warnf("PILOT_ENDPOINT_SHARD_STALENESS is ignored, it requires V2_REFRESH to be set")
+		return
+	}
+	ticker := time.NewTicker(staleness / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.evictStaleShards(time.Now().Add(-staleness))
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// evictStaleShards removes the shards last updated before the given time, and requests an
+// EDS push of the affected services. The shards of Kubernetes registries are never evicted.
+func (s *DiscoveryServer) evictStaleShards(before time.Time) {
+	edsUpdates := map[string]struct{}{}
+	namespaces := map[string]struct{}{}
+	kubeShards := s.kubeShards()
+
+	s.mutex.Lock()
+	for serviceName, byNamespace := range s.EndpointShardsByService {
+		for namespace, ep := range byNamespace {
+			ep.mutex.Lock()
+			for shard, updated := range ep.ShardUpdateTimes {
+				if !updated.Before(before) || kubeShards[shard] {
+					continue
+				}
+				adsLog.Warnf("Evicting stale endpoints of shard %s for service %s/%s, last updated %v",
+					shard, namespace, serviceName, updated)
+				delete(ep.Shards, shard)
+				delete(ep.ShardHashes, shard)
+				delete(ep.ShardUpdateTimes, shard)
+				edsUpdates[serviceName] = struct{}{}
+				namespaces[namespace] = struct{}{}
+			}
+			svcShards := len(ep.Shards)
+			ep.mutex.Unlock()
+			if svcShards == 0 {
+				delete(byNamespace, namespace)
+			}
+		}
+	}
+	s.mutex.Unlock()
+
+	if len(edsUpdates) > 0 {
+		s.ConfigUpdate(&model.PushRequest{
+			Full:             false,
+			TargetNamespaces: namespaces,
+			EdsUpdates:       edsUpdates,
+			Reason:           []model.TriggerReason{model.EndpointUpdate},
 		})
 	}
 }
 
+// endpointsHash computes a hash of the endpoints of a shard, covering the fields that affect
+// the generated EDS. EnvoyEndpoint is a cache derived from the other fields and is not included.
+func endpointsHash(istioEndpoints []*model.IstioEndpoint) uint64 {
+	h := fnv.New64a()
+	for _, e := range istioEndpoints {
+		_, _ = fmt.Fprintf(h, "%d|%s|%s|%s|%s|%s|%s|%d|%d|",
+			e.Family, e.Address, e.ServicePortName, e.UID, e.ServiceAccount, e.Network, e.Locality,
+			e.EndpointPort, e.LbWeight)
+		keys := make([]string, 0, len(e.Labels))
+		for k := range e.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			_, _ = fmt.Fprintf(h, "%s=%s,", k, e.Labels[k])
+		}
+		_, _ = h.Write([]byte{'\n'})
+	}
+	return h.Sum64()
+}
+
 // LocalityLbEndpointsFromInstances returns a list of Envoy v2 LocalityLbEndpoints.
 // Envoy v2 Endpoints are constructed from Pilot's older data structure involving
 // model.ServiceInstance objects. Envoy expects the endpoints grouped by zone, so
@@ -905,6 +1092,9 @@ func endpointDiscoveryResponse(loadAssignments []*xdsapi.ClusterLoadAssignment,
 }
 
 // build LocalityLbEndpoints for a cluster from existing EndpointShards.
+// Endpoints of all shards are grouped by locality, endpoints without a locality share a single
+// default locality. The weight of a locality is the sum of the weights of its endpoints, so
+// localities of unweighted endpoints are weighted by their endpoint count.
 func buildLocalityLbEndpointsFromShards(
 	shards *EndpointShards,
 	svcPort *model.Port,
@@ -963,3 +1153,21 @@ func buildLocalityLbEndpointsFromShards(
 
 	return locEps
 }
+
+// kubeShards returns the shards of the Kubernetes registries. Kubernetes registries only send
+// the Endpoints that changed, resyncs of unchanged Endpoints are dropped, so the update time of
+// their shards does not tell whether the registry stopped receiving updates.
+func (s *DiscoveryServer) kubeShards() map[string]bool {
+	shards := map[string]bool{}
+	if s.Env == nil {
+		return shards
+	}
+	if agg, ok := s.Env.ServiceDiscovery.(*aggregate.Controller); ok {
+		for _, registry := range agg.GetRegistries() {
+			if registry.Name == serviceregistry.KubernetesRegistry {
+				shards[registry.ClusterID] = true
+			}
+		}
+	}
+	return shards
+}
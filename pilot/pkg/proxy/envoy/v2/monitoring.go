@@ -130,6 +130,32 @@ var (
 		"Total number of internal XDS errors in pilot.",
 	)
 
+	pushTriggers = monitoring.NewSum(
+		"pilot_push_triggers",
+		"Total number of push requests, by what triggered them.",
+		typeTag,
+	)
+
+	secureNamingFullPushes = monitoring.NewSum(
+		"pilot_secure_naming_full_pushes",
+		"Total number of full pushes triggered by new service accounts in the endpoints of a service.",
+	)
+
+	pushesInFlight = monitoring.NewGauge(
+		"pilot_xds_pushes_in_flight",
+		"Number of pushes currently in flight, limited by PILOT_PUSH_THROTTLE.",
+	)
+
+	pushChannelDepth = monitoring.NewGauge(
+		"pilot_push_channel_depth",
+		"Number of push requests queued for debouncing.",
+	)
+
+	pushChannelBlocked = monitoring.NewSum(
+		"pilot_push_channel_blocked",
+		"Total number of push requests that blocked because the debounce queue was full.",
+	)
+
 	inboundUpdates = monitoring.NewSum(
 		"pilot_inbound_updates",
 		"Total number of updates received by pilot.",
@@ -169,6 +195,11 @@ func init() {
 		xdsClients,
 		xdsResponseWriteTimeouts,
 		pushes,
+		pushTriggers,
+		pushChannelDepth,
+		pushChannelBlocked,
+		pushesInFlight,
+		secureNamingFullPushes,
 		proxiesConvergeDelay,
 		proxiesQueueTime,
 		proxiesConvergeDelayCdsErrors,
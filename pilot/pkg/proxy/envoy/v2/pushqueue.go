@@ -90,6 +90,34 @@ func (p *PushQueue) Dequeue() (*XdsConnection, *PushEvent) {
 		p.cond.Wait()
 	}
 
+	return p.dequeueLocked()
+}
+
+// WaitPending blocks until there is at least one proxy in the queue, without removing it.
+func (p *PushQueue) WaitPending() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.connections) == 0 {
+		p.cond.Wait()
+	}
+}
+
+// TryDequeue removes a proxy from the queue like Dequeue, but returns nil instead of blocking
+// if there are no proxies ready to be removed.
+func (p *PushQueue) TryDequeue() (*XdsConnection, *PushEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.connections) == 0 {
+		return nil, nil
+	}
+	return p.dequeueLocked()
+}
+
+// dequeueLocked removes the first proxy from the queue. It must be called with the lock held
+// and a non-empty queue.
+func (p *PushQueue) dequeueLocked() (*XdsConnection, *PushEvent) {
 	head := p.connections[0]
 	p.connections = p.connections[1:]
 	info := p.eventsMap[head]
@@ -124,6 +124,20 @@ func TestProxyQueue(t *testing.T) {
 		wg.Wait()
 	})
 
+	t.Run("try remove should not block", func(t *testing.T) {
+		p := NewPushQueue()
+		if con, _ := p.TryDequeue(); con != nil {
+			t.Fatalf("Expected no proxy from an empty queue, got %v", con)
+		}
+		p.Enqueue(proxies[0], &PushEvent{})
+		if con, _ := p.TryDequeue(); con != proxies[0] {
+			t.Fatalf("Expected proxy %v, got %v", proxies[0], con)
+		}
+		if n := p.Pending(); n != 0 {
+			t.Fatalf("Expected empty queue, got %d pending", n)
+		}
+	})
+
 	t.Run("should merge PushEvent", func(t *testing.T) {
 		p := NewPushQueue()
 		firstTime := time.Now()
@@ -0,0 +1,89 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"sync"
+)
+
+// PushSemaphore limits the number of concurrent pushes. Unlike a buffered channel, its limit
+// can be changed while pushes are in flight.
+type PushSemaphore struct {
+	mu       sync.Mutex
+	limit    int
+	inFlight int
+	// changed is closed and replaced whenever a slot is released or the limit changes, to wake up
+	// the waiting acquirers.
+	changed chan struct{}
+}
+
+// NewPushSemaphore creates a semaphore allowing limit concurrent pushes.
+func NewPushSemaphore(limit int) *PushSemaphore {
+	return &PushSemaphore{
+		limit:   limit,
+		changed: make(chan struct{}),
+	}
+}
+
+// Acquire takes a slot, blocking until one is available. It returns false if stop is closed first.
+func (p *PushSemaphore) Acquire(stop <-chan struct{}) bool {
+	for {
+		p.mu.Lock()
+		if p.inFlight < p.limit {
+			p.inFlight++
+			pushesInFlight.Record(float64(p.inFlight))
+			p.mu.Unlock()
+			return true
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// Release frees a slot taken by Acquire.
+func (p *PushSemaphore) Release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inFlight--
+	pushesInFlight.Record(float64(p.inFlight))
+	p.notifyLocked()
+}
+
+// Resize changes the limit. When shrinking, pushes already in flight are not interrupted: new
+// pushes wait until the number of pushes in flight is below the new limit.
+func (p *PushSemaphore) Resize(limit int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limit = limit
+	p.notifyLocked()
+}
+
+// Limit returns the current limit and the number of pushes in flight.
+func (p *PushSemaphore) Limit() (limit int, inFlight int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.limit, p.inFlight
+}
+
+func (p *PushSemaphore) notifyLocked() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"testing"
+	"time"
+)
+
+// startHeldPushes starts pushing to n proxies, returning the channel receiving the push events.
+// Pushes stay in flight until done is called on the received event.
+func startHeldPushes(t *testing.T, semaphore *PushSemaphore, n int) (chan *XdsEvent, *PushQueue, func()) {
+	t.Helper()
+	stopCh := make(chan struct{})
+	queue := NewPushQueue()
+	received := make(chan *XdsEvent, n)
+	for _, proxy := range createProxies(n) {
+		proxy := proxy
+		go func() {
+			received <- <-proxy.pushChannel
+		}()
+		queue.Enqueue(proxy, &PushEvent{start: time.Now()})
+	}
+	go doSendPushes(stopCh, semaphore, queue, mockNeedsPush)
+	return received, queue, func() { close(stopCh) }
+}
+
+func expectInFlight(t *testing.T, semaphore *PushSemaphore, expected int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; {
+		if _, inFlight := semaphore.Limit(); inFlight == expected {
+			break
+		}
+		if time.Now().After(deadline) {
+			_, inFlight := semaphore.Limit()
+			t.Fatalf("expected %d pushes in flight, got %d", expected, inFlight)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Make sure no more pushes start.
+	time.Sleep(time.Millisecond * 50)
+	if _, inFlight := semaphore.Limit(); inFlight != expected {
+		t.Fatalf("expected %d pushes in flight, got %d", expected, inFlight)
+	}
+}
+
+func TestPushSemaphoreResizeUp(t *testing.T) {
+	semaphore := NewPushSemaphore(1)
+	received, queue, stop := startHeldPushes(t, semaphore, 4)
+	defer stop()
+
+	expectInFlight(t, semaphore, 1)
+	if n := queue.Pending(); n != 3 {
+		t.Fatalf("expected 3 pending pushes, got %d", n)
+	}
+
+	semaphore.Resize(3)
+	expectInFlight(t, semaphore, 3)
+
+	for i := 0; i < 4; i++ {
+		(<-received).done()
+	}
+	// doSendPushes does not hold a slot while waiting for the next push.
+	expectInFlight(t, semaphore, 0)
+	if n := queue.Pending(); n != 0 {
+		t.Fatalf("expected all pushes to be sent, got %d pending", n)
+	}
+}
+
+func TestPushSemaphoreResizeDown(t *testing.T) {
+	semaphore := NewPushSemaphore(3)
+	received, queue, stop := startHeldPushes(t, semaphore, 5)
+	defer stop()
+
+	expectInFlight(t, semaphore, 3)
+
+	// Pushes in flight are not interrupted, new pushes wait for them to drop below the new limit.
+	semaphore.Resize(1)
+	(<-received).done()
+	expectInFlight(t, semaphore, 2)
+	(<-received).done()
+	expectInFlight(t, semaphore, 1)
+	if n := queue.Pending(); n != 2 {
+		t.Fatalf("expected 2 pending pushes, got %d", n)
+	}
+
+	(<-received).done()
+	expectInFlight(t, semaphore, 1)
+	if n := queue.Pending(); n != 1 {
+		t.Fatalf("expected 1 pending push, got %d", n)
+	}
+	for i := 0; i < 2; i++ {
+		(<-received).done()
+	}
+	// doSendPushes does not hold a slot while waiting for the next push.
+	expectInFlight(t, semaphore, 0)
+	if n := queue.Pending(); n != 0 {
+		t.Fatalf("expected all pushes to be sent, got %d pending", n)
+	}
+}
+
+func TestPushSemaphoreAcquireStop(t *testing.T) {
+	semaphore := NewPushSemaphore(1)
+	if !semaphore.Acquire(nil) {
+		t.Fatalf("expected to acquire a free slot")
+	}
+	stop := make(chan struct{})
+	close(stop)
+	if semaphore.Acquire(stop) {
+		t.Fatalf("expected acquire to stop while the semaphore is full")
+	}
+}
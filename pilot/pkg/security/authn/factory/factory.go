@@ -15,6 +15,8 @@
 package factory
 
 import (
+	"istio.io/pkg/log"
+
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/security/authn"
 	"istio.io/istio/pilot/pkg/security/authn/v1alpha1"
@@ -22,10 +24,19 @@ import (
 )
 
 // NewPolicyApplier returns the appropriate (policy) applier, depends on the versions of the policy exists
-// for the given service instance.
-func NewPolicyApplier(configStore model.IstioConfigStore,
+// for the given service instance. The policy lookup is memoized in push, if not nil.
+func NewPolicyApplier(push *model.PushContext, configStore model.IstioConfigStore,
 	serviceInstance *model.ServiceInstance) authn.PolicyApplier {
 	// TODO: check v1alpha2 policy and returns alpha2 applier, if exists.
-	authnPolicy := authn_model.GetConsolidateAuthenticationPolicy(configStore, serviceInstance)
+	// On failure no policy is applied; the failure is also recorded in the push status.
+	authnPolicy, err := authn_model.GetConsolidateAuthenticationPolicy(push, configStore, serviceInstance)
+	if err != nil {
+		port := 0
+		if serviceInstance.Endpoint.ServicePort != nil {
+			port = serviceInstance.Endpoint.ServicePort.Port
+		}
+		log.Warnf("No authentication policy applied to service %s port %d: %v",
+			serviceInstance.Service.Hostname, port, err)
+	}
 	return v1alpha1.NewPolicyApplier(authnPolicy)
 }
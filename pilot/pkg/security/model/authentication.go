@@ -15,7 +15,11 @@
 package model
 
 import (
+	"container/list"
+	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
@@ -48,6 +52,9 @@ const (
 	// Binary header name must has suffix "-bin", according to https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md.
 	K8sSAJwtTokenHeaderKey = "istio_sds_credentials_header-bin"
 
+	// binaryHeaderSuffix is the suffix of the gRPC binary header names.
+	binaryHeaderSuffix = "-bin"
+
 	// IngressGatewaySdsUdsPath is the UDS path for ingress gateway to get credentials via SDS.
 	IngressGatewaySdsUdsPath = "unix:/var/run/ingress_gateway/sds"
 
@@ -60,21 +67,53 @@ var JwtKeyResolver = model.NewJwksResolver(model.JwtPubKeyEvictionDuration, mode
 
 // GetConsolidateAuthenticationPolicy returns the authentication policy for workload specified by
 // hostname (or label selector if specified) and port, if defined.
-// It also tries to resolve JWKS URI if necessary.
-func GetConsolidateAuthenticationPolicy(store model.IstioConfigStore, serviceInstance *model.ServiceInstance) *authn.Policy {
+// It also tries to resolve JWKS URI if necessary. It returns a nil policy and no error if there is no
+// policy, and a nil policy and an error if the policy exists but its JWKS URIs cannot be resolved.
+// The result is memoized in push, if not nil, so listeners of the same workload built during a push
+// share the lookup and JWKS resolution. Resolution failures are not memoized and are retried; they
+// are recorded in the push status under ProxyStatusAuthnPolicyJwksFailure.
+func GetConsolidateAuthenticationPolicy(push *model.PushContext, store model.IstioConfigStore,
+	serviceInstance *model.ServiceInstance) (*authn.Policy, error) {
 	service := serviceInstance.Service
 	port := serviceInstance.Endpoint.ServicePort
 	labels := serviceInstance.Labels
 
-	config := store.AuthenticationPolicyForWorkload(service, labels, port)
-	if config != nil {
+	resolve := func() (*authn.Policy, error) {
+		config := store.AuthenticationPolicyForWorkload(service, labels, port)
+		if config == nil {
+			return nil, nil
+		}
 		policy := config.Spec.(*authn.Policy)
-		if err := JwtKeyResolver.SetAuthenticationPolicyJwksURIs(policy); err == nil {
-			return policy
+		if err := JwtKeyResolver.SetAuthenticationPolicyJwksURIs(policy); err != nil {
+			err = fmt.Errorf("failed to resolve the JWKS URIs of authentication policy %s/%s: %v",
+				config.Namespace, config.Name, err)
+			// Failures are retried for every listener, so report them once per policy and push.
+			push.Add(model.ProxyStatusAuthnPolicyJwksFailure, config.Namespace+"/"+config.Name, nil, err.Error())
+			return nil, err
 		}
+		return policy, nil
+	}
+	if push == nil {
+		return resolve()
 	}
+	return push.AuthenticationPolicyForWorkload(service, labels, port, resolve)
+}
 
-	return nil
+// ConstructSdsCaSecretConfigForGatewayListener constructs the SDS secret configuration of the root CA
+// for the ingress gateway credential name. The CA resource name defaults to name+IngressGatewaySdsCaSuffix
+// and the CA UDS path to sdsUdsPath when caName and caSdsUdsPath are empty, so gateways fetching their
+// CAs from another SDS backend can override both.
+func ConstructSdsCaSecretConfigForGatewayListener(name, sdsUdsPath, caName, caSdsUdsPath string) *auth.SdsSecretConfig {
+	if name == "" {
+		return nil
+	}
+	if caName == "" {
+		caName = name + IngressGatewaySdsCaSuffix
+	}
+	if caSdsUdsPath == "" {
+		caSdsUdsPath = sdsUdsPath
+	}
+	return ConstructSdsSecretConfigForGatewayListener(caName, caSdsUdsPath)
 }
 
 // ConstructSdsSecretConfig constructs SDS secret configuration for ingress gateway.
@@ -109,11 +148,46 @@ func ConstructSdsSecretConfigForGatewayListener(name, sdsUdsPath string) *auth.S
 }
 
 // ConstructSdsSecretConfig constructs SDS Sececret Configuration for workload proxy.
+// If the proxy metadata sets NodeMetadataSdsEnvoyGrpcCluster, the secrets are fetched with the Envoy gRPC
+// client from that statically defined cluster, which supplies the credentials, instead of the Google gRPC
+// client connecting to sdsUdsPath.
 func ConstructSdsSecretConfig(name, sdsUdsPath string, metadata map[string]string) *auth.SdsSecretConfig {
 	if name == "" || sdsUdsPath == "" {
 		return nil
 	}
 
+	grpcService := &core.GrpcService{
+		Timeout: sdsRequestTimeout(metadata),
+	}
+	if cluster := metadata[model.NodeMetadataSdsEnvoyGrpcCluster]; cluster != "" {
+		grpcService.TargetSpecifier = &core.GrpcService_EnvoyGrpc_{
+			EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
+				ClusterName: cluster,
+			},
+		}
+	} else {
+		grpcService.TargetSpecifier = &core.GrpcService_GoogleGrpc_{
+			GoogleGrpc: constructSdsGoogleGrpc(sdsUdsPath, metadata),
+		}
+	}
+
+	return &auth.SdsSecretConfig{
+		Name: name,
+		SdsConfig: &core.ConfigSource{
+			ConfigSourceSpecifier: &core.ConfigSource_ApiConfigSource{
+				ApiConfigSource: &core.ApiConfigSource{
+					ApiType:      core.ApiConfigSource_GRPC,
+					GrpcServices: []*core.GrpcService{grpcService},
+				},
+			},
+			InitialFetchTimeout: features.InitialFetchTimeout,
+		},
+	}
+}
+
+// constructSdsGoogleGrpc constructs the Google gRPC client of the workload SDS service, authenticated
+// with the proxy token.
+func constructSdsGoogleGrpc(sdsUdsPath string, metadata map[string]string) *core.GrpcService_GoogleGrpc {
 	gRPCConfig := &core.GrpcService_GoogleGrpc{
 		TargetUri:  sdsUdsPath,
 		StatPrefix: SDSStatPrefix,
@@ -136,25 +210,24 @@ func ConstructSdsSecretConfig(name, sdsUdsPath string, metadata map[string]strin
 		gRPCConfig.CredentialsFactoryName = FileBasedMetadataPlugName
 		gRPCConfig.CallCredentials = ConstructgRPCCallCredentials(K8sSATrustworthyJwtFileName, K8sSAJwtTokenHeaderKey)
 	}
+	return gRPCConfig
+}
 
-	return &auth.SdsSecretConfig{
-		Name: name,
-		SdsConfig: &core.ConfigSource{
-			ConfigSourceSpecifier: &core.ConfigSource_ApiConfigSource{
-				ApiConfigSource: &core.ApiConfigSource{
-					ApiType: core.ApiConfigSource_GRPC,
-					GrpcServices: []*core.GrpcService{
-						{
-							TargetSpecifier: &core.GrpcService_GoogleGrpc_{
-								GoogleGrpc: gRPCConfig,
-							},
-						},
-					},
-				},
-			},
-			InitialFetchTimeout: features.InitialFetchTimeout,
-		},
+// sdsRequestTimeout returns the timeout of the SDS gRPC requests, from the proxy metadata or
+// features.SdsRequestTimeout. Returns nil, for no timeout, if neither is set to a positive duration.
+func sdsRequestTimeout(metadata map[string]string) *types.Duration {
+	timeout := features.SdsRequestTimeout
+	if v, found := metadata[model.NodeMetadataSdsRequestTimeout]; found {
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			log.Warnf("ignoring invalid %s %q", model.NodeMetadataSdsRequestTimeout, v)
+		} else {
+			timeout = d
+		}
+	}
+	if timeout <= 0 {
+		return nil
 	}
+	return types.DurationProto(timeout)
 }
 
 // ConstructValidationContext constructs ValidationContext in CommonTlsContext.
@@ -176,8 +249,58 @@ func ConstructValidationContext(rootCAFilePath string, subjectAltNames []string)
 	return ret
 }
 
+// ConstructgRPCSslCredentials constructs the channel credentials for a Google gRPC client using
+// certificate files on the proxy. certChain and privateKey are optional and enable mTLS when set.
+// Returns nil if no root certificate is given.
+func ConstructgRPCSslCredentials(rootCert, certChain, privateKey string) *core.GrpcService_GoogleGrpc_ChannelCredentials {
+	if rootCert == "" {
+		return nil
+	}
+
+	ssl := &core.GrpcService_GoogleGrpc_SslCredentials{
+		RootCerts: &core.DataSource{
+			Specifier: &core.DataSource_Filename{
+				Filename: rootCert,
+			},
+		},
+	}
+	if certChain != "" && privateKey != "" {
+		ssl.CertChain = &core.DataSource{
+			Specifier: &core.DataSource_Filename{
+				Filename: certChain,
+			},
+		}
+		ssl.PrivateKey = &core.DataSource{
+			Specifier: &core.DataSource_Filename{
+				Filename: privateKey,
+			},
+		}
+	}
+
+	return &core.GrpcService_GoogleGrpc_ChannelCredentials{
+		CredentialSpecifier: &core.GrpcService_GoogleGrpc_ChannelCredentials_SslCredentials{
+			SslCredentials: ssl,
+		},
+	}
+}
+
+// ValidateCallCredentialsHeaderKey checks that headerKey can carry the binary token read by the file based
+// metadata plugin. gRPC requires binary header names to have the binaryHeaderSuffix suffix, other headers
+// must be printable ASCII, which the token data is not guaranteed to be.
+func ValidateCallCredentialsHeaderKey(headerKey string) error {
+	if !strings.HasSuffix(headerKey, binaryHeaderSuffix) {
+		return fmt.Errorf("invalid call credentials header key %q: binary token headers must end with %q",
+			headerKey, binaryHeaderSuffix)
+	}
+	return nil
+}
+
 // this function is used to construct SDS config which is only available from 1.1
 func ConstructgRPCCallCredentials(tokenFileName, headerKey string) []*core.GrpcService_GoogleGrpc_CallCredentials {
+	if err := ValidateCallCredentialsHeaderKey(headerKey); err != nil {
+		log.Warnf("%v, Envoy may fail to send the token %s", err, tokenFileName)
+	}
+
 	// If k8s sa jwt token file exists, envoy only handles plugin credentials.
 	config := &v2alpha.FileBasedMetadataConfig{
 		SecretData: &core.DataSource{
@@ -208,27 +331,77 @@ type fbMetadataAnyKey struct {
 	headerKey     string
 }
 
-var fileBasedMetadataConfigAnyMap sync.Map
+// fileBasedMetadataConfigCacheSize is the maximum number of marshaled FileBasedMetadataConfig kept
+// in fileBasedMetadataConfigCache. Token paths may be per pod, so the cache must not grow unbounded.
+const fileBasedMetadataConfigCacheSize = 1024
+
+// fbMetadataAnyCache is a least recently used cache of the marshaled FileBasedMetadataConfig.
+type fbMetadataAnyCache struct {
+	mu      sync.Mutex
+	maxSize int
+	// entries is ordered from the most to the least recently used.
+	entries *list.List
+	index   map[fbMetadataAnyKey]*list.Element
+}
+
+type fbMetadataAnyEntry struct {
+	key fbMetadataAnyKey
+	any types.Any
+}
+
+func newFbMetadataAnyCache(maxSize int) *fbMetadataAnyCache {
+	return &fbMetadataAnyCache{
+		maxSize: maxSize,
+		entries: list.New(),
+		index:   make(map[fbMetadataAnyKey]*list.Element),
+	}
+}
 
-// findOrMarshalFileBasedMetadataConfig searches google.protobuf.Any in fileBasedMetadataConfigAnyMap
+// getOrAdd returns the cached google.protobuf.Any of key, marshaling it with marshal if not cached.
+// The least recently used entry is evicted once the cache is full.
+func (c *fbMetadataAnyCache) getOrAdd(key fbMetadataAnyKey, marshal func() *types.Any) *types.Any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, found := c.index[key]; found {
+		c.entries.MoveToFront(e)
+		marshalAny := e.Value.(*fbMetadataAnyEntry).any
+		return &marshalAny
+	}
+	any := marshal()
+	c.index[key] = c.entries.PushFront(&fbMetadataAnyEntry{key: key, any: *any})
+	if c.entries.Len() > c.maxSize {
+		oldest := c.entries.Back()
+		c.entries.Remove(oldest)
+		delete(c.index, oldest.Value.(*fbMetadataAnyEntry).key)
+	}
+	return any
+}
+
+func (c *fbMetadataAnyCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.Len()
+}
+
+var fileBasedMetadataConfigCache = newFbMetadataAnyCache(fileBasedMetadataConfigCacheSize)
+
+// findOrMarshalFileBasedMetadataConfig searches google.protobuf.Any in fileBasedMetadataConfigCache
 // by tokenFileName and headerKey, and returns google.protobuf.Any proto if found. If not found,
 // it takes the fbMetadata and marshals it into google.protobuf.Any, and stores this new
-// google.protobuf.Any into fileBasedMetadataConfigAnyMap.
+// google.protobuf.Any into fileBasedMetadataConfigCache.
 // FileBasedMetadataConfig only supports non-deterministic marshaling. As each SDS config contains
 // marshaled FileBasedMetadataConfig, the SDS config would differ if marshaling FileBasedMetadataConfig
 // returns different result. Once SDS config differs, Envoy will create multiple SDS clients to fetch
 // same SDS resource. To solve this problem, we use findOrMarshalFileBasedMetadataConfig so that
-// FileBasedMetadataConfig is marshaled once, and is reused in all SDS configs.
+// FileBasedMetadataConfig is marshaled once, and is reused in all SDS configs. The cache is bounded
+// and only evicts the least recently used entries, which belong to token paths no longer in use.
 func findOrMarshalFileBasedMetadataConfig(tokenFileName, headerKey string, fbMetadata *v2alpha.FileBasedMetadataConfig) *types.Any {
 	key := fbMetadataAnyKey{
 		tokenFileName: tokenFileName,
 		headerKey:     headerKey,
 	}
-	if v, found := fileBasedMetadataConfigAnyMap.Load(key); found {
-		marshalAny := v.(types.Any)
-		return &marshalAny
-	}
-	any, _ := types.MarshalAny(fbMetadata)
-	fileBasedMetadataConfigAnyMap.Store(key, *any)
-	return any
+	return fileBasedMetadataConfigCache.getOrAdd(key, func() *types.Any {
+		any, _ := types.MarshalAny(fbMetadata)
+		return any
+	})
 }
@@ -16,14 +16,22 @@ package model
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	"github.com/envoyproxy/go-control-plane/envoy/config/grpc_credential/v2alpha"
+	"github.com/gogo/protobuf/types"
+
+	authn "istio.io/api/authentication/v1alpha1"
 
 	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/labels"
 )
 
 func TestConstructSdsSecretConfig(t *testing.T) {
@@ -107,6 +115,117 @@ func TestConstructSdsSecretConfig(t *testing.T) {
 	}
 }
 
+func TestConstructSdsSecretConfigRequestTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { features.SdsRequestTimeout = timeout }(features.SdsRequestTimeout)
+
+	cases := []struct {
+		name     string
+		feature  time.Duration
+		metadata map[string]string
+		expected *types.Duration
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:     "feature",
+			feature:  10 * time.Second,
+			expected: types.DurationProto(10 * time.Second),
+		},
+		{
+			name:     "metadata",
+			metadata: map[string]string{model.NodeMetadataSdsRequestTimeout: "5s"},
+			expected: types.DurationProto(5 * time.Second),
+		},
+		{
+			name:     "metadata overrides feature",
+			feature:  10 * time.Second,
+			metadata: map[string]string{model.NodeMetadataSdsRequestTimeout: "5s"},
+			expected: types.DurationProto(5 * time.Second),
+		},
+		{
+			name:     "metadata disables feature",
+			feature:  10 * time.Second,
+			metadata: map[string]string{model.NodeMetadataSdsRequestTimeout: "0s"},
+		},
+		{
+			name:     "invalid metadata",
+			feature:  10 * time.Second,
+			metadata: map[string]string{model.NodeMetadataSdsRequestTimeout: "soon"},
+			expected: types.DurationProto(10 * time.Second),
+		},
+		{
+			name:     "negative metadata",
+			metadata: map[string]string{model.NodeMetadataSdsRequestTimeout: "-5s"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			features.SdsRequestTimeout = c.feature
+			got := ConstructSdsSecretConfig("spiffe://cluster.local/ns/bar/sa/foo", "/tmp/sdsuds.sock", c.metadata)
+			service := got.SdsConfig.GetApiConfigSource().GrpcServices[0]
+			if !reflect.DeepEqual(service.Timeout, c.expected) {
+				t.Errorf("got timeout %v, want %v", service.Timeout, c.expected)
+			}
+			// The initial fetch timeout is configured separately.
+			if !reflect.DeepEqual(got.SdsConfig.InitialFetchTimeout, features.InitialFetchTimeout) {
+				t.Errorf("got initial fetch timeout %v, want %v", got.SdsConfig.InitialFetchTimeout, features.InitialFetchTimeout)
+			}
+		})
+	}
+}
+
+func TestConstructSdsSecretConfigTransport(t *testing.T) {
+	cases := []struct {
+		name       string
+		metadata   map[string]string
+		envoyGrpc  *core.GrpcService_EnvoyGrpc
+		googleGrpc bool
+	}{
+		{
+			name:       "google grpc",
+			googleGrpc: true,
+		},
+		{
+			name:      "envoy grpc",
+			metadata:  map[string]string{model.NodeMetadataSdsEnvoyGrpcCluster: "sds-grpc"},
+			envoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: "sds-grpc"},
+		},
+		{
+			name: "envoy grpc ignores token path",
+			metadata: map[string]string{
+				model.NodeMetadataSdsEnvoyGrpcCluster: "sds-grpc",
+				model.NodeMetadataSdsTokenPath:        "/var/run/sds/token",
+			},
+			envoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: "sds-grpc"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := ConstructSdsSecretConfig("spiffe://cluster.local/ns/bar/sa/foo", "/tmp/sdsuds.sock", c.metadata)
+			if !reflect.DeepEqual(got.SdsConfig.InitialFetchTimeout, features.InitialFetchTimeout) {
+				t.Errorf("got initial fetch timeout %v, want %v", got.SdsConfig.InitialFetchTimeout, features.InitialFetchTimeout)
+			}
+			service := got.SdsConfig.GetApiConfigSource().GrpcServices[0]
+			if c.googleGrpc {
+				google := service.GetGoogleGrpc()
+				if google == nil || google.TargetUri != "/tmp/sdsuds.sock" || google.CallCredentials == nil {
+					t.Errorf("expected google grpc to /tmp/sdsuds.sock with call credentials, got %#v", service.TargetSpecifier)
+				}
+				return
+			}
+			if !reflect.DeepEqual(service.GetEnvoyGrpc(), c.envoyGrpc) {
+				t.Errorf("got envoy grpc %#v, want %#v", service.TargetSpecifier, c.envoyGrpc)
+			}
+			if len(service.InitialMetadata) != 0 {
+				t.Errorf("expected no credentials, got initial metadata %v", service.InitialMetadata)
+			}
+		})
+	}
+}
+
 func TestConstructSdsSecretConfigForGatewayListener(t *testing.T) {
 	cases := []struct {
 		serviceAccount string
@@ -158,6 +277,128 @@ func TestConstructSdsSecretConfigForGatewayListener(t *testing.T) {
 	}
 }
 
+func TestConstructSdsCaSecretConfigForGatewayListener(t *testing.T) {
+	cases := []struct {
+		name           string
+		credentialName string
+		sdsUdsPath     string
+		caName         string
+		caSdsUdsPath   string
+		expectedName   string
+		expectedPath   string
+	}{
+		{
+			name:           "defaults",
+			credentialName: "ingress-cert",
+			sdsUdsPath:     IngressGatewaySdsUdsPath,
+			expectedName:   "ingress-cert" + IngressGatewaySdsCaSuffix,
+			expectedPath:   IngressGatewaySdsUdsPath,
+		},
+		{
+			name:           "ca name override",
+			credentialName: "ingress-cert",
+			sdsUdsPath:     IngressGatewaySdsUdsPath,
+			caName:         "tenant-a-root",
+			expectedName:   "tenant-a-root",
+			expectedPath:   IngressGatewaySdsUdsPath,
+		},
+		{
+			name:           "ca path override",
+			credentialName: "ingress-cert",
+			sdsUdsPath:     IngressGatewaySdsUdsPath,
+			caSdsUdsPath:   "unix:/var/run/tenant-a/sds",
+			expectedName:   "ingress-cert" + IngressGatewaySdsCaSuffix,
+			expectedPath:   "unix:/var/run/tenant-a/sds",
+		},
+		{
+			name:           "both overrides",
+			credentialName: "ingress-cert",
+			sdsUdsPath:     IngressGatewaySdsUdsPath,
+			caName:         "tenant-a-root",
+			caSdsUdsPath:   "unix:/var/run/tenant-a/sds",
+			expectedName:   "tenant-a-root",
+			expectedPath:   "unix:/var/run/tenant-a/sds",
+		},
+		{
+			name:         "no credential name",
+			sdsUdsPath:   IngressGatewaySdsUdsPath,
+			caName:       "tenant-a-root",
+			caSdsUdsPath: "unix:/var/run/tenant-a/sds",
+		},
+		{
+			name:           "no uds path",
+			credentialName: "ingress-cert",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := ConstructSdsCaSecretConfigForGatewayListener(c.credentialName, c.sdsUdsPath, c.caName, c.caSdsUdsPath)
+			var expected *auth.SdsSecretConfig
+			if c.expectedName != "" {
+				expected = ConstructSdsSecretConfigForGatewayListener(c.expectedName, c.expectedPath)
+			}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("got(%#v) != want(%#v)", got, expected)
+			}
+			// The certificate entry is not affected by the CA overrides.
+			cert := ConstructSdsSecretConfigForGatewayListener(c.credentialName, c.sdsUdsPath)
+			if cert != nil && (cert.Name != c.credentialName ||
+				cert.SdsConfig.GetApiConfigSource().GrpcServices[0].GetGoogleGrpc().TargetUri != c.sdsUdsPath) {
+				t.Errorf("unexpected certificate SDS config %#v", cert)
+			}
+		})
+	}
+}
+
+func TestConstructgRPCSslCredentials(t *testing.T) {
+	fileSource := func(name string) *core.DataSource {
+		return &core.DataSource{Specifier: &core.DataSource_Filename{Filename: name}}
+	}
+	cases := []struct {
+		name                            string
+		rootCert, certChain, privateKey string
+		expected                        *core.GrpcService_GoogleGrpc_SslCredentials
+	}{
+		{
+			name: "no root cert",
+		},
+		{
+			name:     "tls",
+			rootCert: "/etc/certs/root-cert.pem",
+			expected: &core.GrpcService_GoogleGrpc_SslCredentials{
+				RootCerts: fileSource("/etc/certs/root-cert.pem"),
+			},
+		},
+		{
+			name:       "mtls",
+			rootCert:   "/etc/certs/root-cert.pem",
+			certChain:  "/etc/certs/cert-chain.pem",
+			privateKey: "/etc/certs/key.pem",
+			expected: &core.GrpcService_GoogleGrpc_SslCredentials{
+				RootCerts:  fileSource("/etc/certs/root-cert.pem"),
+				CertChain:  fileSource("/etc/certs/cert-chain.pem"),
+				PrivateKey: fileSource("/etc/certs/key.pem"),
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := ConstructgRPCSslCredentials(c.rootCert, c.certChain, c.privateKey)
+			if c.expected == nil {
+				if got != nil {
+					t.Fatalf("expected no credentials, got %v", got)
+				}
+				return
+			}
+			if ssl := got.GetSslCredentials(); !reflect.DeepEqual(ssl, c.expected) {
+				t.Errorf("ConstructgRPCSslCredentials: got(%#v) != want(%#v)", ssl, c.expected)
+			}
+		})
+	}
+}
+
 func constructLocalChannelCredConfig() *core.GrpcService_GoogleGrpc_ChannelCredentials {
 	return &core.GrpcService_GoogleGrpc_ChannelCredentials{
 		CredentialSpecifier: &core.GrpcService_GoogleGrpc_ChannelCredentials_LocalCredentials{
@@ -201,3 +442,245 @@ func constructsdsconfighelper(tokenFileName, headerKey string, metaConfig *v2alp
 		},
 	}
 }
+
+func TestFbMetadataAnyCache(t *testing.T) {
+	marshals := 0
+	marshal := func(tokenFileName string) func() *types.Any {
+		return func() *types.Any {
+			marshals++
+			any, _ := types.MarshalAny(&v2alpha.FileBasedMetadataConfig{
+				SecretData: &core.DataSource{
+					Specifier: &core.DataSource_Filename{Filename: tokenFileName},
+				},
+				HeaderKey: K8sSAJwtTokenHeaderKey,
+			})
+			return any
+		}
+	}
+	key := func(tokenFileName string) fbMetadataAnyKey {
+		return fbMetadataAnyKey{tokenFileName: tokenFileName, headerKey: K8sSAJwtTokenHeaderKey}
+	}
+
+	cache := newFbMetadataAnyCache(2)
+	a := cache.getOrAdd(key("a"), marshal("a"))
+	if again := cache.getOrAdd(key("a"), marshal("a")); !reflect.DeepEqual(again.Value, a.Value) || marshals != 1 {
+		t.Fatalf("expected the cached bytes of a after %d marshals, got %v want %v", marshals, again.Value, a.Value)
+	}
+
+	cache.getOrAdd(key("b"), marshal("b"))
+	// Use a so that b is the least recently used entry.
+	cache.getOrAdd(key("a"), marshal("a"))
+	cache.getOrAdd(key("c"), marshal("c"))
+	if n := cache.len(); n != 2 {
+		t.Fatalf("expected the cache to be bounded to 2 entries, got %d", n)
+	}
+	if marshals != 3 {
+		t.Fatalf("expected 3 marshals, got %d", marshals)
+	}
+
+	cache.getOrAdd(key("a"), marshal("a"))
+	if marshals != 3 {
+		t.Errorf("expected a to stay cached, got %d marshals", marshals)
+	}
+	cache.getOrAdd(key("b"), marshal("b"))
+	if marshals != 4 {
+		t.Errorf("expected b to be evicted, got %d marshals", marshals)
+	}
+}
+
+func TestValidateCallCredentialsHeaderKey(t *testing.T) {
+	cases := []struct {
+		headerKey string
+		valid     bool
+	}{
+		{headerKey: K8sSAJwtTokenHeaderKey, valid: true},
+		{headerKey: "custom-token-bin", valid: true},
+		{headerKey: "authorization"},
+		{headerKey: "token-bin-header"},
+		{headerKey: ""},
+	}
+
+	for _, c := range cases {
+		if err := ValidateCallCredentialsHeaderKey(c.headerKey); (err == nil) != c.valid {
+			t.Errorf("ValidateCallCredentialsHeaderKey(%q): got error %v, want valid %v", c.headerKey, err, c.valid)
+		}
+	}
+}
+
+type countingConfigStore struct {
+	model.IstioConfigStore
+	policy *model.Config
+	calls  int
+}
+
+func (s *countingConfigStore) AuthenticationPolicyForWorkload(*model.Service, labels.Instance, *model.Port) *model.Config {
+	s.calls++
+	return s.policy
+}
+
+func TestGetConsolidateAuthenticationPolicyMemoized(t *testing.T) {
+	policy := &authn.Policy{
+		Origins: []*authn.OriginAuthenticationMethod{
+			{
+				Jwt: &authn.Jwt{
+					Issuer:  "https://secret.foo.com",
+					JwksUri: "https://secret.foo.com/jwks",
+				},
+			},
+		},
+	}
+	store := &countingConfigStore{policy: &model.Config{Spec: policy}}
+	instance := func(port int, l labels.Instance) *model.ServiceInstance {
+		return &model.ServiceInstance{
+			Service: &model.Service{Hostname: "foo.default.svc.cluster.local"},
+			Endpoint: model.NetworkEndpoint{
+				ServicePort: &model.Port{Name: "http", Port: port},
+			},
+			Labels: l,
+		}
+	}
+
+	push := model.NewPushContext()
+	for i := 0; i < 2; i++ {
+		got, err := GetConsolidateAuthenticationPolicy(push, store, instance(80, labels.Instance{"app": "foo", "version": "v1"}))
+		if got != policy || err != nil {
+			t.Fatalf("got policy %v and error %v, want %v", got, err, policy)
+		}
+	}
+	if store.calls != 1 {
+		t.Errorf("expected the policy to be resolved once per push, got %d", store.calls)
+	}
+
+	_, _ = GetConsolidateAuthenticationPolicy(push, store, instance(8080, labels.Instance{"app": "foo", "version": "v1"}))
+	_, _ = GetConsolidateAuthenticationPolicy(push, store, instance(80, labels.Instance{"app": "foo", "version": "v2"}))
+	if store.calls != 3 {
+		t.Errorf("expected other ports and labels to be resolved separately, got %d resolutions", store.calls)
+	}
+
+	_, _ = GetConsolidateAuthenticationPolicy(model.NewPushContext(), store, instance(80, labels.Instance{"app": "foo", "version": "v1"}))
+	if store.calls != 4 {
+		t.Errorf("expected a new push to resolve the policy again, got %d resolutions", store.calls)
+	}
+
+	_, _ = GetConsolidateAuthenticationPolicy(nil, store, instance(80, labels.Instance{"app": "foo", "version": "v1"}))
+	_, _ = GetConsolidateAuthenticationPolicy(nil, store, instance(80, labels.Instance{"app": "foo", "version": "v1"}))
+	if store.calls != 6 {
+		t.Errorf("expected no memoization without a push context, got %d resolutions", store.calls)
+	}
+}
+
+func TestGetConsolidateAuthenticationPolicyErrors(t *testing.T) {
+	// The issuer serves an OpenID discovery configuration without jwks_uri.
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer issuer.Close()
+
+	instance := &model.ServiceInstance{
+		Service: &model.Service{Hostname: "foo.default.svc.cluster.local"},
+		Endpoint: model.NetworkEndpoint{
+			ServicePort: &model.Port{Name: "http", Port: 80},
+		},
+	}
+	cases := []struct {
+		name        string
+		config      *model.Config
+		expectErr   bool
+		resolutions int
+		failures    int
+	}{
+		{
+			name:        "no policy",
+			resolutions: 1,
+		},
+		{
+			name: "jwks resolution failure",
+			config: &model.Config{
+				ConfigMeta: model.ConfigMeta{Name: "default", Namespace: "default"},
+				Spec: &authn.Policy{
+					Origins: []*authn.OriginAuthenticationMethod{
+						{Jwt: &authn.Jwt{Issuer: issuer.URL}},
+					},
+				},
+			},
+			expectErr:   true,
+			resolutions: 2,
+			failures:    1,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store := &countingConfigStore{policy: c.config}
+			push := model.NewPushContext()
+			for i := 0; i < 2; i++ {
+				policy, err := GetConsolidateAuthenticationPolicy(push, store, instance)
+				if policy != nil {
+					t.Errorf("expected no policy, got %v", policy)
+				}
+				if (err != nil) != c.expectErr {
+					t.Errorf("got error %v, want error %v", err, c.expectErr)
+				}
+			}
+			// Only successful resolutions are memoized, failures are retried.
+			if store.calls != c.resolutions {
+				t.Errorf("expected %d resolutions, got %d", c.resolutions, store.calls)
+			}
+			// Repeated failures are reported once per policy.
+			failures := push.ProxyStatus[model.ProxyStatusAuthnPolicyJwksFailure.Name()]
+			if got, want := len(failures), c.failures; got != want {
+				t.Errorf("expected %d recorded failures, got %d: %v", want, got, failures)
+			}
+		})
+	}
+}
+
+// namespaceConfigStore returns the authentication policy of the namespace of the service.
+type namespaceConfigStore struct {
+	model.IstioConfigStore
+	policies map[string]*model.Config
+}
+
+func (s *namespaceConfigStore) AuthenticationPolicyForWorkload(service *model.Service, _ labels.Instance, _ *model.Port) *model.Config {
+	return s.policies[service.Attributes.Namespace]
+}
+
+func TestGetConsolidateAuthenticationPolicySameHostnameInNamespaces(t *testing.T) {
+	mtls := &authn.Policy{
+		Peers: []*authn.PeerAuthenticationMethod{{
+			Params: &authn.PeerAuthenticationMethod_Mtls{Mtls: &authn.MutualTls{}},
+		}},
+	}
+	permissive := &authn.Policy{
+		Peers: []*authn.PeerAuthenticationMethod{{
+			Params: &authn.PeerAuthenticationMethod_Mtls{Mtls: &authn.MutualTls{Mode: authn.MutualTls_PERMISSIVE}},
+		}},
+	}
+	store := &namespaceConfigStore{policies: map[string]*model.Config{
+		"ns1": {Spec: mtls},
+		"ns2": {Spec: permissive},
+	}}
+	// ServiceEntries of different namespaces may share a hostname.
+	instance := func(namespace string) *model.ServiceInstance {
+		return &model.ServiceInstance{
+			Service: &model.Service{
+				Hostname:   "foo.example.com",
+				Attributes: model.ServiceAttributes{Namespace: namespace},
+			},
+			Endpoint: model.NetworkEndpoint{
+				ServicePort: &model.Port{Name: "http", Port: 80},
+			},
+		}
+	}
+
+	push := model.NewPushContext()
+	for namespace, want := range map[string]*authn.Policy{"ns1": mtls, "ns2": permissive} {
+		got, err := GetConsolidateAuthenticationPolicy(push, store, instance(namespace))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("expected the policy of namespace %s %v, got %v", namespace, want, got)
+		}
+	}
+}
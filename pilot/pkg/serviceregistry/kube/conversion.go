@@ -42,6 +42,14 @@ const (
 	// responsible for it
 	IngressClassAnnotation = "kubernetes.io/ingress.class"
 
+	// HTTPSRedirectPortsAnnotation is the annotation on services listing the comma separated
+	// service ports whose inbound HTTP requests are redirected to HTTPS
+	HTTPSRedirectPortsAnnotation = "networking.istio.io/httpsRedirectPorts"
+
+	// DisableAccessLogAnnotation is the annotation on services that, when set to "true",
+	// turns off access logs for the inbound listeners of the service
+	DisableAccessLogAnnotation = "networking.istio.io/disableAccessLog"
+
 	managementPortPrefix = "mgmt-"
 )
 
@@ -78,6 +86,8 @@ func ConvertService(svc coreV1.Service, domainSuffix string, clusterID string) *
 	}
 
 	var exportTo map[visibility.Instance]bool
+	var httpsRedirectPorts map[int]bool
+	disableAccessLog := false
 	serviceaccounts := make([]string, 0)
 	if svc.Annotations != nil {
 		if svc.Annotations[annotation.AlphaCanonicalServiceAccounts.Name] != "" {
@@ -94,6 +104,15 @@ func ConvertService(svc coreV1.Service, domainSuffix string, clusterID string) *
 				exportTo[visibility.Instance(e)] = true
 			}
 		}
+		if svc.Annotations[HTTPSRedirectPortsAnnotation] != "" {
+			httpsRedirectPorts = make(map[int]bool)
+			for _, p := range strings.Split(svc.Annotations[HTTPSRedirectPortsAnnotation], ",") {
+				if port, err := strconv.Atoi(strings.TrimSpace(p)); err == nil {
+					httpsRedirectPorts[port] = true
+				}
+			}
+		}
+		disableAccessLog = svc.Annotations[DisableAccessLogAnnotation] == "true"
 	}
 	sort.Strings(serviceaccounts)
 
@@ -110,6 +129,9 @@ func ConvertService(svc coreV1.Service, domainSuffix string, clusterID string) *
 			Namespace: svc.Namespace,
 			UID:       fmt.Sprintf("istio://%s/services/%s", svc.Namespace, svc.Name),
 			ExportTo:  exportTo,
+
+			HTTPSRedirectPorts: httpsRedirectPorts,
+			DisableAccessLog:   disableAccessLog,
 		},
 	}
 
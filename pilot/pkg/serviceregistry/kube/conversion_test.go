@@ -240,6 +240,73 @@ func TestServiceConversionWithEmptyServiceAccountsAnnotation(t *testing.T) {
 	}
 }
 
+func TestServiceConversionWithHTTPSRedirectPortsAnnotation(t *testing.T) {
+	localSvc := coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "service1",
+			Namespace: "default",
+			Annotations: map[string]string{
+				HTTPSRedirectPortsAnnotation: "8080, 9090,invalid",
+			},
+		},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports: []coreV1.ServicePort{
+				{
+					Name:     "http",
+					Port:     8080,
+					Protocol: coreV1.ProtocolTCP,
+				},
+			},
+		},
+	}
+
+	service := ConvertService(localSvc, domainSuffix, clusterID)
+	if service == nil {
+		t.Fatalf("could not convert service")
+	}
+
+	expected := map[int]bool{8080: true, 9090: true}
+	if !reflect.DeepEqual(service.Attributes.HTTPSRedirectPorts, expected) {
+		t.Fatalf("expected https redirect ports %v, got %v", expected, service.Attributes.HTTPSRedirectPorts)
+	}
+}
+
+func TestServiceConversionWithDisableAccessLogAnnotation(t *testing.T) {
+	localSvc := coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "service1",
+			Namespace: "default",
+			Annotations: map[string]string{
+				DisableAccessLogAnnotation: "true",
+			},
+		},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports: []coreV1.ServicePort{
+				{
+					Name:     "http",
+					Port:     8080,
+					Protocol: coreV1.ProtocolTCP,
+				},
+			},
+		},
+	}
+
+	service := ConvertService(localSvc, domainSuffix, clusterID)
+	if service == nil {
+		t.Fatalf("could not convert service")
+	}
+	if !service.Attributes.DisableAccessLog {
+		t.Fatalf("expected access logs to be disabled for service %s", service.Hostname)
+	}
+
+	delete(localSvc.Annotations, DisableAccessLogAnnotation)
+	if service = ConvertService(localSvc, domainSuffix, clusterID); service.Attributes.DisableAccessLog {
+		t.Fatalf("expected access logs to follow the mesh setting for service %s", service.Hostname)
+	}
+}
+
 func TestExternalServiceConversion(t *testing.T) {
 	serviceName := "service1"
 	namespace := "default"
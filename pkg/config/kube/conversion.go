@@ -50,18 +50,25 @@ func ConvertProtocol(name string, proto coreV1.Protocol) protocol.Instance {
 	case coreV1.ProtocolUDP:
 		out = protocol.UDP
 	case coreV1.ProtocolTCP:
-		if len(name) >= grpcWebLen && strings.EqualFold(name[:grpcWebLen], grpcWeb) {
-			out = protocol.GRPCWeb
-			break
-		}
-		i := strings.IndexByte(name, '-')
-		if i >= 0 {
-			name = name[:i]
-		}
-		p := protocol.Parse(name)
-		if p != protocol.UDP && p != protocol.Unsupported {
+		if p := ParsePortName(name); p != protocol.Unsupported {
 			out = p
 		}
 	}
 	return out
 }
+
+// ParsePortName returns the protocol selected by the prefix of a port name, e.g. http-foo or
+// grpc-web-bar, or protocol.Unsupported if the name does not select a protocol. UDP cannot be
+// selected by name.
+func ParsePortName(name string) protocol.Instance {
+	if len(name) >= grpcWebLen && strings.EqualFold(name[:grpcWebLen], grpcWeb) {
+		return protocol.GRPCWeb
+	}
+	if i := strings.IndexByte(name, '-'); i >= 0 {
+		name = name[:i]
+	}
+	if p := protocol.Parse(name); p != protocol.UDP {
+		return p
+	}
+	return protocol.Unsupported
+}